@@ -29,7 +29,7 @@ import (
 const (
 	NonceSize    = 12
 	BlockSize    = aes.BlockSize
-	HeaderSize   = NonceSize + BlockSize + 2
+	HeaderSize   = NonceSize + BlockSize + 3
 	OverheadSize = HeaderSize + BlockSize
 )
 
@@ -54,7 +54,19 @@ func AEAD(k []byte) (cipher.AEAD, error) {
 	return cipher.NewGCM(b)
 }
 
-func Encrypt(gcm cipher.AEAD, nonce [NonceSize]byte, b []byte) []byte {
+// Encrypt encrypts b into the next frame of the transcript ts. The first
+// HeaderSize and the last BlockSize bytes of b are room for the overhead
+func Encrypt(gcm cipher.AEAD, ts *Transcript, nonce [NonceSize]byte, b []byte) []byte {
+	return encrypt(gcm, ts, 0, nonce, b)
+}
+
+// EncryptFinal is Encrypt of the last frame of the body, which may have
+// nothing else in it
+func EncryptFinal(gcm cipher.AEAD, ts *Transcript, nonce [NonceSize]byte, b []byte) []byte {
+	return encrypt(gcm, ts, FrameFinal, nonce, b)
+}
+
+func encrypt(gcm cipher.AEAD, ts *Transcript, flags byte, nonce [NonceSize]byte, b []byte) []byte {
 	if len(nonce) != gcm.NonceSize() {
 		panic("Invalid nonce")
 	}
@@ -64,48 +76,59 @@ func Encrypt(gcm cipher.AEAD, nonce [NonceSize]byte, b []byte) []byte {
 	if len(b) > math.MaxUint16 {
 		panic("Invalid data length")
 	}
+	ts.start(nonce)
 	nlen := copy(b, nonce[:])
 	blen := len(b) - OverheadSize
 	b[nlen] = byte(blen >> 8)
 	b[nlen+1] = byte(blen)
-	hlen := len(gcm.Seal(b[nlen:nlen], nonce[:], b[nlen:nlen+2], nil)) + nlen
+	b[nlen+2] = flags
+	hlen := len(gcm.Seal(b[nlen:nlen], nonce[:], b[nlen:nlen+3], ts.data(true, flags))) + nlen
 	if hlen != HeaderSize {
 		panic("Generated an invalid header")
 	}
 	nonce[0]++
-	elen := len(gcm.Seal(b[hlen:hlen], nonce[:], b[hlen:hlen+blen], nil))
+	elen := len(gcm.Seal(b[hlen:hlen], nonce[:], b[hlen:hlen+blen], ts.data(false, flags)))
 	if elen != BlockSize+blen {
 		panic("Generated an invalid body")
 	}
 	if elen+hlen != len(b) {
 		panic("Invalid data length")
 	}
+	ts.next(flags)
 	return b
 }
 
-func Decrypt(t Time, gcm func() (cipher.AEAD, error), nv NonceVerifier, f *reader.Fetcher, eoferr error, c func(b []byte) error) error {
+// Decrypt decrypts the frames of the transcript ts fetched from f, and
+// hands the segments of them to c. It returns once the final frame has been
+// decrypted, and fails when f ends before that
+func Decrypt(t Time, gcm func() (cipher.AEAD, error), ts *Transcript, nv NonceVerifier, f *reader.Fetcher, eoferr error, c func(b []byte) error) error {
 	nonce := [NonceSize]byte{}
 	for {
 		d, e := f.Fetch(HeaderSize)
 		if e != nil {
 			if e == eoferr {
-				return nil
+				return ErrTruncated
 			}
 			return e
 		}
 		copy(nonce[:], d[:NonceSize])
+		ts.start(nonce)
 		nlen := len(nonce)
 		gg, e := gcm()
 		if e != nil {
 			return e
 		}
-		o, e := gg.Open(d[nlen:nlen], nonce[:], d[nlen:HeaderSize], nil)
+		o, e := gg.Open(d[nlen:nlen], nonce[:], d[nlen:HeaderSize], ts.data(true, 0))
 		if e != nil {
 			return e
 		}
-		if len(o) != 2 {
+		if len(o) != 3 {
 			return ErrInvalidSize
 		}
+		flags := o[2]
+		if flags&^FrameFinal != 0 {
+			return ErrInvalidFlags
+		}
 		if !nv(nonce[:], t) {
 			return ErrInvalidNonce
 		}
@@ -115,13 +138,20 @@ func Decrypt(t Time, gcm func() (cipher.AEAD, error), nv NonceVerifier, f *reade
 			return e
 		}
 		nonce[0]++
-		o, e = gg.Open(d[:0], nonce[:], d, nil)
+		o, e = gg.Open(d[:0], nonce[:], d, ts.data(false, flags))
 		if e != nil {
 			return e
 		}
-		e = c(o)
-		if e != nil {
-			return e
+		ts.next(flags)
+		// The final frame may have nothing in it but the end of the body
+		if len(o) > 0 || !ts.final {
+			e = c(o)
+			if e != nil {
+				return e
+			}
+		}
+		if ts.final {
+			return nil
 		}
 	}
 }
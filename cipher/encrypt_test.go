@@ -44,11 +44,11 @@ func TestEncrypt(t *testing.T) {
 		panic(err.Error())
 	}
 	var r []byte
-	ee := Encrypt(aesgcm, nonce, []byte("                              ABC                "))
+	ee := EncryptFinal(aesgcm, NewTranscript("/"), nonce, append(make([]byte, HeaderSize), "ABC                "...))
 	eereader := reader.NewFetcher(reader.ByteFetch(ee, io.EOF))
 	err = Decrypt(tt, func() (cipher.AEAD, error) {
 		return aesgcm, nil
-	}, func(b []byte, t Time) bool {
+	}, NewTranscript("/"), func(b []byte, t Time) bool {
 		return true
 	}, &eereader, io.EOF, func(b []byte) error {
 		r = b
@@ -17,32 +17,235 @@
 package cipher
 
 import (
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"io"
 	"time"
 )
 
 const (
 	KeySwitchInterval = 120 * time.Second
+	KeyIDSize         = 4
+
+	// StretchPBKDF2 stretches passphrases with PBKDF2-HMAC-SHA256
+	StretchPBKDF2 = "pbkdf2"
+	// StretchNone uses the passphrases as keys as they are, for the keys
+	// which are random already
+	StretchNone = "none"
+	// DefaultSalt is the salt passphrases are stretched with when none is
+	// given. It's the same for everybody, and only kept so the setups which
+	// rely on it keep working
+	DefaultSalt = "Warwolf System"
+
+	stretchedKeySize = 32
+	randomKeySize    = 32
+	randomSaltSize   = 16
+	keyIDInfo        = "Warwolf key ID"
+)
+
+var (
+	ErrKeyUnknownStretch = errors.New("Cipher: Stretching function must be pbkdf2 or none")
+	ErrKeyNoneActive     = errors.New("Cipher: No key is active")
 )
 
 type Time [binary.MaxVarintLen64]byte
 
 func timeByte() Time {
+	return timeByteAt(time.Now())
+}
+
+func timeByteAt(now time.Time) Time {
 	t := Time{}
-	s := time.Now().Truncate(KeySwitchInterval).Unix()
+	s := now.Truncate(KeySwitchInterval).Unix()
 	binary.PutVarint(t[:], s)
 	return t
 }
 
+func (t Time) unix() int64 {
+	s, _ := binary.Varint(t[:])
+	return s
+}
+
+// epochs returns the time of the key of now, followed by the times of the
+// keys of the intervals next to it which are within skew of now. skew is no
+// longer than KeySwitchInterval, so that's the intervals right before and
+// after at most
+func epochs(now time.Time, skew time.Duration) []Time {
+	r := []Time{timeByteAt(now)}
+	for _, d := range []time.Duration{-skew, skew} {
+		t := timeByteAt(now.Add(d))
+		if t != r[0] && t != r[len(r)-1] {
+			r = append(r, t)
+		}
+	}
+	return r
+}
+
 type KeyGen struct {
 	Key []byte
 }
 
 func (k KeyGen) Get() ([]byte, Time) {
+	return k.GetAt(time.Now())
+}
+
+// GetAt returns the key of the interval now is in, for a clock which has to
+// be corrected to match the one of the other side
+func (k KeyGen) GetAt(now time.Time) ([]byte, Time) {
+	t := timeByteAt(now)
+	return k.At(t), t
+}
+
+// At returns the key of the time t
+func (k KeyGen) At(t Time) []byte {
 	mac := hmac.New(sha256.New, k.Key)
-	t := timeByte()
 	mac.Write(t[:])
-	return mac.Sum(nil)[:16], t
+	return mac.Sum(nil)[:16]
+}
+
+// KeyID tells the shared keys apart. It's derived from the key, so it's
+// the same on every side which has the key
+type KeyID [KeyIDSize]byte
+
+// Key is a shared key, which has been stretched from a passphrase
+type Key struct {
+	KeyGen
+	ID KeyID
+}
+
+// Stretch turns passphrases into keys. Rounds is the iteration count of
+// PBKDF2, and 0 leaves the passphrases as they are
+type Stretch struct {
+	Salt   []byte
+	Rounds int
+}
+
+// NewStretch returns the Stretch of the stretching function, which is
+// either StretchPBKDF2 or StretchNone
+func NewStretch(function string, rounds int, salt []byte) (Stretch, error) {
+	switch function {
+	case StretchPBKDF2:
+		return Stretch{Salt: salt, Rounds: rounds}, nil
+	case StretchNone:
+		return Stretch{Salt: salt, Rounds: 0}, nil
+	}
+	return Stretch{}, ErrKeyUnknownStretch
+}
+
+// Key stretches passphrase into a Key
+func (s Stretch) Key(passphrase []byte) Key {
+	k := passphrase
+	if s.Rounds > 0 {
+		// It only fails for key lengths out of range, which
+		// stretchedKeySize is not
+		k, _ = pbkdf2.Key(sha256.New, string(passphrase), s.Salt, s.Rounds, stretchedKeySize)
+	}
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(keyIDInfo))
+	key := Key{KeyGen: KeyGen{Key: k}, ID: KeyID{}}
+	copy(key.ID[:], mac.Sum(nil))
+	return key
+}
+
+// RandomKey returns a random key, base64 encoded. It's random enough to be
+// used without stretching
+func RandomKey() (string, error) {
+	k := make([]byte, randomKeySize)
+	_, err := io.ReadFull(rand.Reader, k)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k), nil
+}
+
+// RandomSalt returns a random salt to stretch passphrases with, base64
+// encoded
+func RandomSalt() (string, error) {
+	s := make([]byte, randomSaltSize)
+	_, err := io.ReadFull(rand.Reader, s)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(s), nil
+}
+
+// Trial is the AEAD of a key frame which has been encrypted with any one of
+// a few keys, at a time which may be off by a skew. Open tries each of them
+// in turn, and once one of them has opened the frame it's the only one used
+// from then on
+type Trial struct {
+	keys   []Key
+	times  []Time
+	aeads  []cipher.AEAD
+	opened int
+}
+
+// NewTrial returns the Trial of keys at the times within skew of now, with
+// the time of now. skew must not be longer than KeySwitchInterval
+func NewTrial(keys []Key, skew time.Duration) (*Trial, Time, error) {
+	times := epochs(time.Now(), skew)
+	aeads := make([]cipher.AEAD, 0, len(keys)*len(times))
+	for i := range keys {
+		for _, t := range times {
+			a, err := AEAD(keys[i].At(t))
+			if err != nil {
+				return nil, times[0], err
+			}
+			aeads = append(aeads, a)
+		}
+	}
+	return &Trial{
+		keys:   keys,
+		times:  times,
+		aeads:  aeads,
+		opened: -1,
+	}, times[0], nil
+}
+
+// Opened returns the key which has opened the frame, and the time of it
+func (t *Trial) Opened() (Key, Time, bool) {
+	if t.opened < 0 {
+		return Key{}, Time{}, false
+	}
+	return t.keys[t.opened/len(t.times)], t.times[t.opened%len(t.times)], true
+}
+
+func (t *Trial) NonceSize() int {
+	return NonceSize
+}
+
+func (t *Trial) Overhead() int {
+	return BlockSize
+}
+
+func (t *Trial) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if t.opened < 0 {
+		panic("Trial has opened nothing to seal with")
+	}
+	return t.aeads[t.opened].Seal(dst, nonce, plaintext, additionalData)
+}
+
+func (t *Trial) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if t.opened >= 0 {
+		return t.aeads[t.opened].Open(dst, nonce, ciphertext, additionalData)
+	}
+	// A failed Open clears dst, which is usually the ciphertext itself, so
+	// every key tries a copy of it
+	c := append([]byte(nil), ciphertext...)
+	err := ErrKeyNoneActive
+	for i := range t.aeads {
+		o, e := t.aeads[i].Open(dst, nonce, c, additionalData)
+		if e == nil {
+			t.opened = i
+			return o, nil
+		}
+		err = e
+	}
+	return nil, err
 }
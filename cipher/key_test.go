@@ -0,0 +1,116 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cipher
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+	"warwolf/reader"
+)
+
+func TestStretch(t *testing.T) {
+	k := Stretch{Salt: []byte("NaCl"), Rounds: 80000}.Key([]byte("Password"))
+	expected, _ := hex.DecodeString("4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56")
+	if !bytes.Equal(k.Key, expected) {
+		t.Errorf("Expected %x, got %x", expected, k.Key)
+		return
+	}
+	s := Stretch{Salt: []byte("salt"), Rounds: 1}.Key([]byte("passwd"))
+	expected, _ = hex.DecodeString("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc")
+	if !bytes.Equal(s.Key, expected) {
+		t.Errorf("Expected %x, got %x", expected, s.Key)
+		return
+	}
+	if k.ID == s.ID {
+		t.Error("Key IDs of different keys must be different")
+	}
+	n := Stretch{}.Key([]byte("Password"))
+	if !bytes.Equal(n.Key, []byte("Password")) {
+		t.Error("Passphrase must be left as it is without stretching")
+	}
+	_, err := NewStretch("scrypt", 1, nil)
+	if err != ErrKeyUnknownStretch {
+		t.Errorf("Expected %s, got %v", ErrKeyUnknownStretch, err)
+	}
+}
+
+func TestTrial(t *testing.T) {
+	keys := []Key{
+		Stretch{}.Key([]byte("OldKey")),
+		Stretch{}.Key([]byte("NewKey")),
+	}
+	tr, tt, err := NewTrial(keys, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	key, _ := keys[1].Get()
+	gcm, _ := AEAD(key)
+	nonce, _ := Nonce()
+	b := EncryptFinal(gcm, NewTranscript("/"), nonce, append(make([]byte, HeaderSize), "ABC                "...))
+	f := reader.NewFetcher(reader.ByteFetch(b, io.EOF))
+	err = Decrypt(tt, func() (cipher.AEAD, error) {
+		return tr, nil
+	}, NewTranscript("/"), func(b []byte, t Time) bool {
+		return true
+	}, &f, io.EOF, func(b []byte) error {
+		if !bytes.Equal(b, []byte("ABC")) {
+			t.Error("Invalid data")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	opened, at, ok := tr.Opened()
+	if !ok || opened.ID != keys[1].ID || at != tt {
+		t.Error("The frame must have been opened by the second key")
+	}
+	none, _, _ := NewTrial(nil, 0)
+	_, err = none.Open(nil, nonce[:], b[NonceSize:HeaderSize], nil)
+	if err != ErrKeyNoneActive {
+		t.Errorf("Expected %s, got %v", ErrKeyNoneActive, err)
+	}
+}
+
+func TestTrialSkew(t *testing.T) {
+	keys := []Key{Stretch{}.Key([]byte("TestKey"))}
+	key, kt := keys[0].GetAt(time.Now().Add(KeySwitchInterval))
+	gcm, _ := AEAD(key)
+	nonce, _ := Nonce()
+	b := Encrypt(gcm, NewTranscript("/"), nonce, append(make([]byte, HeaderSize), "ABC                "...))
+	ts := NewTranscript("/")
+	ts.start(nonce)
+	for _, skew := range []time.Duration{0, KeySwitchInterval} {
+		tr, _, _ := NewTrial(keys, skew)
+		_, err := tr.Open(nil, nonce[:], b[NonceSize:HeaderSize], ts.data(true, 0))
+		if skew == 0 && err == nil {
+			t.Error("Key of the next interval must not be accepted without skew")
+		}
+		if skew > 0 && err != nil {
+			t.Errorf("Key of the next interval must be accepted within skew, got %s", err)
+		}
+		if _, at, ok := tr.Opened(); skew > 0 && (!ok || at != kt) {
+			t.Error("Frame must have been opened at the time of the next interval")
+		}
+	}
+}
@@ -17,40 +17,188 @@
 package cipher
 
 import (
+	"hash/maphash"
 	"sync"
 )
 
+// nonceGenerations is how many intervals of keys the nonces are kept for.
+// A frame may be keyed for the interval before or after the one it's
+// received in, so a replay of it may still be opened two intervals later
+const nonceGenerations = 3
+
+const (
+	// NonceFalsePositive is how often at most a new nonce is taken for a
+	// replay by the record of an interval which holds as many nonces as the
+	// capacity of it. A new nonce is looked up in the records of every
+	// interval kept, so it's refused at up to three times the rate. A frame
+	// refused by mistake fails its request, which is sent again, while a
+	// replay is never accepted
+	NonceFalsePositive = 1e-6
+
+	// nonceBits is how many bits the record of an interval takes for each
+	// nonce of its capacity, and nonceHashes how many of them a nonce sets,
+	// for a false positive rate of (1 - e^(-20/29))^20, about 8.9e-7
+	nonceBits   = 29
+	nonceHashes = 20
+)
+
+// NonceStats are the counters of the Nonces since they have been created
+type NonceStats struct {
+	// Verified is how many nonces have been verified
+	Verified uint64
+	// Replays is how many nonces have been refused as replays, of which
+	// about NonceFalsePositive are new ones. Nonces of the intervals which
+	// are no longer kept are refused as such too
+	Replays uint64
+	// Overflows is how many nonces have been recorded beyond the capacity
+	// of their interval, each of which raises the false positive rate
+	Overflows uint64
+	// Memory is how many bytes the records take, which never grows
+	Memory int
+}
+
+// nonceRecord is the Bloom filter of the nonces of an interval
+type nonceRecord struct {
+	bits  []uint64
+	count int
+}
+
+func (r *nonceRecord) has(indexes []uint64) bool {
+	for _, i := range indexes {
+		if r.bits[i/64]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *nonceRecord) add(indexes []uint64) {
+	for _, i := range indexes {
+		r.bits[i/64] |= 1 << (i % 64)
+	}
+	r.count++
+}
+
+func (r *nonceRecord) clear() {
+	for i := range r.bits {
+		r.bits[i] = 0
+	}
+	r.count = 0
+}
+
+// Nonces are the nonces seen, which are kept for the last few intervals of
+// keys. The nonces of older intervals can't be replayed, as the keys of them
+// are no longer accepted. The nonces of each interval are recorded in a
+// Bloom filter of a fixed size, so the memory taken stays the same however
+// many nonces there are
 type Nonces struct {
-	size    int
-	t       Time
-	records map[string]struct{}
-	l       *sync.Mutex
+	capacity int
+	size     uint64
+	times    [nonceGenerations]int64
+	records  [nonceGenerations]nonceRecord
+	hashes   [2]maphash.Hash
+	indexes  [nonceHashes]uint64
+	stats    NonceStats
+	l        *sync.Mutex
 }
 
-func (n *Nonces) clear() {
-	n.records = make(map[string]struct{}, n.size)
+// generation returns the generation of the records of the interval t, or
+// -1 when t is older than the intervals kept. The generations are kept
+// newest first, and a new interval takes the place of the oldest one
+func (n *Nonces) generation(t Time) int {
+	s := t.unix()
+	g := 0
+	for ; g < nonceGenerations; g++ {
+		if n.times[g] == s {
+			return g
+		}
+		if n.times[g] < s {
+			break
+		}
+	}
+	if g == nonceGenerations {
+		return -1
+	}
+	oldest := n.records[nonceGenerations-1]
+	oldest.clear()
+	copy(n.times[g+1:], n.times[g:])
+	copy(n.records[g+1:], n.records[g:])
+	n.times[g] = s
+	n.records[g] = oldest
+	return g
+}
+
+// index sets the indexes of the bits of nonce, which are derived from two
+// hashes of it keyed for this process only
+func (n *Nonces) index(nonce []byte) {
+	h := [2]uint64{}
+	for i := range n.hashes {
+		n.hashes[i].Reset()
+		n.hashes[i].Write(nonce)
+		h[i] = n.hashes[i].Sum64()
+	}
+	// An odd step is never a multiple of the size, which is one of 64, so
+	// the hashes of a nonce never all land on the same bit
+	h[1] |= 1
+	for i := range n.indexes {
+		n.indexes[i] = (h[0] + uint64(i)*h[1]) % n.size
+	}
 }
 
 func (n *Nonces) Verify(nonce []byte, t Time) bool {
 	n.l.Lock()
 	defer n.l.Unlock()
-	if n.t != t {
-		n.clear()
-	}
-	nn := string(nonce)
-	_, ex := n.records[nn]
-	if ex {
+	g := n.generation(t)
+	n.stats.Verified++
+	// The nonces of the intervals which are no longer kept are unknown, so
+	// any of them may be a replay
+	if g < 0 {
+		n.stats.Replays++
 		return false
 	}
-	n.records[nn] = struct{}{}
+	n.index(nonce)
+	for i := range n.records {
+		if n.records[i].has(n.indexes[:]) {
+			n.stats.Replays++
+			return false
+		}
+	}
+	if n.records[g].count >= n.capacity {
+		n.stats.Overflows++
+	}
+	n.records[g].add(n.indexes[:])
 	return true
 }
 
-func NewNonces(size int, l *sync.Mutex) Nonces {
-	return Nonces{
-		size:    size,
-		t:       Time{},
-		records: make(map[string]struct{}, size),
-		l:       l,
+// Stats returns the counters of the Nonces
+func (n *Nonces) Stats() NonceStats {
+	n.l.Lock()
+	defer n.l.Unlock()
+	return n.stats
+}
+
+// NewNonces returns the Nonces which keep up to capacity nonces for each
+// interval at the NonceFalsePositive rate. More nonces are still recorded,
+// at a higher rate, in the same memory
+func NewNonces(capacity int, l *sync.Mutex) Nonces {
+	words := (capacity*nonceBits + 63) / 64
+	if words < 1 {
+		words = 1
+	}
+	n := Nonces{
+		capacity: capacity,
+		size:     uint64(words * 64),
+		l:        l,
+	}
+	for i := range n.records {
+		n.records[i] = nonceRecord{
+			bits:  make([]uint64, words),
+			count: 0,
+		}
+	}
+	for i := range n.hashes {
+		n.hashes[i].SetSeed(maphash.MakeSeed())
 	}
+	n.stats.Memory = nonceGenerations * words * 8
+	return n
 }
@@ -0,0 +1,141 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cipher
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNonces(t *testing.T) {
+	n := NewNonces(16, &sync.Mutex{})
+	now := time.Now()
+	at := func(i int) Time {
+		return timeByteAt(now.Add(time.Duration(i) * KeySwitchInterval))
+	}
+	if !n.Verify([]byte("A"), at(0)) {
+		t.Error("New nonce must be accepted")
+		return
+	}
+	if n.Verify([]byte("A"), at(0)) {
+		t.Error("Replayed nonce must be refused")
+		return
+	}
+	if n.Verify([]byte("A"), at(2)) {
+		t.Error("Replayed nonce must be refused two intervals later")
+		return
+	}
+	if !n.Verify([]byte("B"), at(1)) {
+		t.Error("New nonce of an older interval must be accepted")
+		return
+	}
+	if !n.Verify([]byte("C"), at(3)) {
+		t.Error("New nonce must be accepted")
+		return
+	}
+	if !n.Verify([]byte("A"), at(4)) {
+		t.Error("Nonce must be forgotten once its interval is gone")
+	}
+}
+
+func TestNoncesOldInterval(t *testing.T) {
+	n := NewNonces(16, &sync.Mutex{})
+	now := time.Now()
+	at := func(i int) Time {
+		return timeByteAt(now.Add(time.Duration(i) * KeySwitchInterval))
+	}
+	if !n.Verify([]byte("A"), at(0)) || !n.Verify([]byte("B"), at(1)) {
+		t.Fatal("New nonces must be accepted")
+	}
+	// The replay is keyed for the interval before, after one rotation
+	if n.Verify([]byte("A"), at(0)) {
+		t.Error("Replayed nonce of the interval before must be refused")
+	}
+	if !n.Verify([]byte("C"), at(3)) || !n.Verify([]byte("D"), at(4)) || !n.Verify([]byte("E"), at(5)) {
+		t.Fatal("New nonces must be accepted")
+	}
+	// The intervals of A and B are no longer kept, and neither is the one
+	// of F, which has never been seen
+	for _, c := range []struct {
+		nonce string
+		at    int
+	}{
+		{"A", 0},
+		{"B", 1},
+		{"F", 2},
+	} {
+		if n.Verify([]byte(c.nonce), at(c.at)) {
+			t.Errorf("Nonce %s of an interval older than the ones kept must be refused", c.nonce)
+		}
+	}
+	s := n.Stats()
+	if s.Verified != 9 || s.Replays != 4 {
+		t.Errorf("Invalid counters %+v", s)
+	}
+}
+
+func TestNoncesBounded(t *testing.T) {
+	const capacity = 4096
+	n := NewNonces(capacity, &sync.Mutex{})
+	memory := n.Stats().Memory
+	if memory < nonceGenerations*capacity*nonceBits/8 {
+		t.Errorf("Records must hold the capacity, got %d bytes", memory)
+		return
+	}
+	now := timeByteAt(time.Now())
+	nonce := make([]byte, NonceSize)
+	for i := 0; i < capacity; i++ {
+		binary.BigEndian.PutUint64(nonce, uint64(i))
+		if !n.Verify(nonce, now) {
+			t.Errorf("New nonce %d must be accepted", i)
+			return
+		}
+	}
+	for i := 0; i < capacity; i++ {
+		binary.BigEndian.PutUint64(nonce, uint64(i))
+		if n.Verify(nonce, now) {
+			t.Errorf("Replayed nonce %d must be refused", i)
+			return
+		}
+	}
+	// About 0.09 of them are expected to be found at the capacity
+	found := 0
+	for i := capacity; i < capacity+100000; i++ {
+		binary.BigEndian.PutUint64(nonce, uint64(i))
+		n.index(nonce)
+		if n.records[0].has(n.indexes[:]) {
+			found++
+		}
+	}
+	if found > 2 {
+		t.Errorf("Too many new nonces found: %d", found)
+	}
+	binary.BigEndian.PutUint64(nonce, uint64(capacity))
+	n.Verify(nonce, now)
+	s := n.Stats()
+	if s.Verified != 2*capacity+1 || s.Replays != capacity {
+		t.Errorf("Invalid counters %+v", s)
+	}
+	if s.Overflows != 1 {
+		t.Errorf("Nonces beyond the capacity must be counted, got %d", s.Overflows)
+	}
+	if s.Memory != memory {
+		t.Error("Records must not grow")
+	}
+}
@@ -0,0 +1,364 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cipher
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Every body, in either direction, starts with a key frame. It's encrypted
+// with the shared key, and names the session of which the keys encrypt the
+// rest of the frames of the body. Sessions are established by a key
+// exchange of ephemeral X25519 keys carried in the key frames, so the
+// traffic can't be decrypted with the shared key once the ephemeral keys
+// are gone
+const (
+	SessionIDSize  = 16
+	KeyMessageSize = 1 + KeyIDSize + keyStampSize + 32
+	KeyFrameSize   = OverheadSize + KeyMessageSize
+
+	sessionKeySize = 16
+	keyStampSize   = 8
+	sessionInfo    = "Warwolf session"
+)
+
+const (
+	// KeyHello carries the public key of the client which asks for a new
+	// session
+	KeyHello byte = 1
+	// KeyAccept carries the public key of the server which has established
+	// the session
+	KeyAccept byte = 2
+	// KeyUse names the session which encrypts the rest of the body
+	KeyUse byte = 3
+	// KeyUnknown tells the session named by the request is unknown to the
+	// server, and has to be established again
+	KeyUnknown byte = 4
+
+	// keyBindPath is set on the kind of a key frame which binds the rest of
+	// the frames of the body to the path of the request
+	keyBindPath byte = 0x80
+)
+
+var (
+	ErrKeyInvalidMessage  = errors.New("Cipher: Invalid key message")
+	ErrKeyUnknownSession  = errors.New("Cipher: Unknown session")
+	ErrKeyExchangeFailure = errors.New("Cipher: Key exchange failure")
+)
+
+type SessionID [SessionIDSize]byte
+
+// KeyMessage is the content of a key frame. It names the shared key which
+// has encrypted the frame, and is stamped with the time the frame was sent
+// at. Every kind of it has the same size, so they can't be told apart by it
+type KeyMessage [KeyMessageSize]byte
+
+const keyDataStart = 1 + KeyIDSize + keyStampSize
+
+func newKeyMessage(kind byte, key KeyID, data []byte) KeyMessage {
+	m := KeyMessage{}
+	m[0] = kind
+	copy(m[1:], key[:])
+	copy(m[keyDataStart:], data)
+	return m
+}
+
+// UseKey returns the KeyMessage which names the session id of the key
+func UseKey(key KeyID, id SessionID) KeyMessage {
+	return newKeyMessage(KeyUse, key, id[:])
+}
+
+// UnknownKey returns the KeyMessage which tells the session id of the key
+// is unknown
+func UnknownKey(key KeyID, id SessionID) KeyMessage {
+	return newKeyMessage(KeyUnknown, key, id[:])
+}
+
+// ParseKeyMessage parses the segment of a key frame
+func ParseKeyMessage(b []byte) (KeyMessage, error) {
+	m := KeyMessage{}
+	if len(b) != KeyMessageSize || b[0]&^keyBindPath < KeyHello || b[0]&^keyBindPath > KeyUnknown {
+		return m, ErrKeyInvalidMessage
+	}
+	copy(m[:], b)
+	return m, nil
+}
+
+func (m KeyMessage) Kind() byte {
+	return m[0] &^ keyBindPath
+}
+
+// BindsPath returns whether the rest of the frames are bound to the path
+func (m KeyMessage) BindsPath() bool {
+	return m[0]&keyBindPath != 0
+}
+
+// KeyID returns the shared key named by the message
+func (m KeyMessage) KeyID() KeyID {
+	id := KeyID{}
+	copy(id[:], m[1:])
+	return id
+}
+
+// Time returns the time the message was stamped with by the side which has
+// sent it, to the millisecond
+func (m KeyMessage) Time() time.Time {
+	ms := int64(binary.BigEndian.Uint64(m[1+KeyIDSize:]))
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func (m *KeyMessage) stamp(at time.Time) {
+	ms := at.UnixNano() / int64(time.Millisecond)
+	binary.BigEndian.PutUint64(m[1+KeyIDSize:], uint64(ms))
+}
+
+// ID returns the session named by a KeyUse or KeyUnknown message
+func (m KeyMessage) ID() SessionID {
+	id := SessionID{}
+	copy(id[:], m[keyDataStart:])
+	return id
+}
+
+func (m KeyMessage) public() []byte {
+	return m[keyDataStart:]
+}
+
+// KeyFrame encrypts m, stamped with the time at, into b with the shared
+// key as the first frame of ts, and returns the frame. It's the final one
+// when final is true. b must be at least KeyFrameSize long
+func KeyFrame(shared cipher.AEAD, ts *Transcript, m KeyMessage, at time.Time, final bool, b []byte) ([]byte, error) {
+	nonce, err := Nonce()
+	if err != nil {
+		return nil, err
+	}
+	m.stamp(at)
+	if ts.bound {
+		m[0] |= keyBindPath
+	}
+	copy(b[HeaderSize:], m[:])
+	if final {
+		return EncryptFinal(shared, ts, nonce, b[:KeyFrameSize]), nil
+	}
+	return Encrypt(shared, ts, nonce, b[:KeyFrameSize]), nil
+}
+
+// Keyed returns the AEAD and the segment handler for Decrypt, of a body of
+// the transcript ts which starts with a key frame encrypted by shared. The
+// message of the key frame is handed to key, which returns the AEAD of the
+// rest of the frames, and the segments of them are handed to c
+func Keyed(ts *Transcript, shared func() (cipher.AEAD, error), key func(m KeyMessage) (cipher.AEAD, error), c func(b []byte) error) (func() (cipher.AEAD, error), func(b []byte) error) {
+	var cur cipher.AEAD
+	return func() (cipher.AEAD, error) {
+			if cur == nil {
+				return shared()
+			}
+			return cur, nil
+		}, func(b []byte) error {
+			if cur != nil {
+				return c(b)
+			}
+			m, err := ParseKeyMessage(b)
+			if err != nil {
+				return err
+			}
+			if m.BindsPath() {
+				ts.BindPath()
+			}
+			a, err := key(m)
+			if err != nil {
+				return err
+			}
+			cur = a
+			return nil
+		}
+}
+
+// Session is the pair of traffic keys shared by a client and a server,
+// which has been established with the shared key Key
+type Session struct {
+	ID      SessionID
+	Key     KeyID
+	Created time.Time
+	Request cipher.AEAD
+	Respond cipher.AEAD
+}
+
+// derive derives size bytes of keys from secret with HKDF-SHA256
+func derive(secret []byte, salt []byte, info []byte, size int) ([]byte, error) {
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Expand(sha256.New, prk, string(info), size)
+}
+
+func newSession(shared Key, secret []byte, client []byte, server []byte) (*Session, error) {
+	info := make([]byte, 0, len(sessionInfo)+len(client)+len(server))
+	info = append(info, sessionInfo...)
+	info = append(info, client...)
+	info = append(info, server...)
+	k, err := derive(secret, shared.Key, info, SessionIDSize+sessionKeySize*2)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		ID:      SessionID{},
+		Key:     shared.ID,
+		Created: time.Now(),
+	}
+	copy(s.ID[:], k[:SessionIDSize])
+	s.Request, err = AEAD(k[SessionIDSize : SessionIDSize+sessionKeySize])
+	if err != nil {
+		return nil, err
+	}
+	s.Respond, err = AEAD(k[SessionIDSize+sessionKeySize:])
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Handshake is the client side of the key exchange of a session
+type Handshake struct {
+	key *ecdh.PrivateKey
+}
+
+func NewHandshake() (Handshake, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Handshake{}, err
+	}
+	return Handshake{key: k}, nil
+}
+
+// Hello returns the KeyMessage which asks for the session of the key
+func (h Handshake) Hello(key KeyID) KeyMessage {
+	return newKeyMessage(KeyHello, key, h.key.PublicKey().Bytes())
+}
+
+// Finish establishes the session of the shared key with the KeyAccept
+// message of the server
+func (h Handshake) Finish(shared Key, m KeyMessage) (*Session, error) {
+	if m.Kind() != KeyAccept || m.KeyID() != shared.ID {
+		return nil, ErrKeyExchangeFailure
+	}
+	peer, err := ecdh.X25519().NewPublicKey(m.public())
+	if err != nil {
+		return nil, ErrKeyExchangeFailure
+	}
+	secret, err := h.key.ECDH(peer)
+	if err != nil {
+		return nil, ErrKeyExchangeFailure
+	}
+	return newSession(shared, secret, h.key.PublicKey().Bytes(), m.public())
+}
+
+// Accept establishes the session asked for by the KeyHello message m of a
+// client, and returns it with the KeyAccept message to answer. m must name
+// the shared key
+func Accept(shared Key, m KeyMessage) (*Session, KeyMessage, error) {
+	if m.Kind() != KeyHello || m.KeyID() != shared.ID {
+		return nil, KeyMessage{}, ErrKeyExchangeFailure
+	}
+	peer, err := ecdh.X25519().NewPublicKey(m.public())
+	if err != nil {
+		return nil, KeyMessage{}, ErrKeyExchangeFailure
+	}
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, KeyMessage{}, err
+	}
+	secret, err := k.ECDH(peer)
+	if err != nil {
+		return nil, KeyMessage{}, ErrKeyExchangeFailure
+	}
+	pub := k.PublicKey().Bytes()
+	s, err := newSession(shared, secret, m.public(), pub)
+	if err != nil {
+		return nil, KeyMessage{}, err
+	}
+	return s, newKeyMessage(KeyAccept, shared.ID, pub), nil
+}
+
+type sessionRecord struct {
+	session *Session
+	used    time.Time
+}
+
+// Sessions are the sessions established by a server. A session is forgotten
+// once it has been unused for the idle timeout, and its keys with it
+type Sessions struct {
+	lock     sync.Mutex
+	idle     time.Duration
+	sessions map[SessionID]*sessionRecord
+}
+
+func NewSessions(idle time.Duration) Sessions {
+	return Sessions{
+		lock:     sync.Mutex{},
+		idle:     idle,
+		sessions: make(map[SessionID]*sessionRecord, 16),
+	}
+}
+
+// Add adds the session s, and forgets the sessions which have expired
+func (s *Sessions) Add(ss *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for id, r := range s.sessions {
+		if now.Sub(r.used) > s.idle {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[ss.ID] = &sessionRecord{
+		session: ss,
+		used:    now,
+	}
+}
+
+// Get returns the session id when it's known and hasn't expired
+func (s *Sessions) Get(id SessionID) (*Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if now.Sub(r.used) > s.idle {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	r.used = now
+	return r.session, true
+}
+
+// Clear forgets every session
+func (s *Sessions) Clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions = make(map[SessionID]*sessionRecord, 16)
+}
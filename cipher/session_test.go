@@ -0,0 +1,170 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cipher
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+	"warwolf/reader"
+)
+
+func TestHandshake(t *testing.T) {
+	key := Stretch{}.Key([]byte("TestKey"))
+	h, err := NewHandshake()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server, accept, err := Accept(key, h.Hello(key.ID))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client, err := h.Finish(key, accept)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if client.ID != server.ID {
+		t.Error("Session IDs are different")
+		return
+	}
+	nonce, _ := Nonce()
+	b := EncryptFinal(client.Request, NewTranscript("/"), nonce, append(make([]byte, HeaderSize), "ABC                "...))
+	f := reader.NewFetcher(reader.ByteFetch(b, io.EOF))
+	err = Decrypt(Time{}, func() (cipher.AEAD, error) {
+		return server.Request, nil
+	}, NewTranscript("/"), func(b []byte, t Time) bool {
+		return true
+	}, &f, io.EOF, func(b []byte) error {
+		if !bytes.Equal(b, []byte("ABC")) {
+			t.Error("Invalid data")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, err = Accept(key, accept)
+	if err != ErrKeyExchangeFailure {
+		t.Errorf("Expected %s, got %v", ErrKeyExchangeFailure, err)
+	}
+	other := Stretch{}.Key([]byte("OtherKey"))
+	_, _, err = Accept(other, h.Hello(key.ID))
+	if err != ErrKeyExchangeFailure {
+		t.Errorf("Expected %s for another key, got %v", ErrKeyExchangeFailure, err)
+	}
+	s, _, _ := Accept(other, h.Hello(other.ID))
+	if s.ID == server.ID {
+		t.Error("Session of another shared key must be different")
+	}
+}
+
+func TestDerive(t *testing.T) {
+	// The test cases 1 and 3 of RFC 5869
+	for _, c := range []struct {
+		secret string
+		salt   string
+		info   string
+		okm    string
+	}{
+		{
+			"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			"000102030405060708090a0b0c",
+			"f0f1f2f3f4f5f6f7f8f9",
+			"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			"",
+			"",
+			"8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	} {
+		secret, _ := hex.DecodeString(c.secret)
+		salt, _ := hex.DecodeString(c.salt)
+		info, _ := hex.DecodeString(c.info)
+		okm, err := derive(secret, salt, info, 42)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if hex.EncodeToString(okm) != c.okm {
+			t.Errorf("Expected %s, got %x", c.okm, okm)
+		}
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	key := Stretch{}.Key([]byte("TestKey"))
+	h, _ := NewHandshake()
+	s, _, _ := Accept(key, h.Hello(key.ID))
+	shared, _ := AEAD(make([]byte, 16))
+	body := make([]byte, KeyFrameSize)
+	sent := NewTranscript("/")
+	_, err := KeyFrame(shared, sent, UseKey(key.ID, s.ID), time.Now(), false, body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	nonce, _ := Nonce()
+	body = append(body, EncryptFinal(s.Request, sent, nonce, append(make([]byte, HeaderSize), "ABC                "...))...)
+	var r []byte
+	f := reader.NewFetcher(reader.ByteFetch(body, io.EOF))
+	received := NewTranscript("/")
+	gcm, c := Keyed(received, func() (cipher.AEAD, error) {
+		return shared, nil
+	}, func(m KeyMessage) (cipher.AEAD, error) {
+		if m.Kind() != KeyUse || m.KeyID() != key.ID || m.ID() != s.ID {
+			return nil, ErrKeyUnknownSession
+		}
+		return s.Request, nil
+	}, func(b []byte) error {
+		r = append(r, b...)
+		return nil
+	})
+	err = Decrypt(Time{}, gcm, received, func(b []byte, t Time) bool {
+		return true
+	}, &f, io.EOF, c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(r, []byte("ABC")) {
+		t.Error("Invalid data")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	key := Stretch{}.Key([]byte("TestKey"))
+	h, _ := NewHandshake()
+	s, _, _ := Accept(key, h.Hello(key.ID))
+	ss := NewSessions(50 * time.Millisecond)
+	ss.Add(s)
+	if g, ok := ss.Get(s.ID); !ok || g != s {
+		t.Error("Session must be found")
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := ss.Get(s.ID); ok {
+		t.Error("Session must have expired")
+	}
+}
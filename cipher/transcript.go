@@ -0,0 +1,118 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cipher
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Every frame is authenticated along with the transcript of the body it's
+// in: the nonce of the first frame of the request, the direction of the
+// body, and the sequence number of the frame in it. So a frame can't be
+// moved to another place of the body, to another body, or to the respond of
+// another request. The last frame of a body is marked final, so a body
+// which has been cut short fails as well
+const (
+	// FrameFinal marks the last frame of a body
+	FrameFinal byte = 1
+
+	transcriptRequest byte = 1
+	transcriptRespond byte = 2
+	transcriptSize         = 1 + NonceSize + 8 + 1
+)
+
+var (
+	ErrTruncated    = errors.New("Cipher: Body has ended before its final frame")
+	ErrInvalidFlags = errors.New("Cipher: Invalid frame flags")
+)
+
+// Transcript is what the frames of a body are bound to. The path of the
+// request is only bound once the key frame has asked for it, as it may be
+// rewritten on the way by a proxy
+type Transcript struct {
+	direction byte
+	started   bool
+	request   [NonceSize]byte
+	path      string
+	bound     bool
+	seq       uint64
+	final     bool
+	ad        []byte
+}
+
+// NewTranscript returns the transcript of a request sent to path, which
+// starts with the nonce of its first frame
+func NewTranscript(path string) *Transcript {
+	return &Transcript{
+		direction: transcriptRequest,
+		path:      path,
+		ad:        make([]byte, 0, transcriptSize+len(path)),
+	}
+}
+
+// Respond returns the transcript of the respond to the request, of which
+// the first frame must have been encrypted or decrypted
+func (t *Transcript) Respond() *Transcript {
+	if !t.started {
+		panic("Transcript of the request has not started")
+	}
+	return &Transcript{
+		direction: transcriptRespond,
+		started:   true,
+		request:   t.request,
+		path:      t.path,
+		bound:     t.bound,
+		ad:        make([]byte, 0, transcriptSize+len(t.path)),
+	}
+}
+
+// BindPath binds the frames after the key frame to the path as well
+func (t *Transcript) BindPath() {
+	t.bound = true
+}
+
+func (t *Transcript) start(nonce [NonceSize]byte) {
+	if t.started {
+		return
+	}
+	t.request = nonce
+	t.started = true
+}
+
+// data returns the additional data of the header of the next frame, or of
+// the body of it with the flags of the header. The key frame, which tells
+// whether the path is bound, is never bound to it
+func (t *Transcript) data(header bool, flags byte) []byte {
+	seq := [8]byte{}
+	binary.BigEndian.PutUint64(seq[:], t.seq)
+	t.ad = append(t.ad[:0], t.direction)
+	t.ad = append(t.ad, t.request[:]...)
+	t.ad = append(t.ad, seq[:]...)
+	if !header {
+		t.ad = append(t.ad, flags)
+	}
+	if t.bound && t.seq > 0 {
+		t.ad = append(t.ad, t.path...)
+	}
+	return t.ad
+}
+
+func (t *Transcript) next(flags byte) {
+	t.seq++
+	t.final = flags&FrameFinal != 0
+}
@@ -0,0 +1,147 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cipher
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"testing"
+	"warwolf/reader"
+)
+
+func transcriptFrames(gcm cipher.AEAD, ts *Transcript, segments ...string) [][]byte {
+	r := make([][]byte, 0, len(segments))
+	for i, s := range segments {
+		nonce, _ := Nonce()
+		b := append(make([]byte, HeaderSize), s...)
+		b = append(b, make([]byte, BlockSize)...)
+		if i == len(segments)-1 {
+			r = append(r, EncryptFinal(gcm, ts, nonce, b))
+			continue
+		}
+		r = append(r, Encrypt(gcm, ts, nonce, b))
+	}
+	return r
+}
+
+func transcriptDecrypt(gcm cipher.AEAD, ts *Transcript, frames ...[]byte) ([]string, error) {
+	body := []byte{}
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	r := []string{}
+	f := reader.NewFetcher(reader.ByteFetch(body, io.EOF))
+	err := Decrypt(Time{}, func() (cipher.AEAD, error) {
+		return gcm, nil
+	}, ts, func(b []byte, t Time) bool {
+		return true
+	}, &f, io.EOF, func(b []byte) error {
+		r = append(r, string(b))
+		return nil
+	})
+	return r, err
+}
+
+func TestTranscript(t *testing.T) {
+	gcm, _ := AEAD(make([]byte, 16))
+	sent := NewTranscript("/")
+	request := transcriptFrames(gcm, sent, "A", "B", "C")
+	received := NewTranscript("/")
+	r, err := transcriptDecrypt(gcm, received, request...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(r) != 3 || r[0] != "A" || r[1] != "B" || r[2] != "C" {
+		t.Errorf("Invalid segments %q", r)
+	}
+	respond := transcriptFrames(gcm, sent.Respond(), "D", "")
+	r, err = transcriptDecrypt(gcm, received.Respond(), respond...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(r) != 1 || r[0] != "D" {
+		t.Errorf("Final frame must end the respond alone, got %q", r)
+	}
+	for name, frames := range map[string][][]byte{
+		"Reordered": {request[1], request[0], request[2]},
+		"Dropped":   {request[0], request[2]},
+		"Repeated":  {request[0], request[0], request[1], request[2]},
+		"Reflected": {respond[0], respond[1]},
+	} {
+		_, err = transcriptDecrypt(gcm, NewTranscript("/"), frames...)
+		if err == nil {
+			t.Errorf("%s frames must fail", name)
+		}
+	}
+	_, err = transcriptDecrypt(gcm, NewTranscript("/"), request[0], request[1])
+	if err != ErrTruncated {
+		t.Errorf("Expected %s, got %v", ErrTruncated, err)
+	}
+	other := NewTranscript("/")
+	transcriptFrames(gcm, other, "E")
+	_, err = transcriptDecrypt(gcm, other.Respond(), respond...)
+	if err == nil {
+		t.Error("Respond to another request must fail")
+	}
+}
+
+func TestTranscriptPath(t *testing.T) {
+	gcm, _ := AEAD(make([]byte, 16))
+	shared, _ := AEAD(make([]byte, 16))
+	key := Stretch{}.Key([]byte("TestKey"))
+	h, _ := NewHandshake()
+	s, _, _ := Accept(key, h.Hello(key.ID))
+	sent := NewTranscript("/a")
+	sent.BindPath()
+	k, err := KeyFrame(shared, sent, UseKey(key.ID, s.ID), s.Created, false, make([]byte, KeyFrameSize))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body := append([]byte{}, k...)
+	for _, f := range transcriptFrames(gcm, sent, "A") {
+		body = append(body, f...)
+	}
+	for _, path := range []string{"/a", "/b"} {
+		received := NewTranscript(path)
+		var r []byte
+		f := reader.NewFetcher(reader.ByteFetch(append([]byte{}, body...), io.EOF))
+		aead, c := Keyed(received, func() (cipher.AEAD, error) {
+			return shared, nil
+		}, func(m KeyMessage) (cipher.AEAD, error) {
+			if !m.BindsPath() || m.Kind() != KeyUse {
+				t.Error("Key frame must bind the path")
+			}
+			return gcm, nil
+		}, func(b []byte) error {
+			r = append(r, b...)
+			return nil
+		})
+		err = Decrypt(Time{}, aead, received, func(b []byte, t Time) bool {
+			return true
+		}, &f, io.EOF, c)
+		if path == "/a" && (err != nil || !bytes.Equal(r, []byte("A"))) {
+			t.Errorf("Body sent to the path must be decrypted, got %v", err)
+		}
+		if path == "/b" && err == nil {
+			t.Error("Body sent to another path must fail")
+		}
+	}
+}
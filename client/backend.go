@@ -0,0 +1,292 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/codec"
+	"warwolf/protocol"
+)
+
+const (
+	backendMaxFailures   = 3
+	backendLatencyWeight = 4
+)
+
+var (
+	ErrBackendNoURL             = errors.New("Backend: No URL given")
+	ErrBackendInvalidURL        = errors.New("Backend: Invalid URL")
+	ErrBackendInvalidHost       = errors.New("Backend: Invalid enforced host")
+	ErrBackendTooManyHostsGiven = errors.New("Backend: More per backend options than backend URLs")
+)
+
+type backendTarget struct {
+	url         *url.URL
+	hostEnforce string
+	hostHeader  string
+	carrier     string
+	encoding    string
+	websocket   bool
+}
+
+// backendPositions are the comma separated lists of which each position
+// belongs to the backend URL of the same position
+type backendPositions struct {
+	hostEnforce string
+	hostHeader  string
+	carrier     string
+	encoding    string
+}
+
+func splitBackendList(s string) []string {
+	r := make([]string, 0, 4)
+	for _, v := range strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || c == '|'
+	}) {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		r = append(r, v)
+	}
+	return r
+}
+
+func parseBackendHost(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		_, err = strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return "", ErrBackendInvalidHost
+		}
+		port = s
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitBackendPositions splits a comma separated list of which each position
+// belongs to the backend URL of the same position
+func splitBackendPositions(s string, urls int) ([]string, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+	r := strings.Split(s, ",")
+	if len(r) > urls {
+		return nil, ErrBackendTooManyHostsGiven
+	}
+	for i := range r {
+		r[i] = strings.TrimSpace(r[i])
+	}
+	return r, nil
+}
+
+// parseBackendTargets parses a list of backend URLs separated by "," or "|",
+// and pairs each of them with the enforced host, the Host header, the
+// request carrier and the respond encoding of the same position in the
+// lists of p. An empty position leaves the default in place. URLs of the ws
+// and wss schemes select the WebSocket transport for the backend
+func parseBackendTargets(backends string, p backendPositions) ([]backendTarget, error) {
+	urls := splitBackendList(backends)
+	if len(urls) == 0 {
+		return nil, ErrBackendNoURL
+	}
+	hosts, err := splitBackendPositions(p.hostEnforce, len(urls))
+	if err != nil {
+		return nil, err
+	}
+	headers, err := splitBackendPositions(p.hostHeader, len(urls))
+	if err != nil {
+		return nil, err
+	}
+	carriers, err := splitBackendPositions(p.carrier, len(urls))
+	if err != nil {
+		return nil, err
+	}
+	encodings, err := splitBackendPositions(p.encoding, len(urls))
+	if err != nil {
+		return nil, err
+	}
+	r := make([]backendTarget, len(urls))
+	for i, u := range urls {
+		uu, err := url.Parse(u)
+		if err != nil || len(uu.Scheme) == 0 || len(uu.Host) == 0 {
+			return nil, ErrBackendInvalidURL
+		}
+		switch uu.Scheme {
+		case "ws":
+			uu.Scheme, r[i].websocket = "http", true
+		case "wss":
+			uu.Scheme, r[i].websocket = "https", true
+		}
+		r[i].url = uu
+		if i < len(headers) {
+			r[i].hostHeader = headers[i]
+		}
+		if i < len(carriers) {
+			r[i].carrier = strings.ToLower(carriers[i])
+			err = codec.VerifyCarrier(r[i].carrier)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i < len(encodings) {
+			r[i].encoding = strings.ToLower(encodings[i])
+			err = codec.VerifyEncoding(r[i].encoding)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i >= len(hosts) || len(hosts[i]) == 0 {
+			continue
+		}
+		r[i].hostEnforce, err = parseBackendHost(hosts[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type backend struct {
+	index     int
+	url       *url.URL
+	host      string
+	client    http.Client
+	dial      dialContext
+	shaper    *shaper
+	requests  chan request
+	wrequests chan request
+	cooldown  time.Duration
+	lock      sync.Mutex
+	latency   time.Duration
+	failures  int
+	ejected   time.Time
+	channel   protocol.ID
+	websocket bool
+	carried   bool
+	buffering *buffering
+	tls       *tls.Config
+	keys      keyring
+}
+
+func newBackend(index int, t backendTarget, c Config, tlsc *tls.Config, key cipher.Key) *backend {
+	// The proxy setting has been verified with the config
+	proxy, _ := upstreamProxy(c.UpstreamProxy, t.url)
+	dial := newDialer(c, t, proxy)
+	sh := newShaper(c, t)
+	return &backend{
+		index:     index,
+		url:       t.url,
+		host:      t.hostEnforce,
+		client:    newClient(c, t, proxy, dial, sh, tlsc),
+		dial:      dial,
+		shaper:    sh,
+		requests:  make(chan request),
+		wrequests: make(chan request),
+		cooldown:  c.BackendCooldown,
+		lock:      sync.Mutex{},
+		latency:   0,
+		failures:  0,
+		ejected:   time.Time{},
+		channel:   protocol.ID{},
+		websocket: t.websocket,
+		carried:   t.carrier == codec.CarrierQuery || t.carrier == codec.CarrierCookie,
+		buffering: newBuffering(c.Buffering, c.BufferedHold),
+		tls:       tlsc,
+		keys:      newKeyring(key, c.RekeyInterval, sh),
+	}
+}
+
+// maxBatchSize returns how many bytes of requests are batched together at
+// most. Requests carried in the URL query or the cookies are kept short, as
+// proxies often limit the size of them. A request larger than that is still
+// sent alone
+func (b *backend) maxBatchSize(max int) int {
+	if b.carried && max > requestMaxCarriedBatchSize {
+		return requestMaxCarriedBatchSize
+	}
+	return max
+}
+
+// address returns the host and port that connections to the backend go to
+func (b *backend) address() string {
+	if len(b.host) > 0 {
+		return b.host
+	}
+	port := b.url.Port()
+	if len(port) == 0 {
+		port = "80"
+		if b.url.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(b.url.Hostname(), port)
+}
+
+func (b *backend) healthy(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return !now.Before(b.ejected)
+}
+
+func (b *backend) state() (time.Duration, int, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.latency, b.failures, b.ejected
+}
+
+// report records the result of a request, and returns true when the backend
+// has just been ejected because of it
+func (b *backend) report(err error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < backendMaxFailures {
+		return false
+	}
+	b.failures = 0
+	b.ejected = time.Now().Add(b.cooldown)
+	return true
+}
+
+// probed records the result of a latency probe, the latency is smoothed so
+// a single slow probe won't move sessions around
+func (b *backend) probed(cost time.Duration, err error) bool {
+	if err == nil {
+		b.lock.Lock()
+		if b.latency == 0 {
+			b.latency = cost
+		} else {
+			b.latency += (cost - b.latency) / backendLatencyWeight
+		}
+		b.lock.Unlock()
+	}
+	return b.report(err)
+}
@@ -0,0 +1,155 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"sync"
+	"time"
+	"warwolf/log"
+	"warwolf/protocol"
+)
+
+const (
+	bufferingOff          = "off"
+	bufferingAuto         = "auto"
+	bufferingOn           = "on"
+	bufferingMinSpan      = 300 * time.Millisecond
+	bufferingStrikes      = 2
+	bufferingMaxHold      = 60 * time.Second
+	bufferingSpanFraction = 4
+)
+
+// buffering tells whether the responses of a backend are buffered by an
+// intermediary, which only passes them on once they have ended. The backend
+// marks each response with the time it has been responding for, so a
+// response which took long on the backend but arrived all at once has been
+// buffered. Buffered responses are asked to be held briefly, so a long wait
+// for data won't starve the rest of the batch
+type buffering struct {
+	mode      string
+	hold      time.Duration
+	lock      sync.Mutex
+	buffered  bool
+	strikes   int
+	responses uint64
+	delayed   uint64
+}
+
+// BufferingStats are the counters of the responses of a backend which have
+// been checked for buffering
+type BufferingStats struct {
+	// Backend is the URL of the backend
+	Backend string
+	// Buffered is whether the responses are found buffered, so they are
+	// held by the backend
+	Buffered bool
+	// Responses is how many responses have been checked
+	Responses uint64
+	// Delayed is how many of them have been buffered
+	Delayed uint64
+}
+
+func newBuffering(mode string, hold time.Duration) *buffering {
+	if len(mode) == 0 {
+		mode = bufferingOff
+	}
+	return &buffering{
+		mode:      mode,
+		hold:      hold,
+		lock:      sync.Mutex{},
+		buffered:  mode == bufferingOn,
+		strikes:   0,
+		responses: 0,
+		delayed:   0,
+	}
+}
+
+// request returns the TimingRequest which opens a batch, or false when the
+// responses are not to be marked
+func (b *buffering) request() (protocol.TimingRequest, bool) {
+	if b.mode == bufferingOff {
+		return protocol.TimingRequest{}, false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.buffered {
+		return protocol.TimingRequest{}, true
+	}
+	return protocol.TimingRequest{
+		Hold: uint16(b.hold / time.Millisecond),
+	}, true
+}
+
+// responseMarks are the TimingResponds of one response, and when they
+// arrived
+type responseMarks struct {
+	count        int
+	firstArrival time.Time
+	lastArrival  time.Time
+	firstElapsed time.Duration
+	lastElapsed  time.Duration
+}
+
+func (m *responseMarks) mark(rsp protocol.TimingRespond) {
+	now := time.Now()
+	if m.count == 0 {
+		m.firstArrival, m.firstElapsed = now, rsp.Duration()
+	}
+	m.lastArrival, m.lastElapsed = now, rsp.Duration()
+	m.count++
+}
+
+// observe compares how far apart the marks of a response arrived with how
+// far apart the backend wrote them. Responses too short to tell are skipped
+func (b *buffering) observe(lg log.Log, m responseMarks) {
+	if b.mode == bufferingOff || m.count < 2 {
+		return
+	}
+	span := m.lastElapsed - m.firstElapsed
+	if span < bufferingMinSpan {
+		return
+	}
+	arrival := m.lastArrival.Sub(m.firstArrival)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.responses++
+	if arrival <= span/bufferingSpanFraction {
+		b.delayed++
+		b.strikes++
+		if b.buffered || b.strikes < bufferingStrikes {
+			return
+		}
+		b.buffered = true
+		lg("Buffering: Responses are buffered on the way (written over %s, arrived within %s), holding them for up to %s. %d of %d responses buffered",
+			span, arrival, b.hold, b.delayed, b.responses)
+		return
+	}
+	b.strikes = 0
+	if !b.buffered || b.mode == bufferingOn || arrival < span/2 {
+		return
+	}
+	b.buffered = false
+	lg("Buffering: Responses are no longer buffered on the way, no longer holding them. %d of %d responses buffered",
+		b.delayed, b.responses)
+}
+
+// stats returns the counters of the responses checked
+func (b *buffering) stats() (bool, uint64, uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffered, b.responses, b.delayed
+}
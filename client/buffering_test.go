@@ -0,0 +1,96 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// bufferingMarks are the marks of a response which the backend wrote over
+// span, and which arrived over arrival
+func bufferingMarks(span, arrival time.Duration) responseMarks {
+	now := time.Now()
+	return responseMarks{
+		count:        2,
+		firstArrival: now,
+		lastArrival:  now.Add(arrival),
+		firstElapsed: 0,
+		lastElapsed:  span,
+	}
+}
+
+func TestBufferingDetection(t *testing.T) {
+	lg := func(format string, v ...interface{}) {}
+	b := newBuffering(bufferingAuto, 1500*time.Millisecond)
+	if r, ok := b.request(); !ok || r.Hold != 0 {
+		t.Errorf("Responses must be marked without hold, got %+v, %v", r, ok)
+	}
+	// Too short to tell
+	b.observe(lg, responseMarks{count: 1})
+	b.observe(lg, bufferingMarks(bufferingMinSpan/2, 0))
+	buffered, responses, delayed := b.stats()
+	if buffered || responses != 0 || delayed != 0 {
+		t.Errorf("Short responses must be skipped, got %v %d %d", buffered, responses, delayed)
+	}
+	b.observe(lg, bufferingMarks(time.Second, 10*time.Millisecond))
+	if buffered, _, _ := b.stats(); buffered {
+		t.Error("A single buffered response must not be enough")
+	}
+	b.observe(lg, bufferingMarks(time.Second, time.Second))
+	b.observe(lg, bufferingMarks(time.Second, 10*time.Millisecond))
+	if buffered, _, _ := b.stats(); buffered {
+		t.Error("Buffered responses must be consecutive")
+	}
+	b.observe(lg, bufferingMarks(time.Second, 10*time.Millisecond))
+	buffered, responses, delayed = b.stats()
+	if !buffered || responses != 4 || delayed != 3 {
+		t.Errorf("Expected buffered after 2 strikes, got %v %d %d", buffered, responses, delayed)
+	}
+	if r, ok := b.request(); !ok || r.Hold != 1500 {
+		t.Errorf("Responses must be held, got %+v, %v", r, ok)
+	}
+	// Responses arriving in pieces, but not clearly streamed, keep the hold
+	b.observe(lg, bufferingMarks(time.Second, 300*time.Millisecond))
+	if buffered, _, _ := b.stats(); !buffered {
+		t.Error("Hold must be kept")
+	}
+	b.observe(lg, bufferingMarks(time.Second, 900*time.Millisecond))
+	if buffered, _, _ := b.stats(); buffered {
+		t.Error("Streamed response must release the hold")
+	}
+}
+
+func TestBufferingModes(t *testing.T) {
+	lg := func(format string, v ...interface{}) {}
+	off := newBuffering("", time.Second)
+	if _, ok := off.request(); ok {
+		t.Error("Responses must not be marked when off")
+	}
+	off.observe(lg, bufferingMarks(time.Second, 0))
+	if _, responses, _ := off.stats(); responses != 0 {
+		t.Error("Responses must not be checked when off")
+	}
+	on := newBuffering(bufferingOn, time.Second)
+	if r, ok := on.request(); !ok || r.Hold != 1000 {
+		t.Errorf("Responses must be held from the start, got %+v, %v", r, ok)
+	}
+	on.observe(lg, bufferingMarks(time.Second, time.Second))
+	if buffered, responses, _ := on.stats(); !buffered || responses != 1 {
+		t.Error("Hold must be kept when on")
+	}
+}
@@ -20,68 +20,292 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"warwolf/cipher"
 	"warwolf/config"
 )
 
 type Config struct {
 	Backend               string
 	Key                   []byte
+	KeyStretch            string
+	KeyRounds             int
+	KeySalt               string
 	Listen                string
 	Username              string
 	Password              string
 	BackendHostEnforce    string
+	BackendProbeInterval  time.Duration
+	BackendCooldown       time.Duration
 	MaxClientConnections  int
 	MaxBackendConnections int
 	MaxRetrieveLength     uint16
 	RequestTimeout        time.Duration
 	IdleTimeout           time.Duration
 	MaxRetries            int
+	Forwards              []Forward
+	ForwardsFile          string
+	Reverses              []Reverse
+	Backends              map[string]string
+	Rules                 string
+	RetrieveMode          string
+	Transport             string
+	HTTPVersion           string
+	UpstreamProxy         string
+	BackendHostHeader     string
+	RequestHeaders        string
+	UserAgent             string
+	RequestPaths          string
+	BindPath              string
+	RequestMethods        string
+	CacheBuster           string
+	RequestCarrier        string
+	RespondEncoding       string
+	Buffering             string
+	BufferedHold          time.Duration
+	BackendCA             string
+	BackendPins           string
+	ClientCertFile        string
+	ClientKeyFile         string
+	RekeyInterval         time.Duration
+}
+
+func parseBackends(s string) map[string]string {
+	r := make(map[string]string, 4)
+	for _, b := range strings.Split(s, ",") {
+		nu := strings.SplitN(b, "=", 2)
+		if len(nu) != 2 {
+			continue
+		}
+		r[strings.TrimSpace(nu[0])] = strings.TrimSpace(nu[1])
+	}
+	return r
+}
+
+// DefaultConfig returns the config of which every option is at its default,
+// for a Tunnel which is set up without the environment variables. Backend
+// is left for the caller to set
+func DefaultConfig() Config {
+	return Config{
+		Key:                   []byte("TheRightToCommunicateFreelyPrivatelySecretlyAndSecurelyIsEssentialForASafeSociety"),
+		KeyStretch:            cipher.StretchPBKDF2,
+		KeyRounds:             200000,
+		KeySalt:               cipher.DefaultSalt,
+		Listen:                "127.0.0.1:1080",
+		BackendProbeInterval:  30 * time.Second,
+		BackendCooldown:       60 * time.Second,
+		MaxClientConnections:  128,
+		MaxBackendConnections: 5,
+		MaxRetrieveLength:     requestMaxReqPayloadSize,
+		RequestTimeout:        32 * time.Second,
+		IdleTimeout:           128 * time.Second,
+		MaxRetries:            6,
+		RetrieveMode:          retrieveModePoll,
+		Transport:             transportBatch,
+		HTTPVersion:           httpVersion1,
+		BindPath:              bindPathOff,
+		Buffering:             bufferingOff,
+		BufferedHold:          1 * time.Second,
+		RekeyInterval:         600 * time.Second,
+	}
 }
 
 func (c Config) Load() Config {
+	d := DefaultConfig()
+	httpVersion := strings.TrimSpace(config.LoadStringDefault("HTTPVersion", d.HTTPVersion))
+	maxBackendConnections := uint16(d.MaxBackendConnections)
+	if httpVersion == httpVersion2 {
+		// Requests share the connections, so a lot more of them can be sent
+		// at once
+		maxBackendConnections = 64
+	}
 	return Config{
 		Backend:               strings.TrimSpace(config.LoadString("Backend")),
-		Key:                   []byte(strings.TrimSpace(config.LoadStringDefault("Key", "TheRightToCommunicateFreelyPrivatelySecretlyAndSecurelyIsEssentialForASafeSociety"))),
-		Listen:                strings.TrimSpace(config.HostPortDefault("Listen", "127.0.0.1:1080")),
+		Key:                   []byte(strings.TrimSpace(config.LoadStringDefault("Key", string(d.Key)))),
+		KeyStretch:            strings.ToLower(strings.TrimSpace(config.LoadStringDefault("KeyStretch", d.KeyStretch))),
+		KeyRounds:             int(config.LoadUint32Default("KeyRounds", uint32(d.KeyRounds))),
+		KeySalt:               strings.TrimSpace(config.LoadStringDefault("KeySalt", d.KeySalt)),
+		Listen:                strings.TrimSpace(config.HostPortDefault("Listen", d.Listen)),
 		Username:              strings.TrimSpace(config.LoadString("Username")),
 		Password:              strings.TrimSpace(config.LoadString("Password")),
-		BackendHostEnforce:    strings.TrimSpace(config.HostPortDefault("BackendHostEnforce", "")),
-		MaxClientConnections:  int(config.LoadUint16Default("MaxClientConnections", 128)),
-		MaxBackendConnections: int(config.LoadUint16Default("MaxBackendConnections", 5)),
-		MaxRetrieveLength:     config.LoadUint16Default("MaxRetrieveLength", requestMaxReqPayloadSize),
-		RequestTimeout:        config.LoadTimeDurationDefault("RequestTimeout", 32*time.Second),
-		IdleTimeout:           config.LoadTimeDurationDefault("IdleTimeout", 128*time.Second),
-		MaxRetries:            int(config.LoadUint16Default("MaxRetries", 6)),
+		BackendHostEnforce:    strings.TrimSpace(config.LoadString("BackendHostEnforce")),
+		BackendProbeInterval:  config.LoadTimeDurationDefault("BackendProbeInterval", d.BackendProbeInterval),
+		BackendCooldown:       config.LoadTimeDurationDefault("BackendCooldown", d.BackendCooldown),
+		MaxClientConnections:  int(config.LoadUint16Default("MaxClientConnections", uint16(d.MaxClientConnections))),
+		MaxBackendConnections: int(config.LoadUint16Default("MaxBackendConnections", maxBackendConnections)),
+		MaxRetrieveLength:     config.LoadUint16Default("MaxRetrieveLength", d.MaxRetrieveLength),
+		RequestTimeout:        config.LoadTimeDurationDefault("RequestTimeout", d.RequestTimeout),
+		IdleTimeout:           config.LoadTimeDurationDefault("IdleTimeout", d.IdleTimeout),
+		MaxRetries:            int(config.LoadUint16Default("MaxRetries", uint16(d.MaxRetries))),
+		Forwards:              parseForwards(config.LoadString("Forwards")),
+		ForwardsFile:          strings.TrimSpace(config.LoadString("ForwardsFile")),
+		Reverses:              parseReverses(config.LoadString("Reverses")),
+		Backends:              parseBackends(config.LoadString("Backends")),
+		Rules:                 strings.TrimSpace(config.LoadString("Rules")),
+		RetrieveMode:          strings.TrimSpace(config.LoadStringDefault("RetrieveMode", d.RetrieveMode)),
+		Transport:             strings.TrimSpace(config.LoadStringDefault("Transport", d.Transport)),
+		HTTPVersion:           httpVersion,
+		UpstreamProxy:         strings.TrimSpace(config.LoadString("UpstreamProxy")),
+		BackendHostHeader:     strings.TrimSpace(config.LoadString("BackendHostHeader")),
+		RequestHeaders:        strings.TrimSpace(config.LoadString("RequestHeaders")),
+		UserAgent:             strings.TrimSpace(config.LoadString("UserAgent")),
+		RequestPaths:          strings.TrimSpace(config.LoadString("RequestPaths")),
+		BindPath:              strings.ToLower(strings.TrimSpace(config.LoadStringDefault("BindPath", d.BindPath))),
+		RequestMethods:        strings.TrimSpace(config.LoadString("RequestMethods")),
+		CacheBuster:           strings.TrimSpace(config.LoadString("CacheBuster")),
+		RequestCarrier:        strings.TrimSpace(config.LoadString("RequestCarrier")),
+		RespondEncoding:       strings.TrimSpace(config.LoadString("RespondEncoding")),
+		Buffering:             strings.ToLower(strings.TrimSpace(config.LoadStringDefault("Buffering", d.Buffering))),
+		BufferedHold:          config.LoadTimeDurationDefault("BufferedHold", d.BufferedHold),
+		BackendCA:             strings.TrimSpace(config.LoadString("BackendCA")),
+		BackendPins:           strings.TrimSpace(config.LoadString("BackendPins")),
+		ClientCertFile:        strings.TrimSpace(config.LoadString("ClientCertFile")),
+		ClientKeyFile:         strings.TrimSpace(config.LoadString("ClientKeyFile")),
+		RekeyInterval:         config.LoadTimeDurationDefault("RekeyInterval", d.RekeyInterval),
+	}
+}
+
+func (c Config) backendPositions() backendPositions {
+	return backendPositions{
+		hostEnforce: c.BackendHostEnforce,
+		hostHeader:  c.BackendHostHeader,
+		carrier:     c.RequestCarrier,
+		encoding:    c.RespondEncoding,
 	}
 }
 
 func (c Config) Verify() (Config, error) {
+	if len(c.Listen) == 0 {
+		return c, fmt.Errorf("Option \"Listen\" is required")
+	}
+	err := c.verifyTunnel()
+	if err != nil {
+		return c, err
+	}
+	for _, f := range c.Forwards {
+		err = f.Verify()
+		if err != nil {
+			return c, fmt.Errorf("Option \"Forwards\" contains invalid forward %s: %s", f, err)
+		}
+	}
+	for name, u := range c.Backends {
+		if len(name) == 0 || len(u) == 0 {
+			return c, fmt.Errorf("Option \"Backends\" must be in name=URL form")
+		}
+		_, err := parseBackendTargets(u, backendPositions{})
+		if err != nil {
+			return c, fmt.Errorf("Option \"Backends\" contains invalid backend %s: %s", name, err)
+		}
+		err = verifyUpstreamProxy(c.UpstreamProxy, u)
+		if err != nil {
+			return c, fmt.Errorf("Option \"UpstreamProxy\" or the proxy environment variables are invalid: %s", err)
+		}
+	}
+	for _, r := range c.Reverses {
+		err = r.Verify()
+		if err != nil {
+			return c, fmt.Errorf("Option \"Reverses\" contains invalid reverse tunnel %s: %s", r, err)
+		}
+	}
+	return c, nil
+}
+
+// verifyTunnel verifies the options of the tunnel to the Backend, which is
+// all a Tunnel needs
+func (c Config) verifyTunnel() error {
 	if len(c.Backend) == 0 {
-		return c, fmt.Errorf("Option \"Backend\" is required")
+		return fmt.Errorf("Option \"Backend\" is required")
+	}
+	_, err := parseBackendTargets(c.Backend, c.backendPositions())
+	if err != nil {
+		return fmt.Errorf("Option \"Backend\", \"BackendHostEnforce\", \"BackendHostHeader\", \"RequestCarrier\" or \"RespondEncoding\" is invalid: %s", err)
 	}
 	if len(c.Key) == 0 {
-		return c, fmt.Errorf("Option \"Key\" is required")
+		return fmt.Errorf("Option \"Key\" is required")
 	}
-	if len(c.Listen) == 0 {
-		return c, fmt.Errorf("Option \"Listen\" is required")
+	_, err = c.stretch()
+	if err != nil {
+		return fmt.Errorf("Option \"KeyStretch\" is invalid: %s", err)
+	}
+	if c.KeyStretch == cipher.StretchPBKDF2 && c.KeyRounds < 1000 {
+		return fmt.Errorf("Option \"KeyRounds\" is required and must not be smaller than 1000")
 	}
 	if c.MaxClientConnections < 1 {
-		return c, fmt.Errorf("Option \"MaxClientConnections\" is required and must be greater than 0")
+		return fmt.Errorf("Option \"MaxClientConnections\" is required and must be greater than 0")
 	}
 	if c.MaxBackendConnections < 1 {
-		return c, fmt.Errorf("Option \"MaxBackendConnections\" is required and must be greater than 0")
+		return fmt.Errorf("Option \"MaxBackendConnections\" is required and must be greater than 0")
 	}
 	if c.MaxRetrieveLength < 1 {
-		return c, fmt.Errorf("Option \"MaxRetrieveLength\" is required and must be greater than 0")
+		return fmt.Errorf("Option \"MaxRetrieveLength\" is required and must be greater than 0")
 	}
 	if c.RequestTimeout < 1*time.Second {
-		return c, fmt.Errorf("Option \"RequestTimeout\" is required and must be greater than %s", 1*time.Second)
+		return fmt.Errorf("Option \"RequestTimeout\" is required and must be greater than %s", 1*time.Second)
 	}
 	if c.IdleTimeout < c.RequestTimeout {
-		return c, fmt.Errorf("Option \"IdleTimeout\" is required and must be greater than the \"RequestTimeout\" which currently is %s", c.RequestTimeout)
+		return fmt.Errorf("Option \"IdleTimeout\" is required and must be greater than the \"RequestTimeout\" which currently is %s", c.RequestTimeout)
+	}
+	if c.BackendProbeInterval < 1*time.Second {
+		return fmt.Errorf("Option \"BackendProbeInterval\" is required and must be greater than %s", 1*time.Second)
+	}
+	if c.BackendCooldown < 1*time.Second {
+		return fmt.Errorf("Option \"BackendCooldown\" is required and must be greater than %s", 1*time.Second)
+	}
+	if c.RekeyInterval < 10*time.Second {
+		return fmt.Errorf("Option \"RekeyInterval\" is required and must be greater than %s", 10*time.Second)
 	}
 	if c.MaxRetries < 1 {
-		return c, fmt.Errorf("Option \"MaxRetries\" is required and must be greater than 0")
+		return fmt.Errorf("Option \"MaxRetries\" is required and must be greater than 0")
 	}
-	return c, nil
+	if c.RetrieveMode != retrieveModePoll && c.RetrieveMode != retrieveModePush {
+		return fmt.Errorf("Option \"RetrieveMode\" must be either %q or %q", retrieveModePoll, retrieveModePush)
+	}
+	if c.Transport != transportBatch && c.Transport != transportStream {
+		return fmt.Errorf("Option \"Transport\" must be either %q or %q", transportBatch, transportStream)
+	}
+	if c.HTTPVersion != httpVersion1 && c.HTTPVersion != httpVersion2 {
+		return fmt.Errorf("Option \"HTTPVersion\" must be either %q or %q", httpVersion1, httpVersion2)
+	}
+	if c.Buffering != bufferingOff && c.Buffering != bufferingAuto && c.Buffering != bufferingOn {
+		return fmt.Errorf("Option \"Buffering\" must be one of %q, %q or %q", bufferingOff, bufferingAuto, bufferingOn)
+	}
+	if c.BufferedHold < 1*time.Second || c.BufferedHold > bufferingMaxHold || c.BufferedHold >= c.RequestTimeout {
+		return fmt.Errorf("Option \"BufferedHold\" must be between %s and %s, and less than the \"RequestTimeout\" which currently is %s", 1*time.Second, bufferingMaxHold, c.RequestTimeout)
+	}
+	_, err = parseShapeHeaders(c.RequestHeaders, c.UserAgent)
+	if err != nil {
+		return fmt.Errorf("Option \"RequestHeaders\" is invalid: %s", err)
+	}
+	_, err = parseShapePaths(c.RequestPaths)
+	if err != nil {
+		return fmt.Errorf("Option \"RequestPaths\" is invalid: %s", err)
+	}
+	if c.BindPath != bindPathOff && c.BindPath != bindPathOn {
+		return fmt.Errorf("Option \"BindPath\" must be either %q or %q", bindPathOff, bindPathOn)
+	}
+	_, err = parseShapeMethods(c.RequestMethods)
+	if err != nil {
+		return fmt.Errorf("Option \"RequestMethods\" is invalid: %s", err)
+	}
+	_, err = newTLSConfig(c)
+	if err != nil {
+		return fmt.Errorf("Option \"BackendCA\", \"BackendPins\", \"ClientCertFile\" or \"ClientKeyFile\" is invalid: %s", err)
+	}
+	err = verifyUpstreamProxy(c.UpstreamProxy, c.Backend)
+	if err != nil {
+		return fmt.Errorf("Option \"UpstreamProxy\" or the proxy environment variables are invalid: %s", err)
+	}
+	return nil
+}
+
+// stretch returns the Stretch which turns the Key into the shared key
+func (c Config) stretch() (cipher.Stretch, error) {
+	return cipher.NewStretch(c.KeyStretch, c.KeyRounds, []byte(c.KeySalt))
+}
+
+const keysDefaultSaltNotice = "Keys: Stretched with the default salt, which is the same for everybody. Set the option \"KeySalt\" to one of your own, like the one WWFAs=Keygen prints, on the client and the backend alike"
+
+// defaultSalt returns whether the keys are stretched with the default salt,
+// which is the same for everybody
+func (c Config) defaultSalt() bool {
+	return c.KeyStretch == cipher.StretchPBKDF2 && c.KeySalt == cipher.DefaultSalt
 }
@@ -65,7 +65,8 @@ func (d *dialedConn) retriever() {
 		d.Close()
 		d.wg.Done()
 	}()
-	buf := [protocol.RetrieveRequestOverhead]byte{}
+	// Subscribe is the largest of the requests sent for retrieving
+	buf := [protocol.SubscribeRequestOverhead]byte{}
 	p := reader.NewPusher(buf[:])
 	for {
 		e := d.requester.retrieve(d.id, &p)
@@ -101,3 +102,13 @@ func (d *dialedConn) Close() {
 	d.rwg.Wait()
 	d.hosted.Close()
 }
+
+// idleRetriever is the retriever of a session that carries no data over
+// the requests
+type idleRetriever struct{}
+
+func (r idleRetriever) Dialed()              {}
+func (r idleRetriever) Retrieved(b []byte)   {}
+func (r idleRetriever) Retrieving(bool)      {}
+func (r idleRetriever) Serve(b []byte) error { return nil }
+func (r idleRetriever) Close()               {}
@@ -18,7 +18,6 @@ package client
 
 import (
 	"io"
-	"net/url"
 	"sync"
 	"warwolf/buffer"
 	"warwolf/cipher"
@@ -29,12 +28,20 @@ import (
 	"warwolf/session"
 )
 
+type bindReport func(atyp protocol.AddressType, addr []byte, port uint16) error
+
 type dial struct {
 	lg             log.Log
 	requester      requester
 	maxRetrieveLen uint16
 }
 
+// pinnedDial is a dial which establishes its sessions on one fixed backend
+type pinnedDial struct {
+	d       *dial
+	backend *backend
+}
+
 func (d *dial) Start() {
 	d.requester.init()
 }
@@ -52,6 +59,20 @@ func (d *dial) dial(
 	p *reader.Pusher,
 	hosted io.ReadWriteCloser,
 	after func(),
+) error {
+	return d.dialVia(nil, aTyp, addr, port, reqData, reqDataLen, p, hosted, after)
+}
+
+func (d *dial) dialVia(
+	via *backend,
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	reqDataLen int,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	after func(),
 ) error {
 	rr := protocol.DialRequest{
 		ID:             protocol.ID{},
@@ -64,26 +85,101 @@ func (d *dial) dial(
 	}
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
-	ret, err := d.requester.dial(rr, p, func(id protocol.ID) session.Retriever {
+	ret, err := d.requester.dial(rr, p, d.retriever(hosted, &wg), via, after)
+	if err != nil {
+		return err
+	}
+	return ret.Serve(reqData)
+}
+
+func (d *dial) bind(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	bound bindReport,
+	accepted bindReport,
+	after func(),
+) error {
+	rr := protocol.BindRequest{
+		ID:             protocol.ID{},
+		ATyp:           aTyp,
+		Addr:           addr,
+		Port:           port,
+		MaxRetrieveLen: d.maxRetrieveLen,
+	}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ret, err := d.requester.bind(rr, p, d.retriever(hosted, &wg), bound, accepted, after)
+	if err != nil {
+		return err
+	}
+	return ret.Serve(reqData)
+}
+
+func (d *dial) adopt(
+	id protocol.ID,
+	via protocol.ID,
+	reqData []byte,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	after func(),
+) error {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ret, err := d.requester.adopt(id, via, p, d.retriever(hosted, &wg), after)
+	if err != nil {
+		return err
+	}
+	return ret.Serve(reqData)
+}
+
+func (d pinnedDial) dial(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	reqDataLen int,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	after func(),
+) error {
+	return d.d.dialVia(d.backend, aTyp, addr, port, reqData, reqDataLen, p, hosted, after)
+}
+
+func (d pinnedDial) bind(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	bound bindReport,
+	accepted bindReport,
+	after func(),
+) error {
+	return d.d.bind(aTyp, addr, port, reqData, p, hosted, bound, accepted, after)
+}
+
+func (d *dial) retriever(hosted io.ReadWriteCloser, wg *sync.WaitGroup) session.RetrieverBuilder {
+	return func(id protocol.ID) session.Retriever {
 		return &dialedConn{
 			id:         id,
 			maxSendLen: d.maxRetrieveLen,
 			requester:  &d.requester,
 			hosted:     hosted,
 			rwg:        sync.WaitGroup{},
-			wg:         &wg,
+			wg:         wg,
 		}
-	}, after)
-	if err != nil {
-		return err
 	}
-	return ret.Serve(reqData)
 }
 
 func newDial(
 	lg log.Log,
 	b *buffer.Buffer,
-	url *url.URL,
+	targets []backendTarget,
 	session *session.Retrievers,
 	dispatch *dispatch.Requester,
 	nv cipher.NonceVerifier,
@@ -95,7 +191,7 @@ func newDial(
 	}
 	return dial{
 		lg:             lg,
-		requester:      newRequester(lg, b, url, session, dispatch, nv, c),
+		requester:      newRequester(lg, b, targets, session, dispatch, nv, c),
 		maxRetrieveLen: maxRetrieveLen,
 	}
 }
@@ -0,0 +1,429 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"warwolf/buffer"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+var (
+	ErrForwardInvalidNetwork = errors.New("Forward: Network must be either tcp or udp")
+	ErrForwardInvalidListen  = errors.New("Forward: Invalid listen address")
+	ErrForwardInvalidRemote  = errors.New("Forward: Invalid remote address")
+	ErrForwardExists         = errors.New("Forward: Already exists")
+	ErrForwardNotFound       = errors.New("Forward: Not found")
+	ErrForwardNotRunning     = errors.New("Forward: Forwarder is not running")
+)
+
+const (
+	forwardDefaultNetwork = "tcp"
+	forwardUDPIdleTimeout = 60 * time.Second
+	maxForwardUDPClients  = 64
+)
+
+// Forward is a static port forward. Connections accepted on Listen (or
+// datagrams received on it when Network is "udp") are sent to Remote
+// through the backend without going through the Socks5 handshake
+type Forward struct {
+	Network string
+	Listen  string
+	Remote  string
+}
+
+// ParseForward parses a forward in "[tcp/|udp/]listen=remote" form, for
+// example "udp/127.0.0.1:5353=10.0.0.53:53"
+func ParseForward(s string) Forward {
+	f := Forward{
+		Network: forwardDefaultNetwork,
+	}
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "/"); i >= 0 {
+		f.Network = strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+	}
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		f.Listen = strings.TrimSpace(s)
+		return f
+	}
+	f.Listen = strings.TrimSpace(s[:i])
+	f.Remote = strings.TrimSpace(s[i+1:])
+	return f
+}
+
+func parseForwards(s string) []Forward {
+	r := make([]Forward, 0, 8)
+	for _, f := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(f)) == 0 {
+			continue
+		}
+		r = append(r, ParseForward(f))
+	}
+	return r
+}
+
+func loadForwardsFile(path string) ([]Forward, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := make([]Forward, 0, 8)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := s.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		if len(strings.TrimSpace(l)) == 0 {
+			continue
+		}
+		fw := ParseForward(l)
+		err = fw.Verify()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", l, err)
+		}
+		r = append(r, fw)
+	}
+	return r, s.Err()
+}
+
+func (f Forward) String() string {
+	return f.Network + "/" + f.Listen + "=" + f.Remote
+}
+
+func (f Forward) key() string {
+	return f.Network + "/" + f.Listen
+}
+
+func (f Forward) remote() (protocol.AddressType, []byte, uint16, error) {
+	host, port, err := net.SplitHostPort(f.Remote)
+	if err != nil || len(host) == 0 || len(host) > 255 {
+		return 0, nil, 0, ErrForwardInvalidRemote
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return 0, nil, 0, ErrForwardInvalidRemote
+	}
+	if f.Network == "udp" {
+		return protocol.UDPHost, []byte(host), uint16(p), nil
+	}
+	return protocol.TCPHost, []byte(host), uint16(p), nil
+}
+
+func (f Forward) Verify() error {
+	if f.Network != "tcp" && f.Network != "udp" {
+		return ErrForwardInvalidNetwork
+	}
+	_, _, err := net.SplitHostPort(f.Listen)
+	if err != nil {
+		return ErrForwardInvalidListen
+	}
+	_, _, _, err = f.remote()
+	return err
+}
+
+type forward struct {
+	f    Forward
+	file bool
+	stop func()
+}
+
+type forwards struct {
+	lg      log.Log
+	d       *dial
+	b       *buffer.Buffer
+	running map[string]*forward
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+}
+
+func newForwards() *forwards {
+	return &forwards{
+		lg:      nil,
+		d:       nil,
+		b:       nil,
+		running: make(map[string]*forward, 8),
+		lock:    sync.Mutex{},
+		wg:      sync.WaitGroup{},
+	}
+}
+
+func (f *forwards) start(lg log.Log, d *dial, b *buffer.Buffer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lg = lg
+	f.d = d
+	f.b = b
+}
+
+func (f *forwards) stop() {
+	f.lock.Lock()
+	stops := make([]func(), 0, len(f.running))
+	for k, v := range f.running {
+		stops = append(stops, v.stop)
+		delete(f.running, k)
+	}
+	f.d = nil
+	f.lock.Unlock()
+	for i := range stops {
+		stops[i]()
+	}
+	f.wg.Wait()
+}
+
+func (f *forwards) add(fw Forward) error {
+	return f.addForward(fw, false)
+}
+
+func (f *forwards) addForward(fw Forward, file bool) error {
+	err := fw.Verify()
+	if err != nil {
+		return err
+	}
+	atyp, addr, port, _ := fw.remote()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.d == nil {
+		return ErrForwardNotRunning
+	}
+	if _, ex := f.running[fw.key()]; ex {
+		return ErrForwardExists
+	}
+	lg := func(format string, v ...interface{}) {
+		f.lg("Forward "+fw.String()+": "+format, v...)
+	}
+	var stop func()
+	switch fw.Network {
+	case "udp":
+		stop, err = f.serveUDP(lg, fw, atyp, addr, port)
+	default:
+		stop, err = f.serveTCP(lg, fw, atyp, addr, port)
+	}
+	if err != nil {
+		return err
+	}
+	f.running[fw.key()] = &forward{
+		f:    fw,
+		file: file,
+		stop: stop,
+	}
+	lg("Started")
+	return nil
+}
+
+func (f *forwards) remove(network, listen string) error {
+	f.lock.Lock()
+	key := Forward{Network: network, Listen: listen}.key()
+	fw, ex := f.running[key]
+	if !ex {
+		f.lock.Unlock()
+		return ErrForwardNotFound
+	}
+	delete(f.running, key)
+	f.lock.Unlock()
+	fw.stop()
+	f.lg("Forward %s: Stopped", fw.f)
+	return nil
+}
+
+func (f *forwards) list() []Forward {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	r := make([]Forward, 0, len(f.running))
+	for _, v := range f.running {
+		r = append(r, v.f)
+	}
+	return r
+}
+
+// sync makes the forwards loaded from file match the given list. Forwards
+// added by other means are left untouched
+func (f *forwards) sync(fws []Forward) {
+	wanted := make(map[string]Forward, len(fws))
+	for _, fw := range fws {
+		wanted[fw.key()] = fw
+	}
+	f.lock.Lock()
+	loaded := make([]Forward, 0, len(f.running))
+	for _, v := range f.running {
+		if !v.file {
+			delete(wanted, v.f.key())
+			continue
+		}
+		loaded = append(loaded, v.f)
+	}
+	f.lock.Unlock()
+	for _, fw := range loaded {
+		w, ex := wanted[fw.key()]
+		if ex && w == fw {
+			delete(wanted, fw.key())
+			continue
+		}
+		f.remove(fw.Network, fw.Listen)
+	}
+	for _, fw := range wanted {
+		err := f.addForward(fw, true)
+		if err != nil {
+			f.lg("Forward %s: Unable to start: %s", fw, err)
+		}
+	}
+}
+
+func (f *forwards) serveTCP(lg log.Log, fw Forward, atyp protocol.AddressType, addr []byte, port uint16) (func(), error) {
+	l, err := net.Listen("tcp", fw.Listen)
+	if err != nil {
+		return nil, err
+	}
+	d := f.d
+	b := f.b
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+			f.wg.Add(1)
+			go func(conn net.Conn) {
+				defer func() {
+					conn.Close()
+					f.wg.Done()
+				}()
+				req := b.Request()
+				defer b.Return(req)
+				c := reader.NewNetConn(conn)
+				lg("Accepted %s", conn.RemoteAddr())
+				err := dialTCP(d, b, atyp, addr, port, req, readInitial(c, req), c)
+				if err != nil {
+					lg("%s: Request failed: %s", conn.RemoteAddr(), err)
+				}
+			}(conn)
+		}
+	}()
+	return func() {
+		l.Close()
+	}, nil
+}
+
+func (f *forwards) serveUDP(lg log.Log, fw Forward, atyp protocol.AddressType, addr []byte, port uint16) (func(), error) {
+	la, err := net.ResolveUDPAddr("udp", fw.Listen)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUDP("udp", la)
+	if err != nil {
+		return nil, err
+	}
+	d := f.d
+	bb := f.b
+	clients := make(map[string]*socks5UDPClient, maxForwardUDPClients)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	f.wg.Add(1)
+	go func() {
+		defer func() {
+			lock.Lock()
+			for _, v := range clients {
+				v.close()
+			}
+			lock.Unlock()
+			wg.Wait()
+			f.wg.Done()
+		}()
+		b := bb.Request()
+		defer bb.Return(b)
+		for {
+			n, caddr, err := l.ReadFromUDP(b)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+			id := caddr.String()
+			now := time.Now()
+			lock.Lock()
+			c, ex := clients[id]
+			if ex {
+				c.expire = now.Add(forwardUDPIdleTimeout)
+				err = c.send(bb, 0, b[:n])
+				lock.Unlock()
+				if err != nil {
+					lg("UDP packet from %s was failed to dispatched: %s", caddr, err)
+				}
+				continue
+			}
+			for k, v := range clients {
+				if v.expire.After(now) {
+					continue
+				}
+				v.close()
+				delete(clients, k)
+			}
+			if len(clients) >= maxForwardUDPClients {
+				lock.Unlock()
+				lg("UDP packet from %s was failed to dispatched: %s", caddr, ErrTooManyUDPClient)
+				continue
+			}
+			c = &socks5UDPClient{
+				expire:  now.Add(forwardUDPIdleTimeout),
+				receive: make(chan socks5UDPConnReceive, maxSocks5UDPClients),
+				frag:    0,
+			}
+			clients[id] = c
+			lock.Unlock()
+			buf := bb.Request()
+			ll := copy(buf[:reqDataSafeSize], b[:n])
+			wg.Add(1)
+			go func(c *socks5UDPClient, caddr *net.UDPAddr, id string) {
+				defer func() {
+					bb.Return(buf)
+					lock.Lock()
+					defer lock.Unlock()
+					if clients[id] == c {
+						delete(clients, id)
+					}
+					wg.Done()
+				}()
+				err := c.handle(caddr, l, d, nil, atyp, addr, port, 0, buf, ll, bb)
+				if err != nil {
+					lg("%s: Request failed: %s", caddr, err)
+				}
+			}(c, caddr, id)
+		}
+	}()
+	return func() {
+		l.Close()
+	}, nil
+}
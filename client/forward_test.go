@@ -0,0 +1,184 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+	"warwolf/buffer"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func startTestForwards() *forwards {
+	b := buffer.New(reqDataSize, 2)
+	f := newForwards()
+	f.start(func(format string, v ...interface{}) {}, &dial{}, &b)
+	return f
+}
+
+func forwardKeys(f *forwards) []string {
+	r := make([]string, 0, 4)
+	for _, fw := range f.list() {
+		r = append(r, fw.String())
+	}
+	sort.Strings(r)
+	return r
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseForward(t *testing.T) {
+	for _, c := range []struct {
+		s   string
+		f   Forward
+		err error
+	}{
+		{"127.0.0.1:8080=example.com:80", Forward{"tcp", "127.0.0.1:8080", "example.com:80"}, nil},
+		{" UDP/127.0.0.1:5353 = 10.0.0.53:53 ", Forward{"udp", "127.0.0.1:5353", "10.0.0.53:53"}, nil},
+		{"sctp/127.0.0.1:1=a:1", Forward{"sctp", "127.0.0.1:1", "a:1"}, ErrForwardInvalidNetwork},
+		{"127.0.0.1=a:1", Forward{"tcp", "127.0.0.1", "a:1"}, ErrForwardInvalidListen},
+		{"127.0.0.1:1", Forward{"tcp", "127.0.0.1:1", ""}, ErrForwardInvalidRemote},
+		{"127.0.0.1:1=a:0", Forward{"tcp", "127.0.0.1:1", "a:0"}, ErrForwardInvalidRemote},
+	} {
+		f := ParseForward(c.s)
+		if f != c.f {
+			t.Errorf("%q: Expected %+v, got %+v", c.s, c.f, f)
+		}
+		if err := f.Verify(); err != c.err {
+			t.Errorf("%q: Expected error %v, got %v", c.s, c.err, err)
+		}
+	}
+}
+
+func TestListenerForwards(t *testing.T) {
+	s := Listener{}
+	if err := s.AddForward(ParseForward("127.0.0.1:1=a:1")); err != ErrForwardNotRunning {
+		t.Errorf("Expected %v, got %v", ErrForwardNotRunning, err)
+	}
+	s = New()
+	if err := s.AddForward(ParseForward("127.0.0.1:1=a:1")); err != ErrForwardNotRunning {
+		t.Errorf("Expected %v before start, got %v", ErrForwardNotRunning, err)
+	}
+	s.forwards = startTestForwards()
+	defer s.forwards.stop()
+	tcp := ParseForward(freeAddr(t) + "=example.com:80")
+	udp := ParseForward("udp/" + tcp.Listen + "=10.0.0.53:53")
+	for _, fw := range []Forward{tcp, udp} {
+		if err := s.AddForward(fw); err != nil {
+			t.Fatalf("%s: %s", fw, err)
+		}
+	}
+	if err := s.AddForward(tcp); err != ErrForwardExists {
+		t.Errorf("Expected %v, got %v", ErrForwardExists, err)
+	}
+	if k := forwardKeys(s.forwards); !equalKeys(k, []string{tcp.String(), udp.String()}) {
+		t.Errorf("Unexpected forwards %v", k)
+	}
+	if l, err := net.Listen("tcp", tcp.Listen); err == nil {
+		l.Close()
+		t.Error("Forward is not listening")
+	}
+	if err := s.RemoveForward("tcp", tcp.Listen); err != nil {
+		t.Error(err)
+	}
+	if err := s.RemoveForward("tcp", tcp.Listen); err != ErrForwardNotFound {
+		t.Errorf("Expected %v, got %v", ErrForwardNotFound, err)
+	}
+	l, err := net.Listen("tcp", tcp.Listen)
+	if err != nil {
+		t.Errorf("Removed forward is still listening: %s", err)
+	} else {
+		l.Close()
+	}
+	if k := forwardKeys(s.forwards); !equalKeys(k, []string{udp.String()}) {
+		t.Errorf("Unexpected forwards %v", k)
+	}
+}
+
+func TestReloadForwards(t *testing.T) {
+	s := Listener{forwards: startTestForwards()}
+	defer s.forwards.stop()
+	path := filepath.Join(t.TempDir(), "forwards")
+	kept := ParseForward(freeAddr(t) + "=a.example:80")
+	changed := ParseForward(freeAddr(t) + "=b.example:80")
+	removed := ParseForward(freeAddr(t) + "=c.example:80")
+	runtime := ParseForward(freeAddr(t) + "=d.example:80")
+	if err := s.AddForward(runtime); err != nil {
+		t.Fatal(err)
+	}
+	write := func(fws ...Forward) {
+		d := "# Forwards\n\n"
+		for _, fw := range fws {
+			d += fw.String() + "\n"
+		}
+		if err := os.WriteFile(path, []byte(d), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(kept, changed, removed)
+	s.reloadForwards(s.forwards, path)
+	expected := []string{kept.String(), changed.String(), removed.String(), runtime.String()}
+	sort.Strings(expected)
+	if k := forwardKeys(s.forwards); !equalKeys(k, expected) {
+		t.Fatalf("Unexpected forwards %v", k)
+	}
+	// An invalid file must leave running forwards alone
+	if err := os.WriteFile(path, []byte("sctp/127.0.0.1:1=a:1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadForwards(s.forwards, path)
+	if k := forwardKeys(s.forwards); !equalKeys(k, expected) {
+		t.Fatalf("Unexpected forwards after invalid reload %v", k)
+	}
+	changed.Remote = "e.example:80"
+	write(kept, changed)
+	stop := s.watchForwards(s.forwards, path)
+	defer stop()
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	expected = []string{kept.String(), changed.String(), runtime.String()}
+	sort.Strings(expected)
+	deadline := time.Now().Add(5 * time.Second)
+	for !equalKeys(forwardKeys(s.forwards), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Forwards were not reloaded on SIGHUP: %v", forwardKeys(s.forwards))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,246 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+	"warwolf/buffer"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+var (
+	ErrHTTPProxyAuthFailed         = errors.New("HTTP Proxy: Auth failed")
+	ErrHTTPProxyBadAddress         = errors.New("HTTP Proxy: Bad address")
+	ErrHTTPProxyRequestTooLarge    = errors.New("HTTP Proxy: Request header too large")
+	ErrUnsupportedHTTPProxyRequest = errors.New("HTTP Proxy: Unsupported request")
+)
+
+const (
+	httpProxyDefaultPort = 80
+	httpProxyAuthRealm   = "Warwolf"
+)
+
+func httpProxyCredentials(req *http.Request) (string, string, bool) {
+	const prefix = "Basic "
+	h := req.Header.Get("Proxy-Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	cc := string(c)
+	s := strings.IndexByte(cc, ':')
+	if s < 0 {
+		return "", "", false
+	}
+	return cc[:s], cc[s+1:], true
+}
+
+func httpProxyAuth(auth socks5Auth, req *http.Request) bool {
+	if auth == nil {
+		return true
+	}
+	u, p, ok := httpProxyCredentials(req)
+	if !ok {
+		return false
+	}
+	return auth(u, p)
+}
+
+func httpProxyAddr(hostport string, defPort uint16) ([]byte, uint16, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+		port = strconv.FormatUint(uint64(defPort), 10)
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, 0, ErrHTTPProxyBadAddress
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return nil, 0, ErrHTTPProxyBadAddress
+	}
+	return []byte(host), uint16(p), nil
+}
+
+func httpProxyRespond(r net.Conn, status int, header string) error {
+	_, err := io.WriteString(r, fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), header))
+	return err
+}
+
+func httpProxyBuildRequest(req *http.Request, bb []byte) (int, error) {
+	p := reader.NewPusher(bb[:reqDataSafeSize])
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Keep-Alive")
+	req.Header.Set("Connection", "close")
+	_, err := fmt.Fprintf(&p, "%s %s HTTP/%d.%d\r\nHost: %s\r\n",
+		req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor, req.Host)
+	if err != nil {
+		return 0, ErrHTTPProxyRequestTooLarge
+	}
+	if len(req.TransferEncoding) > 0 {
+		_, err = io.WriteString(&p, "Transfer-Encoding: "+strings.Join(req.TransferEncoding, ", ")+"\r\n")
+		if err != nil {
+			return 0, ErrHTTPProxyRequestTooLarge
+		}
+	}
+	err = req.Header.Write(&p)
+	if err != nil {
+		return 0, ErrHTTPProxyRequestTooLarge
+	}
+	_, err = io.WriteString(&p, "\r\n")
+	if err != nil {
+		return 0, ErrHTTPProxyRequestTooLarge
+	}
+	return p.Size(), nil
+}
+
+func httpProxy(lg log.Log, rt *router, b *buffer.Buffer, bb []byte, r sniffedConn, auth socks5Auth) error {
+	req, err := http.ReadRequest(r.r)
+	if err != nil {
+		return err
+	}
+	if !httpProxyAuth(auth, req) {
+		httpProxyRespond(r, http.StatusProxyAuthRequired,
+			"Proxy-Authenticate: Basic realm=\""+httpProxyAuthRealm+"\"\r\n")
+		return ErrHTTPProxyAuthFailed
+	}
+	user := ""
+	if auth != nil {
+		user, _, _ = httpProxyCredentials(req)
+	}
+	if req.Method == http.MethodConnect {
+		addr, port, err := httpProxyAddr(req.Host, 443)
+		if err != nil {
+			httpProxyRespond(r, http.StatusBadRequest, "")
+			return err
+		}
+		lg("HTTP CONNECT %s", req.Host)
+		d, err := rt.route("tcp", user, protocol.TCPHost, addr, port)
+		if err != nil {
+			httpProxyRespond(r, http.StatusForbidden, "")
+			return err
+		}
+		_, err = io.WriteString(r, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			return err
+		}
+		return dialTCP(d, b, protocol.TCPHost, addr, port, bb, readInitial(r, bb), r)
+	}
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		httpProxyRespond(r, http.StatusBadRequest, "")
+		return ErrUnsupportedHTTPProxyRequest
+	}
+	addr, port, err := httpProxyAddr(req.URL.Host, httpProxyDefaultPort)
+	if err != nil {
+		httpProxyRespond(r, http.StatusBadRequest, "")
+		return err
+	}
+	if len(req.Host) == 0 {
+		req.Host = req.URL.Host
+	}
+	l, err := httpProxyBuildRequest(req, bb)
+	if err != nil {
+		httpProxyRespond(r, http.StatusRequestHeaderFieldsTooLarge, "")
+		return err
+	}
+	lg("HTTP %s %s", req.Method, req.URL)
+	d, err := rt.route("tcp", user, protocol.TCPHost, addr, port)
+	if err != nil {
+		httpProxyRespond(r, http.StatusForbidden, "")
+		return err
+	}
+	r.SetDeadline(time.Time{})
+	return httpProxyForward(d, b, addr, port, req, bb, l, r)
+}
+
+// httpProxyBody writes the body of req to w after the header, encoded the
+// way the header says. Nothing is read from the connection after it
+func httpProxyBody(w io.WriteCloser, req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	var err error
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		cw := httputil.NewChunkedWriter(w)
+		_, err = io.Copy(cw, req.Body)
+		if err == nil {
+			err = cw.Close()
+		}
+		if err == nil {
+			_, err = io.WriteString(w, "\r\n")
+		}
+	} else {
+		_, err = io.Copy(w, req.Body)
+	}
+	if err != nil {
+		w.Close()
+	}
+}
+
+// httpProxyForward sends the request, whose header is in bb, to the remote
+// through d, and responds its respond, after which the connection is
+// closed. Only this request is sent, so a request after it on the same
+// connection never reaches the remote without being routed
+func httpProxyForward(d dialer, b *buffer.Buffer, addr []byte, port uint16, req *http.Request, bb []byte, l int, r net.Conn) error {
+	local, hosted := net.Pipe()
+	defer local.Close()
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- dialTCP(d, b, protocol.TCPHost, addr, port, bb, l, hosted)
+		hosted.Close()
+	}()
+	go httpProxyBody(local, req)
+	br := bufio.NewReader(local)
+	for {
+		rsp, err := http.ReadResponse(br, req)
+		if err != nil {
+			local.Close()
+			if derr := <-dialed; derr != nil {
+				err = derr
+			}
+			httpProxyRespond(r, http.StatusBadGateway, "")
+			return err
+		}
+		// Interim responds are followed by the final one
+		interim := rsp.StatusCode >= 100 && rsp.StatusCode < 200 && rsp.StatusCode != http.StatusSwitchingProtocols
+		rsp.Close = !interim
+		err = rsp.Write(r)
+		if err != nil || !interim {
+			local.Close()
+			<-dialed
+			return err
+		}
+	}
+}
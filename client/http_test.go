@@ -0,0 +1,144 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"warwolf/buffer"
+)
+
+// keepAliveOrigin responds the Host and the body of every request on a
+// connection, and keeps it open even when asked to close it
+func keepAliveOrigin(t *testing.T, requests *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					body, _ := io.ReadAll(req.Body)
+					atomic.AddInt32(requests, 1)
+					rsp := req.Host + " " + string(body)
+					io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(rsp))+"\r\n\r\n"+rsp)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestHTTPProxyOneRequest(t *testing.T) {
+	requests := int32(0)
+	origin := keepAliveOrigin(t, &requests)
+	defer origin.Close()
+	rules, _ := loadRules(strings.NewReader("direct"))
+	rt, _ := newRouter(rules, nil, nil, nil)
+	b := buffer.New(reqDataSize, 2)
+	addr := origin.Addr().String()
+	other := strings.Replace(addr, "127.0.0.1", "localhost", 1)
+	for _, body := range []string{
+		"Content-Length: 5\r\n\r\nHello",
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nHello\r\n0\r\n\r\n",
+	} {
+		conn, proxied := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			bb := b.Request()
+			defer b.Return(bb)
+			done <- httpProxy(func(format string, v ...interface{}) {}, rt, &b, bb, newSniffedConn(proxied), nil)
+			proxied.Close()
+		}()
+		// The second request goes to another host on the same connection
+		go io.WriteString(conn, "POST http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n"+body+
+			"GET http://"+other+"/ HTTP/1.1\r\nHost: "+other+"\r\n\r\n")
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(rsp.Body)
+		if string(got) != addr+" Hello" || !rsp.Close {
+			t.Errorf("Invalid respond %q, close %v", got, rsp.Close)
+		}
+		if _, err = http.ReadResponse(br, nil); err == nil {
+			t.Error("Connection must be closed after the first respond")
+		}
+		conn.Close()
+		<-done
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Only the first request of each connection must reach the origin, got %d", n)
+	}
+}
+
+func TestHTTPProxyUserWithoutAuth(t *testing.T) {
+	requests := int32(0)
+	origin := keepAliveOrigin(t, &requests)
+	defer origin.Close()
+	rules, _ := loadRules(strings.NewReader("block user:alice\ndirect"))
+	rt, _ := newRouter(rules, nil, nil, nil)
+	b := buffer.New(reqDataSize, 2)
+	addr := origin.Addr().String()
+	for _, c := range []struct {
+		auth   socks5Auth
+		status int
+	}{
+		// Credentials are only used for routing when the proxy asks for them
+		{nil, http.StatusOK},
+		{func(u, p string) bool { return true }, http.StatusForbidden},
+	} {
+		conn, proxied := net.Pipe()
+		go func() {
+			bb := b.Request()
+			defer b.Return(bb)
+			httpProxy(func(format string, v ...interface{}) {}, rt, &b, bb, newSniffedConn(proxied), c.auth)
+			proxied.Close()
+		}()
+		go io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+
+			"\r\nProxy-Authorization: Basic YWxpY2U6eA==\r\n\r\n")
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != c.status {
+			t.Errorf("Expected status %d, got %d", c.status, rsp.StatusCode)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,234 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	cph "crypto/cipher"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/log"
+)
+
+const (
+	// keySkewNotice is how far off the local clock has to be from the one
+	// of the backend for it to be logged
+	keySkewNotice = 5 * time.Second
+	// keyDateSkewNotice is how far off the Date header of a backend which
+	// has failed a handshake has to be for it to be logged. The header is
+	// not authenticated, so it's only a hint
+	keyDateSkewNotice = 30 * time.Second
+)
+
+// keyring is the session of the traffic keys shared with a backend. It's
+// established with a handshake when there's none, and established again
+// once it's due for a rekey or the backend has forgotten it. The shared key
+// follows the clock of the backend, which is learned from the handshakes
+type keyring struct {
+	shared  cipher.Key
+	rekey   time.Duration
+	shaper  *shaper
+	lock    sync.Mutex
+	session *cipher.Session
+	clock   sync.Mutex
+	offset  time.Duration
+	skewed  bool
+}
+
+func newKeyring(key cipher.Key, rekey time.Duration, sh *shaper) keyring {
+	return keyring{
+		shared:  key,
+		rekey:   rekey,
+		shaper:  sh,
+		lock:    sync.Mutex{},
+		session: nil,
+		clock:   sync.Mutex{},
+		offset:  0,
+		skewed:  false,
+	}
+}
+
+// now returns the time on the clock of the backend, as far as it's known
+func (k *keyring) now() time.Time {
+	k.clock.Lock()
+	defer k.clock.Unlock()
+	return time.Now().Add(k.offset)
+}
+
+// sharedCipher returns the AEAD of the shared key of the time being, which
+// encrypts the key frames, with the time of it
+func (k *keyring) sharedCipher() (cph.AEAD, cipher.Time, error) {
+	key, t := k.shared.GetAt(k.now())
+	cip, err := cipher.AEAD(key)
+	if err != nil {
+		return nil, t, ErrRequestCipherFailed
+	}
+	return cip, t, nil
+}
+
+// sharedCipherAt returns the AEAD of the shared key of the time t, which
+// the key frame of the respond to a request sent at t is encrypted with
+func (k *keyring) sharedCipherAt(t cipher.Time) (cph.AEAD, error) {
+	cip, err := cipher.AEAD(k.shared.At(t))
+	if err != nil {
+		return nil, ErrRequestCipherFailed
+	}
+	return cip, nil
+}
+
+func skewed(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " behind"
+	}
+	return d.String() + " ahead of"
+}
+
+// synchronize corrects the clock with the time the backend has stamped m
+// with. m is the respond of a handshake sent at sent and received at
+// received, so it has been stamped about halfway in between
+func (k *keyring) synchronize(lg log.Log, m cipher.KeyMessage, sent time.Time, received time.Time) {
+	local := sent.Add(received.Sub(sent) / 2)
+	offset := m.Time().Sub(local)
+	k.clock.Lock()
+	defer k.clock.Unlock()
+	k.offset = offset
+	if offset >= keySkewNotice || offset <= -keySkewNotice {
+		k.skewed = true
+		lg("Clock: The local clock is %s the one of the backend, which is corrected for. Sync the clock, as it can't be corrected before a handshake once it's too far off", skewed(-offset))
+		return
+	}
+	if k.skewed {
+		k.skewed = false
+		lg("Clock: The local clock is in sync with the one of the backend again")
+	}
+}
+
+// diagnose logs when the clock looks off from the Date header of a backend
+// which has failed a handshake
+func (k *keyring) diagnose(lg log.Log, date time.Time) {
+	if date.IsZero() {
+		return
+	}
+	d := k.now().Sub(date)
+	if d < keyDateSkewNotice && d > -keyDateSkewNotice {
+		return
+	}
+	lg("Clock: Handshake has failed while the local clock is %s the Date of the backend. Requests fail when the clock is too far off, so sync the clock", skewed(d))
+}
+
+// transcript returns the transcript of a request to u, with the URL to send
+// it to. A bound path is picked here, so the body is bound to the path the
+// request is sent to
+func (k *keyring) transcript(u *url.URL) (*cipher.Transcript, *url.URL) {
+	if !k.shaper.bind {
+		return cipher.NewTranscript(u.Path), u
+	}
+	u = k.shaper.pick(u)
+	ts := cipher.NewTranscript(u.Path)
+	ts.BindPath()
+	return ts, u
+}
+
+// get returns the session, which is established with handshake first when
+// there's none or it's due for a rekey. Handshakes are sent one at a time,
+// and the requests wait for the one being sent
+func (k *keyring) get(handshake func(h cipher.Handshake) (*cipher.Session, error)) (*cipher.Session, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.session != nil && time.Since(k.session.Created) < k.rekey {
+		return k.session, nil
+	}
+	h, err := cipher.NewHandshake()
+	if err != nil {
+		return nil, ErrRequestCipherFailed
+	}
+	s, err := handshake(h)
+	if err != nil {
+		return nil, err
+	}
+	// The keys of the session replaced are dropped along with it, so what
+	// they have encrypted can no longer be decrypted here
+	k.session = s
+	return s, nil
+}
+
+// forget drops the session s once the backend has told it's unknown to it
+func (k *keyring) forget(s *cipher.Session) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.session == s {
+		k.session = nil
+	}
+}
+
+// respond returns the handler of the key frame of the respond to a request
+// sent with the session s
+func (k *keyring) respond(s *cipher.Session) func(m cipher.KeyMessage) (cph.AEAD, error) {
+	return func(m cipher.KeyMessage) (cph.AEAD, error) {
+		if m.KeyID() != s.Key {
+			return nil, cipher.ErrKeyInvalidMessage
+		}
+		switch {
+		case m.Kind() == cipher.KeyUse && m.ID() == s.ID:
+			return s.Respond, nil
+		case m.Kind() == cipher.KeyUnknown && m.ID() == s.ID:
+			k.forget(s)
+			return nil, cipher.ErrKeyUnknownSession
+		}
+		return nil, cipher.ErrKeyInvalidMessage
+	}
+}
+
+// seal encrypts the request in body with the session s, after the key frame
+// which names it, as the whole body of the transcript ts. body has
+// requestReqPadSize bytes of room before the request and cipher.BlockSize
+// bytes after it. It returns the time of the shared key
+func (k *keyring) seal(s *cipher.Session, ts *cipher.Transcript, body []byte) ([]byte, cipher.Time, error) {
+	shared, t, err := k.sharedCipher()
+	if err != nil {
+		return nil, t, err
+	}
+	_, err = cipher.KeyFrame(shared, ts, cipher.UseKey(s.Key, s.ID), k.now(), false, body[:cipher.KeyFrameSize])
+	if err != nil {
+		return nil, t, ErrRequestCipherFailed
+	}
+	n, err := cipher.Nonce()
+	if err != nil {
+		return nil, t, ErrRequestCipherFailed
+	}
+	cipher.EncryptFinal(s.Request, ts, n, body[cipher.KeyFrameSize:])
+	return body, t, nil
+}
+
+// writeKey writes the key frame which names the session s to w, as the
+// first frame of ts, which every direction of a stream starts with. It
+// returns the time of the shared key
+func (k *keyring) writeKey(w io.Writer, s *cipher.Session, ts *cipher.Transcript) (cipher.Time, error) {
+	shared, t, err := k.sharedCipher()
+	if err != nil {
+		return t, err
+	}
+	f, err := cipher.KeyFrame(shared, ts, cipher.UseKey(s.Key, s.ID), k.now(), false, make([]byte, cipher.KeyFrameSize))
+	if err != nil {
+		return t, ErrRequestCipherFailed
+	}
+	_, err = w.Write(f)
+	return t, err
+}
@@ -0,0 +1,131 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+	"warwolf/cipher"
+)
+
+func testKeyring(rekey time.Duration) keyring {
+	return newKeyring(cipher.Stretch{}.Key([]byte("TestKey")), rekey, newShaper(DefaultConfig(), backendTarget{}))
+}
+
+// accepted returns the handshake of k accepted by a backend
+func accepted(k *keyring, handshakes *int) func(h cipher.Handshake) (*cipher.Session, error) {
+	return func(h cipher.Handshake) (*cipher.Session, error) {
+		*handshakes++
+		_, m, err := cipher.Accept(k.shared, h.Hello(k.shared.ID))
+		if err != nil {
+			return nil, err
+		}
+		return h.Finish(k.shared, m)
+	}
+}
+
+func TestKeyringGet(t *testing.T) {
+	k := testKeyring(time.Hour)
+	handshakes := 0
+	failed := errors.New("Failed")
+	if _, err := k.get(func(h cipher.Handshake) (*cipher.Session, error) {
+		handshakes++
+		return nil, failed
+	}); err != failed {
+		t.Errorf("Expected %v, got %v", failed, err)
+	}
+	s, err := k.get(accepted(&k, &handshakes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss, _ := k.get(accepted(&k, &handshakes)); ss != s || handshakes != 2 {
+		t.Errorf("Session must be reused, %d handshakes", handshakes)
+	}
+	// A session the backend doesn't know is established again
+	respond := k.respond(s)
+	if _, err := respond(cipher.UseKey(s.Key, s.ID)); err != nil {
+		t.Error(err)
+	}
+	if _, err := respond(cipher.UseKey(cipher.KeyID{}, s.ID)); err != cipher.ErrKeyInvalidMessage {
+		t.Errorf("Expected %v, got %v", cipher.ErrKeyInvalidMessage, err)
+	}
+	if _, err := respond(cipher.UseKey(s.Key, cipher.SessionID{})); err != cipher.ErrKeyInvalidMessage {
+		t.Errorf("Expected %v, got %v", cipher.ErrKeyInvalidMessage, err)
+	}
+	if ss, _ := k.get(accepted(&k, &handshakes)); ss != s {
+		t.Error("Session must be kept after an invalid respond")
+	}
+	if _, err := respond(cipher.UnknownKey(s.Key, s.ID)); err != cipher.ErrKeyUnknownSession {
+		t.Errorf("Expected %v, got %v", cipher.ErrKeyUnknownSession, err)
+	}
+	ss, _ := k.get(accepted(&k, &handshakes))
+	if ss == s || handshakes != 3 {
+		t.Errorf("Forgotten session must be established again, %d handshakes", handshakes)
+	}
+	// Forgetting a session which has been replaced already keeps the new one
+	k.forget(s)
+	if sss, _ := k.get(accepted(&k, &handshakes)); sss != ss {
+		t.Error("Replaced session must not be forgotten")
+	}
+}
+
+func TestKeyringRekey(t *testing.T) {
+	k := testKeyring(time.Millisecond)
+	handshakes := 0
+	s, _ := k.get(accepted(&k, &handshakes))
+	time.Sleep(2 * time.Millisecond)
+	if ss, _ := k.get(accepted(&k, &handshakes)); ss == s || handshakes != 2 {
+		t.Errorf("Session must be rekeyed, %d handshakes", handshakes)
+	}
+}
+
+func TestKeyringSynchronize(t *testing.T) {
+	k := testKeyring(time.Hour)
+	lg := func(format string, v ...interface{}) {}
+	sent := time.Now()
+	for _, offset := range []time.Duration{time.Minute, -time.Minute, 0} {
+		m := cipher.UseKey(k.shared.ID, cipher.SessionID{})
+		// The backend stamps its respond halfway between sent and received
+		at := sent.Add(time.Second).Add(offset)
+		binary.BigEndian.PutUint64(m[1+cipher.KeyIDSize:], uint64(at.UnixNano()/int64(time.Millisecond)))
+		k.synchronize(lg, m, sent, sent.Add(2*time.Second))
+		if d := k.now().Sub(time.Now().Add(offset)); d > time.Second || d < -time.Second {
+			t.Errorf("Clock must follow the backend %s ahead, %s off", offset, d)
+		}
+		if k.skewed != (offset != 0) {
+			t.Errorf("Clock %s ahead must be skewed: %v", offset, k.skewed)
+		}
+	}
+}
+
+func TestKeyringTranscript(t *testing.T) {
+	k := testKeyring(time.Hour)
+	u, _ := url.Parse("https://backend.example/wwf")
+	if _, uu := k.transcript(u); uu != u {
+		t.Error("Path must be left as it is when not bound")
+	}
+	c := DefaultConfig()
+	c.RequestPaths = "/api"
+	c.BindPath = bindPathOn
+	k.shaper = newShaper(c, backendTarget{})
+	if _, uu := k.transcript(u); uu.Path != "/api" {
+		t.Errorf("Bound path must be picked, got %s", uu.Path)
+	}
+}
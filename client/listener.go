@@ -19,8 +19,10 @@ package client
 import (
 	ll "log"
 	"net"
-	"net/url"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 	"warwolf/buffer"
 	"warwolf/cipher"
@@ -32,19 +34,22 @@ import (
 )
 
 const (
-	reqDataSize               = requestMaxReqPayloadSize
-	reqDefaultNonceVerifySize = 512
-	reqDataSafeSize           = reqDataSize - protocol.DialSafeOverheadSize
-	reqDataReadDelay          = 100 * time.Millisecond
+	reqDataSize      = requestMaxReqPayloadSize
+	reqDataSafeSize  = reqDataSize - protocol.DialSafeOverheadSize
+	reqDataReadDelay = 100 * time.Millisecond
+
+	// reqNonceCapacity is how many frames of the responds are kept against
+	// replays for each key interval, in about 700 KiB
+	reqNonceCapacity = 65536
 )
 
-func client(lg log.Log, a socks5Auth, t time.Duration, addr *net.TCPAddr, cc net.Conn, d *dial, b *buffer.Buffer) {
+func client(lg log.Log, a socks5Auth, t time.Duration, addr *net.TCPAddr, cc net.Conn, rt *router, b *buffer.Buffer) {
 	defer cc.Close()
 	req := b.Request()
 	defer b.Return(req)
 	cc.SetDeadline(time.Now().Add(t))
 	lg("Accepted")
-	err := socks5(lg, d, b, req, addr, cc, a, socks5TCP, socks5UDP)
+	err := sniff(lg, rt, b, req, addr, cc, a)
 	if err != nil {
 		lg("Request failed: %s", err)
 	} else {
@@ -52,7 +57,7 @@ func client(lg log.Log, a socks5Auth, t time.Duration, addr *net.TCPAddr, cc net
 	}
 }
 
-func serve(l *net.TCPListener, d *dial, a socks5Auth, t time.Duration, b *buffer.Buffer) error {
+func serve(l *net.TCPListener, rt *router, a socks5Auth, t time.Duration, b *buffer.Buffer) error {
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 	conns := make(map[uint64]net.Conn, 128)
@@ -82,7 +87,7 @@ func serve(l *net.TCPListener, d *dial, a socks5Auth, t time.Duration, b *buffer
 		}
 		connsLock.Unlock()
 		wg.Add(1)
-		go func(i uint64, d *dial, conn *net.TCPConn, b *buffer.Buffer, swg *sync.WaitGroup) {
+		go func(i uint64, rt *router, conn *net.TCPConn, b *buffer.Buffer, swg *sync.WaitGroup) {
 			defer func() {
 				connsLock.Lock()
 				defer connsLock.Unlock()
@@ -94,15 +99,83 @@ func serve(l *net.TCPListener, d *dial, a socks5Auth, t time.Duration, b *buffer
 			addr := conn.LocalAddr().(*net.TCPAddr)
 			client(func(format string, v ...interface{}) {
 				ll.Printf(conn.RemoteAddr().String()+": "+format, v...)
-			}, a, t, addr, reader.NewNetConn(conn), d, b)
-		}(id, d, conn, b, &wg)
+			}, a, t, addr, reader.NewNetConn(conn), rt, b)
+		}(id, rt, conn, b, &wg)
+	}
+}
+
+func startTunnel(lg log.Log, b *buffer.Buffer, targets []backendTarget, c Config) (*dial, func()) {
+	sess := session.NewRetrievers(c.MaxClientConnections)
+	nonce := cipher.NewNonces(reqNonceCapacity, &sync.Mutex{})
+	dis := dispatch.NewRequester(&sess)
+	cc := newDial(lg, b, targets, &sess, &dis, nonce.Verify, c)
+	cc.Start()
+	return &cc, func() {
+		cc.Stop()
+		sess.CloseAll()
+	}
+}
+
+type Listener struct {
+	forwards *forwards
+}
+
+func (s Listener) reloadForwards(f *forwards, path string) {
+	fws, err := loadForwardsFile(path)
+	if err != nil {
+		ll.Printf("Unable to load forwards from %s: %s", path, err)
+		return
+	}
+	f.sync(fws)
+}
+
+func (s Listener) watchForwards(f *forwards, path string) func() {
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-sig:
+				ll.Printf("Reloading forwards from %s", path)
+				s.reloadForwards(f, path)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
+
+// AddForward starts a new port forward on a running Listener
+func (s Listener) AddForward(f Forward) error {
+	if s.forwards == nil {
+		return ErrForwardNotRunning
+	}
+	return s.forwards.add(f)
+}
+
+// RemoveForward stops the port forward listening on the given address
+func (s Listener) RemoveForward(network, listen string) error {
+	if s.forwards == nil {
+		return ErrForwardNotRunning
 	}
+	return s.forwards.remove(network, listen)
 }
 
-type Listener struct{}
+// Forwards returns currently running port forwards
+func (s Listener) Forwards() []Forward {
+	if s.forwards == nil {
+		return nil
+	}
+	return s.forwards.list()
+}
 
 func (s Listener) Listen(config Config) error {
-	ll.Printf("Warwolf System is starting up as local socks5 server")
+	ll.Printf("Warwolf System is starting up as local socks5 and HTTP proxy server")
 	ll.Printf("(C) 2020 The Warwolf Authors. All rights reserved")
 	ll.Printf("The right to communicate freely, privately and securely is essential for everyone")
 	c, err := config.Load().Verify()
@@ -110,42 +183,103 @@ func (s Listener) Listen(config Config) error {
 		ll.Fatalf("Configuration error: %s", err)
 		return err
 	}
-	u, e := url.Parse(c.Backend)
+	targets, e := parseBackendTargets(c.Backend, c.backendPositions())
 	if e != nil {
-		ll.Printf("Invalid Backend URL %s: %s", c.Backend, e)
+		ll.Printf("Invalid Backend %s: %s", c.Backend, e)
 		return e
 	}
-	ll.Printf("Backend interface: %s", u)
+	for _, t := range targets {
+		ll.Printf("Backend interface: %s", t.url)
+	}
+	if c.defaultSalt() {
+		ll.Printf(keysDefaultSaltNotice)
+	}
 	buf := buffer.New(reqDataSize, c.MaxClientConnections)
-	sess := session.NewRetrievers(c.MaxClientConnections)
-	defer sess.CloseAll()
-	nonce := cipher.NewNonces(reqDefaultNonceVerifySize, &sync.Mutex{})
-	dis := dispatch.NewRequester(&sess)
-	cc := newDial(func(format string, v ...interface{}) {
+	cc, stop := startTunnel(func(format string, v ...interface{}) {
 		ll.Printf(format, v...)
-	}, &buf, u, &sess, &dis, nonce.Verify, c)
-	cc.Start()
-	defer cc.Stop()
+	}, &buf, targets, c)
+	defer stop()
+	backends := make(map[string]dialer, len(c.Backends))
+	for name, bu := range c.Backends {
+		bt, e := parseBackendTargets(bu, backendPositions{})
+		if e != nil {
+			ll.Printf("Invalid URL %s for backend %s: %s", bu, name, e)
+			return e
+		}
+		for _, t := range bt {
+			ll.Printf("Backend %s interface: %s", name, t.url)
+		}
+		name := name
+		bcc, bstop := startTunnel(func(format string, v ...interface{}) {
+			ll.Printf("Backend "+name+": "+format, v...)
+		}, &buf, bt, c)
+		defer bstop()
+		backends[name] = bcc
+	}
+	rules := []rule(nil)
+	if len(c.Rules) > 0 {
+		rules, e = loadRulesFile(c.Rules)
+		if e != nil {
+			ll.Printf("Unable to load rules from %s: %s", c.Rules, e)
+			return e
+		}
+		ll.Printf("Loaded %d rules from %s", len(rules), c.Rules)
+	}
+	mp := newMultipath(func(format string, v ...interface{}) {
+		ll.Printf(format, v...)
+	}, cc, &buf, c)
+	rt, e := newRouter(rules, cc, mp, backends)
+	if e != nil {
+		ll.Printf("Invalid rules: %s", e)
+		return e
+	}
+	fwd := s.forwards
+	if fwd == nil {
+		fwd = newForwards()
+	}
+	fwd.start(func(format string, v ...interface{}) {
+		ll.Printf(format, v...)
+	}, cc, &buf)
+	defer fwd.stop()
+	for _, f := range c.Forwards {
+		err := fwd.add(f)
+		if err != nil {
+			ll.Printf("Forward %s: Unable to start: %s", f, err)
+		}
+	}
+	rev := newReverses(func(format string, v ...interface{}) {
+		ll.Printf(format, v...)
+	}, cc, &buf)
+	defer rev.stop()
+	for _, r := range c.Reverses {
+		rev.start(r)
+	}
+	if len(c.ForwardsFile) > 0 {
+		s.reloadForwards(fwd, c.ForwardsFile)
+		defer s.watchForwards(fwd, c.ForwardsFile)()
+	}
 	l, e := net.Listen("tcp", c.Listen)
 	if e != nil {
-		ll.Printf("Socks5 listen failed: %s", e)
+		ll.Printf("Proxy listen failed: %s", e)
 		return e
 	}
-	ll.Printf("Start Socks5 listening on %s", l.Addr())
+	ll.Printf("Start Socks5/HTTP proxy listening on %s", l.Addr())
 	var auth socks5Auth
 	if len(c.Username) > 0 || len(c.Password) > 0 {
 		auth = func(u, p string) bool {
 			return u == c.Username && p == c.Password
 		}
-		ll.Printf("Socks5 Auth enabled: %s:%s", c.Username, c.Password)
+		ll.Printf("Proxy Auth enabled: %s:%s", c.Username, c.Password)
 	} else {
 		auth = nil
-		ll.Printf("Socks5 Auth disabled")
+		ll.Printf("Proxy Auth disabled")
 	}
 	defer ll.Printf("Shutting down")
-	return serve(l.(*net.TCPListener), &cc, auth, c.RequestTimeout, &buf)
+	return serve(l.(*net.TCPListener), rt, auth, c.RequestTimeout, &buf)
 }
 
 func New() Listener {
-	return Listener{}
+	return Listener{
+		forwards: newForwards(),
+	}
 }
@@ -0,0 +1,281 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"warwolf/buffer"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+	"warwolf/relay"
+	"warwolf/session"
+)
+
+var (
+	ErrMultipathJoinRejected = errors.New("Multipath: Backend rejected the path")
+	ErrMultipathNoPath       = errors.New("Multipath: No path could be joined")
+)
+
+// multipathConn reads what has been buffered while reading the join respond
+// before reading the connection itself
+type multipathConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (m multipathConn) Read(b []byte) (int, error) {
+	return m.Reader.Read(b)
+}
+
+type multipathLocal struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// multipath dials TCP connections as multipath sessions, of which the
+// stream is striped over one path through each of the healthy backends.
+// Everything else is dialed normally
+type multipath struct {
+	lg      log.Log
+	d       *dial
+	b       *buffer.Buffer
+	timeout time.Duration
+}
+
+func newMultipath(lg log.Log, d *dial, b *buffer.Buffer, c Config) *multipath {
+	return &multipath{
+		lg:      lg,
+		d:       d,
+		b:       b,
+		timeout: c.RequestTimeout,
+	}
+}
+
+func (m *multipath) dial(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	reqDataLen int,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	after func(),
+) error {
+	switch aTyp {
+	case protocol.TCPIPv4, protocol.TCPIPv6, protocol.TCPHost:
+	default:
+		return m.d.dial(aTyp, addr, port, reqData, reqDataLen, p, hosted, after)
+	}
+	id, key, egress, err := m.d.requester.multipath(protocol.MultipathRequest{
+		ID:   protocol.ID{},
+		ATyp: aTyp,
+		Addr: addr,
+		Port: port,
+	}, p, func(id protocol.ID) session.Retriever {
+		return idleRetriever{}
+	})
+	initial := append([]byte{}, reqData[:reqDataLen]...)
+	after()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		push := m.b.Request()
+		defer m.b.Return(push)
+		pp := reader.NewPusher(push[:])
+		m.d.requester.close(id, &pp)
+		m.d.requester.session.Release(id, func(e session.Retriever) error {
+			return nil
+		})
+	}()
+	mp := relay.NewMultipath(key)
+	defer mp.Close()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	m.paths(mp, id, egress, &wg)
+	return mp.Stream(multipathLocal{
+		Reader:      io.MultiReader(bytes.NewReader(initial), hosted),
+		WriteCloser: hosted,
+	}, reqData)
+}
+
+func (m *multipath) bind(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	bound bindReport,
+	accepted bindReport,
+	after func(),
+) error {
+	return m.d.bind(aTyp, addr, port, reqData, p, hosted, bound, accepted, after)
+}
+
+// paths joins one path through each of the healthy backends to the
+// multipath session on the egress backend. The stream is closed when none
+// of them could be joined
+func (m *multipath) paths(mp *relay.Multipath, id protocol.ID, egress *backend, wg *sync.WaitGroup) {
+	now := time.Now()
+	vias := []*backend{egress}
+	for _, bk := range m.d.requester.backends {
+		if bk == egress || !bk.healthy(now) {
+			continue
+		}
+		vias = append(vias, bk)
+	}
+	lock := sync.Mutex{}
+	failed := 0
+	for _, via := range vias {
+		via := via
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := m.path(id, egress, via, wg)
+			if err != nil {
+				m.lg("Multipath %s: Unable to join path via backend %s: %s", id, via.url, err)
+				lock.Lock()
+				failed++
+				none := failed == len(vias)
+				lock.Unlock()
+				if none {
+					m.lg("Multipath %s: %s", id, ErrMultipathNoPath)
+					mp.Close()
+				}
+				return
+			}
+			m.lg("Multipath %s: Joined path via backend %s", id, via.url)
+			err = mp.Join(c, make([]byte, relay.MultipathFrameSize))
+			if err != nil && err != relay.ErrMultipathClosed {
+				m.lg("Multipath %s: Path via backend %s is broken: %s", id, via.url, err)
+			}
+		}()
+	}
+}
+
+// path opens a connection to the egress backend, directly or tunneled
+// through via, and joins it to the multipath session
+func (m *multipath) path(id protocol.ID, egress *backend, via *backend, wg *sync.WaitGroup) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if via == egress {
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		c, err = egress.dial(ctx, "tcp", egress.address())
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c, err = m.tunnel(egress.address(), via, wg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if egress.url.Scheme == "https" {
+		c = tls.Client(c, backendTLSConfig(egress.tls, egress.url.Hostname()))
+	}
+	c.SetDeadline(time.Now().Add(m.timeout))
+	br, err := m.join(c, id, egress)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return multipathConn{
+		Reader: br,
+		Conn:   c,
+	}, nil
+}
+
+// tunnel connects to address through an ordinary session on via
+func (m *multipath) tunnel(address string, via *backend, wg *sync.WaitGroup) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer remote.Close()
+		bb := m.b.Request()
+		defer m.b.Return(bb)
+		err := dialTCP(pinnedDial{
+			d:       m.d,
+			backend: via,
+		}, m.b, protocol.TCPHost, []byte(host), uint16(port), bb, 0, remote)
+		if err != nil && err != io.EOF {
+			m.lg("Multipath: Tunnel via backend %s is closed: %s", via.url, err)
+		}
+	}()
+	return local, nil
+}
+
+// join sends the join request over c, and returns the reader of the rest of
+// the connection once the backend has taken it over
+func (m *multipath) join(c net.Conn, id protocol.ID, egress *backend) (*bufio.Reader, error) {
+	buf := make([]byte, requestReqOverheadSize+protocol.JoinRequestOverhead)
+	p := reader.NewPusher(buf[requestReqPadSize:])
+	req := protocol.JoinRequest{}
+	err := req.Build(id, &p)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := m.d.requester.keySession(m.lg, egress)
+	if err != nil {
+		return nil, err
+	}
+	ts, u := egress.keys.transcript(egress.url)
+	body, _, err := egress.keys.seal(ss, ts, buf[:requestReqOverheadSize+p.Size()])
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq = egress.shaper.shape(hreq)
+	err = hreq.Write(c)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	rsp, err := http.ReadResponse(br, hreq)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK || rsp.ContentLength >= 0 || len(rsp.TransferEncoding) > 0 {
+		return nil, ErrMultipathJoinRejected
+	}
+	return br, nil
+}
@@ -0,0 +1,317 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"warwolf/session"
+)
+
+const (
+	upstreamProxyDirect = "direct"
+)
+
+var (
+	ErrProxyInvalid         = errors.New("Proxy: Invalid URL, must be http://, https://, socks5:// or socks5h:// with a host")
+	ErrProxyConnectRejected = errors.New("Proxy: CONNECT rejected")
+	ErrProxyAuthRequired    = errors.New("Proxy: Authentication required")
+	ErrProxyEarlyData       = errors.New("Proxy: Data received before the tunnel is established")
+	ErrProxySocks5Auth      = errors.New("Proxy: SOCKS5 authentication rejected")
+	ErrProxySocks5Rejected  = errors.New("Proxy: SOCKS5 connect rejected")
+	ErrProxySocks5Invalid   = errors.New("Proxy: Invalid SOCKS5 reply")
+	ErrProxySocks5TooLong   = errors.New("Proxy: Host name too long for SOCKS5")
+)
+
+type dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyError makes a failure of the proxy retryable, as the proxy, not the
+// backend, is who failed
+func proxyError(e error) error {
+	if !strings.HasPrefix(e.Error(), "Proxy: ") {
+		e = errors.New("Proxy: Failed: " + e.Error())
+	}
+	return session.RetrieverError{
+		E:        e,
+		TryAgain: true,
+	}
+}
+
+// upstreamProxy returns the proxy which the target is reached through, or nil
+// when it's reached directly. The setting is used when given, otherwise the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables decide
+func upstreamProxy(setting string, target *url.URL) (*url.URL, error) {
+	if setting == upstreamProxyDirect {
+		return nil, nil
+	}
+	var u *url.URL
+	var err error
+	if len(setting) > 0 {
+		u, err = url.Parse(setting)
+	} else {
+		u, err = http.ProxyFromEnvironment(&http.Request{URL: target})
+	}
+	if err != nil {
+		return nil, ErrProxyInvalid
+	}
+	if u == nil {
+		return nil, nil
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, ErrProxyInvalid
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, ErrProxyInvalid
+	}
+	return u, nil
+}
+
+func verifyUpstreamProxy(setting string, backends string) error {
+	targets, err := parseBackendTargets(backends, backendPositions{})
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		_, err = upstreamProxy(setting, t.url)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwarded returns whether the requests to the target are forwarded by the
+// proxy as they are rather than tunneled through it
+func forwarded(proxy *url.URL, t backendTarget, c Config) bool {
+	return t.url.Scheme == "http" && !t.websocket && c.HTTPVersion == httpVersion1 &&
+		(proxy.Scheme == "http" || proxy.Scheme == "https")
+}
+
+// proxyDialer tunnels connections through a HTTP CONNECT or SOCKS5 proxy
+type proxyDialer struct {
+	proxy   *url.URL
+	dial    dialContext
+	timeout time.Duration
+}
+
+func (p proxyDialer) address() string {
+	port := p.proxy.Port()
+	if len(port) == 0 {
+		switch p.proxy.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(p.proxy.Hostname(), port)
+}
+
+func (p proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := p.dial(ctx, network, p.address())
+	if err != nil {
+		return nil, proxyError(err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(p.timeout)
+	}
+	c.SetDeadline(deadline)
+	if p.proxy.Scheme == "https" {
+		c = tls.Client(c, &tls.Config{
+			ServerName: p.proxy.Hostname(),
+		})
+	}
+	switch p.proxy.Scheme {
+	case "http", "https":
+		err = proxyConnect(c, addr, p.proxy.User)
+	case "socks5":
+		addr, err = proxyResolve(ctx, addr)
+		if err == nil {
+			err = proxySocks5(c, addr, p.proxy.User)
+		}
+	default:
+		err = proxySocks5(c, addr, p.proxy.User)
+	}
+	if err != nil {
+		c.Close()
+		return nil, proxyError(err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// proxyResolve resolves the host of addr locally, for socks5:// proxies,
+// which are given the address rather than the name. socks5h:// proxies
+// resolve the name themselves
+func proxyResolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			return net.JoinHostPort(ip.IP.String(), port), nil
+		}
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+func proxyConnect(c net.Conn, addr string, user *url.Userinfo) error {
+	req := http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	err := req.Write(c)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(c)
+	rsp, err := http.ReadResponse(br, &req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return errors.New(ErrProxyConnectRejected.Error() + ": " + rsp.Status)
+	}
+	if br.Buffered() > 0 {
+		return ErrProxyEarlyData
+	}
+	return nil
+}
+
+func proxySocks5(c net.Conn, addr string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	methods := []byte{socks5Version, 1, socks5MethodNoAuth}
+	if user != nil {
+		methods = []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUsernamePassword}
+	}
+	_, err = c.Write(methods)
+	if err != nil {
+		return err
+	}
+	b := [4]byte{}
+	_, err = io.ReadFull(c, b[:2])
+	if err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return ErrProxySocks5Invalid
+	}
+	switch {
+	case b[1] == socks5MethodNoAuth:
+	case b[1] == socks5MethodUsernamePassword && user != nil:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return ErrProxySocks5Auth
+		}
+		auth := append([]byte{0x01, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		_, err = c.Write(auth)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(c, b[:2])
+		if err != nil {
+			return err
+		}
+		if b[1] != 0x00 {
+			return ErrProxySocks5Auth
+		}
+	default:
+		return ErrProxySocks5Auth
+	}
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		req = append(append(req, socks5ATypeIPv4), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, socks5ATypeIPv6), ip.To16()...)
+	case len(host) > 255:
+		return ErrProxySocks5TooLong
+	default:
+		req = append(append(req, socks5ATypeDomain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = c.Write(req)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(c, b[:4])
+	if err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return ErrProxySocks5Invalid
+	}
+	if b[1] != socks5RepSucceeded {
+		return errors.New(ErrProxySocks5Rejected.Error() + ": Reply " + strconv.Itoa(int(b[1])))
+	}
+	skip := 0
+	switch b[3] {
+	case socks5ATypeIPv4:
+		skip = 4
+	case socks5ATypeIPv6:
+		skip = 16
+	case socks5ATypeDomain:
+		_, err = io.ReadFull(c, b[:1])
+		if err != nil {
+			return err
+		}
+		skip = int(b[0])
+	default:
+		return ErrProxySocks5Invalid
+	}
+	_, err = io.ReadFull(c, make([]byte, skip+2))
+	return err
+}
@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"context"
 	cph "crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -41,12 +43,20 @@ import (
 const (
 	requesterReadWriteBufferSize  = server.MaxRequestBodySize
 	requestMaxHTTPReqSize         = requesterReadWriteBufferSize
-	requestReqOverheadSize        = cipher.OverheadSize
-	requestReqPadSize             = cipher.HeaderSize
+	requestReqOverheadSize        = cipher.KeyFrameSize + cipher.OverheadSize
+	requestReqPadSize             = cipher.KeyFrameSize + cipher.HeaderSize
 	requestMaxReqPayloadSize      = requestMaxHTTPReqSize - requestReqOverheadSize
+	requestMaxCarriedBatchSize    = 4096 - requestReqOverheadSize
 	requestReqSendDelay           = 128 * time.Millisecond
 	requestReqSendShortDelay      = 8 * time.Millisecond
 	requestReqSendSwitchThreshold = 128 * time.Millisecond
+	requestPushRetryDelay         = 1 * time.Second
+	retrieveModePoll              = "poll"
+	retrieveModePush              = "push"
+	transportBatch                = "batch"
+	transportStream               = "stream"
+	httpVersion1                  = "1.1"
+	httpVersion2                  = "2"
 )
 
 var (
@@ -69,6 +79,15 @@ var (
 		E:        errors.New("Requester: HTTP responded with no data"),
 		TryAgain: true,
 	}
+
+	ErrRequestHandshakeFailed = session.RetrieverError{
+		E:        errors.New("Requester: Backend has not accepted the session"),
+		TryAgain: true,
+	}
+
+	ErrRequestAcceptTimeout = errors.New("Requester: Timed out waiting for inbound connection")
+
+	errRequestAcceptWaiting = errors.New("Requester: Waiting for inbound connection")
 )
 
 type requestBodyReadCloser struct {
@@ -79,26 +98,74 @@ func (r requestBodyReadCloser) Close() error {
 	return nil
 }
 
-func newClient(c Config) http.Client {
+// newDialer returns the dialer of the connections to the backend, which go
+// to the enforced host when given, and through the upstream proxy when there
+// is one
+func newDialer(c Config, t backendTarget, proxy *url.URL) dialContext {
 	dl := net.Dialer{
 		Timeout:   c.RequestTimeout,
 		KeepAlive: c.IdleTimeout,
 	}
-	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dl.DialContext(ctx, network, addr)
+	dial := dl.DialContext
+	if proxy != nil {
+		dial = proxyDialer{
+			proxy:   proxy,
+			dial:    dl.DialContext,
+			timeout: c.RequestTimeout,
+		}.DialContext
+	}
+	if len(t.hostEnforce) == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(ctx, network, t.hostEnforce)
+	}
+}
+
+func newClient(c Config, t backendTarget, proxy *url.URL, dial dialContext, sh *shaper, tlsc *tls.Config) http.Client {
+	transport := &http.Transport{
+		DialContext:           dial,
+		IdleConnTimeout:       c.IdleTimeout,
+		ResponseHeaderTimeout: c.RequestTimeout,
+		WriteBufferSize:       requesterReadWriteBufferSize,
+		ReadBufferSize:        requesterReadWriteBufferSize,
+	}
+	if tlsc != nil {
+		transport.TLSClientConfig = tlsc.Clone()
 	}
-	if len(c.BackendHostEnforce) > 0 {
-		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dl.DialContext(ctx, network, c.BackendHostEnforce)
+	if proxy != nil && forwarded(proxy, t, c) {
+		// The proxy is connected to like any other host, and the requests
+		// tell it where to go
+		plain := newDialer(c, backendTarget{}, nil)
+		transport.Proxy = http.ProxyURL(proxy)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := plain(ctx, network, addr)
+			if err != nil {
+				return nil, proxyError(err)
+			}
+			return conn, nil
+		}
+	}
+	if c.HTTPVersion == httpVersion2 {
+		// HTTP/2 is negotiated with ALPN over TLS, and spoken with prior
+		// knowledge otherwise, as there's nothing to fall back on
+		p := http.Protocols{}
+		if t.url.Scheme == "https" {
+			p.SetHTTP1(true)
+			p.SetHTTP2(true)
+		} else {
+			p.SetUnencryptedHTTP2(true)
+		}
+		transport.Protocols = &p
+		transport.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: c.RequestTimeout / 2,
+			PingTimeout:     c.RequestTimeout / 2,
 		}
 	}
 	return http.Client{
-		Transport: &http.Transport{
-			DialContext:           dial,
-			IdleConnTimeout:       c.IdleTimeout,
-			ResponseHeaderTimeout: c.RequestTimeout,
-			WriteBufferSize:       requesterReadWriteBufferSize,
-			ReadBufferSize:        requesterReadWriteBufferSize,
+		Transport: shapedTransport{
+			base:   transport,
+			shaper: sh,
 		},
 		CheckRedirect: nil,
 		Jar:           nil,
@@ -106,26 +173,88 @@ func newClient(c Config) http.Client {
 	}
 }
 
-func buildRequestCipher(key *cipher.KeyGen) (cph.AEAD, cipher.Time, [12]byte, error) {
-	k, t := key.Get()
-	cip, err := cipher.AEAD(k)
+func sendRequest(ctx context.Context, lg log.Log, b *buffer.Buffer, keys *keyring, nv cipher.NonceVerifier, dis *dispatch.Requester, address *url.URL, cookies func() map[string]http.Cookie, rspp func(r *http.Response), body []byte, client *http.Client, retrieverCancels *session.RetrieverCancels, timed func(rsp protocol.TimingRespond)) error {
+	return exchange(ctx, lg, b, keys, nv, address, cookies, rspp, body, client, func(b []byte) error {
+		return dis.Dispatch(func(format string, v ...interface{}) {
+			lg("Dispatch: "+format, v...)
+		}, b, retrieverCancels, dispatch.Config{
+			Timed: timed,
+		})
+	})
+}
+
+// exchange sends body in a HTTP request, and calls segment with every
+// segment of the respond as it is received and decrypted. The session of
+// keys is established first when it has to be
+func exchange(ctx context.Context, lg log.Log, b *buffer.Buffer, keys *keyring, nv cipher.NonceVerifier, address *url.URL, cookies func() map[string]http.Cookie, rspp func(r *http.Response), body []byte, client *http.Client, segment func(b []byte) error) error {
+	s, err := keys.get(func(h cipher.Handshake) (*cipher.Session, error) {
+		return handshake(ctx, lg, b, keys, nv, address, cookies, rspp, client, h)
+	})
 	if err != nil {
-		return cip, t, [12]byte{}, ErrRequestCipherFailed
+		return err
 	}
-	n, err := cipher.Nonce()
+	ts, address := keys.transcript(address)
+	body, t, err := keys.seal(s, ts, body)
 	if err != nil {
-		return cip, t, [12]byte{}, ErrRequestCipherFailed
+		return err
 	}
-	return cip, t, n, err
+	return post(ctx, lg, b, keys, nv, t, ts, address, cookies, rspp, body, client, keys.respond(s), segment)
 }
 
-func sendRequest(lg log.Log, b *buffer.Buffer, key *cipher.KeyGen, nv cipher.NonceVerifier, dis *dispatch.Requester, address *url.URL, cookies func() map[string]http.Cookie, rspp func(r *http.Response), body []byte, client *http.Client, retrieverCancels *session.RetrieverCancels) error {
-	start := time.Now()
-	cip, t, n, err := buildRequestCipher(key)
+// handshake establishes a session with the backend, in a HTTP request of
+// which the body is the key frame of h alone
+func handshake(ctx context.Context, lg log.Log, b *buffer.Buffer, keys *keyring, nv cipher.NonceVerifier, address *url.URL, cookies func() map[string]http.Cookie, rspp func(r *http.Response), client *http.Client, h cipher.Handshake) (*cipher.Session, error) {
+	shared, t, err := keys.sharedCipher()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	ts, address := keys.transcript(address)
+	body, err := cipher.KeyFrame(shared, ts, h.Hello(keys.shared.ID), keys.now(), true, make([]byte, cipher.KeyFrameSize))
+	if err != nil {
+		return nil, ErrRequestCipherFailed
+	}
+	var s *cipher.Session
+	var date time.Time
+	sent := time.Now()
+	err = post(ctx, lg, b, keys, nv, t, ts, address, cookies, func(r *http.Response) {
+		date, _ = http.ParseTime(r.Header.Get("Date"))
+		rspp(r)
+	}, body, client, func(m cipher.KeyMessage) (cph.AEAD, error) {
+		ss, err := h.Finish(keys.shared, m)
+		if err != nil {
+			return nil, err
+		}
+		keys.synchronize(lg, m, sent, time.Now())
+		s = ss
+		return ss.Respond, nil
+	}, func(b []byte) error {
+		return nil
+	})
+	if err == nil && s == nil {
+		err = ErrRequestHandshakeFailed
 	}
-	body = cipher.Encrypt(cip, n, body)
+	if err != nil {
+		keys.diagnose(lg, date)
+		return nil, err
+	}
+	lg("Session keys have been exchanged")
+	return s, nil
+}
+
+// keySession returns the session of the keys of bk, for the requests which
+// aren't sent by exchange
+func (r *requester) keySession(lg log.Log, bk *backend) (*cipher.Session, error) {
+	return bk.keys.get(func(h cipher.Handshake) (*cipher.Session, error) {
+		return handshake(context.Background(), lg, r.b, &bk.keys, r.nv, bk.url, func() map[string]http.Cookie {
+			return nil
+		}, func(*http.Response) {}, &bk.client, h)
+	})
+}
+
+// post sends body, which has been encrypted at the time t as the transcript
+// ts, in a HTTP request. The key frame of the respond is handed to key
+func post(ctx context.Context, lg log.Log, b *buffer.Buffer, keys *keyring, nv cipher.NonceVerifier, t cipher.Time, ts *cipher.Transcript, address *url.URL, cookies func() map[string]http.Cookie, rspp func(r *http.Response), body []byte, client *http.Client, key func(m cipher.KeyMessage) (cph.AEAD, error), segment func(b []byte) error) error {
+	start := time.Now()
 	reqBody := requestBodyReadCloser{
 		Buffer: bytes.NewBuffer(body),
 	}
@@ -139,10 +268,14 @@ func sendRequest(lg log.Log, b *buffer.Buffer, key *cipher.KeyGen, nv cipher.Non
 	for _, c := range cookies() {
 		req.AddCookie(&c)
 	}
-	rsp, err := client.Do(&req)
+	rsp, err := client.Do(req.WithContext(ctx))
 	cost := time.Now().Sub(start)
 	if err != nil {
 		lg("HTTP request failed after %s: %s, retrying ...", cost, err)
+		perr := session.RetrieverError{}
+		if errors.As(err, &perr) {
+			return perr
+		}
 		return err
 	}
 	if rsp.Body == nil {
@@ -152,24 +285,29 @@ func sendRequest(lg log.Log, b *buffer.Buffer, key *cipher.KeyGen, nv cipher.Non
 	lg("HTTP request has been responded after %s, status: %s", cost, rsp.Status)
 	rspp(rsp)
 	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusProxyAuthRequired {
+		return proxyError(ErrProxyAuthRequired)
+	}
+	return receive(lg, b, keys, nv, t, ts, rsp.Body, key, segment)
+}
+
+// receive decrypts the segments read from body, the respond to the request
+// of the transcript ts, and hands them to segment. The key frame body starts
+// with is handed to key
+func receive(lg log.Log, b *buffer.Buffer, keys *keyring, nv cipher.NonceVerifier, t cipher.Time, ts *cipher.Transcript, body io.Reader, key func(m cipher.KeyMessage) (cph.AEAD, error), segment func(b []byte) error) error {
 	bb := b.Request()
 	defer b.Return(bb)
-	rspfetch := reader.NewFetcher(reader.ReaderFetch(bb, rsp.Body, io.EOF))
+	rspfetch := reader.NewFetcher(reader.ReaderFetch(bb, body, io.EOF))
 	var disErr error
-	err = cipher.Decrypt(t, func() (cph.AEAD, error) {
-		k, _ := key.Get()
-		cip, err := cipher.AEAD(k)
-		if err != nil {
-			return cip, ErrRequestCipherFailed
-		}
-		return cip, nil
-	}, nv, &rspfetch, io.EOF, func(b []byte) error {
+	rs := ts.Respond()
+	gcm, dec := cipher.Keyed(rs, func() (cph.AEAD, error) {
+		return keys.sharedCipherAt(t)
+	}, key, func(b []byte) error {
 		lg("A segment of %d bytes respond data is received", len(b))
-		disErr = dis.Dispatch(func(format string, v ...interface{}) {
-			lg("Dispatch: "+format, v...)
-		}, b, retrieverCancels)
+		disErr = segment(b)
 		return disErr
 	})
+	err := cipher.Decrypt(t, gcm, rs, nv, &rspfetch, io.EOF, dec)
 	if err == disErr {
 		return disErr
 	}
@@ -202,16 +340,14 @@ func getRequestRetryDelay(max time.Duration, i, n float64) time.Duration {
 type requester struct {
 	lg                         log.Log
 	b                          *buffer.Buffer
-	key                        cipher.KeyGen
 	nv                         cipher.NonceVerifier
-	url                        *url.URL
-	requester                  http.Client
+	backends                   []*backend
 	current                    int32
 	wait                       sync.WaitGroup
 	session                    *session.Retrievers
 	dispatch                   *dispatch.Requester
-	requests                   chan request
-	wrequests                  chan request
+	probeInterval              time.Duration
+	probeStop                  chan struct{}
 	maxHTTPReqBodySize         int
 	requestReqPadSize          int
 	requestReqOverheadSize     int
@@ -219,33 +355,53 @@ type requester struct {
 	maxConcurrentRequests      int
 	maxRetries                 int
 	maxRetryDelay              time.Duration
+	maxAcceptWait              time.Duration
 	requestSendDelay           time.Duration
 	requestSendShortDelay      time.Duration
 	requestSendSwitchThreshold time.Duration
+	push                       bool
+	pushDuration               time.Duration
+	pushStop                   context.CancelFunc
+	pushContext                context.Context
+	streamed                   bool
+	streamAckTimeout           time.Duration
+	streamLifetime             time.Duration
 }
 
 func newRequester(
 	lg log.Log,
 	b *buffer.Buffer,
-	url *url.URL,
+	targets []backendTarget,
 	session *session.Retrievers,
 	dispatch *dispatch.Requester,
 	nv cipher.NonceVerifier,
 	c Config,
 ) requester {
+	// The TLS settings have been verified with the config
+	tlsc, _ := newTLSConfig(c)
+	// So is the key stretching
+	stretch, _ := c.stretch()
+	key := stretch.Key(c.Key)
+	backends := make([]*backend, len(targets))
+	for i, t := range targets {
+		backends[i] = newBackend(i, t, c, tlsc, key)
+	}
+	pushDuration := c.RequestTimeout / 2
+	if pushDuration < time.Second {
+		pushDuration = time.Second
+	}
+	pushContext, pushStop := context.WithCancel(context.Background())
 	return requester{
 		lg:                         lg,
 		b:                          b,
-		key:                        cipher.KeyGen{Key: c.Key},
 		nv:                         nv,
-		url:                        url,
-		requester:                  newClient(c),
+		backends:                   backends,
 		current:                    0,
 		wait:                       sync.WaitGroup{},
 		session:                    session,
 		dispatch:                   dispatch,
-		requests:                   make(chan request),
-		wrequests:                  make(chan request),
+		probeInterval:              c.BackendProbeInterval,
+		probeStop:                  make(chan struct{}),
 		maxHTTPReqBodySize:         requestMaxHTTPReqSize,
 		requestReqPadSize:          requestReqPadSize,
 		requestReqOverheadSize:     requestReqOverheadSize,
@@ -253,14 +409,28 @@ func newRequester(
 		maxConcurrentRequests:      c.MaxBackendConnections,
 		maxRetries:                 c.MaxRetries,
 		maxRetryDelay:              c.RequestTimeout,
+		maxAcceptWait:              c.IdleTimeout,
 		requestSendDelay:           requestReqSendDelay,
 		requestSendShortDelay:      requestReqSendShortDelay,
 		requestSendSwitchThreshold: requestReqSendSwitchThreshold,
+		push:                       c.RetrieveMode == retrieveModePush,
+		pushDuration:               pushDuration,
+		pushStop:                   pushStop,
+		pushContext:                pushContext,
+		streamed:                   c.Transport == transportStream,
+		streamAckTimeout:           c.RequestTimeout / 2,
+		streamLifetime:             c.IdleTimeout / 2,
 	}
 }
 
-func (r *requester) serve(name string, rchan chan request, wg *sync.WaitGroup) {
+func (r *requester) serve(name string, bk *backend, rchan chan request, wg *sync.WaitGroup) {
 	defer wg.Done()
+	r.batch(name, bk, rchan, nil)
+}
+
+// batch collects the requests of rchan and sends them together in one HTTP
+// request. It returns false when rchan is closed, or true when stop fires
+func (r *requester) batch(name string, bk *backend, rchan chan request, stop <-chan time.Time) bool {
 	var timerChan <-chan time.Time = nil
 	timer := time.NewTimer(r.requestSendDelay)
 	defer timer.Stop()
@@ -287,16 +457,23 @@ func (r *requester) serve(name string, rchan chan request, wg *sync.WaitGroup) {
 			cookies[c.Name] = *c
 		}
 	}
+	send := func() error {
+		marks := responseMarks{}
+		res := sendRequest(context.Background(), runlgs, r.b, &bk.keys, r.nv, r.dispatch, bk.url, reqcookies, rspparse, fullbuf[:r.requestReqOverheadSize+len(paddedbuf)], &bk.client, &cancels, marks.mark)
+		bk.buffering.observe(runlgs, marks)
+		return res
+	}
 
 	for {
 		select {
 		case rr, ok := <-requests:
 			if !ok {
-				return
+				return false
 			}
-			if len(paddedbuf)+rr.pusher.Size() > r.requestMaxReqPayloadSize {
+			if len(paddedbuf) > 0 && len(paddedbuf)+rr.pusher.Size() > bk.maxBatchSize(r.requestMaxReqPayloadSize) {
 				runlgs("Sending %d requests (buffer full)", len(cancels))
-				res := sendRequest(runlgs, r.b, &r.key, r.nv, r.dispatch, r.url, reqcookies, rspparse, fullbuf[:r.requestReqOverheadSize+len(paddedbuf)], &r.requester, &cancels)
+				res := send()
+				r.report(bk, res)
 				if res != nil {
 					runlgs("Request failed: %s", res)
 				} else {
@@ -308,8 +485,17 @@ func (r *requester) serve(name string, rchan chan request, wg *sync.WaitGroup) {
 				cancels.SettleAll(ErrRequestUnresponded)
 				paddedbuf = paddedbuf[:0]
 			}
+			if treq, ok := bk.buffering.request(); ok && len(paddedbuf) == 0 {
+				p := reader.NewPusher(paddedbuf[:cap(paddedbuf)])
+				if treq.Build(&p) == nil {
+					paddedbuf = paddedbuf[:p.Size()]
+				}
+			}
 			if len(paddedbuf)+rr.pusher.Size() > r.requestMaxReqPayloadSize {
 				rr.cancel(ErrRequestBodyTooLarge)
+				if len(cancels) == 0 {
+					paddedbuf = paddedbuf[:0]
+				}
 				continue
 			}
 			paddedbuf = append(paddedbuf, rr.pusher.Data()...)
@@ -323,6 +509,21 @@ func (r *requester) serve(name string, rchan chan request, wg *sync.WaitGroup) {
 			timerChan = timer.C
 			lastReq = curtime
 
+		case <-stop:
+			if len(paddedbuf) == 0 {
+				return true
+			}
+			runlgs("Sending %d requests (stopping)", len(cancels))
+			res := send()
+			r.report(bk, res)
+			if res != nil {
+				runlgs("Request failed: %s", res)
+			} else {
+				runlgs("Request successful")
+			}
+			cancels.SettleAll(ErrRequestUnresponded)
+			return true
+
 		case <-timerChan:
 			timerChan = nil
 			requests = rchan
@@ -330,7 +531,8 @@ func (r *requester) serve(name string, rchan chan request, wg *sync.WaitGroup) {
 				continue
 			}
 			runlgs("Sending %d requests (flush timer)", len(cancels))
-			res := sendRequest(runlgs, r.b, &r.key, r.nv, r.dispatch, r.url, reqcookies, rspparse, fullbuf[:r.requestReqOverheadSize+len(paddedbuf)], &r.requester, &cancels)
+			res := send()
+			r.report(bk, res)
 			if res != nil {
 				runlgs("Request failed: %s", res)
 			} else {
@@ -345,17 +547,231 @@ func (r *requester) serve(name string, rchan chan request, wg *sync.WaitGroup) {
 	}
 }
 
+func (r *requester) name(bk *backend, i int) string {
+	if len(r.backends) <= 1 {
+		return fmt.Sprintf("Requester %d", i)
+	}
+	return fmt.Sprintf("Requester %d/%d", bk.index, i)
+}
+
+func (r *requester) report(bk *backend, err error) {
+	if !bk.report(err) {
+		return
+	}
+	r.lg("Backend %s is ejected for %s after repeated failures", bk.url, bk.cooldown)
+}
+
+func (r *requester) probe(bk *backend) {
+	buf := make([]byte, r.requestReqOverheadSize)
+	cancels := make(session.RetrieverCancels, 1)
+	start := time.Now()
+	err := sendRequest(context.Background(), func(format string, v ...interface{}) {
+		r.lg("Probe "+bk.url.String()+": "+format, v...)
+	}, r.b, &bk.keys, r.nv, r.dispatch, bk.url, func() map[string]http.Cookie {
+		return nil
+	}, func(*http.Response) {}, buf, &bk.client, &cancels, nil)
+	cancels.SettleAll(ErrRequestUnresponded)
+	if bk.probed(time.Now().Sub(start), err) {
+		r.lg("Backend %s is ejected for %s after repeated failures", bk.url, bk.cooldown)
+	}
+}
+
+func (r *requester) probes(wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(r.probeInterval)
+	defer ticker.Stop()
+	for {
+		pwg := sync.WaitGroup{}
+		pwg.Add(len(r.backends))
+		for _, bk := range r.backends {
+			go func(bk *backend) {
+				defer pwg.Done()
+				r.probe(bk)
+			}(bk)
+		}
+		pwg.Wait()
+		select {
+		case <-ticker.C:
+		case <-r.probeStop:
+			return
+		}
+	}
+}
+
+// pushes keeps a push stream open to the backend, which delivers the data of
+// the sessions subscribed to the channel of the backend. A stream which ends
+// early is reopened after a delay, so a failing backend, or one which doesn't
+// support push, won't be flooded with requests
+func (r *requester) pushes(bk *backend, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, r.requestReqOverheadSize+protocol.PushRequestOverhead)
+	name := "Push " + bk.url.String()
+	for {
+		p := reader.NewPusher(buf[r.requestReqPadSize:])
+		req := protocol.PushRequest{
+			Channel:  bk.channel,
+			Duration: uint16(r.pushDuration / time.Second),
+		}
+		err := req.Build(bk.channel, &p)
+		if err != nil {
+			r.lg("%s: Unable to build push request: %s", name, err)
+			return
+		}
+		cancels := make(session.RetrieverCancels, 1)
+		start := time.Now()
+		err = sendRequest(r.pushContext, func(format string, v ...interface{}) {
+			r.lg(name+": "+format, v...)
+		}, r.b, &bk.keys, r.nv, r.dispatch, bk.url, func() map[string]http.Cookie {
+			return nil
+		}, func(*http.Response) {}, buf[:r.requestReqOverheadSize+p.Size()], &bk.client, &cancels, nil)
+		cancels.SettleAll(ErrRequestUnresponded)
+		if r.pushContext.Err() != nil {
+			return
+		}
+		if err == nil && time.Now().Sub(start) >= r.pushDuration/2 {
+			continue
+		}
+		select {
+		case <-time.After(requestPushRetryDelay):
+		case <-r.pushContext.Done():
+			return
+		}
+	}
+}
+
+// pick selects the backend for a new session. Backends that are not ejected
+// are preferred, then the ones with fewer recent failures and lower latency.
+// When all backends are ejected, the one which will be back soonest is used
+func (r *requester) pick() *backend {
+	now := time.Now()
+	var best *backend
+	var bestLatency time.Duration
+	var bestFailures int
+	var bestEjected time.Time
+	for _, bk := range r.backends {
+		latency, failures, ejected := bk.state()
+		if best == nil {
+			best, bestLatency, bestFailures, bestEjected = bk, latency, failures, ejected
+			continue
+		}
+		healthy, bestHealthy := !now.Before(ejected), !now.Before(bestEjected)
+		switch {
+		case healthy != bestHealthy:
+			if !healthy {
+				continue
+			}
+		case !healthy:
+			if !ejected.Before(bestEjected) {
+				continue
+			}
+		case failures != bestFailures:
+			if failures > bestFailures {
+				continue
+			}
+		case latency >= bestLatency:
+			continue
+		}
+		best, bestLatency, bestFailures, bestEjected = bk, latency, failures, ejected
+	}
+	return best
+}
+
+// buffering returns the counters of the buffering detection of every backend
+func (r *requester) buffering() []BufferingStats {
+	st := make([]BufferingStats, 0, len(r.backends))
+	for _, bk := range r.backends {
+		buffered, responses, delayed := bk.buffering.stats()
+		st = append(st, BufferingStats{
+			Backend:   bk.url.String(),
+			Buffered:  buffered,
+			Responses: responses,
+			Delayed:   delayed,
+		})
+	}
+	return st
+}
+
+// owner returns the backend which the session is pinned to
+func (r *requester) owner(id protocol.ID) (*backend, error) {
+	o, err := r.session.Owner(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.backends[o], nil
+}
+
+// repin selects the backend again for a session which has not yet been
+// established, so the retries of a failed attempt go to the best backend.
+// The failed attempt may have opened the session on the former backend
+// anyway, so it's closed there
+func (r *requester) repin(id protocol.ID) (*backend, error) {
+	bk, err := r.owner(id)
+	if err != nil {
+		return nil, err
+	}
+	nbk := r.pick()
+	if nbk == bk {
+		return bk, nil
+	}
+	buf := r.b.Request()
+	p := reader.NewPusher(buf)
+	cc, err := r.session.Move(id, nbk.index, &p, func(e session.RetrieverError) {
+		r.b.Return(buf)
+	})
+	if err != nil {
+		r.b.Return(buf)
+		return nil, err
+	}
+	select {
+	case bk.requests <- request{id: id, pusher: &p, cancel: cc}:
+	case bk.wrequests <- request{id: id, pusher: &p, cancel: cc}:
+	}
+	r.lg("Moving new session from backend %s to %s", bk.url, nbk.url)
+	return nbk, nil
+}
+
 func (r *requester) init() {
-	r.wait.Add(r.maxConcurrentRequests + 1)
-	go r.serve("Requester 0", r.wrequests, &r.wait)
-	for i := 0; i < r.maxConcurrentRequests; i++ {
-		go r.serve(fmt.Sprintf("Requester %d", i+1), r.requests, &r.wait)
+	for _, bk := range r.backends {
+		if r.streamed || bk.websocket {
+			r.wait.Add(2)
+			go r.streams(r.name(bk, 0), bk, bk.wrequests, &r.wait)
+			go r.streams(r.name(bk, 1), bk, bk.requests, &r.wait)
+			continue
+		}
+		r.wait.Add(r.maxConcurrentRequests + 1)
+		go r.serve(r.name(bk, 0), bk, bk.wrequests, &r.wait)
+		for i := 0; i < r.maxConcurrentRequests; i++ {
+			go r.serve(r.name(bk, i+1), bk, bk.requests, &r.wait)
+		}
+	}
+	if len(r.backends) > 1 {
+		r.wait.Add(1)
+		go r.probes(&r.wait)
+	}
+	if !r.push {
+		return
+	}
+	for _, bk := range r.backends {
+		_, err := io.ReadFull(rand.Reader, bk.channel[:])
+		if err != nil {
+			r.lg("Unable to generate push channel, falling back to polling: %s", err)
+			r.push = false
+			return
+		}
+	}
+	r.wait.Add(len(r.backends))
+	for _, bk := range r.backends {
+		go r.pushes(bk, &r.wait)
 	}
 }
 
 func (r *requester) kill() {
-	close(r.requests)
-	close(r.wrequests)
+	close(r.probeStop)
+	r.pushStop()
+	for _, bk := range r.backends {
+		close(bk.requests)
+		close(bk.wrequests)
+	}
 	r.wait.Wait()
 }
 
@@ -386,21 +802,39 @@ func (r *requester) run(c func() error) error {
 	return result.E
 }
 
+// establisher returns the backend which a new session is established on,
+// which is via when given, or the best one otherwise
+func (r *requester) establisher(id protocol.ID, via *backend) (*backend, error) {
+	if via != nil {
+		return via, nil
+	}
+	return r.repin(id)
+}
+
 func (r *requester) dial(
 	rr protocol.DialRequest,
 	p *reader.Pusher,
 	resp session.RetrieverBuilder,
+	via *backend,
 	after func(),
 ) (session.Retriever, error) {
 	defer after()
 	pt := p.Size()
 	defer p.Truncate(pt)
-	id, ret, err := r.session.Retriever(resp)
+	owner := via
+	if owner == nil {
+		owner = r.pick()
+	}
+	id, ret, err := r.session.Retriever(resp, owner.index)
 	if err != nil {
 		return nil, err
 	}
 	err = r.run(func() error {
 		p.Truncate(pt)
+		bk, err := r.establisher(id, via)
+		if err != nil {
+			return err
+		}
 		sErr := make(chan session.RetrieverError, 1)
 		cc, err := r.session.Register(id, rr, p, ret, func(e session.RetrieverError) {
 			sErr <- e
@@ -408,14 +842,286 @@ func (r *requester) dial(
 		if err != nil {
 			return err
 		}
-		r.requests <- request{
+		bk.requests <- request{
+			id:     id,
+			pusher: p,
+			cancel: cc,
+		}
+		return <-sErr
+	})
+	if err != nil {
+		r.session.Release(id, func(e session.Retriever) error {
+			e.Close()
+			return nil
+		})
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *requester) bind(
+	rr protocol.BindRequest,
+	p *reader.Pusher,
+	resp session.RetrieverBuilder,
+	bound bindReport,
+	accepted bindReport,
+	after func(),
+) (session.Retriever, error) {
+	defer after()
+	pt := p.Size()
+	defer p.Truncate(pt)
+	id, ret, err := r.session.Retriever(resp, r.pick().index)
+	if err != nil {
+		return nil, err
+	}
+	release := func() {
+		r.close(id, p)
+		r.session.Release(id, func(e session.Retriever) error {
+			e.Close()
+			return nil
+		})
+	}
+	var atyp protocol.AddressType
+	var addr []byte
+	var port uint16
+	err = r.run(func() error {
+		p.Truncate(pt)
+		bk, err := r.repin(id)
+		if err != nil {
+			return err
+		}
+		sErr := make(chan session.RetrieverError, 1)
+		cc, err := r.session.Bind(id, rr, p, func(t protocol.AddressType, a []byte, pp uint16, e session.RetrieverError) {
+			atyp, addr, port = t, append([]byte{}, a...), pp
+			sErr <- e
+		})
+		if err != nil {
+			return err
+		}
+		bk.requests <- request{
+			id:     id,
+			pusher: p,
+			cancel: cc,
+		}
+		return <-sErr
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	err = bound(atyp, addr, port)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	err = r.accept(id, p, pt, accepted)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *requester) accept(
+	id protocol.ID,
+	p *reader.Pusher,
+	pt int,
+	accepted bindReport,
+) error {
+	deadline := time.Now().Add(r.maxAcceptWait)
+	for {
+		err := r.run(func() error {
+			p.Truncate(pt)
+			bk, err := r.owner(id)
+			if err != nil {
+				return err
+			}
+			sErr := make(chan session.RetrieverError, 1)
+			cc, err := r.session.Accept(id, p, func(t protocol.AddressType, a []byte, pp uint16, e session.RetrieverError) {
+				if !e.IsError() {
+					accepted(t, a, pp)
+				}
+				sErr <- e
+			})
+			if err != nil {
+				return err
+			}
+			bk.requests <- request{
+				id:     id,
+				pusher: p,
+				cancel: cc,
+			}
+			e := <-sErr
+			if e.E == session.ErrResourceWaiting.E {
+				return errRequestAcceptWaiting
+			}
+			return e
+		})
+		if err != errRequestAcceptWaiting {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrRequestAcceptTimeout
+		}
+	}
+}
+
+func (r *requester) listen(
+	rr protocol.ListenRequest,
+	p *reader.Pusher,
+	resp session.RetrieverBuilder,
+) (protocol.ID, protocol.AddressType, []byte, uint16, error) {
+	pt := p.Size()
+	defer p.Truncate(pt)
+	id, _, err := r.session.Retriever(resp, r.pick().index)
+	if err != nil {
+		return id, 0, nil, 0, err
+	}
+	var atyp protocol.AddressType
+	var addr []byte
+	var port uint16
+	err = r.run(func() error {
+		p.Truncate(pt)
+		bk, err := r.repin(id)
+		if err != nil {
+			return err
+		}
+		sErr := make(chan session.RetrieverError, 1)
+		cc, err := r.session.Listen(id, rr, p, func(t protocol.AddressType, a []byte, pp uint16, e session.RetrieverError) {
+			atyp, addr, port = t, append([]byte{}, a...), pp
+			sErr <- e
+		})
+		if err != nil {
+			return err
+		}
+		bk.requests <- request{
+			id:     id,
+			pusher: p,
+			cancel: cc,
+		}
+		return <-sErr
+	})
+	if err != nil {
+		r.close(id, p)
+		r.session.Release(id, func(e session.Retriever) error {
+			e.Close()
+			return nil
+		})
+		return id, 0, nil, 0, err
+	}
+	return id, atyp, addr, port, nil
+}
+
+func (r *requester) multipath(
+	rr protocol.MultipathRequest,
+	p *reader.Pusher,
+	resp session.RetrieverBuilder,
+) (protocol.ID, [protocol.MultipathKeySize]byte, *backend, error) {
+	pt := p.Size()
+	defer p.Truncate(pt)
+	key := [protocol.MultipathKeySize]byte{}
+	id, _, err := r.session.Retriever(resp, r.pick().index)
+	if err != nil {
+		return id, key, nil, err
+	}
+	err = r.run(func() error {
+		p.Truncate(pt)
+		bk, err := r.repin(id)
+		if err != nil {
+			return err
+		}
+		sErr := make(chan session.RetrieverError, 1)
+		cc, err := r.session.Multipath(id, rr, p, func(k [protocol.MultipathKeySize]byte, e session.RetrieverError) {
+			key = k
+			sErr <- e
+		})
+		if err != nil {
+			return err
+		}
+		bk.requests <- request{
 			id:     id,
 			pusher: p,
 			cancel: cc,
 		}
 		return <-sErr
 	})
+	var bk *backend
+	if err == nil {
+		bk, err = r.owner(id)
+	}
 	if err != nil {
+		r.close(id, p)
+		r.session.Release(id, func(e session.Retriever) error {
+			e.Close()
+			return nil
+		})
+		return id, key, nil, err
+	}
+	return id, key, bk, nil
+}
+
+func (r *requester) incoming(
+	id protocol.ID,
+	p *reader.Pusher,
+) (protocol.ID, protocol.AddressType, []byte, uint16, error) {
+	pt := p.Size()
+	defer p.Truncate(pt)
+	var cid protocol.ID
+	var atyp protocol.AddressType
+	var addr []byte
+	var port uint16
+	err := r.run(func() error {
+		p.Truncate(pt)
+		bk, err := r.owner(id)
+		if err != nil {
+			return err
+		}
+		sErr := make(chan session.RetrieverError, 1)
+		cc, err := r.session.Incoming(id, p, func(c protocol.ID, t protocol.AddressType, a []byte, pp uint16, e session.RetrieverError) {
+			cid, atyp, addr, port = c, t, append([]byte{}, a...), pp
+			sErr <- e
+		})
+		if err != nil {
+			return err
+		}
+		bk.requests <- request{
+			id:     id,
+			pusher: p,
+			cancel: cc,
+		}
+		e := <-sErr
+		if e.E == session.ErrResourceWaiting.E {
+			return errRequestAcceptWaiting
+		}
+		return e
+	})
+	return cid, atyp, addr, port, err
+}
+
+func (r *requester) adopt(
+	id protocol.ID,
+	via protocol.ID,
+	p *reader.Pusher,
+	resp session.RetrieverBuilder,
+	after func(),
+) (session.Retriever, error) {
+	defer after()
+	pt := p.Size()
+	defer p.Truncate(pt)
+	owner, err := r.session.Owner(via)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := r.session.Adopt(id, resp, owner)
+	if err != nil {
+		r.closeVia(id, via, p)
+		return nil, err
+	}
+	err = r.accept(id, p, pt, func(protocol.AddressType, []byte, uint16) error {
+		return nil
+	})
+	if err != nil {
+		r.close(id, p)
 		r.session.Release(id, func(e session.Retriever) error {
 			e.Close()
 			return nil
@@ -433,14 +1139,34 @@ func (r *requester) retrieve(
 	defer p.Truncate(pt)
 	return r.run(func() error {
 		p.Truncate(pt)
+		bk, err := r.owner(id)
+		if err != nil {
+			return err
+		}
 		sErr := make(chan session.RetrieverError, 1)
+		if r.push {
+			cc, send, err := r.session.Await(id, bk.channel, p, func(e session.RetrieverError) {
+				sErr <- e
+			})
+			if err != nil {
+				return err
+			}
+			if send {
+				bk.requests <- request{
+					id:     id,
+					pusher: p,
+					cancel: cc,
+				}
+			}
+			return <-sErr
+		}
 		cc, err := r.session.Retrieve(id, p, func(e session.RetrieverError) {
 			sErr <- e
 		})
 		if err != nil {
 			return err
 		}
-		r.requests <- request{
+		bk.requests <- request{
 			id:     id,
 			pusher: p,
 			cancel: cc,
@@ -467,6 +1193,10 @@ func (r *requester) send(
 	defer p.Truncate(pt)
 	e := r.run(func() error {
 		p.Truncate(pt)
+		bk, err := r.owner(id)
+		if err != nil {
+			return err
+		}
 		sErr := make(chan writeResult, 1)
 		cc, err := r.session.Send(id, req, p, func(size uint16, e session.RetrieverError) {
 			sErr <- writeResult{l: int(size), e: e}
@@ -476,8 +1206,8 @@ func (r *requester) send(
 		}
 		p.Truncate(p.Size() + (rlen - protocol.SendHeaderOverhead))
 		select {
-		case r.requests <- request{id: id, pusher: p, cancel: cc}:
-		case r.wrequests <- request{id: id, pusher: p, cancel: cc}:
+		case bk.requests <- request{id: id, pusher: p, cancel: cc}:
+		case bk.wrequests <- request{id: id, pusher: p, cancel: cc}:
 		}
 		wres = <-sErr
 		return wres.e
@@ -489,10 +1219,23 @@ func (r *requester) send(
 }
 
 func (r *requester) close(id protocol.ID, p *reader.Pusher) error {
+	return r.closeVia(id, id, p)
+}
+
+// closeVia closes the session, sending the request to the backend that owns
+// via when the session itself is not registered locally
+func (r *requester) closeVia(id protocol.ID, via protocol.ID, p *reader.Pusher) error {
 	pt := p.Size()
 	defer p.Truncate(pt)
 	return r.run(func() error {
 		p.Truncate(pt)
+		bk, err := r.owner(id)
+		if err != nil {
+			bk, err = r.owner(via)
+		}
+		if err != nil {
+			return err
+		}
 		sErr := make(chan session.RetrieverError, 1)
 		cc, err := r.session.Close(id, p, func(e session.RetrieverError) {
 			sErr <- e
@@ -501,8 +1244,8 @@ func (r *requester) close(id protocol.ID, p *reader.Pusher) error {
 			return err
 		}
 		select {
-		case r.requests <- request{id: id, pusher: p, cancel: cc}:
-		case r.wrequests <- request{id: id, pusher: p, cancel: cc}:
+		case bk.requests <- request{id: id, pusher: p, cancel: cc}:
+		case bk.wrequests <- request{id: id, pusher: p, cancel: cc}:
 		}
 		return <-sErr
 	})
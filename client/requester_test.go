@@ -0,0 +1,160 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"warwolf/server"
+)
+
+// lossyBackend is a Backend which loses the respond of the request that
+// opened the first connection to the origin, as if it broke on its way back
+type lossyBackend struct {
+	backend *server.Backend
+	armed   *int32
+	opened  *int32
+	lost    int32
+}
+
+func (l *lossyBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := httptest.NewRecorder()
+	l.backend.ServeHTTP(rec, r)
+	if atomic.LoadInt32(l.armed) == 1 && atomic.LoadInt32(&l.lost) == 0 {
+		for i := 0; i < 100 && atomic.LoadInt32(l.opened) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if atomic.LoadInt32(l.opened) > 0 && atomic.CompareAndSwapInt32(&l.lost, 0, 1) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+func TestRequesterFailoverClosesSession(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	opened := int32(0)
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&opened, 1)
+			conns <- c
+		}
+	}()
+	sc := server.DefaultConfig()
+	sc.Logging = false
+	discard := log.New(io.Discard, "", 0)
+	armed := int32(0)
+	backends := make([]*httptest.Server, 2)
+	for i := range backends {
+		b, err := server.NewBackend(sc, discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		var h http.Handler = b
+		if i == 0 {
+			h = &lossyBackend{backend: b, armed: &armed, opened: &opened}
+		}
+		backends[i] = httptest.NewServer(h)
+		defer backends[i].Close()
+	}
+	c := DefaultConfig()
+	c.Backend = backends[0].URL + "," + backends[1].URL
+	// Shortens the delay before the retry
+	c.RequestTimeout = 6 * time.Second
+	tn, err := NewTunnel(c, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tn.Close()
+	// Wait for the first probes, and make sure the session goes to the
+	// lossy backend first
+	bks := tn.dial.requester.backends
+	for _, bk := range bks {
+		for i := 0; ; i++ {
+			latency, _, _ := bk.state()
+			if latency > 0 {
+				break
+			}
+			if i > 500 {
+				t.Fatal("Backends were not probed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	bks[0].lock.Lock()
+	bks[0].latency = time.Millisecond
+	bks[0].lock.Unlock()
+	bks[1].lock.Lock()
+	bks[1].latency = time.Second
+	bks[1].lock.Unlock()
+	atomic.StoreInt32(&armed, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := tn.DialContext(ctx, "tcp", origin.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The connection which the lost attempt opened is closed by the first
+	// backend, and the session goes on on the second one
+	var first, second net.Conn
+	for _, cc := range []*net.Conn{&first, &second} {
+		select {
+		case *cc = <-conns:
+			defer (*cc).Close()
+		case <-time.After(10 * time.Second):
+			t.Fatal("Origin was not connected")
+		}
+	}
+	first.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection opened on the first backend must be closed, got %v", err)
+	}
+	go conn.Write([]byte("Hello"))
+	b := make([]byte, 5)
+	second.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(second, b); err != nil || string(b) != "Hello" {
+		t.Errorf("Session must go on on the second backend, got %q, %v", b, err)
+	}
+	go second.Write([]byte("World"))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "World" {
+		t.Errorf("Session must go on on the second backend, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,217 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"warwolf/buffer"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+	"warwolf/session"
+)
+
+var (
+	ErrReverseInvalidPort  = errors.New("Reverse: Invalid backend port")
+	ErrReverseInvalidLocal = errors.New("Reverse: Invalid local address")
+)
+
+const (
+	reverseRetryDelay  = 5 * time.Second
+	reverseDialTimeout = 5 * time.Second
+)
+
+// Reverse publishes the local service at Local on Port of the backend
+type Reverse struct {
+	Port  uint16
+	Local string
+}
+
+// ParseReverse parses a reverse tunnel in "port=local" form, for example
+// "8022=127.0.0.1:22"
+func ParseReverse(s string) Reverse {
+	r := Reverse{}
+	ss := strings.SplitN(strings.TrimSpace(s), "=", 2)
+	p, err := strconv.ParseUint(strings.TrimSpace(ss[0]), 10, 16)
+	if err == nil {
+		r.Port = uint16(p)
+	}
+	if len(ss) > 1 {
+		r.Local = strings.TrimSpace(ss[1])
+	}
+	return r
+}
+
+func parseReverses(s string) []Reverse {
+	r := make([]Reverse, 0, 4)
+	for _, rv := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(rv)) == 0 {
+			continue
+		}
+		r = append(r, ParseReverse(rv))
+	}
+	return r
+}
+
+func (r Reverse) String() string {
+	return strconv.FormatUint(uint64(r.Port), 10) + "=" + r.Local
+}
+
+func (r Reverse) Verify() error {
+	if r.Port == 0 {
+		return ErrReverseInvalidPort
+	}
+	_, _, err := net.SplitHostPort(r.Local)
+	if err != nil {
+		return ErrReverseInvalidLocal
+	}
+	return nil
+}
+
+func addrString(atyp protocol.AddressType, addr []byte) string {
+	switch atyp {
+	case protocol.TCPIPv4, protocol.TCPIPv6, protocol.UDPIPv4, protocol.UDPIPv6:
+		return net.IP(addr).String()
+	default:
+		return string(addr)
+	}
+}
+
+type reverses struct {
+	lg     log.Log
+	d      *dial
+	b      *buffer.Buffer
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newReverses(lg log.Log, d *dial, b *buffer.Buffer) *reverses {
+	return &reverses{
+		lg:     lg,
+		d:      d,
+		b:      b,
+		closed: make(chan struct{}),
+		wg:     sync.WaitGroup{},
+	}
+}
+
+func (r *reverses) start(rv Reverse) {
+	lg := func(format string, v ...interface{}) {
+		r.lg("Reverse "+rv.String()+": "+format, v...)
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			err := r.serve(lg, rv)
+			if err == session.ErrDialFailedNotAllowed.E {
+				lg("Port is not allowed by the backend, giving up")
+				return
+			}
+			if err != nil {
+				lg("Listen failed: %s", err)
+			}
+			select {
+			case <-r.closed:
+				return
+			case <-time.After(reverseRetryDelay):
+			}
+		}
+	}()
+}
+
+func (r *reverses) stop() {
+	close(r.closed)
+	r.wg.Wait()
+}
+
+func (r *reverses) serve(lg log.Log, rv Reverse) error {
+	push := r.b.Request()
+	defer r.b.Return(push)
+	p := reader.NewPusher(push[:])
+	id, atyp, addr, port, err := r.d.requester.listen(protocol.ListenRequest{
+		ID:             protocol.ID{},
+		Port:           rv.Port,
+		MaxRetrieveLen: r.d.maxRetrieveLen,
+	}, &p, func(id protocol.ID) session.Retriever {
+		return idleRetriever{}
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.d.requester.close(id, &p)
+		r.d.requester.session.Release(id, func(e session.Retriever) error {
+			return nil
+		})
+	}()
+	lg("Listening on backend %s", net.JoinHostPort(addrString(atyp, addr), strconv.FormatUint(uint64(port), 10)))
+	for {
+		select {
+		case <-r.closed:
+			return nil
+		default:
+		}
+		cid, ratyp, raddr, rport, err := r.d.requester.incoming(id, &p)
+		if err == errRequestAcceptWaiting {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lg("%s: Incoming", net.JoinHostPort(addrString(ratyp, raddr), strconv.FormatUint(uint64(rport), 10)))
+		r.wg.Add(1)
+		go func(cid protocol.ID) {
+			defer r.wg.Done()
+			err := r.connect(id, cid, rv)
+			if err != nil {
+				lg("%s: Request failed: %s", cid, err)
+			}
+		}(cid)
+	}
+}
+
+func (r *reverses) connect(id protocol.ID, cid protocol.ID, rv Reverse) error {
+	push := r.b.Request()
+	pushReturned := false
+	defer func() {
+		if pushReturned {
+			return
+		}
+		r.b.Return(push)
+	}()
+	p := reader.NewPusher(push[:])
+	conn, err := net.DialTimeout("tcp", rv.Local, reverseDialTimeout)
+	if err != nil {
+		r.d.requester.closeVia(cid, id, &p)
+		return err
+	}
+	defer conn.Close()
+	req := r.b.Request()
+	defer r.b.Return(req)
+	return r.d.adopt(cid, id, req, &p, reader.NewNetConn(conn), func() {
+		pushReturned = true
+		r.b.Return(push)
+		push = nil
+		p = reader.Pusher{}
+	})
+}
@@ -0,0 +1,67 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+	"testing"
+	"warwolf/protocol"
+)
+
+func TestParseReverse(t *testing.T) {
+	for _, c := range []struct {
+		s   string
+		r   Reverse
+		err error
+	}{
+		{"8022=127.0.0.1:22", Reverse{8022, "127.0.0.1:22"}, nil},
+		{" 8022 = localhost:22 ", Reverse{8022, "localhost:22"}, nil},
+		{"0=127.0.0.1:22", Reverse{0, "127.0.0.1:22"}, ErrReverseInvalidPort},
+		{"65536=127.0.0.1:22", Reverse{0, "127.0.0.1:22"}, ErrReverseInvalidPort},
+		{"ssh=127.0.0.1:22", Reverse{0, "127.0.0.1:22"}, ErrReverseInvalidPort},
+		{"8022", Reverse{8022, ""}, ErrReverseInvalidLocal},
+		{"8022=127.0.0.1", Reverse{8022, "127.0.0.1"}, ErrReverseInvalidLocal},
+	} {
+		r := ParseReverse(c.s)
+		if r != c.r {
+			t.Errorf("%q: Expected %+v, got %+v", c.s, c.r, r)
+		}
+		if err := r.Verify(); err != c.err {
+			t.Errorf("%q: Expected error %v, got %v", c.s, c.err, err)
+		}
+	}
+	rs := parseReverses("8022=127.0.0.1:22,, 8080=127.0.0.1:80 ")
+	if len(rs) != 2 || rs[0].String() != "8022=127.0.0.1:22" || rs[1].String() != "8080=127.0.0.1:80" {
+		t.Errorf("Unexpected reverses %v", rs)
+	}
+}
+
+func TestAddrString(t *testing.T) {
+	for _, c := range []struct {
+		atyp protocol.AddressType
+		addr []byte
+		s    string
+	}{
+		{protocol.TCPIPv4, net.IPv4(10, 0, 0, 1).To4(), "10.0.0.1"},
+		{protocol.TCPIPv6, net.ParseIP("fd00::1"), "fd00::1"},
+		{protocol.TCPHost, []byte("example.com"), "example.com"},
+	} {
+		if s := addrString(c.atyp, c.addr); s != c.s {
+			t.Errorf("Expected %s, got %s", c.s, s)
+		}
+	}
+}
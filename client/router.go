@@ -0,0 +1,421 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+var (
+	ErrRouteBlocked               = errors.New("Router: Connection blocked by rule")
+	ErrRouteUnknownBackend        = errors.New("Router: Unknown backend")
+	ErrRouteInvalidRule           = errors.New("Router: Invalid rule")
+	ErrRouteDirectBindUnsupported = errors.New("Router: BIND is not supported for direct connections")
+)
+
+const (
+	routeDirectDialTimeout = 10 * time.Second
+)
+
+type dialer interface {
+	dial(
+		aTyp protocol.AddressType,
+		addr []byte,
+		port uint16,
+		reqData []byte,
+		reqDataLen int,
+		p *reader.Pusher,
+		hosted io.ReadWriteCloser,
+		after func(),
+	) error
+	bind(
+		aTyp protocol.AddressType,
+		addr []byte,
+		port uint16,
+		reqData []byte,
+		p *reader.Pusher,
+		hosted io.ReadWriteCloser,
+		bound bindReport,
+		accepted bindReport,
+		after func(),
+	) error
+}
+
+type direct struct {
+	timeout time.Duration
+}
+
+func directNetwork(aTyp protocol.AddressType) string {
+	switch aTyp {
+	case protocol.UDPIPv4, protocol.UDPIPv6, protocol.UDPHost:
+		return "udp"
+	default:
+		return "tcp"
+	}
+}
+
+func directPipe(dst io.Writer, src io.Reader, buf []byte) error {
+	for {
+		l, err := src.Read(buf)
+		if l > 0 {
+			_, werr := dst.Write(buf[:l])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d direct) dial(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	reqDataLen int,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	after func(),
+) error {
+	after()
+	conn, err := net.DialTimeout(
+		directNetwork(aTyp),
+		net.JoinHostPort(addrString(aTyp, addr), strconv.FormatUint(uint64(port), 10)),
+		d.timeout,
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if reqDataLen > 0 {
+		_, err = conn.Write(reqData[:reqDataLen])
+		if err != nil {
+			return err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, len(reqData))
+		directPipe(hosted, conn, buf)
+		hosted.Close()
+	}()
+	err = directPipe(conn, hosted, reqData)
+	conn.Close()
+	<-done
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (d direct) bind(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	bound bindReport,
+	accepted bindReport,
+	after func(),
+) error {
+	after()
+	return ErrRouteDirectBindUnsupported
+}
+
+type routeAction int
+
+const (
+	routeTunnel    routeAction = 0
+	routeDirect    routeAction = 1
+	routeBlock     routeAction = 2
+	routeBackend   routeAction = 3
+	routeMultipath routeAction = 4
+)
+
+type routePorts struct {
+	from uint16
+	to   uint16
+}
+
+type rule struct {
+	action   routeAction
+	backend  string
+	suffixes []string
+	hosts    map[string]struct{}
+	cidrs    []*net.IPNet
+	ports    []routePorts
+	users    []string
+	networks []string
+	hostsDB  bool
+}
+
+func routeHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(h), ".")
+}
+
+func parseRouteAction(s string) (routeAction, string, error) {
+	switch {
+	case s == "tunnel":
+		return routeTunnel, "", nil
+	case s == "direct":
+		return routeDirect, "", nil
+	case s == "block":
+		return routeBlock, "", nil
+	case s == "multipath":
+		return routeMultipath, "", nil
+	case strings.HasPrefix(s, "backend:") && len(s) > len("backend:"):
+		return routeBackend, s[len("backend:"):], nil
+	default:
+		return 0, "", ErrRouteInvalidRule
+	}
+}
+
+func parseRoutePorts(s string) (routePorts, error) {
+	pp := strings.SplitN(s, "-", 2)
+	from, err := strconv.ParseUint(pp[0], 10, 16)
+	if err != nil {
+		return routePorts{}, ErrRouteInvalidRule
+	}
+	to := from
+	if len(pp) > 1 {
+		to, err = strconv.ParseUint(pp[1], 10, 16)
+		if err != nil || to < from {
+			return routePorts{}, ErrRouteInvalidRule
+		}
+	}
+	return routePorts{from: uint16(from), to: uint16(to)}, nil
+}
+
+func parseRule(fields []string) (rule, error) {
+	action, backend, err := parseRouteAction(strings.ToLower(fields[0]))
+	if err != nil {
+		return rule{}, err
+	}
+	r := rule{
+		action:  action,
+		backend: backend,
+		hosts:   make(map[string]struct{}),
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return rule{}, ErrRouteInvalidRule
+		}
+		switch strings.ToLower(kv[0]) {
+		case "suffix":
+			r.suffixes = append(r.suffixes, strings.TrimPrefix(routeHost(kv[1]), "."))
+		case "host":
+			r.hosts[routeHost(kv[1])] = struct{}{}
+		case "cidr":
+			_, n, err := net.ParseCIDR(kv[1])
+			if err != nil {
+				return rule{}, err
+			}
+			r.cidrs = append(r.cidrs, n)
+		case "port":
+			p, err := parseRoutePorts(kv[1])
+			if err != nil {
+				return rule{}, err
+			}
+			r.ports = append(r.ports, p)
+		case "user":
+			r.users = append(r.users, kv[1])
+		case "network":
+			n := strings.ToLower(kv[1])
+			if n != "tcp" && n != "udp" {
+				return rule{}, ErrRouteInvalidRule
+			}
+			r.networks = append(r.networks, n)
+		default:
+			return rule{}, ErrRouteInvalidRule
+		}
+	}
+	return r, nil
+}
+
+// loadRules reads rules from r. Each line is either a rule in
+// "<action> [matcher ...]" form, or a hosts file entry in
+// "<address> <host> [host ...]" form which blocks the listed hosts
+func loadRules(r io.Reader) ([]rule, error) {
+	rules := make([]rule, 0, 16)
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		n++
+		l := s.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			if len(rules) == 0 || !rules[len(rules)-1].hostsDB {
+				rules = append(rules, rule{
+					action:  routeBlock,
+					hosts:   make(map[string]struct{}, 1024),
+					hostsDB: true,
+				})
+			}
+			for _, h := range fields[1:] {
+				rules[len(rules)-1].hosts[routeHost(h)] = struct{}{}
+			}
+			continue
+		}
+		rr, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", n, err)
+		}
+		rules = append(rules, rr)
+	}
+	return rules, s.Err()
+}
+
+func loadRulesFile(path string) ([]rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return loadRules(f)
+}
+
+func (r *rule) matchHost(aTyp protocol.AddressType, addr []byte) bool {
+	if len(r.suffixes) == 0 && len(r.hosts) == 0 && len(r.cidrs) == 0 {
+		return true
+	}
+	var ip net.IP
+	host := ""
+	switch aTyp {
+	case protocol.TCPHost, protocol.UDPHost:
+		host = routeHost(string(addr))
+		ip = net.ParseIP(host)
+	default:
+		ip = net.IP(addr)
+		host = ip.String()
+	}
+	if _, ok := r.hosts[host]; ok {
+		return true
+	}
+	for _, s := range r.suffixes {
+		if host == s || strings.HasSuffix(host, "."+s) {
+			return true
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	for _, c := range r.cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) match(network string, user string, aTyp protocol.AddressType, addr []byte, port uint16) bool {
+	if len(r.networks) > 0 && !stringIsIn(network, r.networks) {
+		return false
+	}
+	if len(r.users) > 0 && !stringIsIn(user, r.users) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		matched := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return r.matchHost(aTyp, addr)
+}
+
+func stringIsIn(s string, in []string) bool {
+	for i := range in {
+		if in[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+type router struct {
+	rules     []rule
+	tunnel    dialer
+	direct    dialer
+	multipath dialer
+	backends  map[string]dialer
+}
+
+func newRouter(rules []rule, tunnel dialer, multipath dialer, backends map[string]dialer) (*router, error) {
+	for _, r := range rules {
+		if r.action != routeBackend {
+			continue
+		}
+		if _, ok := backends[r.backend]; !ok {
+			return nil, fmt.Errorf("%s: %s", ErrRouteUnknownBackend, r.backend)
+		}
+	}
+	return &router{
+		rules:     rules,
+		tunnel:    tunnel,
+		direct:    direct{timeout: routeDirectDialTimeout},
+		multipath: multipath,
+		backends:  backends,
+	}, nil
+}
+
+func (r *router) route(network string, user string, aTyp protocol.AddressType, addr []byte, port uint16) (dialer, error) {
+	for i := range r.rules {
+		if !r.rules[i].match(network, user, aTyp, addr, port) {
+			continue
+		}
+		switch r.rules[i].action {
+		case routeDirect:
+			return r.direct, nil
+		case routeBlock:
+			return nil, ErrRouteBlocked
+		case routeBackend:
+			return r.backends[r.rules[i].backend], nil
+		case routeMultipath:
+			return r.multipath, nil
+		default:
+			return r.tunnel, nil
+		}
+	}
+	return r.tunnel, nil
+}
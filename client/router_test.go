@@ -0,0 +1,145 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+type testDialer string
+
+func (d testDialer) dial(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	reqDataLen int,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	after func(),
+) error {
+	return nil
+}
+
+func (d testDialer) bind(
+	aTyp protocol.AddressType,
+	addr []byte,
+	port uint16,
+	reqData []byte,
+	p *reader.Pusher,
+	hosted io.ReadWriteCloser,
+	bound bindReport,
+	accepted bindReport,
+	after func(),
+) error {
+	return nil
+}
+
+const testRules = `
+# Hosts file entries are blocked
+0.0.0.0 ads.example tracker.example.
+:: ipv6.ads.example
+direct host:ads.example
+direct suffix:lan
+direct cidr:10.0.0.0/8 cidr:fd00::/8
+backend:eu suffix:.eu
+multipath port:8000-8100
+block network:udp port:443
+tunnel user:bob
+direct user:alice
+`
+
+func TestRouterRoute(t *testing.T) {
+	rules, err := loadRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 9 {
+		t.Fatalf("Expected 9 rules, got %d", len(rules))
+	}
+	backends := map[string]dialer{"eu": testDialer("eu")}
+	rt, err := newRouter(rules, testDialer("tunnel"), testDialer("multipath"), backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		network string
+		user    string
+		aTyp    protocol.AddressType
+		addr    []byte
+		port    uint16
+		dialer  dialer
+		err     error
+	}{
+		// Hosts file lines come first, so they win over the direct rule
+		{"tcp", "", protocol.TCPHost, []byte("ads.example"), 80, nil, ErrRouteBlocked},
+		{"tcp", "", protocol.TCPHost, []byte("Tracker.Example."), 80, nil, ErrRouteBlocked},
+		{"tcp", "", protocol.TCPHost, []byte("ipv6.ads.example"), 80, nil, ErrRouteBlocked},
+		{"tcp", "", protocol.TCPHost, []byte("sub.ads.example"), 80, testDialer("tunnel"), nil},
+		{"tcp", "", protocol.TCPHost, []byte("printer.lan"), 80, direct{timeout: routeDirectDialTimeout}, nil},
+		{"tcp", "", protocol.TCPHost, []byte("lan"), 80, direct{timeout: routeDirectDialTimeout}, nil},
+		{"tcp", "", protocol.TCPHost, []byte("wlan"), 80, testDialer("tunnel"), nil},
+		{"tcp", "", protocol.TCPIPv4, net.IPv4(10, 1, 2, 3).To4(), 80, direct{timeout: routeDirectDialTimeout}, nil},
+		{"tcp", "", protocol.TCPHost, []byte("10.1.2.3"), 80, direct{timeout: routeDirectDialTimeout}, nil},
+		{"tcp", "", protocol.TCPIPv6, net.ParseIP("fd00::1"), 80, direct{timeout: routeDirectDialTimeout}, nil},
+		{"tcp", "", protocol.TCPIPv4, net.IPv4(11, 1, 2, 3).To4(), 80, testDialer("tunnel"), nil},
+		{"tcp", "", protocol.TCPHost, []byte("www.example.eu"), 80, testDialer("eu"), nil},
+		// The first matching rule wins
+		{"tcp", "", protocol.TCPHost, []byte("www.example.eu"), 8050, testDialer("eu"), nil},
+		{"tcp", "", protocol.TCPHost, []byte("example.com"), 8050, testDialer("multipath"), nil},
+		{"tcp", "", protocol.TCPHost, []byte("example.com"), 8101, testDialer("tunnel"), nil},
+		{"udp", "", protocol.UDPHost, []byte("example.com"), 443, nil, ErrRouteBlocked},
+		{"tcp", "", protocol.TCPHost, []byte("example.com"), 443, testDialer("tunnel"), nil},
+		{"udp", "bob", protocol.UDPHost, []byte("example.com"), 443, nil, ErrRouteBlocked},
+		{"tcp", "bob", protocol.TCPHost, []byte("example.com"), 443, testDialer("tunnel"), nil},
+		{"tcp", "alice", protocol.TCPHost, []byte("example.com"), 443, direct{timeout: routeDirectDialTimeout}, nil},
+		{"tcp", "alice", protocol.TCPHost, []byte("example.com"), 8000, testDialer("multipath"), nil},
+	} {
+		d, err := rt.route(c.network, c.user, c.aTyp, c.addr, c.port)
+		if d != c.dialer || err != c.err {
+			t.Errorf("%s %s %s:%d: Expected %v (%v), got %v (%v)",
+				c.network, c.user, addrString(c.aTyp, c.addr), c.port, c.dialer, c.err, d, err)
+		}
+	}
+}
+
+func TestRouterInvalidRules(t *testing.T) {
+	for _, r := range []string{
+		"reject",
+		"backend:",
+		"direct host",
+		"direct host:",
+		"direct colour:red",
+		"direct cidr:10.0.0.0",
+		"direct port:80-79",
+		"direct port:http",
+		"direct network:sctp",
+	} {
+		if _, err := loadRules(strings.NewReader(r)); err == nil {
+			t.Errorf("%q: Expected an error", r)
+		}
+	}
+	rules, _ := loadRules(strings.NewReader("backend:us"))
+	if _, err := newRouter(rules, nil, nil, map[string]dialer{}); err == nil {
+		t.Error("Unknown backend must be refused")
+	}
+}
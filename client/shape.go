@@ -0,0 +1,220 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"warwolf/codec"
+)
+
+const (
+	bindPathOff = "off"
+	bindPathOn  = "on"
+)
+
+var (
+	ErrShapeInvalidHeader  = errors.New("Shape: Header must be in Name: value form")
+	ErrShapeReservedHeader = errors.New("Shape: Header is managed by the transport and can't be set")
+	ErrShapeInvalidPath    = errors.New("Shape: Path must start with /")
+	ErrShapeInvalidMethod  = errors.New("Shape: Method must be one of POST, PUT or PATCH")
+)
+
+// shaper changes how the requests to a backend look on the wire, so they
+// don't all share the same easily recognized shape. When the path is bound,
+// it's picked before the body is encrypted rather than when it's shaped
+type shaper struct {
+	headers  http.Header
+	paths    []string
+	bind     bool
+	methods  []string
+	buster   string
+	host     string
+	carrier  string
+	encoding string
+}
+
+func parseShapeHeaders(s string, userAgent string) (http.Header, error) {
+	r := http.Header{}
+	for _, h := range strings.Split(s, "|") {
+		if len(strings.TrimSpace(h)) == 0 {
+			continue
+		}
+		nv := strings.SplitN(h, ":", 2)
+		if len(nv) != 2 || len(strings.TrimSpace(nv[0])) == 0 {
+			return nil, ErrShapeInvalidHeader
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(nv[0]))
+		switch name {
+		case "Host", "Connection", "Upgrade", "Content-Length", "Transfer-Encoding":
+			return nil, ErrShapeReservedHeader
+		}
+		r.Add(name, strings.TrimSpace(nv[1]))
+	}
+	if len(userAgent) > 0 {
+		r.Set("User-Agent", userAgent)
+	}
+	return r, nil
+}
+
+func parseShapePaths(s string) ([]string, error) {
+	r := make([]string, 0, 4)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		if p[0] != '/' {
+			return nil, ErrShapeInvalidPath
+		}
+		r = append(r, p)
+	}
+	return r, nil
+}
+
+func parseShapeMethods(s string) ([]string, error) {
+	r := make([]string, 0, 3)
+	for _, m := range strings.Split(s, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch m {
+		case "":
+			continue
+		case "POST", "PUT", "PATCH":
+		default:
+			return nil, ErrShapeInvalidMethod
+		}
+		r = append(r, m)
+	}
+	return r, nil
+}
+
+// newShaper creates the shaper of the backend target, the config must have
+// been verified
+func newShaper(c Config, t backendTarget) *shaper {
+	headers, _ := parseShapeHeaders(c.RequestHeaders, c.UserAgent)
+	paths, _ := parseShapePaths(c.RequestPaths)
+	methods, _ := parseShapeMethods(c.RequestMethods)
+	return &shaper{
+		headers:  headers,
+		paths:    paths,
+		bind:     c.BindPath == bindPathOn,
+		methods:  methods,
+		buster:   c.CacheBuster,
+		host:     t.hostHeader,
+		carrier:  t.carrier,
+		encoding: t.encoding,
+	}
+}
+
+// shape returns a copy of req shaped. Only the method of POST requests is
+// changed, as the others are not carrying requests in their body
+func (s *shaper) shape(req *http.Request) *http.Request {
+	req = req.Clone(req.Context())
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+	if len(s.host) > 0 {
+		req.Host = s.host
+	}
+	if !s.bind {
+		req.URL = s.pick(req.URL)
+	}
+	if len(s.buster) > 0 {
+		q := req.URL.Query()
+		q.Set(s.buster, strconv.FormatUint(rand.Uint64(), 36))
+		req.URL.RawQuery = q.Encode()
+	}
+	if req.Method == "POST" && len(s.methods) > 0 {
+		req.Method = s.methods[rand.Intn(len(s.methods))]
+	}
+	return req
+}
+
+// pick returns a copy of u with one of the paths, or u when there's none
+func (s *shaper) pick(u *url.URL) *url.URL {
+	if len(s.paths) == 0 {
+		return u
+	}
+	p := *u
+	p.Path = s.paths[rand.Intn(len(s.paths))]
+	p.RawPath = ""
+	return &p
+}
+
+// carry moves the body of the shaped req into the carrier of the backend,
+// and asks for the respond encoding of it. Upgrades and requests of unknown
+// length, like the upload of a stream, are left as they are
+func (s *shaper) carry(req *http.Request) error {
+	if len(req.Header.Get("Upgrade")) > 0 {
+		return nil
+	}
+	if len(s.encoding) > 0 && s.encoding != codec.EncodingBinary {
+		req.Header.Set("Accept", codec.Accept(s.encoding))
+	}
+	if len(s.carrier) == 0 || s.carrier == codec.CarrierBody || req.ContentLength <= 0 || req.Body == nil {
+		return nil
+	}
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	codec.Carry(req, s.carrier, b)
+	return nil
+}
+
+// decode replaces the body of rsp with the decoded one, when the backend
+// has responded in the encoding asked for
+func (s *shaper) decode(rsp *http.Response) {
+	if len(s.encoding) == 0 || s.encoding == codec.EncodingBinary || rsp.Body == nil {
+		return
+	}
+	rsp.Body = decodedBody{
+		Reader: codec.NewReader(rsp.Body, rsp.Header.Get("Content-Type")),
+		Closer: rsp.Body,
+	}
+}
+
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// shapedTransport shapes every request before sending it
+type shapedTransport struct {
+	base   http.RoundTripper
+	shaper *shaper
+}
+
+func (s shapedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = s.shaper.shape(req)
+	err := s.shaper.carry(req)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := s.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	s.shaper.decode(rsp)
+	return rsp, nil
+}
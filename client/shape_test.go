@@ -0,0 +1,93 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseShape(t *testing.T) {
+	h, err := parseShapeHeaders("Accept: text/html | x-requested-with: XMLHttpRequest|", "Agent/1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("Accept") != "text/html" || h.Get("X-Requested-With") != "XMLHttpRequest" || h.Get("User-Agent") != "Agent/1.0" {
+		t.Errorf("Unexpected headers %v", h)
+	}
+	for s, e := range map[string]error{
+		"Accept":            ErrShapeInvalidHeader,
+		": text/html":       ErrShapeInvalidHeader,
+		"host: example":     ErrShapeReservedHeader,
+		"Content-Length: 1": ErrShapeReservedHeader,
+	} {
+		if _, err := parseShapeHeaders(s, ""); err != e {
+			t.Errorf("%q: Expected %v, got %v", s, e, err)
+		}
+	}
+	p, err := parseShapePaths(" /a, ,/b/c ")
+	if err != nil || len(p) != 2 || p[0] != "/a" || p[1] != "/b/c" {
+		t.Errorf("Unexpected paths %v, %v", p, err)
+	}
+	if _, err := parseShapePaths("/a,b"); err != ErrShapeInvalidPath {
+		t.Errorf("Expected %v, got %v", ErrShapeInvalidPath, err)
+	}
+	m, err := parseShapeMethods("put, Patch,")
+	if err != nil || len(m) != 2 || m[0] != "PUT" || m[1] != "PATCH" {
+		t.Errorf("Unexpected methods %v, %v", m, err)
+	}
+	if _, err := parseShapeMethods("POST,GET"); err != ErrShapeInvalidMethod {
+		t.Errorf("Expected %v, got %v", ErrShapeInvalidMethod, err)
+	}
+}
+
+func TestShaperShape(t *testing.T) {
+	c := DefaultConfig()
+	c.RequestHeaders = "Accept: text/html"
+	c.UserAgent = "Agent/1.0"
+	c.RequestPaths = "/api"
+	c.RequestMethods = "PUT"
+	c.CacheBuster = "v"
+	s := newShaper(c, backendTarget{hostHeader: "front.example"})
+	req, _ := http.NewRequest("POST", "http://backend.example/wwf?a=1", nil)
+	shaped := s.shape(req)
+	if shaped.Method != "PUT" || shaped.Host != "front.example" || shaped.URL.Path != "/api" {
+		t.Errorf("Unexpected request %s %s %s", shaped.Method, shaped.Host, shaped.URL)
+	}
+	if q := shaped.URL.Query(); q.Get("a") != "1" || len(q.Get("v")) == 0 {
+		t.Errorf("Unexpected query %s", shaped.URL.RawQuery)
+	}
+	if shaped.Header.Get("Accept") != "text/html" || shaped.Header.Get("User-Agent") != "Agent/1.0" {
+		t.Errorf("Unexpected headers %v", shaped.Header)
+	}
+	if req.Method != "POST" || req.URL.Path != "/wwf" || len(req.Header) != 0 {
+		t.Error("Original request must be left as it is")
+	}
+	get, _ := http.NewRequest("GET", "http://backend.example/wwf", nil)
+	if m := s.shape(get).Method; m != "GET" {
+		t.Errorf("Only POST requests can change their method, got %s", m)
+	}
+	// Bound paths are picked before the request is built
+	c.BindPath = bindPathOn
+	s = newShaper(c, backendTarget{})
+	if p := s.shape(req).URL.Path; p != "/wwf" {
+		t.Errorf("Bound path must be left as it is, got %s", p)
+	}
+	if p := s.pick(req.URL).Path; p != "/api" {
+		t.Errorf("Expected /api, got %s", p)
+	}
+}
@@ -0,0 +1,56 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"net"
+	"warwolf/buffer"
+	"warwolf/log"
+)
+
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newSniffedConn(c net.Conn) sniffedConn {
+	return sniffedConn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+	}
+}
+
+func (s sniffedConn) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func sniff(lg log.Log, rt *router, bb *buffer.Buffer, b []byte, laddr *net.TCPAddr, r net.Conn, auth socks5Auth) error {
+	c := newSniffedConn(r)
+	v, err := c.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch v[0] {
+	case socks5Version:
+		return socks5(lg, rt, bb, b, laddr, c, auth, socks5TCP, socks5Bind, socks5UDP)
+	case socks4Version:
+		return socks4(lg, rt, bb, b, c, auth)
+	default:
+		return httpProxy(lg, rt, bb, b, c, auth)
+	}
+}
@@ -0,0 +1,96 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"warwolf/cipher"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/websocket"
+)
+
+// openSocket opens a stream over a WebSocket. The upgrade itself is the
+// acknowledgement, and a backend that refuses it is considered unable to
+// be streamed to. What's sent over it is encrypted with the session ss
+func (r *requester) openSocket(lg log.Log, bk *backend, channel protocol.ID, ss *cipher.Session, buf []byte, s *streaming) (streamConn, error) {
+	key, err := websocket.Key()
+	if err != nil {
+		return streamConn{}, err
+	}
+	ts, u := bk.keys.transcript(bk.url)
+	req := http.Request{
+		Header: http.Header{
+			"Connection":            []string{"Upgrade"},
+			"Upgrade":               []string{"websocket"},
+			"Sec-Websocket-Version": []string{"13"},
+			"Sec-Websocket-Key":     []string{key},
+		},
+		Method: "GET",
+		URL:    u,
+	}
+	// The socket outlives the timeout of the backend client, and can only
+	// be upgraded to from HTTP/1.1
+	transport := bk.client.Transport.(shapedTransport).base.(*http.Transport).Clone()
+	transport.Protocols = &http.Protocols{}
+	transport.Protocols.SetHTTP1(true)
+	client := http.Client{
+		Transport: shapedTransport{
+			base:   transport,
+			shaper: bk.shaper,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.streamAckTimeout)
+	defer cancel()
+	rsp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return streamConn{}, err
+	}
+	rwc, ok := rsp.Body.(io.ReadWriteCloser)
+	if rsp.StatusCode != http.StatusSwitchingProtocols || !ok ||
+		!strings.EqualFold(rsp.Header.Get("Upgrade"), "websocket") ||
+		rsp.Header.Get("Sec-Websocket-Accept") != websocket.Accept(key) {
+		rsp.Body.Close()
+		transport.CloseIdleConnections()
+		return streamConn{}, ErrStreamUnavailable
+	}
+	conn := websocket.NewConn(rwc, true)
+	t, err := bk.keys.writeKey(conn, ss, ts)
+	if err != nil {
+		conn.Close()
+		return streamConn{}, err
+	}
+	down := make(chan error, 1)
+	go func() {
+		down <- receive(lg, r.b, &bk.keys, r.nv, t, ts, conn, bk.keys.respond(ss), r.segment(lg, s))
+	}()
+	return streamConn{
+		w:    conn,
+		ts:   ts,
+		down: down,
+		up:   nil,
+		end: func() {
+			conn.Shutdown()
+		},
+		cancel: func() {
+			conn.Close()
+		},
+	}, nil
+}
@@ -0,0 +1,125 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"warwolf/buffer"
+	"warwolf/log"
+	"warwolf/protocol"
+)
+
+var (
+	ErrNoSocks4AuthFailed       = errors.New("Socks4: Auth failed")
+	ErrSocks4FieldTooLong       = errors.New("Socks4: Field too long")
+	ErrUnsupportedSocks4Request = errors.New("Socks4: Unsupported request")
+)
+
+const (
+	socks4Version             = 0x04
+	socks4CmdConnect          = 0x01
+	socks4CmdBind             = 0x02
+	socks4ReplyGranted        = 0x5A
+	socks4ReplyRejected       = 0x5B
+	socks4ReplyUserIDMismatch = 0x5D
+	socks4MaxFieldLength      = 255
+)
+
+func socks4Field(r io.Reader) ([]byte, error) {
+	f := make([]byte, 0, socks4MaxFieldLength)
+	b := [1]byte{}
+	for {
+		_, err := io.ReadFull(r, b[:])
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			return f, nil
+		}
+		if len(f) >= socks4MaxFieldLength {
+			return nil, ErrSocks4FieldTooLong
+		}
+		f = append(f, b[0])
+	}
+}
+
+// socks4UserID splits the USERID field into the username and password
+// pair used by socks5Auth. Since Socks4 has no password field, clients
+// that need to pass one can send it as "username:password"
+func socks4UserID(userid string) (string, string) {
+	s := strings.IndexByte(userid, ':')
+	if s < 0 {
+		return userid, ""
+	}
+	return userid[:s], userid[s+1:]
+}
+
+func socks4Reply(r net.Conn, code byte) error {
+	_, err := r.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socks4(lg log.Log, rt *router, bb *buffer.Buffer, b []byte, r net.Conn, auth socks5Auth) error {
+	_, err := io.ReadFull(r, b[:8])
+	if err != nil {
+		return err
+	}
+	cmd := b[1]
+	port := uint16(b[2])<<8 | uint16(b[3])
+	ip := make([]byte, 4)
+	copy(ip, b[4:8])
+	userid, err := socks4Field(r)
+	if err != nil {
+		return err
+	}
+	user, password := socks4UserID(string(userid))
+	if auth != nil && !auth(user, password) {
+		socks4Reply(r, socks4ReplyUserIDMismatch)
+		return ErrNoSocks4AuthFailed
+	}
+	atyp := protocol.TCPIPv4
+	addr := ip
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		addr, err = socks4Field(r)
+		if err != nil {
+			return err
+		}
+		if len(addr) == 0 {
+			socks4Reply(r, socks4ReplyRejected)
+			return ErrNoSocks5BadAddressType
+		}
+		atyp = protocol.TCPHost
+	}
+	if cmd != socks4CmdConnect {
+		socks4Reply(r, socks4ReplyRejected)
+		return ErrUnsupportedSocks4Request
+	}
+	d, err := rt.route("tcp", user, atyp, addr, port)
+	if err != nil {
+		socks4Reply(r, socks4ReplyRejected)
+		return err
+	}
+	err = socks4Reply(r, socks4ReplyGranted)
+	if err != nil {
+		return err
+	}
+	lg("Socks4 CONNECT %s:%d", addrString(atyp, addr), port)
+	return dialTCP(d, bb, atyp, addr, port, b, readInitial(r, b), r)
+}
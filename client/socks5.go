@@ -33,6 +33,7 @@ var (
 )
 
 const (
+	socks5Version                = 0x05
 	socks5MethodNoAuth           = 0x00
 	socks5MethodGSSAPI           = 0x01
 	socks5MethodUsernamePassword = 0x02
@@ -45,10 +46,13 @@ const (
 	socks5ATypeIPv4              = 0x01
 	socks5ATypeDomain            = 0x03
 	socks5ATypeIPv6              = 0x04
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
 )
 
 type socks5Auth func(username, password string) bool
-type socks5Exec func(lg log.Log, d *dial, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error
+type socks5Exec func(lg log.Log, rt *router, user string, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error
 
 func socks5NoAuth(username, password string) bool {
 	return true
@@ -128,7 +132,7 @@ func socks5Addr(atype byte, r io.Reader) ([]byte, uint16, error) {
 	return addr, uint16(addr[alen-2])<<8 | uint16(addr[alen-1]), err
 }
 
-func socks5(lg log.Log, d *dial, bb *buffer.Buffer, b []byte, laddr *net.TCPAddr, r net.Conn, auth socks5Auth, tcpExec socks5Exec, udpExec socks5Exec) error {
+func socks5(lg log.Log, rt *router, bb *buffer.Buffer, b []byte, laddr *net.TCPAddr, r net.Conn, auth socks5Auth, tcpExec socks5Exec, bindExec socks5Exec, udpExec socks5Exec) error {
 	_, err := io.ReadFull(r, b[:2])
 	if err != nil {
 		return err
@@ -139,6 +143,7 @@ func socks5(lg log.Log, d *dial, bb *buffer.Buffer, b []byte, laddr *net.TCPAddr
 	}
 	authSelected := false
 	isNoAuth := false
+	user := ""
 	for i := 0; i < l; i++ {
 		switch b[i] {
 		case socks5MethodNoAuth:
@@ -182,9 +187,10 @@ func socks5(lg log.Log, d *dial, bb *buffer.Buffer, b []byte, laddr *net.TCPAddr
 		if err != nil {
 			return err
 		}
-		if auth(string(username), string(password)) {
+		if !auth(string(username), string(password)) {
 			return ErrNoSocks5AuthFailed
 		}
+		user = string(username)
 		_, err = r.Write([]byte{0x05, 00})
 	}
 	if err != nil {
@@ -201,9 +207,11 @@ func socks5(lg log.Log, d *dial, bb *buffer.Buffer, b []byte, laddr *net.TCPAddr
 	}
 	switch cmd {
 	case socks5CmdConnect:
-		return tcpExec(lg, d, bb, laddr, b, atype, addr[:len(addr)-2], port, r)
+		return tcpExec(lg, rt, user, bb, laddr, b, atype, addr[:len(addr)-2], port, r)
+	case socks5CmdBind:
+		return bindExec(lg, rt, user, bb, laddr, b, atype, addr[:len(addr)-2], port, r)
 	case socks5CmdUDP:
-		return udpExec(lg, d, bb, laddr, b, atype, addr[:len(addr)-2], port, r)
+		return udpExec(lg, rt, user, bb, laddr, b, atype, addr[:len(addr)-2], port, r)
 	default:
 		return ErrUnsupportedSocks5Request
 	}
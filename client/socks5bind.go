@@ -0,0 +1,66 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+	"time"
+	"warwolf/buffer"
+	"warwolf/log"
+	"warwolf/protocol"
+)
+
+func socks5Reply(r net.Conn, rep byte, atyp protocol.AddressType, addr []byte, port uint16) error {
+	resp := make([]byte, 0, 4+1+len(addr)+2)
+	resp = append(resp, 5, rep, 0)
+	switch atyp {
+	case protocol.TCPIPv4:
+		resp = append(resp, socks5ATypeIPv4)
+	case protocol.TCPIPv6:
+		resp = append(resp, socks5ATypeIPv6)
+	default:
+		resp = append(resp, socks5ATypeDomain, byte(len(addr)))
+	}
+	resp = append(resp, addr...)
+	resp = append(resp, byte(port>>8), byte(port))
+	_, err := r.Write(resp)
+	return err
+}
+
+func socks5Bind(lg log.Log, rt *router, user string, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error {
+	atyp := socks5AtypeToProtocolTCPAtype(atype)
+	d, err := rt.route("tcp", user, atyp, addr, port)
+	if err != nil {
+		socks5Reply(r, socks5RepNotAllowed, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0)
+		return err
+	}
+	replies := 0
+	err = bindTCP(d, b, atyp, addr, port, bb, r, func(atyp protocol.AddressType, addr []byte, port uint16) error {
+		replies++
+		lg("Bound on %s", &net.TCPAddr{IP: net.IP(addr), Port: int(port)})
+		r.SetDeadline(time.Time{})
+		return socks5Reply(r, socks5RepSucceeded, atyp, addr, port)
+	}, func(atyp protocol.AddressType, addr []byte, port uint16) error {
+		replies++
+		lg("Accepted inbound connection from %s", &net.TCPAddr{IP: net.IP(addr), Port: int(port)})
+		return socks5Reply(r, socks5RepSucceeded, atyp, addr, port)
+	})
+	if err != nil && replies < 2 {
+		socks5Reply(r, socks5RepGeneralFailure, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0)
+	}
+	return err
+}
@@ -18,13 +18,18 @@ package client
 
 import (
 	"net"
-	"time"
 	"warwolf/buffer"
 	"warwolf/log"
-	"warwolf/reader"
+	"warwolf/protocol"
 )
 
-func socks5TCP(lg log.Log, d *dial, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error {
+func socks5TCP(lg log.Log, rt *router, user string, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error {
+	atyp := socks5AtypeToProtocolTCPAtype(atype)
+	d, e := rt.route("tcp", user, atyp, addr, port)
+	if e != nil {
+		socks5Reply(r, socks5RepNotAllowed, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0)
+		return e
+	}
 	resp, isip4 := socks5BuildAddrFromIP(4, net.IPv4(0, 0, 0, 0), 0)
 	resp[0] = 5
 	if isip4 {
@@ -32,27 +37,9 @@ func socks5TCP(lg log.Log, d *dial, b *buffer.Buffer, laddr *net.TCPAddr, bb []b
 	} else {
 		resp[3] = socks5ATypeIPv6
 	}
-	_, e := r.Write(resp)
+	_, e = r.Write(resp)
 	if e != nil {
 		return e
 	}
-	atyp := socks5AtypeToProtocolTCPAtype(atype)
-	push := b.Request()
-	pushReturned := false
-	defer func() {
-		if pushReturned {
-			return
-		}
-		b.Return(push)
-	}()
-	p := reader.NewPusher(push[:])
-	r.SetDeadline(time.Now().Add(reqDataReadDelay))
-	l, _ := r.Read(bb[:reqDataSafeSize])
-	r.SetDeadline(time.Time{})
-	return d.dial(atyp, addr, port, bb, l, &p, r, func() {
-		pushReturned = true
-		b.Return(push)
-		push = nil
-		p = reader.Pusher{}
-	})
+	return dialTCP(d, b, atyp, addr, port, bb, readInitial(r, bb), r)
 }
@@ -116,7 +116,7 @@ type socks5UDPClient struct {
 	frag    byte
 }
 
-func (s *socks5UDPClient) handle(client *net.UDPAddr, conn *net.UDPConn, d *dial, writeHeader []byte, tatype protocol.AddressType, taddr []byte, tport uint16, frag byte, reqData []byte, reqDataLen int, bb *buffer.Buffer) error {
+func (s *socks5UDPClient) handle(client *net.UDPAddr, conn *net.UDPConn, d dialer, writeHeader []byte, tatype protocol.AddressType, taddr []byte, tport uint16, frag byte, reqData []byte, reqDataLen int, bb *buffer.Buffer) error {
 	push := bb.Request()
 	pushReturned := false
 	defer func() {
@@ -126,13 +126,15 @@ func (s *socks5UDPClient) handle(client *net.UDPAddr, conn *net.UDPConn, d *dial
 		bb.Return(push)
 	}()
 	p := reader.NewPusher(push[:])
+	wbuf := bb.Request()
+	defer bb.Return(wbuf)
 	return d.dial(tatype, taddr, tport, reqData, reqDataLen, &p, &socks5UDPConn{
 		writeHeader: writeHeader,
 		client:      client,
 		conn:        conn,
 		receive:     s.receive,
 		closer:      make(chan struct{}),
-		buf:         reqData,
+		buf:         wbuf,
 		readEOF:     false,
 		lock:        sync.Mutex{},
 	}, func() {
@@ -178,12 +180,14 @@ func (s *socks5UDPClient) close() {
 type socks5UDPServer struct {
 	idleTimeout time.Duration
 	source      net.IP
+	router      *router
+	user        string
 	clients     map[string]*socks5UDPClient
 	lock        sync.Mutex
 	wg          *sync.WaitGroup
 }
 
-func (s *socks5UDPServer) create(l *net.UDPConn, d *dial, client *net.UDPAddr, id string, tatype byte, taddr []byte, tport uint16, frag byte, reqData []byte, bb *buffer.Buffer) error {
+func (s *socks5UDPServer) create(l *net.UDPConn, d dialer, client *net.UDPAddr, id string, tatype byte, taddr []byte, tport uint16, frag byte, reqData []byte, bb *buffer.Buffer) error {
 	fend, f := socks5UDPFrag(frag)
 	if !fend || f != 0 {
 		return ErrNonFirstUDPFragmentNewRequest
@@ -200,7 +204,7 @@ func (s *socks5UDPServer) create(l *net.UDPConn, d *dial, client *net.UDPAddr, i
 	writeHeader := make([]byte, len(taddr)+4)
 	writeHeader[3] = tatype
 	copy(writeHeader[4:], taddr)
-	go func(l *net.UDPConn, d *dial, client *net.UDPAddr, id string, whd []byte, tatype byte, taddr []byte, tport uint16, frag byte, reqData []byte, reqDataLen int, bb *buffer.Buffer) {
+	go func(l *net.UDPConn, d dialer, client *net.UDPAddr, id string, whd []byte, tatype byte, taddr []byte, tport uint16, frag byte, reqData []byte, reqDataLen int, bb *buffer.Buffer) {
 		defer func() {
 			bb.Return(buf)
 			s.lock.Lock()
@@ -213,7 +217,7 @@ func (s *socks5UDPServer) create(l *net.UDPConn, d *dial, client *net.UDPAddr, i
 	return nil
 }
 
-func (s *socks5UDPServer) dispatch(l *net.UDPConn, d *dial, client *net.UDPAddr, data []byte, bb *buffer.Buffer) error {
+func (s *socks5UDPServer) dispatch(l *net.UDPConn, client *net.UDPAddr, data []byte, bb *buffer.Buffer) error {
 	r := reader.NewFetcher(reader.ByteFetch(data, io.EOF))
 	b, err := r.Fetch(4)
 	if err != nil {
@@ -245,13 +249,17 @@ func (s *socks5UDPServer) dispatch(l *net.UDPConn, d *dial, client *net.UDPAddr,
 		if len(s.clients) > maxSocks5UDPClients {
 			return ErrTooManyUDPClient
 		}
+		d, err := s.router.route("udp", s.user, socks5AtypeToProtocolUDPAtype(atype), addr[:len(addr)-2], port)
+		if err != nil {
+			return err
+		}
 		return s.create(l, d, client, id, atype, addr, port, frag, payload, bb)
 	}
 	c.expire = time.Now().Add(s.idleTimeout)
 	return c.send(bb, frag, payload)
 }
 
-func (s *socks5UDPServer) Listen(lg log.Log, d *dial, l *net.UDPConn, bb *buffer.Buffer) error {
+func (s *socks5UDPServer) Listen(lg log.Log, l *net.UDPConn, bb *buffer.Buffer) error {
 	defer func() {
 		for _, v := range s.clients {
 			v.close()
@@ -268,7 +276,7 @@ func (s *socks5UDPServer) Listen(lg log.Log, d *dial, l *net.UDPConn, bb *buffer
 		if !s.source.Equal(caddr.(*net.UDPAddr).IP) {
 			continue
 		}
-		e = s.dispatch(l, d, caddr.(*net.UDPAddr), b[:ll], bb)
+		e = s.dispatch(l, caddr.(*net.UDPAddr), b[:ll], bb)
 		if e == nil {
 			lg("UDP packet from %s was dispatched", caddr)
 			continue
@@ -277,7 +285,7 @@ func (s *socks5UDPServer) Listen(lg log.Log, d *dial, l *net.UDPConn, bb *buffer
 	}
 }
 
-func socks5UDP(lg log.Log, d *dial, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error {
+func socks5UDP(lg log.Log, rt *router, user string, b *buffer.Buffer, laddr *net.TCPAddr, bb []byte, atype byte, addr []byte, port uint16, r net.Conn) error {
 	l, e := net.ListenUDP("udp", &net.UDPAddr{
 		IP:   laddr.IP,
 		Port: 0,
@@ -322,9 +330,11 @@ func socks5UDP(lg log.Log, d *dial, b *buffer.Buffer, laddr *net.TCPAddr, bb []b
 	listen := socks5UDPServer{
 		idleTimeout: 60 * time.Second,
 		source:      r.RemoteAddr().(*net.TCPAddr).IP,
+		router:      rt,
+		user:        user,
 		clients:     make(map[string]*socks5UDPClient, maxSocks5UDPClients),
 		lock:        sync.Mutex{},
 		wg:          &wg,
 	}
-	return listen.Listen(lg, d, l, b)
+	return listen.Listen(lg, l, b)
 }
@@ -0,0 +1,386 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	cph "crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/dispatch"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+	"warwolf/session"
+)
+
+const (
+	requestStreamRetryDelay = 30 * time.Second
+)
+
+var (
+	ErrStreamUnavailable = errors.New("Stream: Not acknowledged in time, unsupported by the backend or buffered on the way")
+	ErrStreamRejected    = errors.New("Stream: Rejected by the backend")
+	ErrStreamEnded       = errors.New("Stream: Ended unexpectedly")
+)
+
+// streaming is the state of a stream shared by its writer and the reader of
+// its responds
+type streaming struct {
+	lock    sync.Mutex
+	cancels session.RetrieverCancels
+	acks    chan byte
+}
+
+func newStreaming() *streaming {
+	return &streaming{
+		lock:    sync.Mutex{},
+		cancels: make(session.RetrieverCancels, 256),
+		acks:    make(chan byte, 2),
+	}
+}
+
+// append tracks the request until it is responded, unless another request of
+// the same session is still waiting for its respond, in which case false is
+// returned
+func (s *streaming) append(id protocol.ID, c session.RetrieverCancel) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.cancels[id]; ok {
+		return false
+	}
+	s.cancels.Append(id, c)
+	return true
+}
+
+func (s *streaming) settle() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancels.SettleAll(ErrRequestUnresponded)
+}
+
+func (s *streaming) ack(e byte, b []byte) error {
+	if e != 0 {
+		return ErrStreamRejected
+	}
+	rsp := protocol.StreamRespond{}
+	f := reader.NewFetcher(reader.ByteFetch(b, io.EOF))
+	err := rsp.Parse(&f)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.acks <- rsp.Direction:
+	default:
+	}
+	return nil
+}
+
+func (s *streaming) acked(direction byte, down chan error, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d := <-s.acks:
+		if d != direction {
+			return ErrStreamUnavailable
+		}
+		return nil
+	case err := <-down:
+		if err == nil {
+			return ErrStreamUnavailable
+		}
+		return err
+	case <-timer.C:
+		return ErrStreamUnavailable
+	}
+}
+
+// streams sends the requests of rchan over streams opened one after another.
+// When the backend can't be streamed to, the requests are batched instead,
+// for good when streams are not acknowledged, or for a while when they fail
+func (r *requester) streams(name string, bk *backend, rchan chan request, wg *sync.WaitGroup) {
+	defer wg.Done()
+	lg := func(format string, v ...interface{}) {
+		r.lg(name+": "+format, v...)
+	}
+	for {
+		closed, err := r.stream(lg, bk, rchan, wg)
+		if closed {
+			return
+		}
+		switch err {
+		case nil:
+			continue
+		case ErrStreamUnavailable:
+			lg("Streaming to %s is unavailable, falling back to batching", bk.url)
+			r.batch(name, bk, rchan, nil)
+			return
+		}
+		r.report(bk, err)
+		lg("Stream failed: %s, batching for %s", err, requestStreamRetryDelay)
+		if !r.batch(name, bk, rchan, time.After(requestStreamRetryDelay)) {
+			return
+		}
+	}
+}
+
+// streamConn is an opened stream, w carries the requests of the transcript
+// ts and down ends when no more responds will be received. up ends when the
+// writing direction fails on its own, and is nil when it can't
+type streamConn struct {
+	w      io.Writer
+	ts     *cipher.Transcript
+	down   chan error
+	up     chan error
+	end    func()
+	cancel func()
+}
+
+// stream opens a stream and writes the requests of rchan to it as they come,
+// until its lifetime is over. The responds of the requests already written
+// are still received after that in the background. It returns true when
+// rchan is closed
+func (r *requester) stream(lg log.Log, bk *backend, rchan chan request, wg *sync.WaitGroup) (bool, error) {
+	channel := protocol.ID{}
+	_, err := io.ReadFull(rand.Reader, channel[:])
+	if err != nil {
+		return false, err
+	}
+	ss, err := r.keySession(lg, bk)
+	if err != nil {
+		return false, err
+	}
+	s := newStreaming()
+	buf := make([]byte, r.maxHTTPReqBodySize)
+	open := r.openStream
+	if bk.websocket {
+		open = r.openSocket
+	}
+	c, err := open(lg, bk, channel, ss, buf, s)
+	if err != nil {
+		return false, err
+	}
+	lg("Stream %s has been opened", channel)
+	closed, downEnded := false, false
+	lifetime := time.NewTimer(r.streamLifetime)
+	defer lifetime.Stop()
+streaming:
+	for {
+		select {
+		case rr, ok := <-rchan:
+			if !ok {
+				closed = true
+				break streaming
+			}
+			if !s.append(rr.id, rr.cancel) {
+				single := make([]byte, r.requestReqOverheadSize+rr.pusher.Size())
+				copy(single[r.requestReqPadSize:], rr.pusher.Data())
+				wg.Add(1)
+				go r.single(lg, bk, rr, single, wg)
+				continue
+			}
+			err = streamWrite(c.w, ss.Request, c.ts, buf, func(p *reader.Pusher) error {
+				_, e := p.Write(rr.pusher.Data())
+				return e
+			})
+			if err != nil {
+				break streaming
+			}
+		case <-lifetime.C:
+			break streaming
+		case err = <-c.down:
+			downEnded = true
+			if err == nil {
+				err = ErrStreamEnded
+			}
+			break streaming
+		case err = <-c.up:
+			if err == nil {
+				err = ErrStreamEnded
+			}
+			break streaming
+		}
+	}
+	if err == nil {
+		// The backend takes the requests as complete only once the final
+		// frame has been written
+		err = streamFinal(c.w, ss.Request, c.ts)
+	}
+	c.end()
+	if err != nil {
+		c.cancel()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer c.cancel()
+		if !downEnded {
+			<-c.down
+		}
+		s.settle()
+		lg("Stream %s has been closed", channel)
+	}()
+	return closed, err
+}
+
+// openStream opens a stream made of a long-lived download and a chunked
+// upload, each of them acknowledged by the backend. The upload is encrypted
+// with the session ss
+func (r *requester) openStream(lg log.Log, bk *backend, channel protocol.ID, ss *cipher.Session, buf []byte, s *streaming) (streamConn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	down := make(chan error, 1)
+	go func() {
+		down <- r.downstream(ctx, lg, bk, channel, s)
+	}()
+	err := s.acked(protocol.StreamDown, down, r.streamAckTimeout)
+	if err != nil {
+		cancel()
+		return streamConn{}, err
+	}
+	pr, pw := io.Pipe()
+	up := make(chan error, 1)
+	ts, u := bk.keys.transcript(bk.url)
+	go func() {
+		up <- r.upstream(ctx, bk, u, pr)
+	}()
+	_, err = bk.keys.writeKey(pw, ss, ts)
+	if err == nil {
+		err = streamWrite(pw, ss.Request, ts, buf, func(p *reader.Pusher) error {
+			req := protocol.StreamRequest{
+				Direction: protocol.StreamUp,
+			}
+			return req.Build(channel, p)
+		})
+	}
+	if err == nil {
+		err = s.acked(protocol.StreamUp, down, r.streamAckTimeout)
+	}
+	if err != nil {
+		pw.Close()
+		cancel()
+		return streamConn{}, err
+	}
+	return streamConn{
+		w:    pw,
+		ts:   ts,
+		down: down,
+		up:   up,
+		end: func() {
+			pw.Close()
+		},
+		cancel: cancel,
+	}, nil
+}
+
+// segment returns the handler of the segments received from a stream
+func (r *requester) segment(lg log.Log, s *streaming) func(b []byte) error {
+	return func(b []byte) error {
+		if len(b) >= protocol.HeaderSize {
+			t, e := protocol.ParseRequestType(protocol.RequestType(b[0]))
+			if t == protocol.StreamType {
+				return s.ack(e, b[protocol.HeaderSize:])
+			}
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return r.dispatch.Dispatch(func(format string, v ...interface{}) {
+			lg("Dispatch: "+format, v...)
+		}, b, &s.cancels, dispatch.Config{})
+	}
+}
+
+func streamWrite(w io.Writer, cip cph.AEAD, ts *cipher.Transcript, buf []byte, build func(p *reader.Pusher) error) error {
+	p := reader.NewPusher(buf[cipher.HeaderSize : len(buf)-cipher.BlockSize])
+	err := build(&p)
+	if err != nil {
+		return err
+	}
+	nonce, err := cipher.Nonce()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(cipher.Encrypt(cip, ts, nonce, buf[:cipher.OverheadSize+p.Size()]))
+	return err
+}
+
+// streamFinal writes the final frame, which ends the requests written to w
+func streamFinal(w io.Writer, cip cph.AEAD, ts *cipher.Transcript) error {
+	nonce, err := cipher.Nonce()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(cipher.EncryptFinal(cip, ts, nonce, make([]byte, cipher.OverheadSize)))
+	return err
+}
+
+// downstream opens the down direction of the stream, and receives the
+// responds of the stream until the backend ends it
+func (r *requester) downstream(ctx context.Context, lg log.Log, bk *backend, channel protocol.ID, s *streaming) error {
+	buf := make([]byte, r.requestReqOverheadSize+protocol.StreamRequestOverhead)
+	p := reader.NewPusher(buf[r.requestReqPadSize:])
+	req := protocol.StreamRequest{
+		Direction: protocol.StreamDown,
+		Duration:  uint16(r.maxRetryDelay / time.Second),
+	}
+	err := req.Build(channel, &p)
+	if err != nil {
+		return err
+	}
+	return exchange(ctx, lg, r.b, &bk.keys, r.nv, bk.url, func() map[string]http.Cookie {
+		return nil
+	}, func(*http.Response) {}, buf[:r.requestReqOverheadSize+p.Size()], &bk.client, r.segment(lg, s))
+}
+
+// upstream uploads the requests written to body in a chunked HTTP request
+// to u
+func (r *requester) upstream(ctx context.Context, bk *backend, u *url.URL, body io.ReadCloser) error {
+	req := http.Request{
+		Header:           http.Header{"Connection": []string{"keep-alive"}},
+		Method:           "POST",
+		URL:              u,
+		Body:             body,
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+	}
+	rsp, err := bk.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+	return nil
+}
+
+// single sends a request on its own, for when the stream is still waiting
+// for the respond to another request of the same session
+func (r *requester) single(lg log.Log, bk *backend, rr request, body []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	cancels := make(session.RetrieverCancels, 1)
+	cancels.Append(rr.id, rr.cancel)
+	err := sendRequest(context.Background(), lg, r.b, &bk.keys, r.nv, r.dispatch, bk.url, func() map[string]http.Cookie {
+		return nil
+	}, func(*http.Response) {}, body, &bk.client, &cancels, nil)
+	r.report(bk, err)
+	cancels.SettleAll(ErrRequestUnresponded)
+}
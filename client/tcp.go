@@ -0,0 +1,69 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"net"
+	"time"
+	"warwolf/buffer"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+func readInitial(r net.Conn, bb []byte) int {
+	r.SetDeadline(time.Now().Add(reqDataReadDelay))
+	l, _ := r.Read(bb[:reqDataSafeSize])
+	r.SetDeadline(time.Time{})
+	return l
+}
+
+func dialTCP(d dialer, b *buffer.Buffer, atyp protocol.AddressType, addr []byte, port uint16, bb []byte, l int, r io.ReadWriteCloser) error {
+	push := b.Request()
+	pushReturned := false
+	defer func() {
+		if pushReturned {
+			return
+		}
+		b.Return(push)
+	}()
+	p := reader.NewPusher(push[:])
+	return d.dial(atyp, addr, port, bb, l, &p, r, func() {
+		pushReturned = true
+		b.Return(push)
+		push = nil
+		p = reader.Pusher{}
+	})
+}
+
+func bindTCP(d dialer, b *buffer.Buffer, atyp protocol.AddressType, addr []byte, port uint16, bb []byte, r io.ReadWriteCloser, bound bindReport, accepted bindReport) error {
+	push := b.Request()
+	pushReturned := false
+	defer func() {
+		if pushReturned {
+			return
+		}
+		b.Return(push)
+	}()
+	p := reader.NewPusher(push[:])
+	return d.bind(atyp, addr, port, bb, &p, r, bound, accepted, func() {
+		pushReturned = true
+		b.Return(push)
+		push = nil
+		p = reader.Pusher{}
+	})
+}
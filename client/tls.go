@@ -0,0 +1,131 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	ErrTLSInvalidCA         = errors.New("TLS: No certificate found in the CA bundle")
+	ErrTLSInvalidPin        = errors.New("TLS: Pin must be the base64 encoded SHA-256 hash of a public key")
+	ErrTLSClientCertNoKey   = errors.New("TLS: Client certificate and key must be given together")
+	ErrTLSPinMismatch       = errors.New("TLS: No certificate of the backend matches the pinned public keys")
+	ErrTLSNoPeerCertificate = errors.New("TLS: Backend has presented no certificate")
+)
+
+// parseTLSPins parses the comma separated list of base64 encoded SHA-256
+// hashes of the SubjectPublicKeyInfo of the pinned public keys. The
+// "sha256/" prefix is optional
+func parseTLSPins(s string) ([][sha256.Size]byte, error) {
+	r := make([][sha256.Size]byte, 0, 2)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+		if len(p) == 0 {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return nil, ErrTLSInvalidPin
+		}
+		pin := [sha256.Size]byte{}
+		copy(pin[:], b)
+		r = append(r, pin)
+	}
+	return r, nil
+}
+
+// verifyTLSPins returns the verifier which accepts the connection when any
+// certificate presented by the backend has one of the pinned public keys.
+// It runs after the usual verification of the certificate chain
+func verifyTLSPins(pins [][sha256.Size]byte) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrTLSNoPeerCertificate
+		}
+		for _, cert := range cs.PeerCertificates {
+			h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(h[:], pin[:]) == 1 {
+					return nil
+				}
+			}
+		}
+		return ErrTLSPinMismatch
+	}
+}
+
+// newTLSConfig returns the TLS config of the connections to the backends,
+// or nil when the defaults are to be used
+func newTLSConfig(c Config) (*tls.Config, error) {
+	if len(c.BackendCA) == 0 && len(c.BackendPins) == 0 &&
+		len(c.ClientCertFile) == 0 && len(c.ClientKeyFile) == 0 {
+		return nil, nil
+	}
+	t := &tls.Config{}
+	if len(c.BackendCA) > 0 {
+		b, err := os.ReadFile(c.BackendCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, ErrTLSInvalidCA
+		}
+		t.RootCAs = pool
+	}
+	if len(c.BackendPins) > 0 {
+		pins, err := parseTLSPins(c.BackendPins)
+		if err != nil {
+			return nil, err
+		}
+		if len(pins) > 0 {
+			t.VerifyConnection = verifyTLSPins(pins)
+		}
+	}
+	if len(c.ClientCertFile) > 0 || len(c.ClientKeyFile) > 0 {
+		if len(c.ClientCertFile) == 0 || len(c.ClientKeyFile) == 0 {
+			return nil, ErrTLSClientCertNoKey
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// backendTLSConfig returns the TLS config of the connections to the backend
+// at serverName
+func backendTLSConfig(t *tls.Config, serverName string) *tls.Config {
+	if t == nil {
+		return &tls.Config{
+			ServerName: serverName,
+		}
+	}
+	c := t.Clone()
+	c.ServerName = serverName
+	return c
+}
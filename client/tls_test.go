@@ -0,0 +1,110 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSPins(t *testing.T) {
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	pins, err := parseTLSPins(" sha256/" + base64.StdEncoding.EncodeToString(a[:]) + ",," +
+		base64.StdEncoding.EncodeToString(b[:]))
+	if err != nil || len(pins) != 2 || pins[0] != a || pins[1] != b {
+		t.Errorf("Unexpected pins %v, %v", pins, err)
+	}
+	for _, s := range []string{
+		"sha256/not base64",
+		base64.StdEncoding.EncodeToString(a[:16]),
+		"sha1/" + base64.StdEncoding.EncodeToString(a[:]),
+	} {
+		if _, err := parseTLSPins(s); err != ErrTLSInvalidPin {
+			t.Errorf("%q: Expected %v, got %v", s, ErrTLSInvalidPin, err)
+		}
+	}
+}
+
+func TestVerifyTLSPins(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	pin := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other"))
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	for _, c := range []struct {
+		pins  [][sha256.Size]byte
+		match bool
+	}{
+		{[][sha256.Size]byte{pin}, true},
+		{[][sha256.Size]byte{other, pin}, true},
+		{[][sha256.Size]byte{other}, false},
+	} {
+		s := make([]string, len(c.pins))
+		for i := range c.pins {
+			s[i] = base64.StdEncoding.EncodeToString(c.pins[i][:])
+		}
+		cfg := DefaultConfig()
+		cfg.BackendPins = strings.Join(s, ",")
+		tc, err := newTLSConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc = backendTLSConfig(tc, "example.com")
+		tc.RootCAs = roots
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), tc)
+		if c.match {
+			if err != nil {
+				t.Errorf("%s: Expected a match, got %s", cfg.BackendPins, err)
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: Expected %v", cfg.BackendPins, ErrTLSPinMismatch)
+		} else if !strings.Contains(err.Error(), ErrTLSPinMismatch.Error()) {
+			t.Errorf("%s: Expected %v, got %v", cfg.BackendPins, ErrTLSPinMismatch, err)
+		}
+	}
+	if err := verifyTLSPins([][sha256.Size]byte{pin})(tls.ConnectionState{}); err != ErrTLSNoPeerCertificate {
+		t.Errorf("Expected %v, got %v", ErrTLSNoPeerCertificate, err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	c := DefaultConfig()
+	if tc, err := newTLSConfig(c); tc != nil || err != nil {
+		t.Errorf("Defaults must be used, got %v, %v", tc, err)
+	}
+	if tc := backendTLSConfig(nil, "example.com"); tc.ServerName != "example.com" {
+		t.Errorf("Unexpected server name %s", tc.ServerName)
+	}
+	c.ClientCertFile = "client.crt"
+	if _, err := newTLSConfig(c); err != ErrTLSClientCertNoKey {
+		t.Errorf("Expected %v, got %v", ErrTLSClientCertNoKey, err)
+	}
+}
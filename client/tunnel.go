@@ -0,0 +1,286 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"warwolf/buffer"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+var (
+	ErrTunnelUnsupportedNetwork = errors.New("Tunnel: Network must be tcp or udp")
+	ErrTunnelInvalidAddress     = errors.New("Tunnel: Address must be in host:port form")
+	ErrTunnelClosed             = errors.New("Tunnel: Closed")
+	ErrTunnelDatagramTooLarge   = errors.New("Tunnel: Datagram is too large")
+)
+
+// Logger is what the Tunnel logs to. The *log.Logger of the standard
+// library is one
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// tunnelAddr is the address of the destination of a tunneled connection,
+// as it was given to DialContext
+type tunnelAddr struct {
+	network string
+	addr    string
+}
+
+func (a tunnelAddr) Network() string { return a.network }
+func (a tunnelAddr) String() string  { return a.addr }
+
+// tunnelConn is the end of a tunneled connection handed to the caller
+type tunnelConn struct {
+	net.Conn
+	remote tunnelAddr
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// tunnelPacketConn is a tunneled UDP connection. Each Read returns one
+// datagram, which is truncated when b is shorter, just like a UDP socket
+type tunnelPacketConn struct {
+	tunnelConn
+	lock sync.Mutex
+	buf  []byte
+	max  int
+}
+
+// tunnelMaxDatagram returns the size of the largest datagram which is sent
+// in one piece, as the data read from the connection is sent as it's read
+func tunnelMaxDatagram(maxSendLen uint16) int {
+	max := reqDataSize - protocol.SendHeaderOverhead
+	if max > int(maxSendLen) {
+		max = int(maxSendLen)
+	}
+	return max
+}
+
+func (c *tunnelPacketConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Every Write on the other end of the pipe is read at once as long as
+	// the buffer is large enough, so one read is one datagram
+	n, err := c.tunnelConn.Read(c.buf)
+	return copy(b, c.buf[:n]), err
+}
+
+// Write sends b as one datagram. A datagram larger than the sends to the
+// backend would be split into several, so it's refused like a UDP socket
+// refuses one larger than it can send
+func (c *tunnelPacketConn) Write(b []byte) (int, error) {
+	if len(b) > c.max {
+		return 0, ErrTunnelDatagramTooLarge
+	}
+	return c.tunnelConn.Write(b)
+}
+
+// Tunnel dials connections through the backend without a local proxy in
+// between, for programs which embed the client. DialContext fits into an
+// http.Transport, a gRPC dialer and the like
+type Tunnel struct {
+	dial   *dial
+	buffer *buffer.Buffer
+	stop   func()
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewTunnel starts the Tunnel to the Backend of the config c, which logs to
+// l. Only the options of the tunnel itself are used, the local proxy and the
+// Forwards, Reverses, Backends and Rules are left out
+func NewTunnel(c Config, l Logger) (*Tunnel, error) {
+	err := c.verifyTunnel()
+	if err != nil {
+		return nil, err
+	}
+	targets, err := parseBackendTargets(c.Backend, c.backendPositions())
+	if err != nil {
+		return nil, err
+	}
+	if c.defaultSalt() {
+		l.Printf(keysDefaultSaltNotice)
+	}
+	buf := buffer.New(reqDataSize, c.MaxClientConnections)
+	d, stop := startTunnel(func(format string, v ...interface{}) {
+		l.Printf(format, v...)
+	}, &buf, targets, c)
+	return &Tunnel{
+		dial:   d,
+		buffer: &buf,
+		stop:   stop,
+		lock:   sync.Mutex{},
+		conns:  make(map[net.Conn]struct{}, 128),
+		closed: false,
+		wg:     sync.WaitGroup{},
+	}, nil
+}
+
+func tunnelRemote(network, address string) (protocol.AddressType, []byte, uint16, error) {
+	atyp := protocol.TCPHost
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		atyp = protocol.UDPHost
+	default:
+		return 0, nil, 0, ErrTunnelUnsupportedNetwork
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || len(host) == 0 || len(host) > 255 {
+		return 0, nil, 0, ErrTunnelInvalidAddress
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return 0, nil, 0, ErrTunnelInvalidAddress
+	}
+	return atyp, []byte(host), uint16(p), nil
+}
+
+// DialContext connects to address through the backend. network is either
+// "tcp" or "udp", or one of their "4" and "6" variants, which are dialed
+// the same way since the backend resolves address. It returns once the
+// backend has connected to address, or ctx is done
+func (t *Tunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atyp, addr, port, err := tunnelRemote(network, address)
+	if err != nil {
+		return nil, err
+	}
+	local, hosted := net.Pipe()
+	var conn net.Conn = &tunnelConn{
+		Conn:   local,
+		remote: tunnelAddr{network: network, addr: address},
+	}
+	if atyp == protocol.UDPHost {
+		conn = &tunnelPacketConn{
+			tunnelConn: tunnelConn{
+				Conn:   local,
+				remote: tunnelAddr{network: network, addr: address},
+			},
+			lock: sync.Mutex{},
+			buf:  make([]byte, reqDataSize),
+			max:  tunnelMaxDatagram(t.dial.maxRetrieveLen),
+		}
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil, ErrTunnelClosed
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	t.lock.Unlock()
+	dialed := make(chan error, 1)
+	go func() {
+		defer func() {
+			hosted.Close()
+			t.lock.Lock()
+			delete(t.conns, conn)
+			t.lock.Unlock()
+			t.wg.Done()
+		}()
+		t.serve(atyp, addr, port, hosted, dialed)
+	}()
+	select {
+	case err = <-dialed:
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case <-ctx.Done():
+		// The dial carries on until it fails or succeeds, then finds the
+		// connection closed
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// serve dials address like dialTCP does, but reports the result of the
+// dial to dialed before serving the connection
+func (t *Tunnel) serve(atyp protocol.AddressType, addr []byte, port uint16, hosted io.ReadWriteCloser, dialed chan<- error) {
+	req := t.buffer.Request()
+	defer t.buffer.Return(req)
+	push := t.buffer.Request()
+	pushReturned := false
+	defer func() {
+		if pushReturned {
+			return
+		}
+		t.buffer.Return(push)
+	}()
+	p := reader.NewPusher(push[:])
+	rr := protocol.DialRequest{
+		ID:             protocol.ID{},
+		ATyp:           atyp,
+		Addr:           addr,
+		Port:           port,
+		MaxRetrieveLen: t.dial.maxRetrieveLen,
+		Request:        req[:0],
+		RequestLength:  0,
+	}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ret, err := t.dial.requester.dial(rr, &p, t.dial.retriever(hosted, &wg), nil, func() {
+		pushReturned = true
+		t.buffer.Return(push)
+		push = nil
+		p = reader.Pusher{}
+	})
+	dialed <- err
+	if err != nil {
+		return
+	}
+	ret.Serve(req)
+}
+
+// Buffering returns the counters of the responses of each backend which
+// have been checked for buffering, see the Buffering option
+func (t *Tunnel) Buffering() []BufferingStats {
+	return t.dial.requester.buffering()
+}
+
+// Close closes every connection dialed by the Tunnel, waits for them to
+// wind down and stops the Tunnel, which can't be used after
+func (t *Tunnel) Close() error {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil
+	}
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.lock.Unlock()
+	// Sessions still retrieving must be gone before the requester is
+	// stopped, or they would send to it once it's stopped
+	t.wg.Wait()
+	t.stop()
+	return nil
+}
@@ -0,0 +1,73 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"warwolf/protocol"
+)
+
+func TestTunnelPacketConn(t *testing.T) {
+	local, hosted := net.Pipe()
+	defer hosted.Close()
+	max := tunnelMaxDatagram(1024)
+	c := &tunnelPacketConn{
+		tunnelConn: tunnelConn{
+			Conn:   local,
+			remote: tunnelAddr{network: "udp", addr: "127.0.0.1:53"},
+		},
+		lock: sync.Mutex{},
+		buf:  make([]byte, reqDataSize),
+		max:  max,
+	}
+	defer c.Close()
+	if max != 1024 {
+		t.Errorf("Datagram must fit the sends, got %d", max)
+	}
+	if m := tunnelMaxDatagram(65535); m != reqDataSize-protocol.SendHeaderOverhead {
+		t.Errorf("Datagram must fit the buffer, got %d", m)
+	}
+	// The sends read the datagrams just like dialedConn does
+	sent := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, max)
+		n, _ := hosted.Read(b)
+		sent <- b[:n]
+	}()
+	d := bytes.Repeat([]byte{'A'}, max)
+	n, err := c.Write(d)
+	if err != nil || n != max {
+		t.Errorf("Datagram must be sent, got %d, %v", n, err)
+		return
+	}
+	if got := <-sent; !bytes.Equal(got, d) {
+		t.Errorf("Datagram must be sent in one piece, got %d bytes", len(got))
+	}
+	n, err = c.Write(append(d, 'B'))
+	if err != ErrTunnelDatagramTooLarge || n != 0 {
+		t.Errorf("Expected %s, got %d, %v", ErrTunnelDatagramTooLarge, n, err)
+	}
+	go hosted.Write([]byte("Reply"))
+	b := make([]byte, 3)
+	n, err = c.Read(b)
+	if err != nil || string(b[:n]) != "Rep" {
+		t.Errorf("Datagram must be truncated to b, got %q, %v", b[:n], err)
+	}
+}
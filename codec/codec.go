@@ -0,0 +1,357 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	CarrierBody   = "body"
+	CarrierQuery  = "query"
+	CarrierCookie = "cookie"
+
+	EncodingBinary = "binary"
+	EncodingBase64 = "base64"
+	EncodingJSON   = "json"
+
+	contentTypeBinary = "application/octet-stream"
+	contentTypeBase64 = "text/plain"
+	contentTypeJSON   = "application/json"
+
+	chunkPrefix = "d"
+	chunkSize   = 2048 // Multiple of 4, so every chunk decodes on its own
+	jsonKey     = "d"
+)
+
+var (
+	ErrInvalidCarrier  = errors.New("Codec: Carrier must be one of body, query or cookie")
+	ErrInvalidEncoding = errors.New("Codec: Encoding must be one of binary, base64 or json")
+	ErrChunkTooLarge   = errors.New("Codec: Carried data is too large")
+	ErrInvalidChunk    = errors.New("Codec: Invalid chunk")
+	ErrInvalidEnvelope = errors.New("Codec: Invalid JSON envelope")
+)
+
+// VerifyCarrier returns an error when c is not a known carrier. Empty stands
+// for the body
+func VerifyCarrier(c string) error {
+	switch c {
+	case "", CarrierBody, CarrierQuery, CarrierCookie:
+		return nil
+	}
+	return ErrInvalidCarrier
+}
+
+// VerifyEncoding returns an error when e is not a known encoding. Empty
+// stands for binary
+func VerifyEncoding(e string) error {
+	switch e {
+	case "", EncodingBinary, EncodingBase64, EncodingJSON:
+		return nil
+	}
+	return ErrInvalidEncoding
+}
+
+func chunkName(i int) string {
+	return chunkPrefix + strconv.Itoa(i)
+}
+
+func chunks(b []byte, each func(name string, value string)) {
+	s := base64.RawURLEncoding.EncodeToString(b)
+	for i := 0; len(s) > 0; i++ {
+		l := chunkSize
+		if l > len(s) {
+			l = len(s)
+		}
+		each(chunkName(i), s[:l])
+		s = s[l:]
+	}
+}
+
+// Carry moves b into req as carried by c, which turns req into a GET request
+// unless c is the body
+func Carry(req *http.Request, c string, b []byte) {
+	switch c {
+	case CarrierQuery:
+		q := req.URL.Query()
+		chunks(b, func(name string, value string) {
+			q.Set(name, value)
+		})
+		req.URL.RawQuery = q.Encode()
+	case CarrierCookie:
+		chunks(b, func(name string, value string) {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		})
+	default:
+		return
+	}
+	req.Method = "GET"
+	req.Body = http.NoBody
+	req.GetBody = nil
+	req.ContentLength = 0
+}
+
+// Carried decodes the data carried in the URL query or the cookies of r
+// into dst. It returns false when r carries nothing
+func Carried(r *http.Request, dst []byte) (int, bool, error) {
+	var get func(name string) (string, bool)
+	q := r.URL.Query()
+	if _, ok := q[chunkName(0)]; ok {
+		get = func(name string) (string, bool) {
+			v, ok := q[name]
+			if !ok || len(v) != 1 {
+				return "", false
+			}
+			return v[0], true
+		}
+	} else if _, err := r.Cookie(chunkName(0)); err == nil {
+		get = func(name string) (string, bool) {
+			c, err := r.Cookie(name)
+			if err != nil {
+				return "", false
+			}
+			return c.Value, true
+		}
+	} else {
+		return 0, false, nil
+	}
+	n := 0
+	for i := 0; ; i++ {
+		v, ok := get(chunkName(i))
+		if !ok {
+			return n, true, nil
+		}
+		if len(v) > chunkSize {
+			return n, true, ErrInvalidChunk
+		}
+		if base64.RawURLEncoding.DecodedLen(len(v)) > len(dst)-n {
+			return n, true, ErrChunkTooLarge
+		}
+		l, err := base64.RawURLEncoding.Decode(dst[n:], []byte(v))
+		if err != nil {
+			return n, true, ErrInvalidChunk
+		}
+		n += l
+	}
+}
+
+// Accept returns the Accept header which asks for the encoding e
+func Accept(e string) string {
+	switch e {
+	case EncodingBase64:
+		return contentTypeBase64
+	case EncodingJSON:
+		return contentTypeJSON
+	}
+	return contentTypeBinary
+}
+
+// Negotiate returns the encoding asked for by the Accept header. Anything
+// but an exact ask is answered in binary
+func Negotiate(accept string) string {
+	switch accept {
+	case contentTypeBase64:
+		return EncodingBase64
+	case contentTypeJSON:
+		return EncodingJSON
+	}
+	return EncodingBinary
+}
+
+// ContentType returns the Content-Type of the encoding e
+func ContentType(e string) string {
+	switch e {
+	case EncodingBase64:
+		return contentTypeBase64 + "; charset=utf-8"
+	case EncodingJSON:
+		return contentTypeJSON
+	}
+	return contentTypeBinary
+}
+
+// Writer encodes every Write as one piece of the respond. Close must be
+// called once all is written, to complete the JSON envelope
+type Writer struct {
+	w        io.Writer
+	encoding string
+	written  bool
+	buf      []byte
+}
+
+func NewWriter(w io.Writer, e string) *Writer {
+	return &Writer{
+		w:        w,
+		encoding: e,
+	}
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	var err error
+	switch w.encoding {
+	case EncodingBase64:
+		w.buf = base64.StdEncoding.AppendEncode(w.buf[:0], b)
+		w.buf = append(w.buf, '\n')
+		_, err = w.w.Write(w.buf)
+	case EncodingJSON:
+		w.buf = w.buf[:0]
+		if !w.written {
+			w.buf = append(w.buf, `{"`+jsonKey+`":[`...)
+		} else {
+			w.buf = append(w.buf, ',')
+		}
+		w.buf = append(w.buf, '"')
+		w.buf = base64.StdEncoding.AppendEncode(w.buf, b)
+		w.buf = append(w.buf, '"')
+		_, err = w.w.Write(w.buf)
+	default:
+		_, err = w.w.Write(b)
+	}
+	w.written = true
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush flushes the underlying writer when it can be
+func (w *Writer) Flush() {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *Writer) Close() error {
+	if w.encoding != EncodingJSON {
+		return nil
+	}
+	var err error
+	if !w.written {
+		_, err = io.WriteString(w.w, `{"`+jsonKey+`":[]}`)
+	} else {
+		_, err = io.WriteString(w.w, "]}")
+	}
+	w.written = true
+	return err
+}
+
+// NewReader returns the reader of the data encoded in r according to the
+// Content-Type of the respond
+func NewReader(r io.Reader, contentType string) io.Reader {
+	t, _, _ := mime.ParseMediaType(contentType)
+	switch t {
+	case contentTypeBase64:
+		return &base64Reader{r: bufio.NewReader(r)}
+	case contentTypeJSON:
+		return &jsonReader{d: json.NewDecoder(r)}
+	}
+	return r
+}
+
+type base64Reader struct {
+	r       *bufio.Reader
+	decoded []byte
+	pending []byte
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		line, err := b.r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			var derr error
+			b.decoded, derr = base64.StdEncoding.AppendDecode(b.decoded[:0], line)
+			if derr != nil {
+				return 0, derr
+			}
+			b.pending = b.decoded
+		}
+		if err != nil && len(b.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+type jsonReader struct {
+	d       *json.Decoder
+	opened  bool
+	closed  bool
+	decoded []byte
+	pending []byte
+}
+
+// open reads the tokens which open the envelope
+func (j *jsonReader) open() error {
+	for _, expected := range []json.Token{json.Delim('{'), jsonKey, json.Delim('[')} {
+		t, err := j.d.Token()
+		if err != nil {
+			return err
+		}
+		if t != expected {
+			return ErrInvalidEnvelope
+		}
+	}
+	return nil
+}
+
+func (j *jsonReader) Read(p []byte) (int, error) {
+	if !j.opened {
+		j.opened = true
+		err := j.open()
+		if err != nil {
+			j.closed = true
+			return 0, err
+		}
+	}
+	for len(j.pending) == 0 {
+		if j.closed {
+			return 0, io.EOF
+		}
+		t, err := j.d.Token()
+		if err != nil {
+			return 0, err
+		}
+		switch v := t.(type) {
+		case json.Delim:
+			if v != ']' {
+				return 0, ErrInvalidEnvelope
+			}
+			j.closed = true
+		case string:
+			j.decoded, err = base64.StdEncoding.AppendDecode(j.decoded[:0], []byte(v))
+			if err != nil {
+				return 0, err
+			}
+			j.pending = j.decoded
+		default:
+			return 0, ErrInvalidEnvelope
+		}
+	}
+	n := copy(p, j.pending)
+	j.pending = j.pending[n:]
+	return n, nil
+}
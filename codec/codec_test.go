@@ -0,0 +1,123 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestCarry(t *testing.T) {
+	data := bytes.Repeat([]byte{0, 1, 2, 253, 254, 255}, 2000)
+	for _, c := range []string{CarrierQuery, CarrierCookie} {
+		req, err := http.NewRequest("POST", "http://example.com/path?a=b", bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		Carry(req, c, data)
+		if req.Method != "GET" || req.ContentLength != 0 {
+			t.Errorf("%s: Request is not turned into GET", c)
+			return
+		}
+		// Sent and received, to see it survive the wire
+		b := bytes.NewBuffer(nil)
+		err = req.Write(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rreq, err := http.ReadRequest(bufio.NewReader(b))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if rreq.URL.Query().Get("a") != "b" {
+			t.Errorf("%s: Query is lost", c)
+			return
+		}
+		dst := make([]byte, len(data))
+		n, ok, err := Carried(rreq, dst)
+		if !ok || err != nil {
+			t.Errorf("%s: Carried data is not found: %v", c, err)
+			return
+		}
+		if !bytes.Equal(dst[:n], data) {
+			t.Errorf("%s: Invalid carried data", c)
+			return
+		}
+		_, _, err = Carried(rreq, dst[:len(data)-1])
+		if err != ErrChunkTooLarge {
+			t.Errorf("%s: Expected %s, got %v", c, ErrChunkTooLarge, err)
+			return
+		}
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	_, ok, _ := Carried(req, make([]byte, 16))
+	if ok {
+		t.Error("Nothing should be carried")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	pieces := [][]byte{
+		[]byte("ABC"),
+		bytes.Repeat([]byte{0, 255, '\n', '"'}, 10000),
+		[]byte("D"),
+	}
+	expected := bytes.Join(pieces, nil)
+	for _, e := range []string{EncodingBinary, EncodingBase64, EncodingJSON} {
+		b := bytes.NewBuffer(nil)
+		w := NewWriter(b, e)
+		for _, p := range pieces {
+			n, err := w.Write(p)
+			if err != nil || n != len(p) {
+				t.Errorf("%s: Write failed: %v", e, err)
+				return
+			}
+		}
+		w.Close()
+		r, err := ioutil.ReadAll(NewReader(b, ContentType(e)))
+		if err != nil {
+			t.Errorf("%s: Read failed: %s", e, err)
+			return
+		}
+		if !bytes.Equal(r, expected) {
+			t.Errorf("%s: Invalid data", e)
+			return
+		}
+		if Negotiate(Accept(e)) != e {
+			t.Errorf("%s: Not negotiated", e)
+			return
+		}
+	}
+	b := bytes.NewBuffer(nil)
+	NewWriter(b, EncodingJSON).Close()
+	r, err := ioutil.ReadAll(NewReader(b, ContentType(EncodingJSON)))
+	if err != nil || len(r) != 0 {
+		t.Errorf("Invalid empty envelope: %v", err)
+		return
+	}
+	_, err = ioutil.ReadAll(NewReader(bytes.NewBufferString(`{"x":[]}`), ContentType(EncodingJSON)))
+	if err != ErrInvalidEnvelope {
+		t.Errorf("Expected %s, got %v", ErrInvalidEnvelope, err)
+		return
+	}
+}
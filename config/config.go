@@ -77,6 +77,26 @@ func LoadUint16Default(name string, def uint16) uint16 {
 	return def
 }
 
+func LoadUint32(name string) uint32 {
+	v := LoadString(name)
+	if len(v) == 0 {
+		return 0
+	}
+	vv, e := strconv.ParseUint(v, 10, 32)
+	if e != nil {
+		return 0
+	}
+	return uint32(vv)
+}
+
+func LoadUint32Default(name string, def uint32) uint32 {
+	v := LoadUint32(name)
+	if v != 0 {
+		return v
+	}
+	return def
+}
+
 func LoadTimeDuration(name string) time.Duration {
 	v := LoadString(name)
 	if len(v) == 0 {
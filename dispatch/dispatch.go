@@ -18,6 +18,7 @@ package dispatch
 
 import (
 	"errors"
+	"net"
 	"sync"
 	"warwolf/log"
 	"warwolf/protocol"
@@ -32,6 +33,9 @@ var (
 
 type Config struct {
 	MaxRetrieveLen int
+	LocalAddr      net.Addr
+	Timing         *Timing
+	Timed          func(rsp protocol.TimingRespond)
 }
 
 type Handler func(lg log.Log, typ byte, d byte, r *reader.Fetcher, p Pusher, wg *sync.WaitGroup, retrieverCancels *session.RetrieverCancels, c *Config) error
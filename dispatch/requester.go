@@ -41,6 +41,57 @@ func (r *Requester) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		return err
 
+	case protocol.BindType:
+		lg("Bind respond received")
+		rsp := protocol.BindRespond{}
+		err := rsp.Parse(rr)
+		if err != nil {
+			lg("Invalid bind respond: %s", err)
+			return err
+		}
+		return r.retrievers.Bound(rData, &rsp, retrieverCancels)
+
+	case protocol.AcceptType:
+		lg("Accept respond received")
+		rsp := protocol.AcceptRespond{}
+		err := rsp.Parse(rr, func(d *protocol.AcceptRespond, rr *reader.Fetcher) error {
+			return r.retrievers.Accepted(rData, d, rr, retrieverCancels)
+		})
+		if err != nil {
+			lg("Invalid accept respond: %s", err)
+		}
+		return err
+
+	case protocol.ListenType:
+		lg("Listen respond received")
+		rsp := protocol.ListenRespond{}
+		err := rsp.Parse(rr)
+		if err != nil {
+			lg("Invalid listen respond: %s", err)
+			return err
+		}
+		return r.retrievers.Listened(rData, &rsp, retrieverCancels)
+
+	case protocol.IncomingType:
+		lg("Incoming respond received")
+		rsp := protocol.IncomingRespond{}
+		err := rsp.Parse(rr)
+		if err != nil {
+			lg("Invalid incoming respond: %s", err)
+			return err
+		}
+		return r.retrievers.Arrived(rData, &rsp, retrieverCancels)
+
+	case protocol.MultipathType:
+		lg("Multipath respond received")
+		rsp := protocol.MultipathRespond{}
+		err := rsp.Parse(rr)
+		if err != nil {
+			lg("Invalid multipath respond: %s", err)
+			return err
+		}
+		return r.retrievers.Multipathed(rData, &rsp, retrieverCancels)
+
 	case protocol.RetrieveType:
 		lg("Retrieve respond received")
 		rsp := protocol.RetrieveRespond{}
@@ -63,6 +114,27 @@ func (r *Requester) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		return err
 
+	case protocol.SubscribeType:
+		lg("Subscribe respond received")
+		rsp := protocol.SubscribeRespond{}
+		err := rsp.Parse(rr)
+		if err != nil {
+			lg("Invalid subscribe respond: %s", err)
+			return err
+		}
+		return r.retrievers.Subscribed(rData, &rsp, retrieverCancels)
+
+	case protocol.PushType:
+		lg("Push respond received")
+		rsp := protocol.PushRespond{}
+		err := rsp.Parse(rr, func(d *protocol.PushRespond, rr *reader.Fetcher) error {
+			return r.retrievers.Pushed(rData, d, rr)
+		})
+		if err != nil {
+			lg("Invalid push respond: %s", err)
+		}
+		return err
+
 	case protocol.SendType:
 		lg("Send respond received")
 		rsp := protocol.SendRespond{}
@@ -73,6 +145,18 @@ func (r *Requester) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		return r.retrievers.Sent(rData, &rsp, retrieverCancels)
 
+	case protocol.TimingType:
+		rsp := protocol.TimingRespond{}
+		err := rsp.Parse(rr)
+		if err != nil {
+			lg("Invalid timing respond: %s", err)
+			return err
+		}
+		if c.Timed != nil {
+			c.Timed(rsp)
+		}
+		return nil
+
 	case protocol.CloseType:
 		lg("Close respond received")
 		rsp := protocol.CloseRespond{}
@@ -88,8 +172,8 @@ func (r *Requester) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 	}
 }
 
-func (r *Requester) Dispatch(lg log.Log, req []byte, retrieverCancels *session.RetrieverCancels) error {
-	return dispatch(lg, req, r.handle, nil, nil, false, retrieverCancels, Config{})
+func (r *Requester) Dispatch(lg log.Log, req []byte, retrieverCancels *session.RetrieverCancels, c Config) error {
+	return dispatch(lg, req, r.handle, nil, nil, false, retrieverCancels, c)
 }
 
 func NewRequester(retrievers *session.Retrievers) Requester {
@@ -17,8 +17,10 @@
 package dispatch
 
 import (
+	"io"
 	"net"
 	"sync"
+	"time"
 	"warwolf/buffer"
 	"warwolf/log"
 	"warwolf/protocol"
@@ -28,10 +30,11 @@ import (
 )
 
 type Responder struct {
-	sessions *session.Sessions
-	laddr    net.Addr
-	rconfig  relay.Config
-	buffer   *buffer.Buffer
+	sessions    *session.Sessions
+	laddr       net.Addr
+	rconfig     relay.Config
+	buffer      *buffer.Buffer
+	listenPorts func(port uint16) bool
 }
 
 func NewResponder(
@@ -39,12 +42,14 @@ func NewResponder(
 	laddr net.Addr,
 	rconfig relay.Config,
 	buffer *buffer.Buffer,
+	listenPorts func(port uint16) bool,
 ) Responder {
 	return Responder{
-		sessions: sessions,
-		laddr:    laddr,
-		rconfig:  rconfig,
-		buffer:   buffer,
+		sessions:    sessions,
+		laddr:       laddr,
+		rconfig:     rconfig,
+		buffer:      buffer,
+		listenPorts: listenPorts,
 	}
 }
 
@@ -73,6 +78,116 @@ func (r *Responder) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		return err
 
+	case protocol.BindType:
+		req := protocol.BindRequest{}
+		err := req.Parse(protocol.AddressType(rData), rr)
+		if err != nil {
+			lg("Invalid bind request: %s", err)
+			return err
+		}
+		lg("%s: Bind", req.ID)
+		laddr := r.laddr
+		if a, ok := c.LocalAddr.(*net.TCPAddr); ok {
+			laddr = &net.TCPAddr{IP: a.IP, Zone: a.Zone}
+		}
+		r.sessions.Bind(&req, laddr, r.rconfig, r.buffer, func(rerrcode byte, rsp protocol.BindRespond) {
+			rerr := pp(func(p *reader.Pusher) error {
+				return rsp.Build(req.ID, rerrcode, p)
+			})
+			if rerr != nil {
+				lg("%s: Bind: Error: %s", req.ID, rerr)
+			} else {
+				lg("%s: Bind: Successful(%d)", req.ID, rerrcode)
+			}
+		})
+		return nil
+
+	case protocol.AcceptType:
+		req := protocol.AcceptRequest{}
+		err := req.Parse(rr)
+		if err != nil {
+			lg("Invalid accept request: %s", err)
+			return err
+		}
+		lg("%s: Accept request", req.ID)
+		wg.Add(1)
+		r.sessions.Accept(req, c.Timing.wait(r.rconfig.RetrieveTimeout), func(rerrcode byte, rsp protocol.AcceptRespond) {
+			defer wg.Done()
+			rerr := pp(func(p *reader.Pusher) error {
+				return rsp.Build(req.ID, rerrcode, p)
+			})
+			if rerr != nil {
+				lg("%s: Accept request: Error %s", req.ID, rerr)
+			} else {
+				lg("%s: Accept request: Responded(%d)", req.ID, rerrcode)
+			}
+		}, c.MaxRetrieveLen)
+		return nil
+
+	case protocol.ListenType:
+		req := protocol.ListenRequest{}
+		err := req.Parse(rr)
+		if err != nil {
+			lg("Invalid listen request: %s", err)
+			return err
+		}
+		lg("%s: Listen on port %d", req.ID, req.Port)
+		r.sessions.Listen(&req, r.laddr, r.listenPorts, r.rconfig, r.buffer, func(rerrcode byte, rsp protocol.ListenRespond) {
+			rerr := pp(func(p *reader.Pusher) error {
+				return rsp.Build(req.ID, rerrcode, p)
+			})
+			if rerr != nil {
+				lg("%s: Listen: Error: %s", req.ID, rerr)
+			} else {
+				lg("%s: Listen: Successful(%d)", req.ID, rerrcode)
+			}
+		})
+		return nil
+
+	case protocol.IncomingType:
+		req := protocol.IncomingRequest{}
+		err := req.Parse(rr)
+		if err != nil {
+			lg("Invalid incoming request: %s", err)
+			return err
+		}
+		lg("%s: Incoming request", req.ID)
+		wg.Add(1)
+		r.sessions.Incoming(req, c.Timing.wait(r.rconfig.RetrieveTimeout), r.rconfig, r.buffer, func(rerrcode byte, rsp protocol.IncomingRespond) {
+			defer wg.Done()
+			rerr := pp(func(p *reader.Pusher) error {
+				return rsp.Build(req.ID, rerrcode, p)
+			})
+			if rerr != nil {
+				lg("%s: Incoming request: Error %s", req.ID, rerr)
+			} else {
+				lg("%s: Incoming request: Responded(%d)", req.ID, rerrcode)
+			}
+		})
+		return nil
+
+	case protocol.MultipathType:
+		req := protocol.MultipathRequest{}
+		err := req.Parse(protocol.AddressType(rData), rr)
+		if err != nil {
+			lg("Invalid multipath request: %s", err)
+			return err
+		}
+		lg("%s: Multipath", req.ID)
+		wg.Add(1)
+		r.sessions.Multipath(&req, r.laddr, r.rconfig, r.buffer, func(rerrcode byte, rsp protocol.MultipathRespond) {
+			defer wg.Done()
+			rerr := pp(func(p *reader.Pusher) error {
+				return rsp.Build(req.ID, rerrcode, p)
+			})
+			if rerr != nil {
+				lg("%s: Multipath: Error: %s", req.ID, rerr)
+			} else {
+				lg("%s: Multipath: Successful(%d)", req.ID, rerrcode)
+			}
+		})
+		return nil
+
 	case protocol.RetrieveType:
 		req := protocol.RetrieveRequest{}
 		err := req.Parse(rr)
@@ -82,11 +197,15 @@ func (r *Responder) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		lg("%s: Retrieve request", req.ID)
 		wg.Add(1)
-		r.sessions.Retrieve(req, func(rerrcode byte, rsp protocol.RetrieveRespond) {
+		t := c.Timing
+		r.sessions.Retrieve(req, t.retrieveHold(), func(rerrcode byte, rsp protocol.RetrieveRespond) {
 			defer wg.Done()
 			rerr := pp(func(p *reader.Pusher) error {
 				return rsp.Build(req.ID, rerrcode, p)
 			})
+			if rerr == nil {
+				t.deliver(len(rsp.Payload))
+			}
 			if rerr != nil {
 				lg("%s: Retrieve request: Error %s", req.ID, rerr)
 			} else {
@@ -104,11 +223,15 @@ func (r *Responder) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		lg("%s: Resume request", req.ID)
 		wg.Add(1)
-		r.sessions.Resume(req, func(rerrcode byte, rsp protocol.ResumeRespond) {
+		t := c.Timing
+		r.sessions.Resume(req, t.retrieveHold(), func(rerrcode byte, rsp protocol.ResumeRespond) {
 			defer wg.Done()
 			rerr := pp(func(p *reader.Pusher) error {
 				return rsp.Build(req.ID, rerrcode, p)
 			})
+			if rerr == nil {
+				t.deliver(len(rsp.Payload))
+			}
 			if rerr != nil {
 				lg("%s: Resume request: Error %s", req.ID, rerr)
 			} else {
@@ -139,6 +262,64 @@ func (r *Responder) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 		}
 		return err
 
+	case protocol.SubscribeType:
+		req := protocol.SubscribeRequest{}
+		err := req.Parse(rr)
+		if err != nil {
+			lg("Invalid subscribe request: %s", err)
+			return err
+		}
+		lg("%s: Subscribe to %s", req.ID, req.Channel)
+		rerrcode, rsp := r.sessions.Subscribe(req, c.MaxRetrieveLen)
+		err = pp(func(p *reader.Pusher) error {
+			return rsp.Build(req.ID, rerrcode, p)
+		})
+		if err != nil {
+			lg("%s: Subscribe: Error: %s", req.ID, err)
+		} else {
+			lg("%s: Subscribe: Responded(%d)", req.ID, rerrcode)
+		}
+		return err
+
+	case protocol.PushType:
+		req := protocol.PushRequest{}
+		err := req.Parse(rr)
+		if err != nil {
+			lg("Invalid push request: %s", err)
+			return err
+		}
+		lg("%s: Push stream", req.Channel)
+		r.sessions.Push(req, time.Duration(req.Duration)*time.Second, func(rerrcode byte, rsp protocol.PushRespond) error {
+			rerr := pp(func(p *reader.Pusher) error {
+				return rsp.Build(rsp.ID, rerrcode, p)
+			})
+			if rerr != nil {
+				lg("%s: Push stream: Error: %s", req.Channel, rerr)
+			} else {
+				lg("%s: Push stream: %s: Pushed(%d)", req.Channel, rsp.ID, rerrcode)
+			}
+			return rerr
+		})
+		lg("%s: Push stream: Ended", req.Channel)
+		return nil
+
+	case protocol.TimingType:
+		req := protocol.TimingRequest{}
+		err := req.Parse(rr)
+		if err != nil {
+			lg("Invalid timing request: %s", err)
+			return err
+		}
+		if c.Timing == nil {
+			// Streamed responses are not marked
+			return nil
+		}
+		c.Timing.request(req)
+		if c.Timing.held() {
+			lg("Timing: Held for up to %s", c.Timing.hold)
+		}
+		return c.Timing.mark(lg, pp)
+
 	case protocol.CloseType:
 		req := protocol.CloseRequest{}
 		err := req.Parse(rr)
@@ -163,8 +344,27 @@ func (r *Responder) handle(lg log.Log, rType byte, rData byte, rr *reader.Fetche
 	}
 }
 
+// Join serves p as a path of a multipath session, the connection which
+// carried the JoinRequest is handed over as p
+func (r *Responder) Join(lg log.Log, req protocol.JoinRequest, p io.ReadWriteCloser, rbuf []byte) {
+	lg("%s: Join", req.ID)
+	rerrcode := r.sessions.Join(req, p, rbuf)
+	lg("%s: Join: Left(%d)", req.ID, rerrcode)
+}
+
+// Dispatch dispatches the requests in req and waits for all of them to be
+// responded. The response is marked as it ends when c.Timing is asked to
 func (r *Responder) Dispatch(lg log.Log, req []byte, p Pusher, c Config) error {
 	wg := sync.WaitGroup{}
-	defer wg.Wait()
-	return dispatch(lg, req, r.handle, p, &wg, true, nil, c)
+	err := dispatch(lg, req, r.handle, p, &wg, true, nil, c)
+	wg.Wait()
+	c.Timing.end(lg, p)
+	return err
+}
+
+// DispatchAsync is Dispatch without waiting for the handlers which respond
+// later, they are tracked by wg instead. The stream transport uses it so a
+// request waiting for data won't hold up the requests following it
+func (r *Responder) DispatchAsync(lg log.Log, req []byte, p Pusher, wg *sync.WaitGroup, c Config) error {
+	return dispatch(lg, req, r.handle, p, wg, true, nil, c)
 }
@@ -74,7 +74,7 @@ func TestResponder(t *testing.T) {
 	}, relay.Config{
 		DialTimeout:     1 * time.Second,
 		RetrieveTimeout: 10 * time.Second,
-	}, &b)
+	}, &b, nil)
 	_, port, _ := net.SplitHostPort(l.Addr().String())
 	portn, _ := strconv.ParseUint(port, 10, 16)
 	var builders []protocol.Builder
@@ -144,3 +144,252 @@ func TestResponder(t *testing.T) {
 	}
 	// fmt.Println("pp.Data()", pp.Data())
 }
+
+func TestResponderBind(t *testing.T) {
+	s := session.New(10, 10*time.Second)
+	b := buffer.New(1024, 6)
+	rsp := NewResponder(&s, nil, relay.Config{
+		DialTimeout:     1 * time.Second,
+		RetrieveTimeout: 1 * time.Second,
+	}, &b, nil)
+	defer s.CloseAll()
+	c := Config{
+		MaxRetrieveLen: 1024,
+		LocalAddr: &net.TCPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: 0,
+		},
+	}
+	p := reader.NewPusher(make([]byte, 1024))
+	pp := reader.NewPusher(make([]byte, 1024))
+	dispatch := func(builder protocol.Builder) []byte {
+		p.Truncate(0)
+		pp.Truncate(0)
+		e := builder(protocol.ID{}, &p)
+		if e != nil {
+			t.Fatal("Build failed")
+		}
+		rsp.Dispatch(
+			func(format string, v ...interface{}) {},
+			p.Data(),
+			func(e PusherExecuter) error {
+				return e(&pp)
+			},
+			c,
+		)
+		return pp.Data()
+	}
+	d := dispatch((&protocol.BindRequest{
+		ATyp:           protocol.TCPIPv4,
+		Addr:           []byte{0, 0, 0, 0},
+		MaxRetrieveLen: 128,
+	}).Build)
+	bound := protocol.BindRespond{}
+	f := reader.NewFetcher(reader.ByteFetch(d[1:], io.EOF))
+	if d[0] != protocol.NewRequestType(protocol.BindType, 0).Byte() || bound.Parse(&f) != nil {
+		t.Error("Invalid bind respond")
+		return
+	}
+	d = dispatch((&protocol.AcceptRequest{}).Build)
+	if d[0] != protocol.NewRequestType(protocol.AcceptType, protocol.ResourceErrorWaiting).Byte() {
+		t.Error("Expecting accept to be waiting")
+		return
+	}
+	cc, e := net.Dial("tcp", (&net.TCPAddr{IP: net.IP(bound.Addr), Port: int(bound.Port)}).String())
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	defer cc.Close()
+	cc.Write([]byte("Peer"))
+	d = dispatch((&protocol.AcceptRequest{}).Build)
+	accepted := protocol.AcceptRespond{}
+	payload := make([]byte, 0, 16)
+	f = reader.NewFetcher(reader.ByteFetch(d[1:], io.EOF))
+	e = accepted.Parse(&f, func(d *protocol.AcceptRespond, r *reader.Fetcher) error {
+		return reader.FetchAll(int(d.RespondLength), r, func(b []byte) {
+			payload = append(payload, b...)
+		})
+	})
+	if e != nil || d[0] != protocol.NewRequestType(protocol.AcceptType, 0).Byte() {
+		t.Error("Invalid accept respond")
+		return
+	}
+	if accepted.ATyp != protocol.TCPIPv4 ||
+		!bytes.Equal(accepted.Addr, []byte{127, 0, 0, 1}) ||
+		!bytes.Equal(payload, []byte("Peer")) {
+		t.Error("Invalid data")
+		return
+	}
+}
+
+func TestResponderListen(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	s := session.New(10, 10*time.Second)
+	b := buffer.New(1024, 6)
+	rsp := NewResponder(&s, &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	}, relay.Config{
+		DialTimeout:     1 * time.Second,
+		RetrieveTimeout: 1 * time.Second,
+	}, &b, func(p uint16) bool {
+		return p == port
+	})
+	defer s.CloseAll()
+	c := Config{
+		MaxRetrieveLen: 1024,
+	}
+	p := reader.NewPusher(make([]byte, 1024))
+	pp := reader.NewPusher(make([]byte, 1024))
+	dispatch := func(id protocol.ID, builder protocol.Builder) []byte {
+		p.Truncate(0)
+		pp.Truncate(0)
+		e := builder(id, &p)
+		if e != nil {
+			t.Fatal("Build failed")
+		}
+		rsp.Dispatch(
+			func(format string, v ...interface{}) {},
+			p.Data(),
+			func(e PusherExecuter) error {
+				return e(&pp)
+			},
+			c,
+		)
+		return pp.Data()
+	}
+	d := dispatch(protocol.ID{}, (&protocol.ListenRequest{
+		Port:           port + 1,
+		MaxRetrieveLen: 128,
+	}).Build)
+	if d[0] != protocol.NewRequestType(protocol.ListenType, protocol.DialErrorNotAllowed).Byte() {
+		t.Error("Expecting listen to be refused")
+		return
+	}
+	d = dispatch(protocol.ID{}, (&protocol.ListenRequest{
+		Port:           port,
+		MaxRetrieveLen: 128,
+	}).Build)
+	if d[0] != protocol.NewRequestType(protocol.ListenType, 0).Byte() {
+		t.Error("Invalid listen respond")
+		return
+	}
+	d = dispatch(protocol.ID{}, (&protocol.IncomingRequest{}).Build)
+	if d[0] != protocol.NewRequestType(protocol.IncomingType, protocol.ResourceErrorWaiting).Byte() {
+		t.Error("Expecting incoming to be waiting")
+		return
+	}
+	cc, e := net.Dial("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}).String())
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	defer cc.Close()
+	cc.Write([]byte("Peer"))
+	d = dispatch(protocol.ID{}, (&protocol.IncomingRequest{}).Build)
+	incoming := protocol.IncomingRespond{}
+	f := reader.NewFetcher(reader.ByteFetch(d[1:], io.EOF))
+	if d[0] != protocol.NewRequestType(protocol.IncomingType, 0).Byte() || incoming.Parse(&f) != nil {
+		t.Error("Invalid incoming respond")
+		return
+	}
+	d = dispatch(incoming.CID, (&protocol.AcceptRequest{}).Build)
+	accepted := protocol.AcceptRespond{}
+	payload := make([]byte, 0, 16)
+	f = reader.NewFetcher(reader.ByteFetch(d[1:], io.EOF))
+	e = accepted.Parse(&f, func(d *protocol.AcceptRespond, r *reader.Fetcher) error {
+		return reader.FetchAll(int(d.RespondLength), r, func(b []byte) {
+			payload = append(payload, b...)
+		})
+	})
+	if e != nil || d[0] != protocol.NewRequestType(protocol.AcceptType, 0).Byte() {
+		t.Error("Invalid accept respond")
+		return
+	}
+	if !bytes.Equal(payload, []byte("Peer")) {
+		t.Error("Invalid data")
+		return
+	}
+}
+
+func TestResponderMultipath(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	defer l.Close()
+	go func() {
+		cc, ce := l.Accept()
+		if ce != nil {
+			return
+		}
+		defer cc.Close()
+		io.Copy(cc, cc)
+	}()
+	s := session.New(10, 10*time.Second)
+	b := buffer.New(relay.MultipathFrameSize, 6)
+	rsp := NewResponder(&s, nil, relay.Config{
+		DialTimeout:     1 * time.Second,
+		RetrieveTimeout: 1 * time.Second,
+	}, &b, nil)
+	defer s.CloseAll()
+	id := protocol.ID{1, 2, 3}
+	p := reader.NewPusher(make([]byte, 1024))
+	pp := reader.NewPusher(make([]byte, 1024))
+	e = (&protocol.MultipathRequest{
+		ATyp: protocol.TCPIPv4,
+		Addr: []byte{127, 0, 0, 1},
+		Port: uint16(l.Addr().(*net.TCPAddr).Port),
+	}).Build(id, &p)
+	if e != nil {
+		t.Error("Build failed")
+		return
+	}
+	rsp.Dispatch(
+		func(format string, v ...interface{}) {},
+		p.Data(),
+		func(e PusherExecuter) error {
+			return e(&pp)
+		},
+		Config{MaxRetrieveLen: 1024},
+	)
+	d := pp.Data()
+	mp := protocol.MultipathRespond{}
+	f := reader.NewFetcher(reader.ByteFetch(d[1:], io.EOF))
+	if d[0] != protocol.NewRequestType(protocol.MultipathType, 0).Byte() || mp.Parse(&f) != nil {
+		t.Error("Invalid multipath respond")
+		return
+	}
+	m := relay.NewMultipath(mp.Key)
+	for i := 0; i < 3; i++ {
+		sp, cp := net.Pipe()
+		go rsp.Join(func(format string, v ...interface{}) {}, protocol.JoinRequest{ID: id}, sp, make([]byte, relay.MultipathFrameSize))
+		go m.Join(cp, make([]byte, relay.MultipathFrameSize))
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	go m.Stream(remote, make([]byte, relay.MultipathChunkSize))
+	data := make([]byte, 10*relay.MultipathChunkSize+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go local.Write(data)
+	echoed := make([]byte, len(data))
+	local.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, e = io.ReadFull(local, echoed)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Error("Invalid data")
+		return
+	}
+}
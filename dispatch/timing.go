@@ -0,0 +1,110 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatch
+
+import (
+	"sync/atomic"
+	"time"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+	"warwolf/session"
+)
+
+// Timing is the timing of one response, which is marked with TimingRespond
+// once the client asks for it with a TimingRequest. When the request asks
+// for a hold, the waits for data in the response are capped to it, and end
+// as soon as some data has been responded
+type Timing struct {
+	start     time.Time
+	requested bool
+	hold      time.Duration
+	delivered int32
+}
+
+func NewTiming() *Timing {
+	return &Timing{
+		start: time.Now(),
+	}
+}
+
+func (t *Timing) request(req protocol.TimingRequest) {
+	t.requested = true
+	t.hold = time.Duration(req.Hold) * time.Millisecond
+}
+
+// held returns whether the response is held for no longer than the hold
+func (t *Timing) held() bool {
+	return t != nil && t.hold > 0
+}
+
+// deliver records that a respond carrying n bytes of data has been responded
+func (t *Timing) deliver(n int) {
+	if !t.held() || n <= 0 {
+		return
+	}
+	atomic.StoreInt32(&t.delivered, 1)
+}
+
+func (t *Timing) cut() bool {
+	return atomic.LoadInt32(&t.delivered) != 0
+}
+
+// retrieveHold returns the Hold of the retrieves of the response
+func (t *Timing) retrieveHold() session.Hold {
+	if !t.held() {
+		return session.Hold{}
+	}
+	return session.Hold{
+		Timeout: t.hold,
+		Cut:     t.cut,
+	}
+}
+
+// wait returns how long to wait for something to arrive, which is timeout
+// unless the hold is shorter
+func (t *Timing) wait(timeout time.Duration) time.Duration {
+	if !t.held() || t.hold >= timeout {
+		return timeout
+	}
+	return t.hold
+}
+
+// mark pushes a TimingRespond of the time elapsed since the response started
+func (t *Timing) mark(lg log.Log, p Pusher) error {
+	req := protocol.TimingRequest{}
+	rsp := req.Respond(time.Now().Sub(t.start))
+	err := p(func(p *reader.Pusher) error {
+		return rsp.Build(0, p)
+	})
+	if err != nil {
+		lg("Timing: Error: %s", err)
+		return err
+	}
+	return nil
+}
+
+// end marks the end of the response when the client has asked for it
+func (t *Timing) end(lg log.Log, p Pusher) {
+	if t == nil || !t.requested {
+		return
+	}
+	if t.held() && t.cut() {
+		lg("Timing: Ended early after %s", time.Now().Sub(t.start))
+	}
+	t.mark(lg, p)
+}
@@ -16,4 +16,4 @@
 
 module warwolf
 
-go 1.13
\ No newline at end of file
+go 1.24
\ No newline at end of file
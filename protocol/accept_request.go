@@ -0,0 +1,80 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+const AcceptType = 6
+
+type AcceptRequest struct {
+	ID ID
+}
+
+func (d *AcceptRequest) Build(id ID, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(AcceptType, 0).Byte()) {
+		return err
+	}
+	// id
+	d.ID = id
+	if !pusherPush(b, &err, d.ID[:]...) {
+		return err
+	}
+	return nil
+}
+
+func (d *AcceptRequest) Parse(r *reader.Fetcher) error {
+	// id
+	_, err := io.ReadFull(r, d.ID[:])
+	return err
+}
+
+func (d *AcceptRequest) RetrieveRequest() RetrieveRequest {
+	return RetrieveRequest{
+		ID:     d.ID,
+		RID:    0,
+		Offset: 0,
+	}
+}
+
+func (d *AcceptRequest) Respond(
+	atyp AddressType,
+	addr []byte,
+	port uint16,
+	rid uint64,
+	total uint16,
+	respond []byte,
+) AcceptRespond {
+	return AcceptRespond{
+		ID:            d.ID,
+		ATyp:          atyp,
+		Addr:          addr,
+		Port:          port,
+		RID:           rid,
+		Total:         total,
+		Respond:       respond,
+		RespondLength: uint16(len(respond)),
+	}
+}
+
+func (d *AcceptRequest) RetrieveRespond(atyp AddressType, addr []byte, port uint16, r RetrieveRespond) AcceptRespond {
+	return d.Respond(atyp, addr, port, r.RID, r.Total, r.Payload)
+}
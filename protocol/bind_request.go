@@ -0,0 +1,95 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+const (
+	BindType             = 2
+	BindSafeOverheadSize = IDSize + 1 + 255 + 2 + 2
+)
+
+type BindRequest struct {
+	ID             ID
+	ATyp           AddressType
+	Addr           []byte
+	Port           uint16
+	MaxRetrieveLen uint16
+}
+
+func (d *BindRequest) Build(id ID, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(BindType, byte(d.ATyp)).Byte()) {
+		return err
+	}
+	// id
+	d.ID = id
+	if !pusherPush(b, &err, d.ID[:]...) {
+		return err
+	}
+	// addr
+	if !pusherAddress(b, &err, d.ATyp, d.Addr) {
+		return err
+	}
+	// port
+	if !pusherU16(b, &err, d.Port) {
+		return err
+	}
+	// max_retrieve_len
+	if !pusherU16(b, &err, d.MaxRetrieveLen) {
+		return err
+	}
+	return nil
+}
+
+func (d *BindRequest) Parse(atyp AddressType, r *reader.Fetcher) error {
+	// id
+	_, err := io.ReadFull(r, d.ID[:])
+	if err != nil {
+		return err
+	}
+	d.ATyp = atyp
+	// addr
+	d.Addr, err = readAddress(d.ATyp, r)
+	if err != nil {
+		return err
+	}
+	// port
+	d.Port, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	// max_retrieve_len
+	d.MaxRetrieveLen, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *BindRequest) Respond(atyp AddressType, addr []byte, port uint16) BindRespond {
+	return BindRespond{
+		ID:   d.ID,
+		ATyp: atyp,
+		Addr: addr,
+		Port: port,
+	}
+}
@@ -0,0 +1,59 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"warwolf/reader"
+)
+
+func TestBindRequest(t *testing.T) {
+	req := BindRequest{
+		ID:             ID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+		ATyp:           TCPIPv4,
+		Addr:           []byte{10, 0, 0, 1},
+		Port:           21,
+		MaxRetrieveLen: 10101,
+	}
+	p := reader.NewPusher(make([]byte, 128))
+	err := req.Build(req.ID, &p)
+	if err != nil {
+		t.Error("Error:", err)
+		return
+	}
+	rType, rData := ParseRequestType(RequestType(p.Data()[0]))
+	if rType != BindType || AddressType(rData) != TCPIPv4 {
+		t.Error("Invalid type")
+		return
+	}
+	req2 := BindRequest{}
+	e := req2.Parse(AddressType(rData), newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	expectedID := ID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	if req2.ATyp != TCPIPv4 ||
+		!bytes.Equal(req2.Addr, []byte{10, 0, 0, 1}) ||
+		req2.MaxRetrieveLen != 10101 ||
+		req2.ID != expectedID ||
+		req2.Port != 21 {
+		t.Error("Invalid data")
+		return
+	}
+}
@@ -0,0 +1,87 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"warwolf/reader"
+)
+
+const (
+	ChunkType         = 11
+	ChunkHeaderSize   = 4 + 2
+	ChunkOverheadSize = HeaderSize + ChunkHeaderSize
+)
+
+const (
+	chunkFlagFin = 1
+)
+
+// ChunkRequest carries a piece of a multipath stream. Chunks are sent over
+// any path of the stream and are put back in order by their Seq
+type ChunkRequest struct {
+	Seq           uint32
+	Fin           bool
+	Payload       []byte
+	PayloadLength uint16
+}
+
+func (d *ChunkRequest) Build(b *reader.Pusher) error {
+	var err error
+	flags := byte(0)
+	if d.Fin {
+		flags |= chunkFlagFin
+	}
+	// rType
+	if !pusherPush(b, &err, NewRequestType(ChunkType, flags).Byte()) {
+		return err
+	}
+	// seq
+	if !pusherU32(b, &err, d.Seq) {
+		return err
+	}
+	// payload
+	if len(d.Payload) != int(d.PayloadLength) {
+		panic("Invalid payload length")
+	}
+	if !pusherU16(b, &err, d.PayloadLength) {
+		return err
+	}
+	if !pusherPush(b, &err, d.Payload...) {
+		return err
+	}
+	return nil
+}
+
+func (d *ChunkRequest) Parse(flags byte, r *reader.Fetcher) error {
+	var err error
+	d.Fin = flags&chunkFlagFin != 0
+	// seq
+	d.Seq, err = readU32(r)
+	if err != nil {
+		return err
+	}
+	// payload
+	d.PayloadLength, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	d.Payload, err = r.Fetch(int(d.PayloadLength))
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"warwolf/reader"
+)
+
+func TestChunkRequest(t *testing.T) {
+	r := ChunkRequest{
+		Seq:           3456789012,
+		Fin:           true,
+		Payload:       []byte("Test1Test2Test3Test4Test5"),
+		PayloadLength: 25,
+	}
+	p := reader.NewPusher(make([]byte, 128))
+	e := r.Build(&p)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if p.Size() != ChunkOverheadSize+25 {
+		t.Error("Invalid size", p.Size())
+		return
+	}
+	rt, flags := ParseRequestType(RequestType(p.Data()[0]))
+	if rt != ChunkType {
+		t.Error("Invalid request type", rt)
+		return
+	}
+	r1 := ChunkRequest{}
+	e = r1.Parse(flags, newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if r1.Seq != 3456789012 ||
+		!r1.Fin ||
+		r1.PayloadLength != 25 ||
+		!bytes.Equal(r1.Payload, []byte("Test1Test2Test3Test4Test5")) {
+		t.Error("Invalid data", r1)
+		return
+	}
+}
@@ -19,6 +19,7 @@ package protocol
 import (
 	"encoding/hex"
 	"errors"
+	"math"
 	"warwolf/reader"
 )
 
@@ -36,6 +37,7 @@ const (
 	ResourceErrorClosed      = 5
 	ResourceErrorSendFailure = 6
 	ResourceErrorUnknown     = 7
+	ResourceErrorWaiting     = 8
 )
 
 const (
@@ -97,6 +99,21 @@ func readU16(b *reader.Fetcher) (uint16, error) {
 	return uint16(bb[0])<<8 | uint16(bb[1]), nil
 }
 
+func writeU32(n uint32, b *reader.Pusher) error {
+	return b.Push(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func readU32(b *reader.Fetcher) (uint32, error) {
+	bb, err := b.Fetch(4)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(bb[0])<<24 |
+		uint32(bb[1])<<16 |
+		uint32(bb[2])<<8 |
+		uint32(bb[3]), nil
+}
+
 func writeU64(n uint64, b *reader.Pusher) error {
 	return b.Push(
 		byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
@@ -128,6 +145,15 @@ func pusherU16(p *reader.Pusher, e *error, u uint16) bool {
 	return false
 }
 
+func pusherU32(p *reader.Pusher, e *error, u uint32) bool {
+	err := writeU32(u, p)
+	if err == nil {
+		return true
+	}
+	*e = err
+	return false
+}
+
 func pusherU64(p *reader.Pusher, e *error, u uint64) bool {
 	err := writeU64(u, p)
 	if err == nil {
@@ -145,3 +171,67 @@ func pusherPush(p *reader.Pusher, e *error, d ...byte) bool {
 	*e = err
 	return false
 }
+
+func pusherAddress(p *reader.Pusher, e *error, t AddressType, a []byte) bool {
+	switch t {
+	case TCPIPv4:
+		fallthrough
+	case UDPIPv4:
+		if len(a) != 4 {
+			*e = ErrInvalidAddress
+			return false
+		}
+		return pusherPush(p, e, a...)
+
+	case TCPIPv6:
+		fallthrough
+	case UDPIPv6:
+		if len(a) != 16 {
+			*e = ErrInvalidAddress
+			return false
+		}
+		return pusherPush(p, e, a...)
+
+	case TCPHost:
+		fallthrough
+	case UDPHost:
+		alen := len(a)
+		if alen > math.MaxUint8 {
+			*e = ErrInvalidAddress
+			return false
+		}
+		if !pusherPush(p, e, byte(alen)) {
+			return false
+		}
+		return pusherPush(p, e, a...)
+
+	default:
+		panic("Unknown address type")
+	}
+}
+
+func readAddress(t AddressType, r *reader.Fetcher) ([]byte, error) {
+	switch t {
+	case UDPIPv4:
+		fallthrough
+	case TCPIPv4:
+		return r.Fetch(4)
+
+	case UDPIPv6:
+		fallthrough
+	case TCPIPv6:
+		return r.Fetch(16)
+
+	case UDPHost:
+		fallthrough
+	case TCPHost:
+		bb, err := r.Fetch(1)
+		if err != nil {
+			return nil, err
+		}
+		return r.Fetch(int(bb[0]))
+
+	default:
+		return nil, ErrInvalidAddress
+	}
+}
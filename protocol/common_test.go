@@ -37,6 +37,15 @@ func TestWriteU16(t *testing.T) {
 	}
 }
 
+func TestWriteU32(t *testing.T) {
+	b := [4]byte{}
+	p := reader.NewPusher(b[:])
+	writeU32(3456789012, &p)
+	if d, _ := readU32(newReadSource(b[:])); d != 3456789012 {
+		t.Error("Conversion failed")
+	}
+}
+
 func TestWriteU64(t *testing.T) {
 	b := [8]byte{}
 	p := reader.NewPusher(b[:])
@@ -49,43 +49,8 @@ func (d *DialRequest) Build(id ID, b *reader.Pusher) error {
 		return err
 	}
 	// addr
-	switch d.ATyp {
-	case TCPIPv4:
-		fallthrough
-	case UDPIPv4:
-		if len(d.Addr) != 4 {
-			return ErrInvalidAddress
-		}
-		if !pusherPush(b, &err, d.Addr...) {
-			return err
-		}
-
-	case TCPIPv6:
-		fallthrough
-	case UDPIPv6:
-		if len(d.Addr) != 16 {
-			return ErrInvalidAddress
-		}
-		if !pusherPush(b, &err, d.Addr...) {
-			return err
-		}
-
-	case TCPHost:
-		fallthrough
-	case UDPHost:
-		alen := len(d.Addr)
-		if alen > math.MaxUint8 {
-			return ErrInvalidAddress
-		}
-		if !pusherPush(b, &err, byte(alen)) {
-			return err
-		}
-		if !pusherPush(b, &err, d.Addr...) {
-			return err
-		}
-
-	default:
-		panic("Unknown address type")
+	if !pusherAddress(b, &err, d.ATyp, d.Addr) {
+		return err
 	}
 	// port
 	if !pusherU16(b, &err, d.Port) {
@@ -113,7 +78,6 @@ func (d *DialRequest) Build(id ID, b *reader.Pusher) error {
 
 func (d *DialRequest) Parse(atyp AddressType, r *reader.Fetcher, rr func(d *DialRequest, r []byte) error) error {
 	var err error
-	var bb []byte
 	// id
 	_, err = io.ReadFull(r, d.ID[:])
 	if err != nil {
@@ -121,37 +85,9 @@ func (d *DialRequest) Parse(atyp AddressType, r *reader.Fetcher, rr func(d *Dial
 	}
 	d.ATyp = atyp
 	// addr
-	switch d.ATyp {
-	case UDPIPv4:
-		fallthrough
-	case TCPIPv4:
-		d.Addr, err = r.Fetch(4)
-		if err != nil {
-			return err
-		}
-
-	case UDPIPv6:
-		fallthrough
-	case TCPIPv6:
-		d.Addr, err = r.Fetch(16)
-		if err != nil {
-			return err
-		}
-
-	case UDPHost:
-		fallthrough
-	case TCPHost:
-		bb, err = r.Fetch(1)
-		if err != nil {
-			return err
-		}
-		d.Addr, err = r.Fetch(int(bb[0]))
-		if err != nil {
-			return err
-		}
-
-	default:
-		return ErrInvalidAddress
+	d.Addr, err = readAddress(d.ATyp, r)
+	if err != nil {
+		return err
 	}
 	// port
 	d.Port, err = readU16(r)
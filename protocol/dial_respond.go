@@ -28,6 +28,7 @@ const (
 	DialErrorOverCapacity    = 3
 	DialErrorAlreadyDialed   = 4
 	DialErrorInternalFailure = 5
+	DialErrorNotAllowed      = 6
 )
 
 type DialRespond struct {
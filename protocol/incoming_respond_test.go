@@ -0,0 +1,55 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"warwolf/reader"
+)
+
+func TestIncomingRespond(t *testing.T) {
+	id := ID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	cid := ID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	r := IncomingRespond{
+		ID:   id,
+		CID:  cid,
+		ATyp: TCPIPv4,
+		Addr: []byte{192, 168, 1, 20},
+		Port: 51234,
+	}
+	p := reader.NewPusher(make([]byte, 128))
+	e := r.Build(id, 0, &p)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	r1 := IncomingRespond{}
+	e = r1.Parse(newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if r1.ID != id ||
+		r1.CID != cid ||
+		r1.ATyp != TCPIPv4 ||
+		!bytes.Equal(r1.Addr, r.Addr) ||
+		r1.Port != 51234 {
+		t.Error("Invalid data", r1)
+		return
+	}
+}
@@ -0,0 +1,58 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+const (
+	JoinType            = 10
+	JoinRequestSize     = IDSize
+	JoinRequestOverhead = HeaderSize + JoinRequestSize
+)
+
+// JoinRequest attaches the connection it was sent on to a multipath session
+// as a path. It is sent as the only request of a HTTP request, the backend
+// takes the connection over instead of responding to it
+type JoinRequest struct {
+	ID ID
+}
+
+func (d *JoinRequest) Build(id ID, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(JoinType, 0).Byte()) {
+		return err
+	}
+	// id
+	d.ID = id
+	if !pusherPush(b, &err, d.ID[:]...) {
+		return err
+	}
+	return nil
+}
+
+func (d *JoinRequest) Parse(r *reader.Fetcher) error {
+	// id
+	_, err := io.ReadFull(r, d.ID[:])
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+type ListenRespond struct {
+	ID   ID
+	ATyp AddressType
+	Addr []byte
+	Port uint16
+}
+
+func (d *ListenRespond) Build(id ID, errcode byte, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(ListenType, errcode).Byte()) {
+		return err
+	}
+	// id
+	d.ID = id
+	if !pusherPush(b, &err, d.ID[:]...) {
+		return err
+	}
+	// atyp
+	if !pusherPush(b, &err, byte(d.ATyp)) {
+		return err
+	}
+	// addr
+	if !pusherAddress(b, &err, d.ATyp, d.Addr) {
+		return err
+	}
+	// port
+	if !pusherU16(b, &err, d.Port) {
+		return err
+	}
+	return nil
+}
+
+func (d *ListenRespond) Parse(r *reader.Fetcher) error {
+	// id
+	_, err := io.ReadFull(r, d.ID[:])
+	if err != nil {
+		return err
+	}
+	// atyp
+	t, err := r.Fetch(1)
+	if err != nil {
+		return err
+	}
+	d.ATyp = AddressType(t[0])
+	// addr
+	d.Addr, err = readAddress(d.ATyp, r)
+	if err != nil {
+		return err
+	}
+	// port
+	d.Port, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
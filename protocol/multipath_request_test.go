@@ -0,0 +1,57 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"warwolf/reader"
+)
+
+func TestMultipathRequest(t *testing.T) {
+	id := ID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	r := MultipathRequest{
+		ID:   id,
+		ATyp: TCPHost,
+		Addr: []byte("example.com"),
+		Port: 443,
+	}
+	p := reader.NewPusher(make([]byte, 128))
+	e := r.Build(id, &p)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	rt, atyp := ParseRequestType(RequestType(p.Data()[0]))
+	if rt != MultipathType {
+		t.Error("Invalid request type", rt)
+		return
+	}
+	r1 := MultipathRequest{}
+	e = r1.Parse(AddressType(atyp), newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if r1.ID != id ||
+		r1.ATyp != TCPHost ||
+		!bytes.Equal(r1.Addr, []byte("example.com")) ||
+		r1.Port != 443 {
+		t.Error("Invalid data", r1)
+		return
+	}
+}
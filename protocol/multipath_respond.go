@@ -0,0 +1,63 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+const (
+	MultipathKeySize = 32
+)
+
+type MultipathRespond struct {
+	ID  ID
+	Key [MultipathKeySize]byte
+}
+
+func (d *MultipathRespond) Build(id ID, errcode byte, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(MultipathType, errcode).Byte()) {
+		return err
+	}
+	// id
+	d.ID = id
+	if !pusherPush(b, &err, d.ID[:]...) {
+		return err
+	}
+	// key
+	if !pusherPush(b, &err, d.Key[:]...) {
+		return err
+	}
+	return nil
+}
+
+func (d *MultipathRespond) Parse(r *reader.Fetcher) error {
+	// id
+	_, err := io.ReadFull(r, d.ID[:])
+	if err != nil {
+		return err
+	}
+	// key
+	_, err = io.ReadFull(r, d.Key[:])
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+const (
+	PushType            = 13
+	PushRequestSize     = IDSize + 2
+	PushRequestOverhead = HeaderSize + PushRequestSize
+)
+
+// PushRequest opens the push stream of a channel. It is sent as the only
+// request of a HTTP request, the backend keeps the response open for up to
+// Duration seconds and streams PushRespond of the subscribed sessions in it
+type PushRequest struct {
+	Channel  ID
+	Duration uint16
+}
+
+func (d *PushRequest) Build(channel ID, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(PushType, 0).Byte()) {
+		return err
+	}
+	// channel
+	d.Channel = channel
+	if !pusherPush(b, &err, d.Channel[:]...) {
+		return err
+	}
+	// duration
+	if !pusherU16(b, &err, d.Duration) {
+		return err
+	}
+	return nil
+}
+
+func (d *PushRequest) Parse(r *reader.Fetcher) error {
+	// channel
+	_, err := io.ReadFull(r, d.Channel[:])
+	if err != nil {
+		return err
+	}
+	// duration
+	d.Duration, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
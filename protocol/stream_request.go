@@ -0,0 +1,94 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+const (
+	StreamType            = 14
+	StreamRequestSize     = IDSize + 1 + 2
+	StreamRequestOverhead = HeaderSize + StreamRequestSize
+)
+
+const (
+	StreamDown byte = 0
+	StreamUp   byte = 1
+)
+
+// StreamRequest opens one direction of a stream. The StreamDown request is
+// sent as the only request of a HTTP request, and the backend keeps its
+// response open for the responds of the stream. The StreamUp request is the
+// first request of a chunked HTTP request, the requests following it in the
+// same body are responded on the StreamDown of the same Channel
+type StreamRequest struct {
+	Channel   ID
+	Direction byte
+	Duration  uint16
+}
+
+func (d *StreamRequest) Build(channel ID, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(StreamType, 0).Byte()) {
+		return err
+	}
+	// channel
+	d.Channel = channel
+	if !pusherPush(b, &err, d.Channel[:]...) {
+		return err
+	}
+	// direction
+	if !pusherPush(b, &err, d.Direction) {
+		return err
+	}
+	// duration
+	if !pusherU16(b, &err, d.Duration) {
+		return err
+	}
+	return nil
+}
+
+func (d *StreamRequest) Parse(r *reader.Fetcher) error {
+	// channel
+	_, err := io.ReadFull(r, d.Channel[:])
+	if err != nil {
+		return err
+	}
+	// direction
+	dir := [1]byte{}
+	_, err = io.ReadFull(r, dir[:])
+	if err != nil {
+		return err
+	}
+	d.Direction = dir[0]
+	// duration
+	d.Duration, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d StreamRequest) Respond() StreamRespond {
+	return StreamRespond{
+		Channel:   d.Channel,
+		Direction: d.Direction,
+	}
+}
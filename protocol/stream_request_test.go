@@ -0,0 +1,50 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"testing"
+	"warwolf/reader"
+)
+
+func TestStreamRequest(t *testing.T) {
+	c := StreamRequest{
+		Channel:   ID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+		Direction: StreamUp,
+		Duration:  3210,
+	}
+	p := reader.NewPusher(make([]byte, StreamRequestOverhead))
+	e := c.Build(c.Channel, &p)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	c2 := StreamRequest{}
+	e = c2.Parse(newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if c2 != c {
+		t.Error("Invalid data", c2)
+		return
+	}
+	if c2.Respond().Channel != c.Channel || c2.Respond().Direction != StreamUp {
+		t.Error("Invalid respond", c2.Respond())
+		return
+	}
+}
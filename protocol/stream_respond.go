@@ -0,0 +1,58 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"warwolf/reader"
+)
+
+// StreamRespond tells the client that a direction of the stream has reached
+// the backend
+type StreamRespond struct {
+	Channel   ID
+	Direction byte
+}
+
+func (d *StreamRespond) Build(channel ID, errcode byte, b *reader.Pusher) error {
+	var err error
+	if !pusherPush(b, &err, NewRequestType(StreamType, errcode).Byte()) {
+		return err
+	}
+	d.Channel = channel
+	if !pusherPush(b, &err, d.Channel[:]...) {
+		return err
+	}
+	if !pusherPush(b, &err, d.Direction) {
+		return err
+	}
+	return nil
+}
+
+func (d *StreamRespond) Parse(r *reader.Fetcher) error {
+	_, rErr := io.ReadFull(r, d.Channel[:])
+	if rErr != nil {
+		return rErr
+	}
+	dir := [1]byte{}
+	_, rErr = io.ReadFull(r, dir[:])
+	if rErr != nil {
+		return rErr
+	}
+	d.Direction = dir[0]
+	return nil
+}
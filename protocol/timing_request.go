@@ -0,0 +1,65 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package protocol
+
+import (
+	"time"
+	"warwolf/reader"
+)
+
+const (
+	TimingType            = 15
+	TimingRequestSize     = 2
+	TimingRequestOverhead = HeaderSize + TimingRequestSize
+)
+
+// TimingRequest asks the backend to mark the response of the HTTP request
+// with TimingRespond, so the client can tell whether the response is
+// buffered on the way. It is sent as the first request of a HTTP request. A
+// Hold other than 0 asks the backend to hold the response for no longer than
+// Hold milliseconds, and to end it soon after data has been responded
+type TimingRequest struct {
+	Hold uint16
+}
+
+func (d *TimingRequest) Build(b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(TimingType, 0).Byte()) {
+		return err
+	}
+	// hold
+	if !pusherU16(b, &err, d.Hold) {
+		return err
+	}
+	return nil
+}
+
+func (d *TimingRequest) Parse(r *reader.Fetcher) error {
+	var err error
+	// hold
+	d.Hold, err = readU16(r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d TimingRequest) Respond(elapsed time.Duration) TimingRespond {
+	return TimingRespond{
+		Elapsed: uint32(elapsed / time.Millisecond),
+	}
+}
@@ -0,0 +1,57 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package protocol
+
+import (
+	"testing"
+	"time"
+	"warwolf/reader"
+)
+
+func TestTimingRequest(t *testing.T) {
+	c := TimingRequest{
+		Hold: 1500,
+	}
+	p := reader.NewPusher(make([]byte, 128))
+	e := c.Build(&p)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if p.Size() != TimingRequestOverhead {
+		t.Error("Invalid size", p.Size())
+		return
+	}
+	typ, _ := ParseRequestType(RequestType(p.Data()[0]))
+	if typ != TimingType {
+		t.Error("Invalid type", typ)
+		return
+	}
+	c2 := TimingRequest{}
+	e = c2.Parse(newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if c2 != c {
+		t.Error("Invalid data", c2)
+		return
+	}
+	if c2.Respond(1234*time.Millisecond).Elapsed != 1234 {
+		t.Error("Invalid respond")
+		return
+	}
+}
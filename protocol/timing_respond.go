@@ -0,0 +1,56 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package protocol
+
+import (
+	"time"
+	"warwolf/reader"
+)
+
+// TimingRespond marks the response with how many milliseconds the backend
+// had been responding for when it was written. The first one is written
+// right away, and the last one right before the response ends
+type TimingRespond struct {
+	Elapsed uint32
+}
+
+func (d *TimingRespond) Build(errcode byte, b *reader.Pusher) error {
+	var err error
+	// rType
+	if !pusherPush(b, &err, NewRequestType(TimingType, errcode).Byte()) {
+		return err
+	}
+	// elapsed
+	if !pusherU32(b, &err, d.Elapsed) {
+		return err
+	}
+	return nil
+}
+
+func (d *TimingRespond) Parse(r *reader.Fetcher) error {
+	var err error
+	// elapsed
+	d.Elapsed, err = readU32(r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Duration returns the elapsed time
+func (d TimingRespond) Duration() time.Duration {
+	return time.Duration(d.Elapsed) * time.Millisecond
+}
@@ -0,0 +1,53 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package protocol
+
+import (
+	"testing"
+	"time"
+	"warwolf/reader"
+)
+
+func TestTimingRespond(t *testing.T) {
+	c := TimingRespond{
+		Elapsed: 3456789,
+	}
+	p := reader.NewPusher(make([]byte, 128))
+	e := c.Build(ResourceErrorSuccess, &p)
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	typ, errcode := ParseRequestType(RequestType(p.Data()[0]))
+	if typ != TimingType || errcode != ResourceErrorSuccess {
+		t.Error("Invalid header", typ, errcode)
+		return
+	}
+	c2 := TimingRespond{}
+	e = c2.Parse(newReadSource(p.Data()[1:]))
+	if e != nil {
+		t.Error("Error:", e)
+		return
+	}
+	if c2 != c {
+		t.Error("Invalid data", c2)
+		return
+	}
+	if c2.Duration() != 3456789*time.Millisecond {
+		t.Error("Invalid duration", c2.Duration())
+		return
+	}
+}
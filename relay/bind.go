@@ -0,0 +1,176 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package relay
+
+import (
+	"io"
+	"net"
+	"time"
+	"warwolf/reader"
+)
+
+type Bind struct {
+	listener net.Listener
+	incoming net.Conn
+	expect   net.IP
+	accepted chan struct{}
+	conn     *conn
+	retReq   chan retrieverReq
+}
+
+func NewBind(
+	laddr net.Addr,
+	expect net.IP,
+) (*Bind, Error) {
+	addr := ":0"
+	if laddr != nil {
+		addr = laddr.String()
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, newError(err)
+	}
+	return &Bind{
+		listener: l,
+		incoming: nil,
+		expect:   expect,
+		accepted: make(chan struct{}),
+		conn:     nil,
+		retReq:   make(chan retrieverReq, 1),
+	}, Error{}
+}
+
+func NewAccepted(c net.Conn) *Bind {
+	return &Bind{
+		listener: nil,
+		incoming: c,
+		expect:   nil,
+		accepted: make(chan struct{}),
+		conn:     nil,
+		retReq:   make(chan retrieverReq, 1),
+	}
+}
+
+func (u *Bind) Addr() net.Addr {
+	if u.listener == nil {
+		return u.incoming.LocalAddr()
+	}
+	return u.listener.Addr()
+}
+
+func (u *Bind) closeListener() {
+	if u.listener == nil {
+		return
+	}
+	u.listener.Close()
+}
+
+func (u *Bind) Accepted(t time.Duration) (net.Addr, Error) {
+	timer := time.NewTimer(t)
+	defer timer.Stop()
+	select {
+	case <-u.accepted:
+		if u.conn == nil {
+			return nil, newError(io.EOF)
+		}
+		return u.conn.RemoteAddr(), Error{}
+	case <-timer.C:
+		return nil, Error{}
+	}
+}
+
+func (u *Bind) getConn() (*conn, error) {
+	<-u.accepted
+	if u.conn == nil {
+		return nil, io.EOF
+	}
+	return u.conn, nil
+}
+
+func (u *Bind) accept() (net.Conn, error) {
+	if u.listener == nil {
+		return u.incoming, nil
+	}
+	for {
+		c, err := u.listener.Accept()
+		if err != nil {
+			if tempErr(err) {
+				continue
+			}
+			return nil, err
+		}
+		if u.expect == nil || u.expect.IsUnspecified() {
+			return c, nil
+		}
+		a, ok := c.RemoteAddr().(*net.TCPAddr)
+		if ok && a.IP.Equal(u.expect) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func (u *Bind) Serve(rbuf []byte, cc Config, connected Connector) Error {
+	ccc, err := u.accept()
+	u.closeListener()
+	if err != nil {
+		close(u.accepted)
+		connected(nil, err)
+		return newError(err)
+	}
+	connected(ccc, nil)
+	ccc.SetDeadline(time.Now().Add(cc.RetrieveTimeout))
+	cconn := &conn{
+		Conn:    reader.NewNetConn(ccc),
+		timeout: cc.RetrieveTimeout,
+	}
+	defer cconn.Close()
+	u.conn = cconn
+	close(u.accepted)
+	return serveConn(cconn, rbuf, u.retReq)
+}
+
+func (u *Bind) Retrieve(r Retriever, t time.Duration) {
+	_, err := u.getConn()
+	if err != nil {
+		r(nil, newError(err))
+		return
+	}
+	u.retReq <- retrieverReq{
+		r: r,
+		t: t,
+	}
+}
+
+func (u *Bind) Send(b []byte) (int, Error) {
+	conn, err := u.getConn()
+	if err != nil {
+		return 0, newError(err)
+	}
+	l, err := conn.Write(b)
+	return l, newError(err)
+}
+
+func (u *Bind) Close() {
+	u.closeListener()
+	conn, err := u.getConn()
+	if err != nil {
+		return
+	}
+	conn.Close()
+	close(u.retReq)
+}
@@ -58,6 +58,11 @@ type Relay interface {
 	Close()
 }
 
+type Accepter interface {
+	Addr() net.Addr
+	Accepted(t time.Duration) (net.Addr, Error)
+}
+
 type retrieverReq struct {
 	r Retriever
 	t time.Duration
@@ -81,3 +86,24 @@ func buildDialer(laddr net.Addr, timeout time.Duration) net.Dialer {
 		Control:   nil,
 	}
 }
+
+func serveConn(cconn *conn, rbuf []byte, retReq chan retrieverReq) Error {
+	for {
+		ret, retok := <-retReq
+		if !retok {
+			return Error{}
+		}
+		var rlen int
+		var rerr error
+		if ret.t > 0 {
+			rlen, rerr = cconn.ReadTimeout(rbuf, ret.t)
+		} else {
+			rlen, rerr = cconn.Read(rbuf)
+		}
+		if rerr != nil {
+			ret.r(nil, newError(rerr))
+			continue
+		}
+		ret.r(rbuf[:rlen], Error{})
+	}
+}
@@ -0,0 +1,98 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	ErrListenerOnly = errors.New("Relay: Listener does not carry data")
+)
+
+type Listener struct {
+	listener net.Listener
+	incoming chan net.Conn
+}
+
+func NewListener(laddr net.Addr, backlog int) (*Listener, Error) {
+	l, err := net.Listen("tcp", laddr.String())
+	if err != nil {
+		return nil, newError(err)
+	}
+	return &Listener{
+		listener: l,
+		incoming: make(chan net.Conn, backlog),
+	}, Error{}
+}
+
+func (u *Listener) Addr() net.Addr {
+	return u.listener.Addr()
+}
+
+func (u *Listener) Incoming(t time.Duration) (net.Conn, Error) {
+	timer := time.NewTimer(t)
+	defer timer.Stop()
+	select {
+	case c, ok := <-u.incoming:
+		if !ok {
+			return nil, newError(io.EOF)
+		}
+		return c, Error{}
+	case <-timer.C:
+		return nil, Error{}
+	}
+}
+
+func (u *Listener) Serve(rbuf []byte, cc Config, connected Connector) Error {
+	defer func() {
+		close(u.incoming)
+		for c := range u.incoming {
+			c.Close()
+		}
+	}()
+	for {
+		c, err := u.listener.Accept()
+		if err != nil {
+			if tempErr(err) {
+				continue
+			}
+			connected(nil, err)
+			return newError(err)
+		}
+		select {
+		case u.incoming <- c:
+		default:
+			c.Close()
+		}
+	}
+}
+
+func (u *Listener) Retrieve(r Retriever, t time.Duration) {
+	r(nil, newError(ErrListenerOnly))
+}
+
+func (u *Listener) Send(b []byte) (int, Error) {
+	return 0, newError(ErrListenerOnly)
+}
+
+func (u *Listener) Close() {
+	u.listener.Close()
+}
@@ -0,0 +1,464 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package relay
+
+import (
+	cph "crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+var (
+	ErrMultipathOnly         = errors.New("Relay: Multipath stream carries data over its paths only")
+	ErrMultipathClosed       = errors.New("Relay: Multipath stream has been closed")
+	ErrMultipathInvalidChunk = errors.New("Relay: Invalid multipath chunk")
+)
+
+const (
+	MultipathChunkSize = 16 * 1024
+	MultipathFrameSize = cipher.OverheadSize + protocol.ChunkOverheadSize + MultipathChunkSize
+	multipathWindow    = 256
+
+	// A chunk that is missing for this long while the window is full was
+	// lost together with its path
+	multipathStallTimeout = 30 * time.Second
+)
+
+type multipathChunk struct {
+	seq  uint32
+	fin  bool
+	data []byte
+}
+
+// Multipath splits a stream into sequence numbered chunks, sends them over
+// whichever of its paths is free, and puts the chunks received from all the
+// paths back in order before writing them to the local end of the stream.
+// Losing any path breaks the stream, as the chunks on it are gone with it
+type Multipath struct {
+	raddr     net.Addr
+	laddr     net.Addr
+	key       [protocol.MultipathKeySize]byte
+	out       chan multipathChunk
+	done      chan struct{}
+	lock      sync.Mutex
+	cond      *sync.Cond
+	pending   map[uint32]multipathChunk
+	next      uint32
+	blocked   int
+	paths     map[io.Closer]struct{}
+	conn      io.Closer
+	finSent   bool
+	finRecv   bool
+	finQueued bool
+	finSeq    uint32
+	closed    bool
+}
+
+// NewMultipath creates a Multipath of which the local end is given to Stream
+func NewMultipath(key [protocol.MultipathKeySize]byte) *Multipath {
+	m := &Multipath{
+		raddr:   nil,
+		laddr:   nil,
+		key:     key,
+		out:     make(chan multipathChunk),
+		done:    make(chan struct{}),
+		lock:    sync.Mutex{},
+		pending: make(map[uint32]multipathChunk, multipathWindow),
+		next:    0,
+		paths:   make(map[io.Closer]struct{}, 8),
+		conn:    nil,
+	}
+	m.cond = sync.NewCond(&m.lock)
+	return m
+}
+
+// NewMultipathTCP creates a Multipath of which the local end is a TCP
+// connection to raddr, dialed by Serve
+func NewMultipathTCP(raddr net.Addr, laddr net.Addr, key [protocol.MultipathKeySize]byte) (*Multipath, Error) {
+	m := NewMultipath(key)
+	m.raddr = raddr
+	m.laddr = laddr
+	return m, Error{}
+}
+
+func (m *Multipath) Serve(rbuf []byte, cc Config, connected Connector) Error {
+	d := buildDialer(m.laddr, cc.DialTimeout)
+	c, err := d.Dial("tcp", m.raddr.String())
+	if err != nil {
+		connected(nil, err)
+		return newError(err)
+	}
+	defer c.Close()
+	connected(c, nil)
+	err = m.Stream(reader.NewNetConn(c), rbuf)
+	if err != nil {
+		return newError(err)
+	}
+	return Error{}
+}
+
+func (m *Multipath) Retrieve(r Retriever, t time.Duration) {
+	r(nil, newError(ErrMultipathOnly))
+}
+
+func (m *Multipath) Send(b []byte) (int, Error) {
+	return 0, newError(ErrMultipathOnly)
+}
+
+func (m *Multipath) Key() [protocol.MultipathKeySize]byte {
+	return m.key
+}
+
+// Joined returns whether there are paths attached to the stream
+func (m *Multipath) Joined() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.paths) > 0
+}
+
+func (m *Multipath) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.done)
+	m.cond.Broadcast()
+	for p := range m.paths {
+		p.Close()
+	}
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+func (m *Multipath) settle() {
+	m.lock.Lock()
+	finished := m.finSent && m.finRecv
+	m.lock.Unlock()
+	if !finished {
+		return
+	}
+	m.Close()
+}
+
+func (m *Multipath) finished() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.finSent && m.finRecv
+}
+
+// completable returns whether all remaining chunks of the remote side has
+// been received, so the stream can finish without any path
+func (m *Multipath) completable() bool {
+	if !m.finQueued {
+		return false
+	}
+	if m.finSeq-m.next >= 1<<31 {
+		return true
+	}
+	return len(m.pending) == int(m.finSeq-m.next)+1
+}
+
+// Stream relays the local end c over the paths until either side finishes
+func (m *Multipath) Stream(c io.ReadWriteCloser, rbuf []byte) error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		c.Close()
+		return ErrMultipathClosed
+	}
+	m.conn = c
+	m.lock.Unlock()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		m.deliver(c)
+	}()
+	go func() {
+		defer wg.Done()
+		m.watch(multipathStallTimeout)
+	}()
+	return m.pump(c, rbuf)
+}
+
+// watch closes the stream once it is stalled on a missing chunk, which is
+// the only sign left of a lost path when the reading of the other paths is
+// blocked by the full window
+func (m *Multipath) watch(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 16)
+	defer ticker.Stop()
+	last := uint32(0)
+	since := time.Now()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.lock.Lock()
+			_, arrived := m.pending[m.next]
+			stalled := m.blocked > 0 && !arrived && m.next == last
+			last = m.next
+			m.lock.Unlock()
+			if !stalled {
+				since = now
+				continue
+			}
+			if now.Sub(since) < timeout {
+				continue
+			}
+			m.Close()
+			return
+		}
+	}
+}
+
+func (m *Multipath) pump(c io.Reader, rbuf []byte) error {
+	defer close(m.out)
+	if len(rbuf) > MultipathChunkSize {
+		rbuf = rbuf[:MultipathChunkSize]
+	}
+	seq := uint32(0)
+	for {
+		l, err := c.Read(rbuf)
+		if l > 0 {
+			select {
+			case m.out <- multipathChunk{seq: seq, data: append([]byte{}, rbuf[:l]...)}:
+				seq++
+			case <-m.done:
+				return ErrMultipathClosed
+			}
+		}
+		if err == nil {
+			continue
+		}
+		select {
+		case m.out <- multipathChunk{seq: seq, fin: true}:
+		case <-m.done:
+			return ErrMultipathClosed
+		}
+		m.lock.Lock()
+		finRecv := m.finRecv
+		m.lock.Unlock()
+		if err == io.EOF || finRecv {
+			return nil
+		}
+		return err
+	}
+}
+
+func (m *Multipath) deliver(c io.WriteCloser) {
+	for {
+		m.lock.Lock()
+		ch, ok := m.pending[m.next]
+		for !ok && !m.closed {
+			m.cond.Wait()
+			ch, ok = m.pending[m.next]
+		}
+		if m.closed {
+			m.lock.Unlock()
+			return
+		}
+		delete(m.pending, m.next)
+		m.next++
+		m.cond.Broadcast()
+		m.lock.Unlock()
+		if len(ch.data) > 0 {
+			_, err := c.Write(ch.data)
+			if err != nil {
+				m.Close()
+				return
+			}
+		}
+		if !ch.fin {
+			continue
+		}
+		m.lock.Lock()
+		m.finRecv = true
+		m.lock.Unlock()
+		c.Close()
+		m.settle()
+		return
+	}
+}
+
+func (m *Multipath) receive(ch multipathChunk) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for {
+		if m.closed {
+			return ErrMultipathClosed
+		}
+		ahead := ch.seq - m.next
+		if ahead >= 1<<31 {
+			return nil
+		}
+		if ahead < multipathWindow {
+			break
+		}
+		m.blocked++
+		m.cond.Wait()
+		m.blocked--
+	}
+	m.pending[ch.seq] = ch
+	if ch.fin {
+		m.finQueued = true
+		m.finSeq = ch.seq
+	}
+	m.cond.Broadcast()
+	return nil
+}
+
+// Join attaches p to the stream as a path, and serves it until the stream
+// is finished or the path is broken
+func (m *Multipath) Join(p io.ReadWriteCloser, rbuf []byte) error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		p.Close()
+		return ErrMultipathClosed
+	}
+	m.paths[p] = struct{}{}
+	m.lock.Unlock()
+	cip, err := cipher.AEAD(m.key[:])
+	if err != nil {
+		p.Close()
+		return m.leave(p, err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		werr := m.send(cip, p)
+		if werr != nil {
+			m.Close()
+		}
+	}()
+	f := reader.NewFetcher(reader.ReaderFetch(rbuf, p, io.EOF))
+	err = cipher.Decrypt(cipher.Time{}, func() (cph.AEAD, error) {
+		return cip, nil
+	}, cipher.NewTranscript(""), func(nonce []byte, t cipher.Time) bool {
+		return true
+	}, &f, io.EOF, func(b []byte) error {
+		ff := reader.NewFetcher(reader.ByteFetch(b, io.EOF))
+		h, err := ff.Fetch(protocol.HeaderSize)
+		if err != nil {
+			return err
+		}
+		t, flags := protocol.ParseRequestType(protocol.RequestType(h[0]))
+		if t != protocol.ChunkType {
+			return ErrMultipathInvalidChunk
+		}
+		req := protocol.ChunkRequest{}
+		err = req.Parse(flags, &ff)
+		if err != nil {
+			return err
+		}
+		return m.receive(multipathChunk{
+			seq:  req.Seq,
+			fin:  req.Fin,
+			data: append([]byte{}, req.Payload...),
+		})
+	})
+	if err == cipher.ErrTruncated {
+		// Paths end without a final frame, the fin chunk tells whether the
+		// stream is complete
+		err = nil
+	}
+	err = m.leave(p, err)
+	p.Close()
+	wg.Wait()
+	return err
+}
+
+// leave detaches a path. The remote side closes its paths only after it has
+// sent everything, so a path closed before that breaks the stream
+func (m *Multipath) leave(p io.Closer, err error) error {
+	m.lock.Lock()
+	delete(m.paths, p)
+	finished := m.finSent && m.finRecv
+	ended := err == nil && m.finSent
+	if ended && len(m.paths) == 0 {
+		ended = m.completable()
+	}
+	m.lock.Unlock()
+	if finished || ended {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	m.Close()
+	return err
+}
+
+func (m *Multipath) send(cip cph.AEAD, w io.Writer) error {
+	buf := make([]byte, MultipathFrameSize)
+	ts := cipher.NewTranscript("")
+	for {
+		var ch multipathChunk
+		var ok bool
+		select {
+		case ch, ok = <-m.out:
+			if !ok {
+				return nil
+			}
+		case <-m.done:
+			return nil
+		}
+		p := reader.NewPusher(buf)
+		p.Truncate(cipher.HeaderSize)
+		req := protocol.ChunkRequest{
+			Seq:           ch.seq,
+			Fin:           ch.fin,
+			Payload:       ch.data,
+			PayloadLength: uint16(len(ch.data)),
+		}
+		err := req.Build(&p)
+		if err != nil {
+			return err
+		}
+		p.Truncate(p.Size() + cipher.BlockSize)
+		nonce, err := cipher.Nonce()
+		if err != nil {
+			return err
+		}
+		// The remote side may finish and close the paths as soon as the fin
+		// chunk arrives, so it is marked as sent before being written
+		if ch.fin {
+			m.lock.Lock()
+			m.finSent = true
+			m.lock.Unlock()
+		}
+		_, err = w.Write(cipher.Encrypt(cip, ts, nonce, p.Data()))
+		if err != nil {
+			return err
+		}
+		if ch.fin {
+			m.settle()
+		}
+	}
+}
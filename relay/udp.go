@@ -78,24 +78,7 @@ func (u *UDP) Serve(rbuf []byte, cc Config, connected Connector) Error {
 	ccc = nil
 	defer cconn.Close()
 	u.connReq <- cconn
-	for {
-		ret, retok := <-u.retReq
-		if !retok {
-			return Error{}
-		}
-		var rlen int
-		var rerr error
-		if ret.t > 0 {
-			rlen, rerr = cconn.ReadTimeout(rbuf, ret.t)
-		} else {
-			rlen, rerr = cconn.Read(rbuf)
-		}
-		if rerr != nil {
-			ret.r(nil, newError(rerr))
-			continue
-		}
-		ret.r(rbuf[:rlen], Error{})
-	}
+	return serveConn(cconn, rbuf, u.retReq)
 }
 
 func (u *UDP) Retrieve(r Retriever, t time.Duration) {
@@ -0,0 +1,177 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+	"warwolf/buffer"
+	"warwolf/cipher"
+	"warwolf/dispatch"
+	"warwolf/relay"
+	"warwolf/session"
+)
+
+// Logger is what the backend logs to. The *log.Logger of the standard
+// library is one
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Backend is the backend server as an http.Handler, so it can be mounted on
+// an HTTP server which serves other things as well. Each Backend has a
+// session pool of its own. Idle sessions are recycled by Run, or by calling
+// Recycle every now and then, and all of them are closed by Close
+type Backend struct {
+	handler   handler
+	sessions  *session.Sessions
+	keys      *cipher.Sessions
+	nonces    *cipher.Nonces
+	replays   cipher.NonceStats
+	recycle   time.Duration
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewBackend returns the Backend of the config c, which logs to l. The
+// Listen and TLS options of c are left to the HTTP server it is mounted on
+func NewBackend(c Config, l Logger) (*Backend, error) {
+	err := c.verifyBackend()
+	if err != nil {
+		return nil, err
+	}
+	stretch, _ := c.stretch()
+	shared, err := newSharedKeys(c.Key, c.KeysFile, stretch)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range shared.all() {
+		l.Printf("Keys: Loaded %s", k)
+	}
+	if c.defaultSalt() {
+		l.Printf("Keys: Stretched with the default salt, which is the same for everybody. Set the option \"KeySalt\" to one of your own, like the one WWFAs=Keygen prints, on the backend and its clients alike")
+	}
+	sess := session.New(c.MaxOutgoingConnections, c.IdleTimeout)
+	buf := buffer.New(rwBufferSize, c.MaxOutgoingConnections*2)
+	reversePorts, _ := parsePortRanges(c.ReversePorts)
+	if len(reversePorts) > 0 {
+		l.Printf("Reverse tunnels enabled on ports: %s", c.ReversePorts)
+	}
+	rsp := dispatch.NewResponder(&sess, nil, relay.Config{
+		DialTimeout:     c.DialTimeout,
+		RetrieveTimeout: c.RetrieveTimeout,
+	}, &buf, reversePorts.allowed)
+	lgg := func(format string, v ...interface{}) {
+		l.Printf(format, v...)
+	}
+	if !c.Logging {
+		lgg = func(format string, v ...interface{}) {}
+	}
+	nonces := cipher.NewNonces(c.ReplayCapacity, &sync.Mutex{})
+	l.Printf("Replays: Frames are kept against replays in %d KiB, up to %d for each key interval", nonces.Stats().Memory/1024, c.ReplayCapacity)
+	keys := cipher.NewSessions(c.IdleTimeout)
+	strms := newStreams()
+	paths, _ := parseVariants(c.AcceptPaths, true)
+	methods, _ := parseVariants(c.AcceptMethods, false)
+	fallback, _ := newFallback(c.Fallback)
+	if fallback != nil {
+		l.Printf("Requests which are not Warwolf's fall back to %s", c.Fallback)
+	}
+	return &Backend{
+		handler: handler{
+			lg:          lgg,
+			dispatch:    &rsp,
+			buffer:      &buf,
+			keys:        shared,
+			skew:        c.KeySkew,
+			sessions:    &keys,
+			nv:          nonces.Verify,
+			streams:     &strms,
+			idleTimeout: c.IdleTimeout,
+			paths:       paths,
+			methods:     methods,
+			fallback:    fallback,
+		},
+		sessions:  &sess,
+		keys:      &keys,
+		nonces:    &nonces,
+		replays:   cipher.NonceStats{},
+		recycle:   c.IdleTimeout / 2,
+		closeOnce: sync.Once{},
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.handler.Serve(w, r)
+}
+
+// Recycle closes the sessions which have been idle for longer than the
+// IdleTimeout
+func (b *Backend) Recycle() {
+	b.sessions.Recycle()
+}
+
+// Replays returns the counters of the frames which have been checked
+// against replays since the Backend was created, and how much memory they
+// are kept in
+func (b *Backend) Replays() cipher.NonceStats {
+	return b.nonces.Stats()
+}
+
+// countReplays logs the replays refused since it was last called, and the
+// frames which have been kept beyond the ReplayCapacity
+func (b *Backend) countReplays() {
+	s := b.nonces.Stats()
+	if s.Replays > b.replays.Replays {
+		b.handler.lg("Replays: %d of %d frames have been refused as replays", s.Replays-b.replays.Replays, s.Verified-b.replays.Verified)
+	}
+	if s.Overflows > b.replays.Overflows {
+		b.handler.lg("Replays: %d frames have been kept beyond the ReplayCapacity, so new frames are taken for replays more often. Raise the ReplayCapacity", s.Overflows-b.replays.Overflows)
+	}
+	b.replays = s
+}
+
+// Run recycles the idle sessions, reloads the keys file when it has changed
+// and logs the replays refused every half of the IdleTimeout, and returns
+// once the Backend is closed
+func (b *Backend) Run() {
+	ticker := time.NewTicker(b.recycle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Recycle()
+			b.handler.keys.reload(b.handler.lg)
+			b.countReplays()
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// Close stops Run and closes all the sessions, and forgets their keys.
+// Requests which are still being served fail, so the HTTP server should be
+// shut down first
+func (b *Backend) Close() {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.sessions.CloseAll()
+		b.keys.Clear()
+	})
+}
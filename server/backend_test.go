@@ -0,0 +1,48 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+	"warwolf/cipher"
+)
+
+func TestBackendReplays(t *testing.T) {
+	b, err := NewBackend(DefaultConfig(), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer b.Close()
+	r := b.Replays()
+	if r.Verified != 0 || r.Memory == 0 {
+		t.Errorf("Invalid counters of a new Backend %+v", r)
+		return
+	}
+	nonce, _ := cipher.Nonce()
+	_, now := cipher.KeyGen{}.GetAt(time.Now())
+	for i := 0; i < 2; i++ {
+		b.handler.nv(nonce[:], now)
+	}
+	r = b.Replays()
+	if r.Verified != 2 || r.Replays != 1 {
+		t.Errorf("Replay must be counted, got %+v", r)
+	}
+}
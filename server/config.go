@@ -20,12 +20,18 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"warwolf/cipher"
 	"warwolf/config"
 )
 
 type Config struct {
 	Listen                 string
 	Key                    []byte
+	KeysFile               string
+	KeyStretch             string
+	KeyRounds              int
+	KeySalt                string
+	KeySkew                time.Duration
 	Logging                bool
 	IdleTimeout            time.Duration
 	RetrieveTimeout        time.Duration
@@ -33,19 +39,71 @@ type Config struct {
 	MaxOutgoingConnections int
 	TLSPublicKeyBlock      []byte
 	TLSPrivateKeyBlock     []byte
+	TLSCertFile            string
+	TLSKeyFile             string
+	TLSReloadInterval      time.Duration
+	TLSClientCA            string
+	ReversePorts           string
+	MaxConcurrentStreams   int
+	AcceptPaths            string
+	AcceptMethods          string
+	Fallback               string
+	ReplayCapacity         int
+}
+
+// DefaultConfig returns the config of which every option is at its default,
+// for a Backend which is set up without the environment variables
+func DefaultConfig() Config {
+	return Config{
+		Listen:                 ":80",
+		Key:                    []byte("TheRightToCommunicateFreelyPrivatelySecretlyAndSecurelyIsEssentialForASafeSociety"),
+		KeyStretch:             cipher.StretchPBKDF2,
+		KeyRounds:              200000,
+		KeySalt:                cipher.DefaultSalt,
+		KeySkew:                60 * time.Second,
+		Logging:                true,
+		IdleTimeout:            120 * time.Second,
+		RetrieveTimeout:        2 * time.Second,
+		DialTimeout:            5 * time.Second,
+		MaxOutgoingConnections: 128,
+		TLSReloadInterval:      60 * time.Second,
+		MaxConcurrentStreams:   256,
+		ReplayCapacity:         262144,
+	}
 }
 
 func (c Config) Load() Config {
+	d := DefaultConfig()
+	keysFile := strings.TrimSpace(config.LoadString("KeysFile"))
+	// The default key would let anybody in along with the keys of the file
+	if len(keysFile) > 0 {
+		d.Key = nil
+	}
 	return Config{
-		Listen:                 strings.TrimSpace(config.HostPortDefault("Listen", ":80")),
-		Key:                    []byte(strings.TrimSpace(config.LoadStringDefault("Key", "TheRightToCommunicateFreelyPrivatelySecretlyAndSecurelyIsEssentialForASafeSociety"))),
+		Listen:                 strings.TrimSpace(config.HostPortDefault("Listen", d.Listen)),
+		Key:                    []byte(strings.TrimSpace(config.LoadStringDefault("Key", string(d.Key)))),
+		KeysFile:               keysFile,
+		KeyStretch:             strings.ToLower(strings.TrimSpace(config.LoadStringDefault("KeyStretch", d.KeyStretch))),
+		KeyRounds:              int(config.LoadUint32Default("KeyRounds", uint32(d.KeyRounds))),
+		KeySalt:                strings.TrimSpace(config.LoadStringDefault("KeySalt", d.KeySalt)),
+		KeySkew:                config.LoadTimeDurationDefault("KeySkew", d.KeySkew),
 		Logging:                strings.ToLower(strings.TrimSpace(config.LoadStringDefault("Logging", "yes"))) == "yes",
-		IdleTimeout:            config.LoadTimeDurationDefault("IdleTimeout", 120*time.Second),
-		RetrieveTimeout:        config.LoadTimeDurationDefault("RetrieveTimeout", 2*time.Second),
-		DialTimeout:            config.LoadTimeDurationDefault("DialTimeout", 5*time.Second),
-		MaxOutgoingConnections: int(config.LoadUint16Default("MaxOutgoingConnections", 128)),
+		IdleTimeout:            config.LoadTimeDurationDefault("IdleTimeout", d.IdleTimeout),
+		RetrieveTimeout:        config.LoadTimeDurationDefault("RetrieveTimeout", d.RetrieveTimeout),
+		DialTimeout:            config.LoadTimeDurationDefault("DialTimeout", d.DialTimeout),
+		MaxOutgoingConnections: int(config.LoadUint16Default("MaxOutgoingConnections", uint16(d.MaxOutgoingConnections))),
 		TLSPublicKeyBlock:      []byte(strings.TrimSpace(config.LoadString("TLSPublicKeyBlock"))),
 		TLSPrivateKeyBlock:     []byte(strings.TrimSpace(config.LoadString("TLSPrivateKeyBlock"))),
+		TLSCertFile:            strings.TrimSpace(config.LoadString("TLSCertFile")),
+		TLSKeyFile:             strings.TrimSpace(config.LoadString("TLSKeyFile")),
+		TLSReloadInterval:      config.LoadTimeDurationDefault("TLSReloadInterval", d.TLSReloadInterval),
+		TLSClientCA:            strings.TrimSpace(config.LoadString("TLSClientCA")),
+		ReversePorts:           strings.TrimSpace(config.LoadString("ReversePorts")),
+		MaxConcurrentStreams:   int(config.LoadUint16Default("MaxConcurrentStreams", uint16(d.MaxConcurrentStreams))),
+		AcceptPaths:            strings.TrimSpace(config.LoadString("AcceptPaths")),
+		AcceptMethods:          strings.TrimSpace(config.LoadString("AcceptMethods")),
+		Fallback:               strings.TrimSpace(config.LoadString("Fallback")),
+		ReplayCapacity:         int(config.LoadUint32Default("ReplayCapacity", uint32(d.ReplayCapacity))),
 	}
 }
 
@@ -53,20 +111,89 @@ func (c Config) Verify() (Config, error) {
 	if len(c.Listen) == 0 {
 		return c, fmt.Errorf("Option \"Listen\" is required")
 	}
-	if len(c.Key) == 0 {
-		return c, fmt.Errorf("Option \"Key\" is required")
+	err := c.verifyBackend()
+	if err != nil {
+		return c, err
+	}
+	if c.MaxConcurrentStreams < 1 {
+		return c, fmt.Errorf("Option \"MaxConcurrentStreams\" is required and must be greater than 0")
+	}
+	certs, err := loadCertificates(c.TLSPublicKeyBlock, c.TLSPrivateKeyBlock, c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return c, fmt.Errorf("Option \"TLSPublicKeyBlock\", \"TLSPrivateKeyBlock\", \"TLSCertFile\" or \"TLSKeyFile\" is invalid: %s", err)
+	}
+	if len(c.TLSClientCA) > 0 && !certs.enabled() {
+		return c, fmt.Errorf("Option \"TLSClientCA\" requires a certificate to be served")
+	}
+	_, err = newTLSConfig(certs, c.TLSClientCA)
+	if err != nil {
+		return c, fmt.Errorf("Option \"TLSClientCA\" is invalid: %s", err)
+	}
+	if c.TLSReloadInterval < 1*time.Second {
+		return c, fmt.Errorf("Option \"TLSReloadInterval\" is required and must not be smaller than %s", 1*time.Second)
+	}
+	return c, nil
+}
+
+// verifyBackend verifies the options of the Backend, which leaves the
+// listening to the HTTP server it is mounted on
+func (c Config) verifyBackend() error {
+	if len(c.Key) == 0 && len(c.KeysFile) == 0 {
+		return fmt.Errorf("Option \"Key\" or \"KeysFile\" is required")
+	}
+	if len(c.KeysFile) > 0 {
+		_, _, err := parseKeysFile(c.KeysFile)
+		if err != nil {
+			return fmt.Errorf("Option \"KeysFile\" is invalid: %s", err)
+		}
+	}
+	_, err := c.stretch()
+	if err != nil {
+		return fmt.Errorf("Option \"KeyStretch\" is invalid: %s", err)
+	}
+	if c.KeyStretch == cipher.StretchPBKDF2 && c.KeyRounds < 1000 {
+		return fmt.Errorf("Option \"KeyRounds\" is required and must not be smaller than 1000")
+	}
+	if c.KeySkew < 1*time.Second || c.KeySkew > cipher.KeySwitchInterval {
+		return fmt.Errorf("Option \"KeySkew\" is required and must be between %s and %s", 1*time.Second, cipher.KeySwitchInterval)
 	}
 	if c.IdleTimeout <= c.RetrieveTimeout {
-		return c, fmt.Errorf("Option \"IdleTimeout\" is required and must be greater than \"RetrieveTimeout\" which is currently %s", c.RetrieveTimeout)
+		return fmt.Errorf("Option \"IdleTimeout\" is required and must be greater than \"RetrieveTimeout\" which is currently %s", c.RetrieveTimeout)
 	}
 	if c.RetrieveTimeout < 1*time.Second {
-		return c, fmt.Errorf("Option \"RetrieveTimeout\" is required and must not be smaller than %s", 1*time.Second)
+		return fmt.Errorf("Option \"RetrieveTimeout\" is required and must not be smaller than %s", 1*time.Second)
 	}
 	if c.DialTimeout < 1*time.Second {
-		return c, fmt.Errorf("Option \"DialTimeout\" is required and must not smaller than %s", 1*time.Second)
+		return fmt.Errorf("Option \"DialTimeout\" is required and must not smaller than %s", 1*time.Second)
 	}
 	if c.MaxOutgoingConnections < 0 {
-		return c, fmt.Errorf("Option \"MaxOutgoingConnections\" is required and must not smaller than 0")
+		return fmt.Errorf("Option \"MaxOutgoingConnections\" is required and must not smaller than 0")
 	}
-	return c, nil
+	_, err = parsePortRanges(c.ReversePorts)
+	if err != nil {
+		return fmt.Errorf("Option \"ReversePorts\" is invalid: %s", err)
+	}
+	_, err = parseVariants(c.AcceptPaths, true)
+	if err != nil {
+		return fmt.Errorf("Option \"AcceptPaths\" is invalid: %s", err)
+	}
+	_, err = newFallback(c.Fallback)
+	if err != nil {
+		return fmt.Errorf("Option \"Fallback\" is invalid: %s", err)
+	}
+	if c.ReplayCapacity < minReplayCapacity || c.ReplayCapacity > maxReplayCapacity {
+		return fmt.Errorf("Option \"ReplayCapacity\" is required and must be between %d and %d", minReplayCapacity, maxReplayCapacity)
+	}
+	return nil
+}
+
+// stretch returns the Stretch which turns the keys into the shared keys
+func (c Config) stretch() (cipher.Stretch, error) {
+	return cipher.NewStretch(c.KeyStretch, c.KeyRounds, []byte(c.KeySalt))
+}
+
+// defaultSalt returns whether the keys are stretched with the default salt,
+// which is the same for everybody
+func (c Config) defaultSalt() bool {
+	return c.KeyStretch == cipher.StretchPBKDF2 && c.KeySalt == cipher.DefaultSalt
 }
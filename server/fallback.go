@@ -0,0 +1,105 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	ErrFallbackNotDirectory = errors.New("Fallback: Must be a directory or an http:// or https:// URL")
+)
+
+// newFallback returns the handler of the requests which are not Warwolf's,
+// which reverse proxies them to the upstream HTTP server at target when it
+// is a URL, or serves the files of the directory at target otherwise. It
+// returns nil when target is empty
+func newFallback(target string) (http.Handler, error) {
+	if len(target) == 0 {
+		return nil, nil
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil || len(u.Host) == 0 {
+			return nil, ErrFallbackNotDirectory
+		}
+		p := httputil.NewSingleHostReverseProxy(u)
+		// Errors of the upstream are the business of the upstream, and
+		// are answered the way a reverse proxy would
+		p.ErrorLog = log.New(io.Discard, "", 0)
+		return p, nil
+	}
+	st, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, ErrFallbackNotDirectory
+	}
+	return http.FileServer(http.Dir(target)), nil
+}
+
+// bodyRecorder records what has been read from the body, until it's told
+// to stop, so the body can be read once again from the start
+type bodyRecorder struct {
+	r       io.Reader
+	max     int
+	stopped bool
+	buf     bytes.Buffer
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if b.stopped {
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if err == nil && b.buf.Len() > b.max {
+		// Larger than any segment, so it can't be Warwolf's
+		return n, errHTTPInvalidBody
+	}
+	return n, err
+}
+
+// replay returns the body as it was before anything was read from it
+func (b *bodyRecorder) replay(body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(b.buf.Bytes()), body),
+		Closer: body,
+	}
+}
+
+// refuse hands the request over to the fallback when there's one, or
+// responds status otherwise
+func (h *handler) refuse(w http.ResponseWriter, r *http.Request, status int) {
+	if h.fallback == nil {
+		w.WriteHeader(status)
+		return
+	}
+	h.fallback.ServeHTTP(w, r)
+}
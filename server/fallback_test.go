@@ -0,0 +1,106 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"warwolf/cipher"
+)
+
+// fallbackSite responds the method, the URI, the size and the hash of the
+// body of each request, which tell whether it has got the request as it was
+func fallbackSite(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		s := sha256.Sum256(b)
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+strconv.Itoa(len(b))+" "+hex.EncodeToString(s[:]))
+	}))
+}
+
+func TestFallback(t *testing.T) {
+	site := fallbackSite(t)
+	defer site.Close()
+	c := DefaultConfig()
+	c.Fallback = site.URL
+	c.Logging = false
+	b, err := NewBackend(c, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer b.Close()
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	for name, size := range map[string]int{
+		"Empty":              0,
+		"Short":              100,
+		"Larger than header": cipher.HeaderSize + 1000,
+		"Buffer sized":       rwBufferSize,
+		"Larger than buffer": 3 * rwBufferSize,
+	} {
+		body := bytes.Repeat([]byte("Warwolf"), size/7+1)[:size]
+		s := sha256.Sum256(body)
+		expected := " " + strconv.Itoa(size) + " " + hex.EncodeToString(s[:])
+		for _, chunked := range []bool{false, true} {
+			var r io.Reader = bytes.NewReader(body)
+			if chunked {
+				// Hides the size, so the body is sent chunked
+				r = io.MultiReader(r)
+			}
+			req, _ := http.NewRequest("POST", srv.URL+"/form?a=b", r)
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				continue
+			}
+			got, _ := io.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			if string(got) != "POST /form?a=b"+expected {
+				t.Errorf("%s (chunked %v): Fallback got %q, expected %q", name, chunked, got, expected)
+			}
+		}
+	}
+	s := sha256.Sum256(nil)
+	for _, cookie := range []bool{false, true} {
+		req, _ := http.NewRequest("GET", srv.URL+"/page?d0=AAAA", nil)
+		if cookie {
+			req, _ = http.NewRequest("GET", srv.URL+"/page", nil)
+			req.AddCookie(&http.Cookie{Name: "d0", Value: "AAAA"})
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(got) != "GET "+req.URL.RequestURI()+" 0 "+hex.EncodeToString(s[:]) {
+			t.Errorf("Carried request must reach the fallback untouched, got %q", got)
+		}
+	}
+}
@@ -17,13 +17,18 @@
 package server
 
 import (
+	"bytes"
 	cph "crypto/cipher"
 	"errors"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 	"warwolf/buffer"
 	"warwolf/cipher"
+	"warwolf/codec"
 	"warwolf/dispatch"
 	"warwolf/log"
 	"warwolf/protocol"
@@ -31,45 +36,166 @@ import (
 )
 
 var (
-	errHTTPSubmitEOF = errors.New("HTTP: All read")
+	errHTTPSubmitEOF   = errors.New("HTTP: All read")
+	errHTTPPeeked      = errors.New("HTTP: Peeked")
+	errHTTPInvalidBody = errors.New("HTTP: Invalid request body")
 )
 
 const (
 	respondHeaderSize  = cipher.OverheadSize
 	maxRespondDataSize = rwBufferSize - (respondHeaderSize + protocol.GreatestHeaderSize)
+	joinBodySize       = cipher.KeyFrameSize + cipher.OverheadSize + protocol.JoinRequestOverhead
+	streamBodySize     = cipher.KeyFrameSize + cipher.OverheadSize + protocol.StreamRequestOverhead
 )
 
 type handler struct {
-	lg       log.Log
-	dispatch *dispatch.Responder
-	buffer   *buffer.Buffer
-	key      cipher.KeyGen
-	nv       cipher.NonceVerifier
+	lg          log.Log
+	dispatch    *dispatch.Responder
+	buffer      *buffer.Buffer
+	keys        *sharedKeys
+	skew        time.Duration
+	sessions    *cipher.Sessions
+	nv          cipher.NonceVerifier
+	streams     *streams
+	idleTimeout time.Duration
+	paths       variants
+	methods     variants
+	fallback    http.Handler
+}
+
+type joinedConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (j joinedConn) Read(b []byte) (int, error) {
+	return j.Reader.Read(b)
+}
+
+// peek parses the request in body, sent to path, when it is the only
+// request in there, of type t, and body has exactly the size of it. The body
+// is decrypted in place, so a copy of it is peeked. Only the sessions
+// already established are accepted, and the one of the request is kept in k
+func (h *handler) peek(body []byte, path string, keyTime cipher.Time, tr *cipher.Trial, k *keying, size int, t byte, parse func(r *reader.Fetcher) error) bool {
+	if len(body) != size {
+		return false
+	}
+	peek := make([]byte, size)
+	copy(peek, body)
+	parsed := false
+	nonce := [cipher.NonceSize]byte{}
+	f := reader.NewFetcher(reader.ByteFetch(peek, errHTTPSubmitEOF))
+	ts := cipher.NewTranscript(path)
+	gcm, dec := cipher.Keyed(ts, func() (cph.AEAD, error) {
+		return tr, nil
+	}, h.sessionKey(h.lg, k, tr, ts, false), func(b []byte) error {
+		if len(b) < protocol.HeaderSize {
+			return errHTTPPeeked
+		}
+		tt, _ := protocol.ParseRequestType(protocol.RequestType(b[0]))
+		if tt != t {
+			return errHTTPPeeked
+		}
+		ff := reader.NewFetcher(reader.ByteFetch(b[protocol.HeaderSize:], io.EOF))
+		parsed = parse(&ff) == nil
+		return errHTTPPeeked
+	})
+	// The nonce of the last frame is the one of the request
+	cipher.Decrypt(keyTime, gcm, ts, func(n []byte, t cipher.Time) bool {
+		copy(nonce[:], n)
+		return true
+	}, &f, errHTTPSubmitEOF, dec)
+	return parsed && h.nv(nonce[:], keyTime)
+}
+
+// joining returns the JoinRequest when it is the only request in the body
+func (h *handler) joining(body []byte, path string, keyTime cipher.Time, tr *cipher.Trial) (protocol.JoinRequest, bool) {
+	req := protocol.JoinRequest{}
+	ok := h.peek(body, path, keyTime, tr, &keying{}, joinBodySize, protocol.JoinType, req.Parse)
+	return req, ok
+}
+
+// streaming returns the StreamRequest which opens the down direction of a
+// stream when it is the only request in the body
+func (h *handler) streaming(body []byte, path string, keyTime cipher.Time, tr *cipher.Trial, k *keying) (protocol.StreamRequest, bool) {
+	req := protocol.StreamRequest{}
+	if !h.peek(body, path, keyTime, tr, k, streamBodySize, protocol.StreamType, req.Parse) {
+		return req, false
+	}
+	return req, req.Direction == protocol.StreamDown
+}
+
+// join takes over the connection and serves it as a path of the multipath
+// session
+func (h *handler) join(w http.ResponseWriter, name string, req protocol.JoinRequest, rbuf []byte) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		h.lg("%s: Join: Connection cannot be taken over", name)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		h.lg("%s: Join: Unable to take over the connection: %s", name, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	_, err = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nCache-Control: no-store\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		h.lg("%s: Join: Unable to respond: %s", name, err)
+		return
+	}
+	h.dispatch.Join(func(format string, v ...interface{}) {
+		h.lg(name+": "+format, v...)
+	}, req, joinedConn{Reader: rw.Reader, Conn: conn}, rbuf)
 }
 
 func (h *handler) Serve(w http.ResponseWriter, r *http.Request) {
 	name := r.RemoteAddr
+	// Upgrades are always GET, and are accepted by the path alone
+	upgrade := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	if !h.paths.has(r.URL.Path) || (!upgrade && !h.methods.has(r.Method)) {
+		h.lg("%s: Ignored: %s %s", name, r.Method, r.URL.Path)
+		h.refuse(w, r, http.StatusNotFound)
+		return
+	}
 	rbuf := h.buffer.Request()
 	defer h.buffer.Return(rbuf)
-	if r.ContentLength <= 0 || r.ContentLength > int64(len(rbuf)) {
-		h.lg("%s: Invalid request: Invalid request size: %d", name, r.ContentLength)
-		w.WriteHeader(http.StatusOK)
+	if upgrade {
+		h.socket(w, r, name, rbuf)
 		return
 	}
-	if r.Body == nil {
-		h.lg("%s: Invalid request: No request body", name)
-		w.WriteHeader(http.StatusBadRequest)
+	// A body of unknown size may be the upload of a stream. It's recorded
+	// until its key frame has been decrypted, and handed to the fallback
+	// from the start when it fails
+	if r.ContentLength < 0 && r.Body != nil {
+		h.upstream(w, r, name, rbuf)
 		return
 	}
-	defer r.Body.Close()
-	rlen, err := io.ReadFull(r.Body, rbuf[:r.ContentLength])
+	read := h.body
+	if r.ContentLength == 0 {
+		read = h.carried
+	}
+	rlen, err := read(w, r, name, rbuf)
 	if err != nil {
-		h.lg("%s: Invalid request: %s", name, err)
-		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	key, keyTime := h.key.Get()
-	cip, err := cipher.AEAD(key)
+	// The body is decrypted in place, so a copy of it is kept for the
+	// fallback in case it isn't Warwolf's. A body larger than rbuf has been
+	// handed over unread, and a request carried in the URL query or the
+	// cookies leaves the request untouched
+	var body []byte
+	if h.fallback != nil && r.ContentLength > 0 {
+		body = h.buffer.Request()
+		defer h.buffer.Return(body)
+		copy(body, rbuf[:rlen])
+		body = body[:rlen]
+	}
+	tr, keyTime, err := h.trial()
 	if err != nil {
 		h.lg("%s: Unable to create cipher: %s", name, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -77,54 +203,148 @@ func (h *handler) Serve(w http.ResponseWriter, r *http.Request) {
 	}
 	h.lg("%s: Has arrived", name)
 	defer h.lg("%s: Has left", name)
-	w.Header().Add("Transfer-Encoding", "chunked")
-	w.Header().Add("Content-Type", "application/octet-stream")
-	w.Header().Add("Cache-Control", "no-store")
-	w.WriteHeader(http.StatusOK)
+	if req, ok := h.joining(rbuf[:rlen], r.URL.Path, keyTime, tr); ok {
+		h.join(w, name, req, rbuf)
+		return
+	}
+	k := &keying{}
+	if req, ok := h.streaming(rbuf[:rlen], r.URL.Path, keyTime, tr, k); ok {
+		h.downstream(w, r, name, req, k)
+		return
+	}
+	k = &keying{}
 	pbuf := h.buffer.Request()
 	defer h.buffer.Return(pbuf)
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
 	f := reader.NewFetcher(reader.ByteFetch(rbuf[:rlen], errHTTPSubmitEOF))
 	p := reader.NewPusher(pbuf)
 	plock := sync.Mutex{}
-	err = cipher.Decrypt(keyTime, func() (cph.AEAD, error) {
-		return cip, nil
-	}, h.nv, &f, errHTTPSubmitEOF, func(b []byte) error {
+	timing := dispatch.NewTiming()
+	// The respond header waits for the first segment to be decrypted, so
+	// the request can still be refused when it fails
+	var cw *codec.Writer
+	ts := cipher.NewTranscript(r.URL.Path)
+	gcm, dec := cipher.Keyed(ts, func() (cph.AEAD, error) {
+		return tr, nil
+	}, h.sessionKey(func(format string, v ...interface{}) {
+		h.lg(name+": "+format, v...)
+	}, k, tr, ts, true), func(b []byte) error {
+		if cw == nil {
+			cw = h.respondHeader(w, r)
+		}
 		return h.dispatch.Dispatch(func(format string, v ...interface{}) {
 			h.lg(name+": "+format, v...)
-		}, b, func(pp dispatch.PusherExecuter) error {
-			vkey, _ := h.key.Get()
-			vcip, verr := cipher.AEAD(vkey)
-			if verr != nil {
-				return verr
-			}
-			plock.Lock()
-			defer plock.Unlock()
-			p.Truncate(cipher.HeaderSize)
-			defer p.Truncate(0)
-			e := pp(&p)
-			if e != nil {
-				return e
-			}
-			flush := p.Size() > cipher.HeaderSize
-			p.Truncate(p.Size() + cipher.BlockSize)
-			nonce, e := cipher.Nonce()
-			if e != nil {
-				return e
-			}
-			_, e = w.Write(cipher.Encrypt(vcip, nonce, p.Data()))
-			if e != nil {
-				return e
-			}
-			if flush {
-				w.(http.Flusher).Flush()
-			}
-			return nil
-		}, dispatch.Config{
+		}, b, h.pusher(cw, &p, &plock, k), dispatch.Config{
 			MaxRetrieveLen: maxRespondDataSize,
+			LocalAddr:      localAddr,
+			Timing:         timing,
 		})
 	})
+	err = cipher.Decrypt(keyTime, gcm, ts, h.nv, &f, errHTTPSubmitEOF, dec)
+	if !k.keyed && h.fallback != nil {
+		h.lg("%s: Refused: %s", name, err)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		h.fallback.ServeHTTP(w, r)
+		return
+	}
+	if cw == nil {
+		cw = h.respondHeader(w, r)
+	}
+	defer cw.Close()
+	if err == nil {
+		err = h.finish(cw, k, &plock)
+	} else {
+		h.flushKey(cw, k, &plock)
+	}
 	if err != nil {
 		h.lg("%s: Response failed: %s", name, err)
 		return
 	}
 }
+
+// body reads the request body into rbuf. Invalid requests are responded
+// right away
+func (h *handler) body(w http.ResponseWriter, r *http.Request, name string, rbuf []byte) (int, error) {
+	if r.ContentLength <= 0 || r.ContentLength > int64(len(rbuf)) {
+		h.lg("%s: Invalid request: Invalid request size: %d", name, r.ContentLength)
+		h.refuse(w, r, http.StatusOK)
+		return 0, errHTTPInvalidBody
+	}
+	if r.Body == nil {
+		h.lg("%s: Invalid request: No request body", name)
+		h.refuse(w, r, http.StatusBadRequest)
+		return 0, errHTTPInvalidBody
+	}
+	defer r.Body.Close()
+	rlen, err := io.ReadFull(r.Body, rbuf[:r.ContentLength])
+	if err != nil {
+		h.lg("%s: Invalid request: %s", name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, err
+	}
+	return rlen, nil
+}
+
+// carried reads the request carried in the URL query or the cookies into
+// rbuf, or the body when there's none
+func (h *handler) carried(w http.ResponseWriter, r *http.Request, name string, rbuf []byte) (int, error) {
+	rlen, ok, err := codec.Carried(r, rbuf)
+	if !ok {
+		return h.body(w, r, name, rbuf)
+	}
+	if err != nil {
+		h.lg("%s: Invalid request: %s", name, err)
+		h.refuse(w, r, http.StatusBadRequest)
+		return 0, err
+	}
+	return rlen, nil
+}
+
+// respondHeader responds the header in the encoding the request has asked
+// for, and returns the Writer which encodes the respond into it
+func (h *handler) respondHeader(w http.ResponseWriter, r *http.Request) *codec.Writer {
+	e := codec.Negotiate(r.Header.Get("Accept"))
+	w.Header().Add("Transfer-Encoding", "chunked")
+	w.Header().Add("Content-Type", codec.ContentType(e))
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return codec.NewWriter(w, e)
+}
+
+// pusher returns the Pusher which encrypts the responds into w with the
+// session of k, after the key frame of it
+func (h *handler) pusher(w io.Writer, p *reader.Pusher, plock *sync.Mutex, k *keying) dispatch.Pusher {
+	return func(pp dispatch.PusherExecuter) error {
+		plock.Lock()
+		defer plock.Unlock()
+		e := h.writeKey(w, k)
+		if e != nil {
+			return e
+		}
+		if k.session == nil {
+			return cipher.ErrKeyUnknownSession
+		}
+		p.Truncate(cipher.HeaderSize)
+		defer p.Truncate(0)
+		e = pp(p)
+		if e != nil {
+			return e
+		}
+		flush := p.Size() > cipher.HeaderSize
+		p.Truncate(p.Size() + cipher.BlockSize)
+		nonce, e := cipher.Nonce()
+		if e != nil {
+			return e
+		}
+		_, e = w.Write(cipher.Encrypt(k.session.Respond, k.transcript, nonce, p.Data()))
+		if e != nil {
+			return e
+		}
+		if f, ok := w.(http.Flusher); ok && flush {
+			f.Flush()
+		}
+		return nil
+	}
+}
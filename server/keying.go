@@ -0,0 +1,165 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	cph "crypto/cipher"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/log"
+)
+
+// keySkewNotice is how far off the clock of a client has to be for it to be
+// logged
+const keySkewNotice = 5 * time.Second
+
+// keying is the session a request is served with, which is named by the key
+// frame the request starts with. The respond starts with a key frame of its
+// own, which answers that one with the same shared key, and is bound to the
+// transcript of the request
+type keying struct {
+	keyed      bool
+	key        cipher.Key
+	epoch      cipher.Time
+	session    *cipher.Session
+	respond    cipher.KeyMessage
+	transcript *cipher.Transcript
+	written    bool
+	frame      [cipher.KeyFrameSize]byte
+}
+
+// trial returns the Trial of the keys which are valid now, which finds the
+// one a request has been encrypted with. The clock of the client may be off
+// by the skew
+func (h *handler) trial() (*cipher.Trial, cipher.Time, error) {
+	return cipher.NewTrial(h.keys.active(time.Now()), h.skew)
+}
+
+// skewed returns how far the clock of the side which has stamped m is
+// ahead of or behind the clock here
+func skewed(m cipher.KeyMessage) string {
+	d := time.Until(m.Time()).Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " behind"
+	}
+	return d.String() + " ahead"
+}
+
+// sessionKey returns the handler of the key frame of a request of the
+// transcript ts opened by tr, which establishes the session first when the
+// key frame asks for one. Only the sessions already established are
+// accepted when establish is false
+func (h *handler) sessionKey(lg log.Log, k *keying, tr *cipher.Trial, ts *cipher.Transcript, establish bool) func(m cipher.KeyMessage) (cph.AEAD, error) {
+	return func(m cipher.KeyMessage) (cph.AEAD, error) {
+		key, epoch, ok := tr.Opened()
+		if !ok || m.KeyID() != key.ID {
+			return nil, cipher.ErrKeyInvalidMessage
+		}
+		k.transcript = ts.Respond()
+		switch {
+		case m.Kind() == cipher.KeyHello && establish:
+			s, accept, err := cipher.Accept(key, m)
+			if err != nil {
+				return nil, err
+			}
+			h.sessions.Add(s)
+			k.keyed, k.key, k.epoch, k.session, k.respond = true, key, epoch, s, accept
+			if d := time.Since(m.Time()); d >= keySkewNotice || d <= -keySkewNotice {
+				lg("Keys: The clock of the client is %s, requests fail once it's more than %s off", skewed(m), h.skew)
+			}
+			return s.Request, nil
+		case m.Kind() == cipher.KeyUse:
+			k.keyed, k.key, k.epoch = true, key, epoch
+			// A session is only used with the key it has been established
+			// with, so it's gone along with the key
+			s, ok := h.sessions.Get(m.ID())
+			if !ok || s.Key != key.ID {
+				k.respond = cipher.UnknownKey(key.ID, m.ID())
+				return nil, cipher.ErrKeyUnknownSession
+			}
+			k.session, k.respond = s, cipher.UseKey(key.ID, s.ID)
+			return s.Request, nil
+		}
+		return nil, cipher.ErrKeyInvalidMessage
+	}
+}
+
+// writeKey writes the key frame of the respond, unless it has been written.
+// It's encrypted with the key of the request, at the time of it, so the
+// client finds it with the key it has sent the request with. Without a
+// session, nothing else can be sent, so it's the final frame
+func (h *handler) writeKey(w io.Writer, k *keying) error {
+	if k.written {
+		return nil
+	}
+	shared, err := cipher.AEAD(k.key.At(k.epoch))
+	if err != nil {
+		return err
+	}
+	f, err := cipher.KeyFrame(shared, k.transcript, k.respond, time.Now(), k.session == nil, k.frame[:])
+	if err != nil {
+		return err
+	}
+	k.written = true
+	_, err = w.Write(f)
+	return err
+}
+
+// flushKey writes the key frame of a respond which may have nothing else in
+// it, such as the respond of a handshake or of an unknown session
+func (h *handler) flushKey(w io.Writer, k *keying, plock *sync.Mutex) error {
+	if !k.keyed {
+		return nil
+	}
+	plock.Lock()
+	defer plock.Unlock()
+	err := h.writeKey(w, k)
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// finish ends the respond with its final frame, once everything else has
+// been written. A respond which has failed is left without it, so the
+// client doesn't take it for complete
+func (h *handler) finish(w io.Writer, k *keying, plock *sync.Mutex) error {
+	err := h.flushKey(w, k, plock)
+	if err != nil || k.session == nil {
+		return err
+	}
+	plock.Lock()
+	defer plock.Unlock()
+	nonce, err := cipher.Nonce()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(cipher.EncryptFinal(k.session.Respond, k.transcript, nonce, make([]byte, cipher.OverheadSize)))
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
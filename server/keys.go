@@ -0,0 +1,288 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/log"
+)
+
+var (
+	ErrKeysInvalidLine   = errors.New("Keys: Each line must be <name> <not before> <not after> <key>")
+	ErrKeysInvalidTime   = errors.New("Keys: Times must be in RFC 3339 format, or - when not limited")
+	ErrKeysInvalidWindow = errors.New("Keys: A key must become valid before it expires")
+	ErrKeysDuplicated    = errors.New("Keys: Names and keys must not be used more than once")
+)
+
+const (
+	keysOptionName = "Key"
+	keysUnlimited  = "-"
+)
+
+// keyEntry is a key as it's written in the keys file, before it's stretched
+type keyEntry struct {
+	name       string
+	notBefore  time.Time
+	notAfter   time.Time
+	passphrase []byte
+}
+
+// sharedKey is a key the backend accepts, from notBefore until notAfter when
+// either of them is set
+type sharedKey struct {
+	cipher.Key
+	name      string
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+func (k sharedKey) valid(now time.Time) bool {
+	if !k.notBefore.IsZero() && now.Before(k.notBefore) {
+		return false
+	}
+	if !k.notAfter.IsZero() && !now.Before(k.notAfter) {
+		return false
+	}
+	return true
+}
+
+func (k sharedKey) String() string {
+	s := k.name + " (ID " + hex.EncodeToString(k.ID[:]) + ")"
+	if !k.notBefore.IsZero() {
+		s += " valid from " + k.notBefore.Format(time.RFC3339)
+	}
+	if !k.notAfter.IsZero() && k.notBefore.IsZero() {
+		s += " valid until " + k.notAfter.Format(time.RFC3339)
+	} else if !k.notAfter.IsZero() {
+		s += " until " + k.notAfter.Format(time.RFC3339)
+	}
+	return s
+}
+
+// sharedKeys are the keys the backend accepts, which are the key of the Key
+// option and the keys of the keys file. The keys file is reloaded once it
+// changes
+type sharedKeys struct {
+	lock     sync.RWMutex
+	stretch  cipher.Stretch
+	option   []sharedKey
+	file     string
+	modified time.Time
+	keys     []sharedKey
+}
+
+func parseKeyTime(s string) (time.Time, error) {
+	if s == keysUnlimited {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, ErrKeysInvalidTime
+	}
+	return t, nil
+}
+
+// cutField cuts the first field off s
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// parseKeys parses the keys file read from r. Every line which isn't empty
+// or a comment is a key, in the form of
+// <name> <not before> <not after> <key>
+// where the key is the rest of the line, so it may contain spaces
+func parseKeys(r io.Reader) ([]keyEntry, error) {
+	entries := make([]keyEntry, 0, 4)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		name, rest := cutField(l)
+		notBefore, rest := cutField(rest)
+		notAfter, rest := cutField(rest)
+		passphrase := strings.TrimSpace(rest)
+		if len(passphrase) == 0 {
+			return nil, ErrKeysInvalidLine
+		}
+		e := keyEntry{
+			name:       name,
+			passphrase: []byte(passphrase),
+		}
+		var err error
+		e.notBefore, err = parseKeyTime(notBefore)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		e.notAfter, err = parseKeyTime(notAfter)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if !e.notBefore.IsZero() && !e.notAfter.IsZero() && !e.notBefore.Before(e.notAfter) {
+			return nil, fmt.Errorf("%s: %s", name, ErrKeysInvalidWindow)
+		}
+		for _, o := range entries {
+			if o.name == e.name {
+				return nil, fmt.Errorf("%s: %s", name, ErrKeysDuplicated)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+func parseKeysFile(path string) ([]keyEntry, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	entries, err := parseKeys(f)
+	return entries, st.ModTime(), err
+}
+
+// stretchKeys stretches the keys of entries. Keys which end up with the
+// same ID as a key in others, or as each other, are refused
+func stretchKeys(entries []keyEntry, stretch cipher.Stretch, others []sharedKey) ([]sharedKey, error) {
+	keys := make([]sharedKey, 0, len(entries))
+	for _, e := range entries {
+		k := sharedKey{
+			Key:       stretch.Key(e.passphrase),
+			name:      e.name,
+			notBefore: e.notBefore,
+			notAfter:  e.notAfter,
+		}
+		for _, o := range append(keys, others...) {
+			if o.ID == k.ID || o.name == k.name {
+				return nil, fmt.Errorf("%s: %s", e.name, ErrKeysDuplicated)
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// newSharedKeys stretches key, when it's given, and the keys in the keys
+// file, when there's one
+func newSharedKeys(key []byte, file string, stretch cipher.Stretch) (*sharedKeys, error) {
+	s := &sharedKeys{
+		lock:     sync.RWMutex{},
+		stretch:  stretch,
+		option:   nil,
+		file:     file,
+		modified: time.Time{},
+		keys:     nil,
+	}
+	var err error
+	if len(key) > 0 {
+		s.option, err = stretchKeys([]keyEntry{{
+			name:       keysOptionName,
+			passphrase: key,
+		}}, stretch, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(file) == 0 {
+		return s, nil
+	}
+	entries, modified, err := parseKeysFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s.keys, err = stretchKeys(entries, stretch, s.option)
+	if err != nil {
+		return nil, err
+	}
+	s.modified = modified
+	return s, nil
+}
+
+// all returns every key, valid or not
+func (s *sharedKeys) all() []sharedKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append(append([]sharedKey{}, s.option...), s.keys...)
+}
+
+// active returns the keys which are valid at now
+func (s *sharedKeys) active(now time.Time) []cipher.Key {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := make([]cipher.Key, 0, len(s.option)+len(s.keys))
+	for _, k := range s.option {
+		r = append(r, k.Key)
+	}
+	for _, k := range s.keys {
+		if k.valid(now) {
+			r = append(r, k.Key)
+		}
+	}
+	return r
+}
+
+// reload reloads the keys file when it has changed. The keys loaded before
+// stay in service when it fails to load
+func (s *sharedKeys) reload(lg log.Log) {
+	if len(s.file) == 0 {
+		return
+	}
+	st, err := os.Stat(s.file)
+	if err != nil {
+		lg("Keys: Unable to check %s: %s", s.file, err)
+		return
+	}
+	if !st.ModTime().After(s.modified) {
+		return
+	}
+	entries, modified, err := parseKeysFile(s.file)
+	if err != nil {
+		lg("Keys: Unable to reload %s: %s", s.file, err)
+		return
+	}
+	keys, err := stretchKeys(entries, s.stretch, s.option)
+	if err != nil {
+		lg("Keys: Unable to reload %s: %s", s.file, err)
+		return
+	}
+	s.lock.Lock()
+	s.keys, s.modified = keys, modified
+	s.lock.Unlock()
+	lg("Keys: %s is reloaded", s.file)
+	for _, k := range keys {
+		lg("Keys: Loaded %s", k)
+	}
+}
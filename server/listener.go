@@ -17,22 +17,21 @@
 package server
 
 import (
-	"crypto/tls"
 	"log"
 	"net/http"
 	"sync"
 	"time"
-	"warwolf/buffer"
-	"warwolf/cipher"
-	"warwolf/dispatch"
-	"warwolf/relay"
-	"warwolf/session"
 )
 
 const (
-	rwBufferSize          = (1024 * 64) - 1 // -1 to avoid overflow
-	defaultNonceStoreSize = 512
-	MaxRequestBodySize    = rwBufferSize
+	rwBufferSize       = (1024 * 64) - 1 // -1 to avoid overflow
+	MaxRequestBodySize = rwBufferSize
+
+	// minReplayCapacity and maxReplayCapacity are the bounds of the frames
+	// kept for each key interval against replays, which take 29 bits each
+	// for each of the 3 intervals kept
+	minReplayCapacity = 1024
+	maxReplayCapacity = 1 << 24
 )
 
 type Listener struct{}
@@ -50,63 +49,67 @@ func (l Listener) Listen(config Config) error {
 	defer wg.Wait()
 	closeChan := make(chan struct{})
 	defer close(closeChan)
-	sess := session.New(c.MaxOutgoingConnections, c.IdleTimeout)
-	defer sess.CloseAll()
+	backend, err := NewBackend(c, log.Default())
+	if err != nil {
+		log.Printf("Unable to start the backend: %s", err)
+		return err
+	}
+	defer backend.Close()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		timer := time.NewTimer(c.IdleTimeout / 2)
-		for {
-			select {
-			case <-timer.C:
-				sess.Recycle()
-			case <-closeChan:
-				return
-			}
-		}
+		backend.Run()
 	}()
-	buf := buffer.New(rwBufferSize, c.MaxOutgoingConnections*2)
-	rsp := dispatch.NewResponder(&sess, nil, relay.Config{
-		DialTimeout:     c.DialTimeout,
-		RetrieveTimeout: c.RetrieveTimeout,
-	}, &buf)
-	lgg := func(format string, v ...interface{}) {
-		log.Printf(format, v...)
-	}
-	if !c.Logging {
-		lgg = func(format string, v ...interface{}) {}
-	}
-	nonces := cipher.NewNonces(defaultNonceStoreSize, &sync.Mutex{})
-	handler := handler{
-		lg:       lgg,
-		dispatch: &rsp,
-		buffer:   &buf,
-		key:      cipher.KeyGen{Key: c.Key},
-		nv:       nonces.Verify,
+	// The certificates have been verified with the config
+	certs, _ := loadCertificates(c.TLSPublicKeyBlock, c.TLSPrivateKeyBlock, c.TLSCertFile, c.TLSKeyFile)
+	tlsConfig, err := newTLSConfig(certs, c.TLSClientCA)
+	if err != nil {
+		log.Printf("Invalid TLS configuration: %s", err)
+		return err
 	}
-	var tlsConfig *tls.Config
-	if len(c.TLSPublicKeyBlock) > 0 && len(c.TLSPrivateKeyBlock) > 0 {
-		cert, err := tls.X509KeyPair(
-			c.TLSPublicKeyBlock,
-			c.TLSPrivateKeyBlock,
-		)
-		if err != nil {
-			log.Printf("Invalid X509 key pair: %s", err)
-			return err
-		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
+	if tlsConfig != nil {
 		log.Printf("TLS enabled")
+		if len(c.TLSClientCA) > 0 {
+			log.Printf("TLS client certificates are required")
+		}
+	}
+	if len(certs.files) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(c.TLSReloadInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					certs.reload(func(format string, v ...interface{}) {
+						log.Printf(format, v...)
+					})
+				case <-closeChan:
+					return
+				}
+			}
+		}()
 	}
+	// HTTP/2 is negotiated with ALPN when TLS is enabled, and accepted with
+	// prior knowledge in cleartext, for load balancers which terminate TLS
+	// and speak h2c to the backend
+	protocols := http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
 	server := http.Server{
 		Addr:              c.Listen,
-		Handler:           http.HandlerFunc(handler.Serve),
+		Handler:           backend,
 		TLSConfig:         tlsConfig,
 		ReadTimeout:       c.IdleTimeout,
 		ReadHeaderTimeout: c.RetrieveTimeout,
 		WriteTimeout:      c.IdleTimeout,
 		IdleTimeout:       c.IdleTimeout,
+		Protocols:         &protocols,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: c.MaxConcurrentStreams,
+		},
 	}
 	log.Printf("Start listening on %s", c.Listen)
 	var e error
@@ -117,6 +120,10 @@ func (l Listener) Listen(config Config) error {
 		}
 		log.Printf("Shutting down: %s", e)
 	}()
+	if tlsConfig != nil {
+		e = server.ListenAndServeTLS("", "")
+		return e
+	}
 	e = server.ListenAndServe()
 	return e
 }
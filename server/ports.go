@@ -0,0 +1,73 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type portRanges []portRange
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("Invalid port \"%s\"", s)
+	}
+	return uint16(p), nil
+}
+
+func parsePortRanges(s string) (portRanges, error) {
+	r := make(portRanges, 0, 4)
+	for _, p := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(p)) == 0 {
+			continue
+		}
+		pp := strings.SplitN(p, "-", 2)
+		from, err := parsePort(pp[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(pp) > 1 {
+			to, err = parsePort(pp[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if to < from {
+			return nil, fmt.Errorf("Invalid port range \"%s\"", p)
+		}
+		r = append(r, portRange{from: from, to: to})
+	}
+	return r, nil
+}
+
+func (p portRanges) allowed(port uint16) bool {
+	for i := range p {
+		if port >= p[i].from && port <= p[i].to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+	"warwolf/buffer"
+	"warwolf/protocol"
+	"warwolf/relay"
+	"warwolf/session"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	for _, c := range []struct {
+		s       string
+		allowed []uint16
+		refused []uint16
+		invalid bool
+	}{
+		{"", nil, []uint16{1, 22, 8000, 65535}, false},
+		{"8000-8100, 9022", []uint16{8000, 8050, 8100, 9022}, []uint16{7999, 8101, 9021, 9023}, false},
+		{"65535", []uint16{65535}, []uint16{65534}, false},
+		{"0", nil, nil, true},
+		{"8100-8000", nil, nil, true},
+		{"80-", nil, nil, true},
+		{"http", nil, nil, true},
+	} {
+		p, err := parsePortRanges(c.s)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%q: Expected an error", c.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.s, err)
+			continue
+		}
+		for _, port := range c.allowed {
+			if !p.allowed(port) {
+				t.Errorf("%q: Port %d must be allowed", c.s, port)
+			}
+		}
+		for _, port := range c.refused {
+			if p.allowed(port) {
+				t.Errorf("%q: Port %d must be refused", c.s, port)
+			}
+		}
+	}
+}
+
+func TestReversePortsVerify(t *testing.T) {
+	c := DefaultConfig()
+	c.ReversePorts = "8100-8000"
+	if _, err := c.Verify(); err == nil {
+		t.Error("Invalid ReversePorts must be refused")
+	}
+}
+
+func TestReversePortsListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	allowed, _ := parsePortRanges("9022")
+	if free == 9022 {
+		t.Skip("Port 9022 is needed as a refused port")
+	}
+	sess := session.New(4, time.Minute)
+	defer sess.CloseAll()
+	b := buffer.New(rwBufferSize, 4)
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	for _, c := range []struct {
+		allowed func(port uint16) bool
+		port    uint16
+		code    byte
+	}{
+		{nil, free, protocol.DialErrorNotAllowed},
+		{allowed.allowed, free, protocol.DialErrorNotAllowed},
+		{portRanges{{from: free, to: free}}.allowed, free, 0},
+	} {
+		code := byte(0xff)
+		sess.Listen(&protocol.ListenRequest{
+			ID:             protocol.ID{byte(c.port), byte(c.port >> 8)},
+			Port:           c.port,
+			MaxRetrieveLen: 1024,
+		}, laddr, c.allowed, relay.Config{
+			DialTimeout:     time.Second,
+			RetrieveTimeout: time.Second,
+		}, &b, func(e byte, r protocol.ListenRespond) {
+			code = e
+		})
+		if code != c.code {
+			t.Errorf("Port %d: Expected code %d, got %d", c.port, c.code, code)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"warwolf/dispatch"
+	"warwolf/reader"
+	"warwolf/websocket"
+)
+
+var (
+	errHTTPSocketInvalid  = errors.New("HTTP: Invalid WebSocket handshake")
+	errHTTPSocketHijacker = errors.New("HTTP: Connection can't be taken over")
+)
+
+// socketConn is a hijacked connection, with the data already buffered by
+// the HTTP server read before the rest. Every read must complete in time
+type socketConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+func (s socketConn) Read(b []byte) (int, error) {
+	err := s.Conn.SetReadDeadline(time.Now().Add(s.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return s.r.Read(b)
+}
+
+func validSocketHandshake(r *http.Request) bool {
+	if r.Method != "GET" || r.Header.Get("Sec-Websocket-Version") != "13" {
+		return false
+	}
+	upgrade := false
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			upgrade = true
+		}
+	}
+	if !upgrade {
+		return false
+	}
+	k, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-Websocket-Key"))
+	return err == nil && len(k) == 16
+}
+
+// socket upgrades the request to a WebSocket and serves the requests sent
+// over it until the client closes it
+func (h *handler) socket(w http.ResponseWriter, r *http.Request, name string, rbuf []byte) {
+	lg := func(format string, v ...interface{}) {
+		h.lg(name+": "+format, v...)
+	}
+	if !validSocketHandshake(r) {
+		lg("Invalid request: %s", errHTTPSocketInvalid)
+		h.refuse(w, r, http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		lg("Invalid request: %s", errHTTPSocketHijacker)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		lg("Unable to take over the connection: %s", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocket.Accept(r.Header.Get("Sec-Websocket-Key")) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		lg("Unable to upgrade: %s", err)
+		return
+	}
+	lg("WebSocket: Opened")
+	ws := websocket.NewConn(socketConn{
+		Conn:    conn,
+		r:       rw.Reader,
+		timeout: h.idleTimeout,
+	}, false)
+	pbuf := h.buffer.Request()
+	defer h.buffer.Return(pbuf)
+	p := reader.NewPusher(pbuf)
+	plock := sync.Mutex{}
+	k := &keying{}
+	push := h.pusher(ws, &p, &plock, k)
+	err = h.serveSegments(lg, r.URL.Path, ws, rbuf, localAddr, k, func(b []byte) (dispatch.Pusher, bool, error) {
+		return push, false, nil
+	})
+	// Nothing else is sent when the session is unknown, and the client
+	// learns of it from the key frame alone
+	if err == nil {
+		err = h.finish(ws, k, &plock)
+	} else {
+		h.flushKey(ws, k, &plock)
+	}
+	if err != nil {
+		lg("WebSocket: Failed: %s", err)
+	}
+	ws.Shutdown()
+	ws.Close()
+	lg("WebSocket: Closed")
+}
@@ -0,0 +1,241 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	cph "crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"warwolf/cipher"
+	"warwolf/dispatch"
+	"warwolf/log"
+	"warwolf/protocol"
+	"warwolf/reader"
+)
+
+var (
+	errHTTPStreamInvalid  = errors.New("HTTP: Stream must start with a StreamUp request")
+	errHTTPStreamNotFound = errors.New("HTTP: Stream has no down direction to attach to")
+)
+
+// stream is a pair of HTTP requests. The down one has its response kept open
+// for the responds, the up one uploads the requests in a chunked body
+type stream struct {
+	push     dispatch.Pusher
+	up       bool
+	attached chan struct{}
+	done     chan struct{}
+}
+
+type streams struct {
+	lock    sync.Mutex
+	streams map[protocol.ID]*stream
+}
+
+func newStreams() streams {
+	return streams{
+		lock:    sync.Mutex{},
+		streams: make(map[protocol.ID]*stream, 16),
+	}
+}
+
+func (s *streams) open(channel protocol.ID, push dispatch.Pusher) (*stream, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.streams[channel]; ok {
+		return nil, false
+	}
+	st := &stream{
+		push:     push,
+		up:       false,
+		attached: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.streams[channel] = st
+	return st, true
+}
+
+func (s *streams) attach(channel protocol.ID) (*stream, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.streams[channel]
+	if !ok || st.up {
+		return nil, false
+	}
+	st.up = true
+	close(st.attached)
+	return st, true
+}
+
+// close removes the stream so it can no longer be attached to, and returns
+// whether it has been attached
+func (s *streams) close(channel protocol.ID, st *stream) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.streams[channel] == st {
+		delete(s.streams, channel)
+	}
+	return st.up
+}
+
+// downstream keeps the response open for the responds to the requests which
+// are uploaded by the up direction of the stream. It is done when the upload
+// is, or when nothing attaches to it in time
+func (h *handler) downstream(w http.ResponseWriter, r *http.Request, name string, req protocol.StreamRequest, k *keying) {
+	cw := h.respondHeader(w, r)
+	defer cw.Close()
+	pbuf := h.buffer.Request()
+	defer h.buffer.Return(pbuf)
+	p := reader.NewPusher(pbuf)
+	plock := sync.Mutex{}
+	push := h.pusher(cw, &p, &plock, k)
+	rsp := req.Respond()
+	st, ok := h.streams.open(req.Channel, push)
+	if !ok {
+		h.lg("%s: %s: Stream already opened", name, req.Channel)
+		err := push(func(p *reader.Pusher) error {
+			return rsp.Build(req.Channel, protocol.ResourceErrorNotReady, p)
+		})
+		if err == nil {
+			h.finish(cw, k, &plock)
+		}
+		return
+	}
+	h.lg("%s: %s: Stream", name, req.Channel)
+	defer h.lg("%s: %s: Stream: Ended", name, req.Channel)
+	err := push(func(p *reader.Pusher) error {
+		return rsp.Build(req.Channel, 0, p)
+	})
+	if err != nil {
+		h.lg("%s: %s: Stream: Error: %s", name, req.Channel, err)
+	}
+	duration := time.Duration(req.Duration) * time.Second
+	if duration > h.idleTimeout/2 {
+		duration = h.idleTimeout / 2
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-st.attached:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	if h.streams.close(req.Channel, st) {
+		<-st.done
+	}
+	err = h.finish(cw, k, &plock)
+	if err != nil {
+		h.lg("%s: %s: Stream: Error: %s", name, req.Channel, err)
+	}
+}
+
+// upstream dispatches the requests of a chunked body as they arrive, and
+// responds them on the down direction of the stream. The body is recorded
+// until its first segment has been decrypted, so it can be handed over to
+// the fallback when it isn't Warwolf's
+func (h *handler) upstream(w http.ResponseWriter, r *http.Request, name string, rbuf []byte) {
+	defer r.Body.Close()
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	lg := func(format string, v ...interface{}) {
+		h.lg(name+": "+format, v...)
+	}
+	rec := &bodyRecorder{
+		r:       r.Body,
+		max:     len(rbuf),
+		stopped: h.fallback == nil,
+	}
+	var st *stream
+	k := &keying{}
+	err := h.serveSegments(lg, r.URL.Path, rec, rbuf, localAddr, k, func(b []byte) (dispatch.Pusher, bool, error) {
+		rec.stopped = true
+		if len(b) < protocol.HeaderSize {
+			return nil, false, errHTTPStreamInvalid
+		}
+		t, _ := protocol.ParseRequestType(protocol.RequestType(b[0]))
+		ff := reader.NewFetcher(reader.ByteFetch(b[protocol.HeaderSize:], io.EOF))
+		req := protocol.StreamRequest{}
+		if t != protocol.StreamType || req.Parse(&ff) != nil || req.Direction != protocol.StreamUp {
+			return nil, false, errHTTPStreamInvalid
+		}
+		ok := false
+		st, ok = h.streams.attach(req.Channel)
+		if !ok {
+			return nil, false, errHTTPStreamNotFound
+		}
+		lg("%s: Stream: Attached", req.Channel)
+		rsp := req.Respond()
+		return st.push, true, st.push(func(p *reader.Pusher) error {
+			return rsp.Build(req.Channel, 0, p)
+		})
+	})
+	if st != nil {
+		close(st.done)
+	}
+	if !k.keyed && h.fallback != nil {
+		lg("Refused: %s", err)
+		r.Body = rec.replay(r.Body)
+		h.fallback.ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		lg("Stream upload failed: %s", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveSegments dispatches the segments read from body, sent to path, as
+// they come, and returns once all of them have been responded. The session
+// of body is kept in k. open is called with the first segment to get the
+// Pusher of the responds, and tells whether it has taken care of the segment
+// itself
+func (h *handler) serveSegments(lg log.Log, path string, body io.Reader, rbuf []byte, localAddr net.Addr, k *keying, open func(b []byte) (dispatch.Pusher, bool, error)) error {
+	tr, keyTime, err := h.trial()
+	if err != nil {
+		return err
+	}
+	var push dispatch.Pusher
+	wg := sync.WaitGroup{}
+	f := reader.NewFetcher(reader.ReaderFetch(rbuf, body, io.EOF))
+	ts := cipher.NewTranscript(path)
+	gcm, dec := cipher.Keyed(ts, func() (cph.AEAD, error) {
+		return tr, nil
+	}, h.sessionKey(lg, k, tr, ts, true), func(b []byte) error {
+		if push == nil {
+			p, done, e := open(b)
+			if e != nil {
+				return e
+			}
+			push = p
+			if done {
+				return nil
+			}
+		}
+		// The buffer of b is reused for the next segment while the
+		// handlers may still be reading it
+		return h.dispatch.DispatchAsync(lg, append([]byte{}, b...), push, &wg, dispatch.Config{
+			MaxRetrieveLen: maxRespondDataSize,
+			LocalAddr:      localAddr,
+		})
+	})
+	err = cipher.Decrypt(keyTime, gcm, ts, h.nv, &f, io.EOF, dec)
+	wg.Wait()
+	return err
+}
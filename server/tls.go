@@ -0,0 +1,215 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"warwolf/log"
+)
+
+var (
+	ErrTLSKeyFilesMismatch = errors.New("TLS: Every certificate file needs a key file of the same position")
+	ErrTLSNoCertificate    = errors.New("TLS: No certificate")
+	ErrTLSInvalidCA        = errors.New("TLS: No certificate found in the CA bundle")
+)
+
+// certificateFile is a certificate and its key loaded from files, which is
+// reloaded once either of the files changes
+type certificateFile struct {
+	cert     string
+	key      string
+	modified time.Time
+	loaded   *tls.Certificate
+}
+
+// certificates are the certificates served, one of which is picked by the
+// server name the client asks for
+type certificates struct {
+	lock   sync.RWMutex
+	inline *tls.Certificate
+	files  []certificateFile
+}
+
+func splitFileList(s string) []string {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil
+	}
+	r := strings.Split(s, ",")
+	for i := range r {
+		r[i] = strings.TrimSpace(r[i])
+	}
+	return r
+}
+
+// modifiedTime returns the time either of the files was last changed
+func (f certificateFile) modifiedTime() (time.Time, error) {
+	var t time.Time
+	for _, name := range []string{f.cert, f.key} {
+		st, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (f *certificateFile) load() error {
+	modified, err := f.modifiedTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+	if err != nil {
+		return err
+	}
+	f.modified = modified
+	f.loaded = &cert
+	return nil
+}
+
+// loadCertificates loads the inline certificate when both of its blocks are
+// given, and the certificates in the comma separated files of certFiles,
+// each paired with the key file of the same position in keyFiles
+func loadCertificates(publicBlock []byte, privateBlock []byte, certFiles string, keyFiles string) (*certificates, error) {
+	c := &certificates{
+		lock:   sync.RWMutex{},
+		inline: nil,
+		files:  nil,
+	}
+	if len(publicBlock) > 0 && len(privateBlock) > 0 {
+		cert, err := tls.X509KeyPair(publicBlock, privateBlock)
+		if err != nil {
+			return nil, err
+		}
+		c.inline = &cert
+	}
+	certs, keys := splitFileList(certFiles), splitFileList(keyFiles)
+	if len(certs) != len(keys) {
+		return nil, ErrTLSKeyFilesMismatch
+	}
+	c.files = make([]certificateFile, len(certs))
+	for i := range certs {
+		c.files[i] = certificateFile{
+			cert: certs[i],
+			key:  keys[i],
+		}
+		err := c.files[i].load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// enabled returns whether there's any certificate to serve
+func (c *certificates) enabled() bool {
+	return c.inline != nil || len(c.files) > 0
+}
+
+// reload reloads the certificates of which the files have changed. A
+// certificate which fails to load keeps the one loaded before it in service
+func (c *certificates) reload(lg log.Log) {
+	for i := range c.files {
+		c.lock.RLock()
+		f := c.files[i]
+		c.lock.RUnlock()
+		modified, err := f.modifiedTime()
+		if err != nil {
+			lg("TLS: Unable to check certificate %s: %s", f.cert, err)
+			continue
+		}
+		if !modified.After(f.modified) {
+			continue
+		}
+		err = f.load()
+		if err != nil {
+			lg("TLS: Unable to reload certificate %s: %s", f.cert, err)
+			continue
+		}
+		c.lock.Lock()
+		c.files[i] = f
+		c.lock.Unlock()
+		lg("TLS: Certificate %s is reloaded", f.cert)
+	}
+}
+
+// get returns the first certificate which is valid for the server name of
+// hello, or the first one of all when there's none
+func (c *certificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	all := make([]*tls.Certificate, 0, len(c.files)+1)
+	for _, f := range c.files {
+		all = append(all, f.loaded)
+	}
+	if c.inline != nil {
+		all = append(all, c.inline)
+	}
+	if len(all) == 0 {
+		return nil, ErrTLSNoCertificate
+	}
+	for _, cert := range all {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return all[0], nil
+}
+
+// loadCertPool loads the certificates of the PEM bundle in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, ErrTLSInvalidCA
+	}
+	return pool, nil
+}
+
+// newTLSConfig returns the TLS config which serves certs, and verifies the
+// certificate of the client against the CA bundle in clientCA when given.
+// It returns nil when there's no certificate to serve
+func newTLSConfig(certs *certificates, clientCA string) (*tls.Config, error) {
+	if !certs.enabled() {
+		return nil, nil
+	}
+	c := &tls.Config{
+		GetCertificate: certs.get,
+	}
+	if len(clientCA) == 0 {
+		return c, nil
+	}
+	pool, err := loadCertPool(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	return c, nil
+}
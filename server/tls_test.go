@@ -0,0 +1,168 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate returns the PEM blocks of a self signed certificate for
+// name, and of its key
+func testCertificate(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: k})
+}
+
+func writeTestCertificate(t *testing.T, dir string, file string, name string) (string, string) {
+	cert, key := testCertificate(t, name)
+	c, k := filepath.Join(dir, file+".crt"), filepath.Join(dir, file+".key")
+	if err := os.WriteFile(c, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(k, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c, k
+}
+
+func testHello(name string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        name,
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+	}
+}
+
+// served returns the name of the certificate served for name
+func served(t *testing.T, certs *certificates, name string) string {
+	c, err := certs.get(testHello(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificatesGet(t *testing.T) {
+	dir := t.TempDir()
+	ac, ak := writeTestCertificate(t, dir, "a", "a.example")
+	bc, bk := writeTestCertificate(t, dir, "b", "b.example")
+	inline, inlineKey := testCertificate(t, "inline.example")
+	certs, err := loadCertificates(inline, inlineKey, ac+", "+bc, ak+", "+bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"a.example":       "a.example",
+		"b.example":       "b.example",
+		"inline.example":  "inline.example",
+		"unknown.example": "a.example",
+		"":                "a.example",
+	} {
+		if got := served(t, certs, name); got != expected {
+			t.Errorf("%q: Expected %s, got %s", name, expected, got)
+		}
+	}
+	if _, err := loadCertificates(nil, nil, ac+","+bc, ak); err != ErrTLSKeyFilesMismatch {
+		t.Errorf("Expected %v, got %v", ErrTLSKeyFilesMismatch, err)
+	}
+	certs, _ = loadCertificates(nil, nil, "", "")
+	if certs.enabled() {
+		t.Error("No certificate must be served")
+	}
+	if _, err := certs.get(testHello("a.example")); err != ErrTLSNoCertificate {
+		t.Errorf("Expected %v, got %v", ErrTLSNoCertificate, err)
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	c, k := writeTestCertificate(t, dir, "a", "a.example")
+	certs, err := loadCertificates(nil, nil, c, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := func(format string, v ...interface{}) {}
+	touch := func(at time.Time) {
+		for _, f := range []string{c, k} {
+			if err := os.Chtimes(f, at, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A certificate which fails to load keeps the old one in service
+	if err := os.WriteFile(c, []byte("Not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Now().Add(time.Minute))
+	certs.reload(lg)
+	if got := served(t, certs, "a.example"); got != "a.example" {
+		t.Errorf("Expected the old certificate, got %s", got)
+	}
+	cert, key := testCertificate(t, "renewed.example")
+	if err := os.WriteFile(c, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(k, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Now().Add(2 * time.Minute))
+	certs.reload(lg)
+	if got := served(t, certs, "renewed.example"); got != "renewed.example" {
+		t.Errorf("Expected the renewed certificate, got %s", got)
+	}
+	// Removed files keep the certificate in service too
+	os.Remove(c)
+	certs.reload(lg)
+	if got := served(t, certs, "renewed.example"); got != "renewed.example" {
+		t.Errorf("Expected the renewed certificate, got %s", got)
+	}
+}
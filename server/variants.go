@@ -0,0 +1,55 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrVariantInvalidPath = errors.New("Variants: Path must start with /")
+)
+
+// variants is a set of accepted request paths or methods, of which an empty
+// one accepts everything
+type variants map[string]struct{}
+
+func parseVariants(s string, path bool) (variants, error) {
+	r := make(variants, 4)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if !path {
+			v = strings.ToUpper(v)
+		} else if v[0] != '/' {
+			return nil, ErrVariantInvalidPath
+		}
+		r[v] = struct{}{}
+	}
+	return r, nil
+}
+
+func (v variants) has(s string) bool {
+	if len(v) == 0 {
+		return true
+	}
+	_, ok := v[s]
+	return ok
+}
@@ -84,3 +84,35 @@ func buildAddr(
 		return nil, ErrInvalidAddress
 	}
 }
+
+func splitAddr(a net.Addr) (protocol.AddressType, []byte, uint16) {
+	switch aa := a.(type) {
+	case *net.TCPAddr:
+		ipv4 := aa.IP.To4()
+		if ipv4 != nil {
+			return protocol.TCPIPv4, []byte(ipv4), uint16(aa.Port)
+		}
+		return protocol.TCPIPv6, []byte(aa.IP.To16()), uint16(aa.Port)
+	case *net.UDPAddr:
+		ipv4 := aa.IP.To4()
+		if ipv4 != nil {
+			return protocol.UDPIPv4, []byte(ipv4), uint16(aa.Port)
+		}
+		return protocol.UDPIPv6, []byte(aa.IP.To16()), uint16(aa.Port)
+	default:
+		return protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0
+	}
+}
+
+func expectedIP(t protocol.AddressType, a []byte) net.IP {
+	switch t {
+	case protocol.TCPIPv4:
+		return net.IPv4(a[0], a[1], a[2], a[3])
+	case protocol.TCPIPv6:
+		ip := make(net.IP, 16)
+		copy(ip, a)
+		return ip
+	default:
+		return nil
+	}
+}
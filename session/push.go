@@ -0,0 +1,242 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"sync"
+	"time"
+	"warwolf/protocol"
+	"warwolf/relay"
+)
+
+type pushFrame struct {
+	e   byte
+	rsp protocol.PushRespond
+}
+
+// pushChannel holds the data of the sessions subscribed to it until a push
+// stream of the channel writes them out. Only the latest frame of each
+// session is kept, as a session has at most one unacknowledged read
+type pushChannel struct {
+	lock     sync.Mutex
+	sessions map[protocol.ID]*session
+	frames   map[protocol.ID]pushFrame
+	wake     chan struct{}
+	streams  int
+}
+
+func newPushChannel() *pushChannel {
+	return &pushChannel{
+		lock:     sync.Mutex{},
+		sessions: make(map[protocol.ID]*session, 16),
+		frames:   make(map[protocol.ID]pushFrame, 16),
+		wake:     make(chan struct{}, 1),
+		streams:  0,
+	}
+}
+
+func (p *pushChannel) subscribe(id protocol.ID, s *session) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sessions[id] = s
+}
+
+func (p *pushChannel) unsubscribe(id protocol.ID, s *session) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.sessions[id] != s {
+		return
+	}
+	delete(p.sessions, id)
+}
+
+func (p *pushChannel) queue(f pushFrame) {
+	p.lock.Lock()
+	p.frames[f.rsp.ID] = f
+	p.lock.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts back the frames which were taken but not written, unless
+// they have been replaced by newer ones in the mean time
+func (p *pushChannel) requeue(frames []pushFrame) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, f := range frames {
+		if _, ok := p.frames[f.rsp.ID]; ok {
+			continue
+		}
+		p.frames[f.rsp.ID] = f
+	}
+}
+
+func (p *pushChannel) take() []pushFrame {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.frames) == 0 {
+		return nil
+	}
+	r := make([]pushFrame, 0, len(p.frames))
+	for id, f := range p.frames {
+		r = append(r, f)
+		delete(p.frames, id)
+	}
+	return r
+}
+
+func (p *pushChannel) subscribed() []*session {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r := make([]*session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		r = append(r, s)
+	}
+	return r
+}
+
+func (p *pushChannel) attach() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.streams++
+}
+
+func (p *pushChannel) detach() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.streams--
+}
+
+func (p *pushChannel) idle() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.streams == 0 && len(p.sessions) == 0 && len(p.frames) == 0
+}
+
+// subscribe switches the session into push mode, where instead of waiting
+// for retrieve requests, the session reads by itself and pushes what it has
+// read to the channel. Reads are still acknowledged with resume requests
+func (s *session) subscribe(id protocol.ID, ch *pushChannel, maxlen int, timeout time.Duration, remover func()) byte {
+	ll := lll(&s.l)
+	ll.lock()
+	defer ll.unlock()
+	if s.closed {
+		return protocol.ResourceErrorNotFound
+	}
+	if s.push != nil && s.push != ch {
+		s.push.unsubscribe(id, s)
+	}
+	s.pushID = id
+	s.push = ch
+	s.pushMaxlen = maxlen
+	s.pushTimeout = timeout
+	s.pushRemover = remover
+	ch.subscribe(id, s)
+	if !s.arm() {
+		return 0
+	}
+	ll.unlock()
+	s.relay.Retrieve(s.pushed, s.pushTimeout)
+	return 0
+}
+
+// arm prepares the session for its next read in push mode, and returns
+// whether the read should be started. Must be called with the lock held
+func (s *session) arm() bool {
+	if s.push == nil || s.closed || s.armed || s.rbusy {
+		return false
+	}
+	if s.rpaused && s.readLen > 0 {
+		return false
+	}
+	s.rpaused = false
+	s.read = nil
+	s.readLen = 0
+	s.armed = true
+	return true
+}
+
+func (s *session) pushed(r []byte, err relay.Error) {
+	ll := lll(&s.l)
+	ll.lock()
+	defer ll.unlock()
+	s.armed = false
+	if s.closed || s.push == nil {
+		return
+	}
+	ch := s.push
+	if err.IsError() && err.IsTimeout {
+		s.armed = true
+		ll.unlock()
+		s.relay.Retrieve(s.pushed, s.pushTimeout)
+		return
+	}
+	if err.IsError() {
+		f := pushFrame{
+			e:   protocol.ResourceErrorBroken,
+			rsp: protocol.PushRespond{ID: s.pushID, RID: s.rid},
+		}
+		remover := s.pushRemover
+		ll.unlock()
+		ch.queue(f)
+		remover()
+		return
+	}
+	s.read = r
+	s.readLen = uint16(len(r))
+	s.rpaused = true
+	f, _ := s.pushing()
+	ll.unlock()
+	ch.queue(f)
+}
+
+// pushing returns the frame of the read which is yet to be acknowledged.
+// Must be called with the lock held
+func (s *session) pushing() (pushFrame, bool) {
+	if s.push == nil || s.closed || !s.rpaused || s.readLen == 0 {
+		return pushFrame{}, false
+	}
+	total, offset, data := s.readData(0, s.pushMaxlen)
+	return pushFrame{
+		e: 0,
+		rsp: protocol.PushRespond{
+			ID:            s.pushID,
+			RID:           s.rid,
+			Total:         total,
+			Offset:        offset,
+			Payload:       append([]byte{}, data...),
+			PayloadLength: uint16(len(data)),
+		},
+	}, true
+}
+
+// repush queues the unacknowledged read again, for when the push stream it
+// has been written to might have been lost
+func (s *session) repush() {
+	ll := lll(&s.l)
+	ll.lock()
+	defer ll.unlock()
+	f, ok := s.pushing()
+	if !ok {
+		return
+	}
+	ch := s.push
+	ll.unlock()
+	ch.queue(f)
+}
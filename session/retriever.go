@@ -58,6 +58,11 @@ var (
 		false,
 	)
 
+	ErrResourceWaiting = newRetrieverError(
+		errors.New("Resource: Waiting"),
+		true,
+	)
+
 	ErrDialFailedInvalidRequest = newRetrieverError(
 		errors.New("Dial failure: Invalid request"),
 		false,
@@ -83,6 +88,11 @@ var (
 		false,
 	)
 
+	ErrDialFailedNotAllowed = newRetrieverError(
+		errors.New("Dial failure: Not allowed"),
+		false,
+	)
+
 	ErrDialFailedUnknown = newRetrieverError(
 		errors.New("Dial failure: Unknown"),
 		false,
@@ -122,6 +132,8 @@ func getRetrieverResourceError(n byte) RetrieverError {
 		return ErrResourceSendFailure
 	case protocol.ResourceErrorUnknown:
 		return ErrResourceUnknown
+	case protocol.ResourceErrorWaiting:
+		return ErrResourceWaiting
 	default:
 		return ErrResourceUnknown
 	}
@@ -139,6 +151,8 @@ func getRetrieverDialError(n byte) RetrieverError {
 		return ErrDialFailedAlreadyDialed
 	case protocol.DialErrorInternalFailure:
 		return ErrDialFailedInternalFailure
+	case protocol.DialErrorNotAllowed:
+		return ErrDialFailedNotAllowed
 	default:
 		return ErrDialFailedUnknown
 	}
@@ -149,6 +163,11 @@ type RetrieverDialResult func(e RetrieverError)
 type RetrieverRetrieveResult func(e RetrieverError)
 type RetrieverSendResult func(size uint16, e RetrieverError)
 type RetrieverCloseResult func(e RetrieverError)
+type RetrieverBindResult func(atyp protocol.AddressType, addr []byte, port uint16, e RetrieverError)
+type RetrieverAcceptResult func(atyp protocol.AddressType, addr []byte, port uint16, e RetrieverError)
+type RetrieverListenResult func(atyp protocol.AddressType, addr []byte, port uint16, e RetrieverError)
+type RetrieverIncomingResult func(cid protocol.ID, atyp protocol.AddressType, addr []byte, port uint16, e RetrieverError)
+type RetrieverMultipathResult func(key [protocol.MultipathKeySize]byte, e RetrieverError)
 
 type Retriever interface {
 	Dialed()
@@ -159,28 +178,48 @@ type Retriever interface {
 }
 
 type retriever struct {
-	rec     Retriever
-	dialcb  RetrieverDialResult
-	rid     uint64
-	roffset uint16
-	rtotal  uint16
-	rcb     RetrieverRetrieveResult
-	wid     uint64
-	wcb     RetrieverSendResult
-	ccb     RetrieverCloseResult
+	rec            Retriever
+	owner          int
+	dialcb         RetrieverDialResult
+	rid            uint64
+	roffset        uint16
+	rtotal         uint16
+	rcb            RetrieverRetrieveResult
+	wid            uint64
+	wcb            RetrieverSendResult
+	ccb            RetrieverCloseResult
+	bcb            RetrieverBindResult
+	acb            RetrieverAcceptResult
+	lcb            RetrieverListenResult
+	icb            RetrieverIncomingResult
+	mcb            RetrieverMultipathResult
+	pushing        bool
+	pushSubscribed bool
+	waiting        bool
+	moved          bool
 }
 
-func newRetriever(rec Retriever) *retriever {
+func newRetriever(rec Retriever, owner int) *retriever {
 	return &retriever{
-		rec:     rec,
-		dialcb:  nil,
-		rid:     0,
-		roffset: 0,
-		rtotal:  0,
-		rcb:     nil,
-		wid:     0,
-		wcb:     nil,
-		ccb:     nil,
+		rec:            rec,
+		owner:          owner,
+		dialcb:         nil,
+		rid:            0,
+		roffset:        0,
+		rtotal:         0,
+		rcb:            nil,
+		wid:            0,
+		wcb:            nil,
+		ccb:            nil,
+		bcb:            nil,
+		acb:            nil,
+		lcb:            nil,
+		icb:            nil,
+		mcb:            nil,
+		pushing:        false,
+		pushSubscribed: false,
+		waiting:        false,
+		moved:          false,
 	}
 }
 
@@ -212,6 +251,118 @@ func (r *retriever) dialed(e byte, d *protocol.DialRespond, rr *reader.Fetcher,
 	})
 }
 
+func (r *retriever) bound(e byte, d *protocol.BindRespond, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
+	if r.bcb == nil {
+		er(ErrNotReady)
+		return ErrNotReady
+	}
+	c.clear(d.ID)
+	bcb := r.bcb
+	r.bcb = nil
+	if e > 0 {
+		err := getRetrieverDialError(e)
+		er(err)
+		l.unlock()
+		bcb(d.ATyp, nil, 0, err)
+		return err
+	}
+	er(nil)
+	l.unlock()
+	bcb(d.ATyp, d.Addr, d.Port, RetrieverError{})
+	return nil
+}
+
+func (r *retriever) accepted(e byte, d *protocol.AcceptRespond, rr *reader.Fetcher, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
+	if r.acb == nil {
+		er(ErrNotReady)
+		return ErrNotReady
+	}
+	c.clear(d.ID)
+	acb := r.acb
+	r.acb = nil
+	if e > 0 {
+		err := getRetrieverResourceError(e)
+		er(err)
+		l.unlock()
+		acb(d.ATyp, nil, 0, err)
+		return err
+	}
+	r.rid = d.RID
+	r.roffset = d.RespondLength
+	r.rtotal = d.Total
+	roffset := r.roffset
+	er(nil)
+	l.unlock()
+	acb(d.ATyp, d.Addr, d.Port, RetrieverError{})
+	r.rec.Dialed()
+	return reader.FetchAll(int(roffset), rr, func(b []byte) {
+		r.rec.Retrieved(b)
+	})
+}
+
+func (r *retriever) listened(e byte, d *protocol.ListenRespond, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
+	if r.lcb == nil {
+		er(ErrNotReady)
+		return ErrNotReady
+	}
+	c.clear(d.ID)
+	lcb := r.lcb
+	r.lcb = nil
+	if e > 0 {
+		err := getRetrieverDialError(e)
+		er(err)
+		l.unlock()
+		lcb(d.ATyp, nil, 0, err)
+		return err
+	}
+	er(nil)
+	l.unlock()
+	lcb(d.ATyp, d.Addr, d.Port, RetrieverError{})
+	return nil
+}
+
+func (r *retriever) multipathed(e byte, d *protocol.MultipathRespond, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
+	if r.mcb == nil {
+		er(ErrNotReady)
+		return ErrNotReady
+	}
+	c.clear(d.ID)
+	mcb := r.mcb
+	r.mcb = nil
+	if e > 0 {
+		err := getRetrieverDialError(e)
+		er(err)
+		l.unlock()
+		mcb([protocol.MultipathKeySize]byte{}, err)
+		return err
+	}
+	er(nil)
+	l.unlock()
+	mcb(d.Key, RetrieverError{})
+	return nil
+}
+
+func (r *retriever) arrived(e byte, d *protocol.IncomingRespond, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
+	if r.icb == nil {
+		er(ErrNotReady)
+		return ErrNotReady
+	}
+	c.clear(d.ID)
+	icb := r.icb
+	r.icb = nil
+	if e > 0 {
+		err := getRetrieverResourceError(e)
+		er(err)
+		l.unlock()
+		icb(d.CID, d.ATyp, nil, 0, err)
+		return err
+	}
+	er(nil)
+	l.unlock()
+	icb(d.CID, d.ATyp, d.Addr, d.Port, RetrieverError{})
+	return nil
+}
+
 func (r *retriever) retrieved(e byte, d *protocol.RetrieveRespond, rr *reader.Fetcher, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
 	if r.rcb == nil {
 		er(ErrNotReady)
@@ -261,6 +412,13 @@ func (r *retriever) resumed(e byte, d *protocol.ResumeRespond, rr *reader.Fetche
 		rcb(err)
 		return err
 	}
+	if r.pushing && r.rid == d.NewRID {
+		// The push of the next read has overtaken this respond
+		er(nil)
+		l.unlock()
+		rcb(RetrieverError{})
+		return nil
+	}
 	if r.rid >= d.NewRID {
 		er(ErrResumeUnexpectedRespondRetry)
 		l.unlock()
@@ -281,6 +439,95 @@ func (r *retriever) resumed(e byte, d *protocol.ResumeRespond, rr *reader.Fetche
 	})
 }
 
+// retrieve builds the request which retrieves the rest of the current read,
+// or which acknowledges it and moves on to the next read
+func (r *retriever) retrieve(id protocol.ID, p *reader.Pusher) error {
+	if r.roffset >= r.rtotal {
+		rr := protocol.ResumeRequest{
+			ID:  id,
+			RID: r.rid,
+		}
+		return rr.Build(id, p)
+	}
+	rr := protocol.RetrieveRequest{
+		ID:     id,
+		RID:    r.rid,
+		Offset: r.roffset,
+	}
+	return rr.Build(id, p)
+}
+
+func (r *retriever) subscribed(e byte, d *protocol.SubscribeRespond, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
+	if r.rcb == nil {
+		er(ErrNotReady)
+		return ErrNotReady
+	}
+	c.clear(d.ID)
+	rcb := r.rcb
+	r.rcb = nil
+	if e > 0 {
+		err := getRetrieverResourceError(e)
+		er(err)
+		l.unlock()
+		rcb(err)
+		return err
+	}
+	r.pushSubscribed = true
+	er(nil)
+	l.unlock()
+	rcb(RetrieverError{})
+	return nil
+}
+
+// pushed takes the data pushed to the session. It's either the first part of
+// the current read, or the first part of the next read after the current one
+// has been fully retrieved and acknowledged. Anything else is a stale push
+// which is ignored
+func (r *retriever) pushed(e byte, d *protocol.PushRespond, rr *reader.Fetcher, l *lock, er retrieverErrorReact) error {
+	if !r.pushing {
+		er(nil)
+		return ErrNotReady
+	}
+	var rcb RetrieverRetrieveResult
+	if r.waiting {
+		rcb = r.rcb
+		r.rcb = nil
+		r.waiting = false
+	}
+	if e > 0 {
+		err := getRetrieverResourceError(e)
+		er(err)
+		l.unlock()
+		if rcb != nil {
+			rcb(err)
+		}
+		return err
+	}
+	current := d.RID == r.rid && d.Offset == r.roffset && r.rtotal == 0
+	next := d.RID == r.rid+1 && d.Offset == 0 && r.rtotal > 0 && r.roffset >= r.rtotal
+	if !current && !next {
+		if rcb != nil {
+			r.rcb = rcb
+			r.waiting = true
+		}
+		er(nil)
+		return nil
+	}
+	r.rid = d.RID
+	r.roffset = d.Offset + d.PayloadLength
+	r.rtotal = d.Total
+	r.rec.Retrieving(true)
+	defer r.rec.Retrieving(false)
+	er(nil)
+	l.unlock()
+	if rcb != nil {
+		rcb(RetrieverError{})
+	}
+	return reader.FetchAll(int(d.PayloadLength), rr, func(b []byte) {
+		r.rec.Retrieved(b)
+	})
+}
+
 func (r *retriever) sent(e byte, d *protocol.SendRespond, l *lock, er retrieverErrorReact, c *RetrieverCancels) error {
 	if r.wcb == nil {
 		er(ErrNotReady)
@@ -314,10 +561,20 @@ func (r *retriever) release() func() {
 	rcb := r.rcb
 	wcb := r.wcb
 	ccb := r.ccb
+	bcb := r.bcb
+	acb := r.acb
+	lcb := r.lcb
+	icb := r.icb
+	mcb := r.mcb
 	r.dialcb = nil
 	r.rcb = nil
 	r.wcb = nil
 	r.ccb = nil
+	r.bcb = nil
+	r.acb = nil
+	r.lcb = nil
+	r.icb = nil
+	r.mcb = nil
 	return func() {
 		if dialcb != nil {
 			dialcb(ErrResourceClosed)
@@ -331,6 +588,21 @@ func (r *retriever) release() func() {
 		if ccb != nil {
 			ccb(ErrResourceClosed)
 		}
+		if bcb != nil {
+			bcb(protocol.TCPIPv4, nil, 0, ErrResourceClosed)
+		}
+		if acb != nil {
+			acb(protocol.TCPIPv4, nil, 0, ErrResourceClosed)
+		}
+		if lcb != nil {
+			lcb(protocol.TCPIPv4, nil, 0, ErrResourceClosed)
+		}
+		if icb != nil {
+			icb(protocol.ID{}, protocol.TCPIPv4, nil, 0, ErrResourceClosed)
+		}
+		if mcb != nil {
+			mcb([protocol.MultipathKeySize]byte{}, ErrResourceClosed)
+		}
 		r.rec.Close()
 	}
 }
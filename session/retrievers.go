@@ -102,7 +102,7 @@ func (r *Retrievers) runExec(exec func()) {
 	exec()
 }
 
-func (r *Retrievers) Retriever(builder RetrieverBuilder) (protocol.ID, Retriever, error) {
+func (r *Retrievers) Retriever(builder RetrieverBuilder, owner int) (protocol.ID, Retriever, error) {
 	ll := lll(r.lock)
 	ll.lock()
 	defer ll.unlock()
@@ -114,11 +114,72 @@ func (r *Retrievers) Retriever(builder RetrieverBuilder) (protocol.ID, Retriever
 		return id, nil, err
 	}
 	rec := builder(id)
-	ret := newRetriever(rec)
+	ret := newRetriever(rec, owner)
 	r.sessions[id] = ret
 	return id, rec, nil
 }
 
+func (r *Retrievers) Owner(id protocol.ID) (int, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		return 0, ErrRetrieverUndefined
+	}
+	return s.owner, nil
+}
+
+func (r *Retrievers) SetOwner(id protocol.ID, owner int) error {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	s.owner = owner
+	return nil
+}
+
+// Move pins the session to another owner, and builds the request which closes
+// what the former owner may have opened for it. The respond to that request
+// is reported to c, and leaves the session open
+func (r *Retrievers) Move(id protocol.ID, owner int, p *reader.Pusher, c RetrieverCloseResult) (RetrieverCancel, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		return nil, ErrRetrieverUndefined
+	}
+	rr := protocol.CloseRequest{
+		ID: id,
+	}
+	err := rr.Build(id, p)
+	if err != nil {
+		return nil, err
+	}
+	s.owner = owner
+	s.moved = true
+	return RetrieverCancel(c), nil
+}
+
+func (r *Retrievers) Adopt(id protocol.ID, builder RetrieverBuilder, owner int) (Retriever, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	if len(r.sessions) >= r.capacity {
+		return nil, ErrRetrieversFull
+	}
+	if _, ex := r.sessions[id]; ex {
+		return nil, ErrRetrieverBusy
+	}
+	rec := builder(id)
+	r.sessions[id] = newRetriever(rec, owner)
+	return rec, nil
+}
+
 func (r *Retrievers) Register(id protocol.ID, rr protocol.DialRequest, p *reader.Pusher, rec Retriever, c RetrieverDialResult) (RetrieverCancel, error) {
 	ll := lll(r.lock)
 	ll.lock()
@@ -167,6 +228,252 @@ func (r *Retrievers) Registered(e byte, d *protocol.DialRespond, rr *reader.Fetc
 	}, c)
 }
 
+func (r *Retrievers) Bind(id protocol.ID, rr protocol.BindRequest, p *reader.Pusher, c RetrieverBindResult) (RetrieverCancel, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		c(rr.ATyp, nil, 0, newRetrieverError(ErrRetrieverUndefined, false))
+		return nil, ErrRetrieverUndefined
+	}
+	if s.bcb != nil {
+		c(rr.ATyp, nil, 0, newRetrieverError(ErrRetrieverBusy, false))
+		return nil, ErrRetrieverBusy
+	}
+	err := rr.Build(id, p)
+	if err != nil {
+		c(rr.ATyp, nil, 0, newRetrieverError(err, false))
+		return nil, err
+	}
+	s.bcb = c
+	return func(e RetrieverError) {
+		ll := lll(r.lock)
+		ll.lock()
+		defer ll.unlock()
+		bcb := s.bcb
+		s.bcb = nil
+		ll.unlock()
+		if bcb == nil {
+			return
+		}
+		bcb(rr.ATyp, nil, 0, e)
+	}, nil
+}
+
+func (r *Retrievers) Bound(e byte, d *protocol.BindRespond, c *RetrieverCancels) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.bound(e, d, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	}, c)
+}
+
+func (r *Retrievers) Accept(id protocol.ID, p *reader.Pusher, c RetrieverAcceptResult) (RetrieverCancel, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		c(protocol.TCPIPv4, nil, 0, newRetrieverError(ErrRetrieverUndefined, false))
+		return nil, ErrRetrieverUndefined
+	}
+	if s.acb != nil {
+		c(protocol.TCPIPv4, nil, 0, newRetrieverError(ErrRetrieverBusy, false))
+		return nil, ErrRetrieverBusy
+	}
+	rr := protocol.AcceptRequest{
+		ID: id,
+	}
+	err := rr.Build(id, p)
+	if err != nil {
+		c(protocol.TCPIPv4, nil, 0, newRetrieverError(err, false))
+		return nil, err
+	}
+	s.acb = c
+	return func(e RetrieverError) {
+		ll := lll(r.lock)
+		ll.lock()
+		defer ll.unlock()
+		acb := s.acb
+		s.acb = nil
+		ll.unlock()
+		if acb == nil {
+			return
+		}
+		acb(protocol.TCPIPv4, nil, 0, e)
+	}, nil
+}
+
+func (r *Retrievers) Accepted(e byte, d *protocol.AcceptRespond, rr *reader.Fetcher, c *RetrieverCancels) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.accepted(e, d, rr, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	}, c)
+}
+
+func (r *Retrievers) Listen(id protocol.ID, rr protocol.ListenRequest, p *reader.Pusher, c RetrieverListenResult) (RetrieverCancel, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		c(protocol.TCPIPv4, nil, 0, newRetrieverError(ErrRetrieverUndefined, false))
+		return nil, ErrRetrieverUndefined
+	}
+	if s.lcb != nil {
+		c(protocol.TCPIPv4, nil, 0, newRetrieverError(ErrRetrieverBusy, false))
+		return nil, ErrRetrieverBusy
+	}
+	err := rr.Build(id, p)
+	if err != nil {
+		c(protocol.TCPIPv4, nil, 0, newRetrieverError(err, false))
+		return nil, err
+	}
+	s.lcb = c
+	return func(e RetrieverError) {
+		ll := lll(r.lock)
+		ll.lock()
+		defer ll.unlock()
+		lcb := s.lcb
+		s.lcb = nil
+		ll.unlock()
+		if lcb == nil {
+			return
+		}
+		lcb(protocol.TCPIPv4, nil, 0, e)
+	}, nil
+}
+
+func (r *Retrievers) Listened(e byte, d *protocol.ListenRespond, c *RetrieverCancels) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.listened(e, d, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	}, c)
+}
+
+func (r *Retrievers) Multipath(id protocol.ID, rr protocol.MultipathRequest, p *reader.Pusher, c RetrieverMultipathResult) (RetrieverCancel, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		c([protocol.MultipathKeySize]byte{}, newRetrieverError(ErrRetrieverUndefined, false))
+		return nil, ErrRetrieverUndefined
+	}
+	if s.mcb != nil {
+		c([protocol.MultipathKeySize]byte{}, newRetrieverError(ErrRetrieverBusy, false))
+		return nil, ErrRetrieverBusy
+	}
+	err := rr.Build(id, p)
+	if err != nil {
+		c([protocol.MultipathKeySize]byte{}, newRetrieverError(err, false))
+		return nil, err
+	}
+	s.mcb = c
+	return func(e RetrieverError) {
+		ll := lll(r.lock)
+		ll.lock()
+		defer ll.unlock()
+		mcb := s.mcb
+		s.mcb = nil
+		ll.unlock()
+		if mcb == nil {
+			return
+		}
+		mcb([protocol.MultipathKeySize]byte{}, e)
+	}, nil
+}
+
+func (r *Retrievers) Multipathed(e byte, d *protocol.MultipathRespond, c *RetrieverCancels) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.multipathed(e, d, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	}, c)
+}
+
+func (r *Retrievers) Incoming(id protocol.ID, p *reader.Pusher, c RetrieverIncomingResult) (RetrieverCancel, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		c(protocol.ID{}, protocol.TCPIPv4, nil, 0, newRetrieverError(ErrRetrieverUndefined, false))
+		return nil, ErrRetrieverUndefined
+	}
+	if s.icb != nil {
+		c(protocol.ID{}, protocol.TCPIPv4, nil, 0, newRetrieverError(ErrRetrieverBusy, false))
+		return nil, ErrRetrieverBusy
+	}
+	rr := protocol.IncomingRequest{
+		ID: id,
+	}
+	err := rr.Build(id, p)
+	if err != nil {
+		c(protocol.ID{}, protocol.TCPIPv4, nil, 0, newRetrieverError(err, false))
+		return nil, err
+	}
+	s.icb = c
+	return func(e RetrieverError) {
+		ll := lll(r.lock)
+		ll.lock()
+		defer ll.unlock()
+		icb := s.icb
+		s.icb = nil
+		ll.unlock()
+		if icb == nil {
+			return
+		}
+		icb(protocol.ID{}, protocol.TCPIPv4, nil, 0, e)
+	}, nil
+}
+
+func (r *Retrievers) Arrived(e byte, d *protocol.IncomingRespond, c *RetrieverCancels) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.arrived(e, d, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	}, c)
+}
+
 func (r *Retrievers) Retrieve(id protocol.ID, p *reader.Pusher, c RetrieverRetrieveResult) (RetrieverCancel, error) {
 	ll := lll(r.lock)
 	ll.lock()
@@ -180,26 +487,16 @@ func (r *Retrievers) Retrieve(id protocol.ID, p *reader.Pusher, c RetrieverRetri
 		c(newRetrieverError(ErrRetrieverBusy, false))
 		return nil, ErrRetrieverBusy
 	}
-	var err error
-	if s.roffset >= s.rtotal {
-		rr := protocol.ResumeRequest{
-			ID:  id,
-			RID: s.rid,
-		}
-		err = rr.Build(id, p)
-	} else {
-		rr := protocol.RetrieveRequest{
-			ID:     id,
-			RID:    s.rid,
-			Offset: s.roffset,
-		}
-		err = rr.Build(id, p)
-	}
+	err := s.retrieve(id, p)
 	if err != nil {
 		c(newRetrieverError(err, false))
 		return nil, err
 	}
 	s.rcb = c
+	return r.retrieveCancel(s), nil
+}
+
+func (r *Retrievers) retrieveCancel(s *retriever) RetrieverCancel {
 	return func(e RetrieverError) {
 		ll := lll(r.lock)
 		ll.lock()
@@ -211,7 +508,79 @@ func (r *Retrievers) Retrieve(id protocol.ID, p *reader.Pusher, c RetrieverRetri
 			return
 		}
 		rcb(e)
-	}, nil
+	}
+}
+
+// Await is Retrieve for sessions which have their data pushed through
+// channel. The first call subscribes the session to the channel. After that,
+// a request is only built when there is something to retrieve or to
+// acknowledge, otherwise c is parked until the data is pushed, and false is
+// returned to tell that nothing is to be sent
+func (r *Retrievers) Await(id protocol.ID, channel protocol.ID, p *reader.Pusher, c RetrieverRetrieveResult) (RetrieverCancel, bool, error) {
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[id]
+	if !ex {
+		c(newRetrieverError(ErrRetrieverUndefined, false))
+		return nil, false, ErrRetrieverUndefined
+	}
+	if s.rcb != nil {
+		c(newRetrieverError(ErrRetrieverBusy, false))
+		return nil, false, ErrRetrieverBusy
+	}
+	var err error
+	switch {
+	case !s.pushSubscribed:
+		rr := protocol.SubscribeRequest{
+			ID:      id,
+			Channel: channel,
+		}
+		err = rr.Build(id, p)
+		s.pushing = s.pushing || err == nil
+	case s.rtotal == 0:
+		s.rcb = c
+		s.waiting = true
+		return nil, false, nil
+	default:
+		err = s.retrieve(id, p)
+	}
+	if err != nil {
+		c(newRetrieverError(err, false))
+		return nil, false, err
+	}
+	s.rcb = c
+	return r.retrieveCancel(s), true, nil
+}
+
+func (r *Retrievers) Subscribed(e byte, d *protocol.SubscribeRespond, c *RetrieverCancels) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.subscribed(e, d, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	}, c)
+}
+
+func (r *Retrievers) Pushed(e byte, d *protocol.PushRespond, rr *reader.Fetcher) error {
+	var u func() = nil
+	defer func() { r.runExec(u) }()
+	ll := lll(r.lock)
+	ll.lock()
+	defer ll.unlock()
+	s, ex := r.sessions[d.ID]
+	if !ex {
+		return ErrRetrieverUndefined
+	}
+	return s.pushed(e, d, rr, &ll, func(e error) {
+		u, _ = r.reactToError(d.ID, e)
+	})
 }
 
 func (r *Retrievers) Retrieved(e byte, d *protocol.RetrieveRespond, rr *reader.Fetcher, c *RetrieverCancels) error {
@@ -364,6 +733,16 @@ func (r *Retrievers) Closed(e byte, d *protocol.CloseRespond, c *RetrieverCancel
 	ll := lll(r.lock)
 	ll.lock()
 	defer ll.unlock()
+	if s, ex := r.sessions[d.ID]; ex && s.moved && s.ccb == nil {
+		// Respond of a former owner to the close sent by Move
+		cc, ok := (*c)[d.ID]
+		c.clear(d.ID)
+		ll.unlock()
+		if ok {
+			cc(RetrieverError{})
+		}
+		return nil
+	}
 	rr, err := r.release(d.ID)
 	if err != nil {
 		return err
@@ -34,23 +34,59 @@ var (
 
 const (
 	initialConnectWait = 300 * time.Millisecond
+	holdSlice          = 50 * time.Millisecond
 )
 
+// Hold is how long a retrieve waits for data, the default wait of the relay
+// when Timeout is 0. With Cut, the wait is done in slices, and it ends early
+// once Cut returns true
+type Hold struct {
+	Timeout time.Duration
+	Cut     func() bool
+}
+
+// slice returns the wait of the next slice before deadline
+func (h Hold) slice(deadline time.Time) time.Duration {
+	if h.Cut == nil {
+		return h.Timeout
+	}
+	d := deadline.Sub(time.Now())
+	if d > holdSlice {
+		return holdSlice
+	}
+	if d < time.Millisecond {
+		// A wait of 0 is the default wait of the relay
+		return time.Millisecond
+	}
+	return d
+}
+
+// again returns whether the wait which has timed out should go on
+func (h Hold) again(deadline time.Time) bool {
+	return h.Cut != nil && !h.Cut() && time.Now().Before(deadline)
+}
+
 type session struct {
-	expired time.Time
-	relay   relay.Relay
-	wg      sync.WaitGroup
-	l       sync.Mutex
-	maxrlen uint16
-	rid     uint64
-	rbusy   bool
-	read    []byte
-	readLen uint16
-	rpaused bool
-	wid     uint64
-	wbusy   bool
-	wlen    uint16
-	closed  bool
+	expired     time.Time
+	relay       relay.Relay
+	wg          sync.WaitGroup
+	l           sync.Mutex
+	maxrlen     uint16
+	rid         uint64
+	rbusy       bool
+	read        []byte
+	readLen     uint16
+	rpaused     bool
+	wid         uint64
+	wbusy       bool
+	wlen        uint16
+	closed      bool
+	push        *pushChannel
+	pushID      protocol.ID
+	pushMaxlen  int
+	pushTimeout time.Duration
+	pushRemover func()
+	armed       bool
 }
 
 func (s *session) serve(c func() relay.Error, after func(e relay.Error)) {
@@ -113,14 +149,65 @@ func (s *session) start(r *protocol.DialRequest, d []byte, b *buffer.Buffer, rco
 	})
 	s.retrieve(r.RetrieveRequest(), func(s *session) byte {
 		return 0
-	}, initialConnectWait, func(e byte, rsp protocol.RetrieveRespond) {
+	}, Hold{Timeout: initialConnectWait}, func(e byte, rsp protocol.RetrieveRespond) {
 		resultOnce.Do(func() {
 			result(0, r.RetrieveRespond(rsp))
 		})
 	}, maxresplen)
 }
 
-func (s *session) retrieve(d protocol.RetrieveRequest, call func(s *session) byte, timeout time.Duration, result func(byte, protocol.RetrieveRespond), maxlen int) {
+func (s *session) listen(b *buffer.Buffer, rconfig relay.Config, remover func()) {
+	var connectionErr error
+	s.serve(func() relay.Error {
+		rbuf := b.Request()
+		defer b.Return(rbuf)
+		return s.relay.Serve(rbuf, rconfig, func(c net.Conn, err error) {
+			connectionErr = err
+		})
+	}, func(e relay.Error) {
+		if connectionErr == nil {
+			return
+		}
+		remover()
+	})
+}
+
+func (s *session) multipath(b *buffer.Buffer, rconfig relay.Config, connected func(err error), remover func()) {
+	s.serve(func() relay.Error {
+		rbuf := b.Request()
+		defer b.Return(rbuf)
+		return s.relay.Serve(rbuf, rconfig, func(c net.Conn, err error) {
+			connected(err)
+		})
+	}, func(e relay.Error) {
+		remover()
+	})
+}
+
+func (s *session) accept(d protocol.AcceptRequest, timeout time.Duration, result func(byte, protocol.AcceptRespond), maxlen int) {
+	a, ok := s.relay.(relay.Accepter)
+	if !ok {
+		result(protocol.ResourceErrorNotFound, d.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0, 0, 0, nil))
+		return
+	}
+	raddr, err := a.Accepted(timeout)
+	if err.IsError() {
+		result(protocol.ResourceErrorBroken, d.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0, 0, 0, nil))
+		return
+	}
+	if raddr == nil {
+		result(protocol.ResourceErrorWaiting, d.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0, 0, 0, nil))
+		return
+	}
+	atyp, addr, port := splitAddr(raddr)
+	s.retrieve(d.RetrieveRequest(), func(s *session) byte {
+		return 0
+	}, Hold{Timeout: initialConnectWait}, func(e byte, rsp protocol.RetrieveRespond) {
+		result(e, d.RetrieveRespond(atyp, addr, port, rsp))
+	}, maxlen)
+}
+
+func (s *session) retrieve(d protocol.RetrieveRequest, call func(s *session) byte, hold Hold, result func(byte, protocol.RetrieveRespond), maxlen int) {
 	ll := lll(&s.l)
 	ll.lock()
 	defer ll.unlock()
@@ -156,13 +243,30 @@ func (s *session) retrieve(d protocol.RetrieveRequest, call func(s *session) byt
 		result(0, rsp)
 		return
 	}
+	if s.push != nil {
+		rsp := d.Respond(s.rid, 0, 0, nil)
+		start := s.arm()
+		ll.unlock()
+		result(0, rsp)
+		if start {
+			s.relay.Retrieve(s.pushed, s.pushTimeout)
+		}
+		return
+	}
 	s.rpaused = true
 	s.rbusy = true
 	ll.unlock()
-	s.relay.Retrieve(func(r []byte, err relay.Error) {
+	deadline := time.Now().Add(hold.Timeout)
+	var retrieved relay.Retriever
+	retrieved = func(r []byte, err relay.Error) {
 		ll := lll(&s.l)
 		ll.lock()
 		defer ll.unlock()
+		if err.IsTimeout && !s.closed && hold.again(deadline) {
+			ll.unlock()
+			s.relay.Retrieve(retrieved, hold.slice(deadline))
+			return
+		}
 		s.rbusy = false
 		if err.IsError() {
 			s.read = nil
@@ -182,10 +286,11 @@ func (s *session) retrieve(d protocol.RetrieveRequest, call func(s *session) byt
 		rsp := d.Respond(s.rid, total, offset, data)
 		ll.unlock()
 		result(0, rsp)
-	}, timeout)
+	}
+	s.relay.Retrieve(retrieved, hold.slice(deadline))
 }
 
-func (s *session) resume(d protocol.ResumeRequest, timeout time.Duration, result func(byte, protocol.ResumeRespond), maxlen int) {
+func (s *session) resume(d protocol.ResumeRequest, hold Hold, result func(byte, protocol.ResumeRespond), maxlen int) {
 	dd := d.RetrieveRequest()
 	s.retrieve(dd, func(s *session) byte {
 		if d.RID != s.rid {
@@ -197,7 +302,7 @@ func (s *session) resume(d protocol.ResumeRequest, timeout time.Duration, result
 		s.rid++
 		s.rpaused = false
 		return protocol.ResourceErrorSuccess
-	}, timeout, func(cerr byte, rsp protocol.RetrieveRespond) {
+	}, hold, func(cerr byte, rsp protocol.RetrieveRespond) {
 		result(cerr, d.RetrieveRespond(rsp))
 	}, maxlen)
 }
@@ -239,6 +344,12 @@ func (s *session) kill() {
 	}
 	s.closed = true
 	s.relay.Close()
+	ch, id := s.push, s.pushID
+	if ch == nil {
+		return
+	}
+	ll.unlock()
+	ch.unsubscribe(id, s)
 }
 
 func (s *session) release() {
@@ -267,5 +378,7 @@ func newSession(relay relay.Relay, maxrlen uint16, expired time.Time) *session {
 		wbusy:   false,
 		wlen:    0,
 		closed:  false,
+		push:    nil,
+		armed:   false,
 	}
 }
@@ -17,6 +17,8 @@
 package session
 
 import (
+	"crypto/rand"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -25,9 +27,14 @@ import (
 	"warwolf/relay"
 )
 
+const (
+	listenBacklog = 16
+)
+
 type Sessions struct {
 	idleTimeout time.Duration
 	sessions    map[protocol.ID]*session
+	channels    map[protocol.ID]*pushChannel
 	lock        sync.Mutex
 	capacity    int
 }
@@ -36,6 +43,7 @@ func New(capacity int, idleTimeout time.Duration) Sessions {
 	return Sessions{
 		idleTimeout: idleTimeout,
 		sessions:    make(map[protocol.ID]*session, capacity),
+		channels:    make(map[protocol.ID]*pushChannel, 16),
 		lock:        sync.Mutex{},
 		capacity:    capacity,
 	}
@@ -60,7 +68,7 @@ func (s *Sessions) Register(r *protocol.DialRequest, d []byte, laddr net.Addr, r
 		rid := ss.rid
 		s.lock.Unlock()
 		if rid == 0 {
-			s.doRetrieve(ss, r.RetrieveRequest(), func(e byte, rsp protocol.RetrieveRespond) {
+			s.doRetrieve(ss, r.RetrieveRequest(), Hold{}, func(e byte, rsp protocol.RetrieveRespond) {
 				result(0, r.RetrieveRespond(rsp))
 			}, maxresplen)
 			return
@@ -100,10 +108,267 @@ func (s *Sessions) Register(r *protocol.DialRequest, d []byte, laddr net.Addr, r
 	}, maxresplen)
 }
 
-func (s *Sessions) doRetrieve(ss *session, d protocol.RetrieveRequest, r func(byte, protocol.RetrieveRespond), maxlen int) {
+func (s *Sessions) Bind(r *protocol.BindRequest, laddr net.Addr, rconfig relay.Config, b *buffer.Buffer, result func(byte, protocol.BindRespond)) {
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[r.ID]
+	if ex {
+		ll.unlock()
+		a, ok := ss.relay.(relay.Accepter)
+		if !ok {
+			result(protocol.DialErrorAlreadyDialed, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+			return
+		}
+		atyp, addr, port := splitAddr(a.Addr())
+		result(0, r.Respond(atyp, addr, port))
+		return
+	}
+	if len(s.sessions) >= s.capacity {
+		result(protocol.DialErrorOverCapacity, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	rl, re := relay.NewBind(laddr, expectedIP(r.ATyp, r.Addr))
+	if re.IsError() {
+		result(protocol.DialErrorInternalFailure, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	ss = newSession(
+		rl,
+		r.MaxRetrieveLen,
+		time.Now().Add(s.idleTimeout),
+	)
+	s.sessions[r.ID] = ss
+	ll.unlock()
+	ss.listen(b, rconfig, func() {
+		s.forceRemove(r.ID)
+	})
+	atyp, addr, port := splitAddr(rl.Addr())
+	result(0, r.Respond(atyp, addr, port))
+}
+
+func (s *Sessions) Listen(r *protocol.ListenRequest, laddr net.Addr, allowed func(port uint16) bool, rconfig relay.Config, b *buffer.Buffer, result func(byte, protocol.ListenRespond)) {
+	if allowed == nil || !allowed(r.Port) {
+		result(protocol.DialErrorNotAllowed, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[r.ID]
+	if ex {
+		ll.unlock()
+		l, ok := ss.relay.(*relay.Listener)
+		if !ok {
+			result(protocol.DialErrorAlreadyDialed, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+			return
+		}
+		atyp, addr, port := splitAddr(l.Addr())
+		result(0, r.Respond(atyp, addr, port))
+		return
+	}
+	if len(s.sessions) >= s.capacity {
+		result(protocol.DialErrorOverCapacity, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	a := &net.TCPAddr{Port: int(r.Port)}
+	if la, ok := laddr.(*net.TCPAddr); ok {
+		a.IP = la.IP
+		a.Zone = la.Zone
+	}
+	rl, re := relay.NewListener(a, listenBacklog)
+	if re.IsError() {
+		result(protocol.DialErrorInternalFailure, r.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	ss = newSession(
+		rl,
+		r.MaxRetrieveLen,
+		time.Now().Add(s.idleTimeout),
+	)
+	s.sessions[r.ID] = ss
+	ll.unlock()
+	ss.listen(b, rconfig, func() {
+		s.forceRemove(r.ID)
+	})
+	atyp, addr, port := splitAddr(rl.Addr())
+	result(0, r.Respond(atyp, addr, port))
+}
+
+func (s *Sessions) Multipath(r *protocol.MultipathRequest, laddr net.Addr, rconfig relay.Config, b *buffer.Buffer, result func(byte, protocol.MultipathRespond)) {
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[r.ID]
+	if ex {
+		ll.unlock()
+		m, ok := ss.relay.(*relay.Multipath)
+		if !ok {
+			result(protocol.DialErrorAlreadyDialed, r.Respond([protocol.MultipathKeySize]byte{}))
+			return
+		}
+		result(0, r.Respond(m.Key()))
+		return
+	}
+	if len(s.sessions) >= s.capacity {
+		result(protocol.DialErrorOverCapacity, r.Respond([protocol.MultipathKeySize]byte{}))
+		return
+	}
+	switch r.ATyp {
+	case protocol.TCPIPv4, protocol.TCPIPv6, protocol.TCPHost:
+	default:
+		result(protocol.DialErrorInvalidRequest, r.Respond([protocol.MultipathKeySize]byte{}))
+		return
+	}
+	addr, e := buildAddr(r.ATyp, r.Addr, r.Port)
+	if e != nil {
+		result(protocol.DialErrorInvalidRequest, r.Respond([protocol.MultipathKeySize]byte{}))
+		return
+	}
+	key := [protocol.MultipathKeySize]byte{}
+	_, e = io.ReadFull(rand.Reader, key[:])
+	if e != nil {
+		result(protocol.DialErrorInternalFailure, r.Respond([protocol.MultipathKeySize]byte{}))
+		return
+	}
+	rl, re := relay.NewMultipathTCP(addr, laddr, key)
+	if re.IsError() {
+		result(protocol.DialErrorInternalFailure, r.Respond([protocol.MultipathKeySize]byte{}))
+		return
+	}
+	ss = newSession(
+		rl,
+		0,
+		time.Now().Add(s.idleTimeout),
+	)
+	s.sessions[r.ID] = ss
+	ll.unlock()
+	ss.multipath(b, rconfig, func(err error) {
+		if err != nil {
+			result(protocol.DialErrorUnreachable, r.Respond([protocol.MultipathKeySize]byte{}))
+			return
+		}
+		result(0, r.Respond(key))
+	}, func() {
+		s.forceRemove(r.ID)
+	})
+}
+
+// Join serves p as a path of the multipath session until the path is done
+func (s *Sessions) Join(d protocol.JoinRequest, p io.ReadWriteCloser, rbuf []byte) byte {
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[d.ID]
+	if !ex {
+		ll.unlock()
+		p.Close()
+		return protocol.ResourceErrorNotFound
+	}
+	m, ok := ss.relay.(*relay.Multipath)
+	if !ok {
+		ll.unlock()
+		p.Close()
+		return protocol.ResourceErrorNotFound
+	}
+	ss.expired = time.Now().Add(s.idleTimeout)
+	ll.unlock()
+	err := m.Join(p, rbuf)
+	if err != nil {
+		return protocol.ResourceErrorBroken
+	}
+	return 0
+}
+
+func (s *Sessions) newID() (protocol.ID, error) {
+	const retries = 1000
+	for i := 0; i < retries; i++ {
+		id, err := newID()
+		if err != nil {
+			return protocol.ID{}, err
+		}
+		_, ex := s.sessions[id]
+		if ex {
+			continue
+		}
+		return id, nil
+	}
+	return protocol.ID{}, ErrUnableToGenerateID
+}
+
+func (s *Sessions) Incoming(d protocol.IncomingRequest, timeout time.Duration, rconfig relay.Config, b *buffer.Buffer, r func(byte, protocol.IncomingRespond)) {
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[d.ID]
+	if !ex {
+		r(protocol.ResourceErrorNotFound, d.Respond(protocol.ID{}, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	l, ok := ss.relay.(*relay.Listener)
+	if !ok {
+		r(protocol.ResourceErrorNotFound, d.Respond(protocol.ID{}, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	ss.expired = time.Now().Add(s.idleTimeout)
+	maxrlen := ss.maxrlen
+	ll.unlock()
+	c, err := l.Incoming(timeout)
+	if err.IsError() {
+		r(protocol.ResourceErrorBroken, d.Respond(protocol.ID{}, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		s.reactToError(d.ID, ErrResourceBroken)
+		return
+	}
+	if c == nil {
+		r(protocol.ResourceErrorWaiting, d.Respond(protocol.ID{}, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	ll.lock()
+	id, idErr := s.newID()
+	if idErr != nil || len(s.sessions) >= s.capacity {
+		ll.unlock()
+		c.Close()
+		r(protocol.ResourceErrorWaiting, d.Respond(protocol.ID{}, protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0))
+		return
+	}
+	cs := newSession(
+		relay.NewAccepted(c),
+		maxrlen,
+		time.Now().Add(s.idleTimeout),
+	)
+	s.sessions[id] = cs
+	ll.unlock()
+	cs.listen(b, rconfig, func() {
+		s.forceRemove(id)
+	})
+	atyp, addr, port := splitAddr(c.RemoteAddr())
+	r(0, d.Respond(id, atyp, addr, port))
+}
+
+func (s *Sessions) Accept(d protocol.AcceptRequest, timeout time.Duration, r func(byte, protocol.AcceptRespond), maxlen int) {
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[d.ID]
+	if !ex {
+		r(protocol.ResourceErrorNotFound, d.Respond(protocol.TCPIPv4, []byte{0, 0, 0, 0}, 0, 0, 0, nil))
+		return
+	}
+	ss.expired = time.Now().Add(s.idleTimeout)
+	ll.unlock()
+	ss.accept(d, timeout, func(b byte, rsp protocol.AcceptRespond) {
+		r(b, rsp)
+		if b == 0 {
+			return
+		}
+		s.reactToError(d.ID, getRetrieverResourceError(b))
+	}, maxlen)
+}
+
+func (s *Sessions) doRetrieve(ss *session, d protocol.RetrieveRequest, hold Hold, r func(byte, protocol.RetrieveRespond), maxlen int) {
 	ss.retrieve(d, func(s *session) byte {
 		return protocol.ResourceErrorSuccess
-	}, 0, func(b byte, d protocol.RetrieveRespond) {
+	}, hold, func(b byte, d protocol.RetrieveRespond) {
 		r(b, d)
 		if b == 0 {
 			return
@@ -112,7 +377,7 @@ func (s *Sessions) doRetrieve(ss *session, d protocol.RetrieveRequest, r func(by
 	}, maxlen)
 }
 
-func (s *Sessions) Retrieve(d protocol.RetrieveRequest, r func(byte, protocol.RetrieveRespond), maxlen int) {
+func (s *Sessions) Retrieve(d protocol.RetrieveRequest, hold Hold, r func(byte, protocol.RetrieveRespond), maxlen int) {
 	ll := lll(&s.lock)
 	ll.lock()
 	defer ll.unlock()
@@ -123,10 +388,10 @@ func (s *Sessions) Retrieve(d protocol.RetrieveRequest, r func(byte, protocol.Re
 	}
 	ss.expired = time.Now().Add(s.idleTimeout)
 	ll.unlock()
-	s.doRetrieve(ss, d, r, maxlen)
+	s.doRetrieve(ss, d, hold, r, maxlen)
 }
 
-func (s *Sessions) Resume(d protocol.ResumeRequest, r func(byte, protocol.ResumeRespond), maxlen int) {
+func (s *Sessions) Resume(d protocol.ResumeRequest, hold Hold, r func(byte, protocol.ResumeRespond), maxlen int) {
 	ll := lll(&s.lock)
 	ll.lock()
 	defer ll.unlock()
@@ -137,7 +402,7 @@ func (s *Sessions) Resume(d protocol.ResumeRequest, r func(byte, protocol.Resume
 	}
 	ss.expired = time.Now().Add(s.idleTimeout)
 	ll.unlock()
-	ss.resume(d, 0, func(b byte, d protocol.ResumeRespond) {
+	ss.resume(d, hold, func(b byte, d protocol.ResumeRespond) {
 		r(b, d)
 		if b == 0 {
 			return
@@ -158,6 +423,90 @@ func (s *Sessions) Send(r protocol.SendRequest, d []byte) (byte, protocol.SendRe
 	return ss.send(r, d, 0)
 }
 
+// channel returns the push channel, creating it when needed. Must be called
+// with the lock held, and the channel must be kept busy before unlocking so
+// it won't be recycled
+func (s *Sessions) channel(id protocol.ID) *pushChannel {
+	ch, ex := s.channels[id]
+	if ex {
+		return ch
+	}
+	ch = newPushChannel()
+	s.channels[id] = ch
+	return ch
+}
+
+// keepalive refreshes the sessions subscribed to ch, as they don't send
+// requests while idle
+func (s *Sessions) keepalive(ch *pushChannel) {
+	subscribed := ch.subscribed()
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	expired := time.Now().Add(s.idleTimeout)
+	for _, ss := range subscribed {
+		ss.expired = expired
+	}
+}
+
+func (s *Sessions) Subscribe(d protocol.SubscribeRequest, maxlen int) (byte, protocol.SubscribeRespond) {
+	ll := lll(&s.lock)
+	ll.lock()
+	defer ll.unlock()
+	ss, ex := s.sessions[d.ID]
+	if !ex {
+		return protocol.ResourceErrorNotFound, d.Respond()
+	}
+	ss.expired = time.Now().Add(s.idleTimeout)
+	ch := s.channel(d.Channel)
+	ch.subscribe(d.ID, ss)
+	ll.unlock()
+	e := ss.subscribe(d.ID, ch, maxlen, s.idleTimeout, func() {
+		s.forceRemove(d.ID)
+	})
+	if e != 0 {
+		ch.unsubscribe(d.ID, ss)
+	}
+	return e, d.Respond()
+}
+
+// Push writes the data of the sessions subscribed to the channel with
+// result as it arrives, until duration has passed or result fails
+func (s *Sessions) Push(d protocol.PushRequest, duration time.Duration, result func(byte, protocol.PushRespond) error) {
+	if duration > s.idleTimeout/2 {
+		duration = s.idleTimeout / 2
+	}
+	ll := lll(&s.lock)
+	ll.lock()
+	ch := s.channel(d.Channel)
+	ch.attach()
+	ll.unlock()
+	defer ch.detach()
+	s.keepalive(ch)
+	defer s.keepalive(ch)
+	for _, ss := range ch.subscribed() {
+		ss.repush()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		frames := ch.take()
+		for i := range frames {
+			err := result(frames[i].e, frames[i].rsp)
+			if err == nil {
+				continue
+			}
+			ch.requeue(frames[i:])
+			return
+		}
+		select {
+		case <-ch.wake:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
 func (s *Sessions) kill(id protocol.ID) *session {
 	ll := lll(&s.lock)
 	ll.lock()
@@ -197,9 +546,18 @@ func (s *Sessions) Recycle() error {
 		if !n.After(v.expired) {
 			continue
 		}
+		if m, ok := v.relay.(*relay.Multipath); ok && m.Joined() {
+			continue
+		}
 		delete(s.sessions, k)
 		recycled = append(recycled, v)
 	}
+	for k, v := range s.channels {
+		if !v.idle() {
+			continue
+		}
+		delete(s.channels, k)
+	}
 	ll.unlock()
 	for i := range recycled {
 		recycled[i].release()
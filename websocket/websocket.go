@@ -0,0 +1,271 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	maxControlPayload = 125
+	keyGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	ErrInvalidFrame   = errors.New("WebSocket: Invalid frame")
+	ErrUnexpectedText = errors.New("WebSocket: Unexpected text message")
+	ErrClosed         = errors.New("WebSocket: Already closed")
+)
+
+// Key returns a new random Sec-WebSocket-Key
+func Key() (string, error) {
+	k := [16]byte{}
+	_, err := io.ReadFull(rand.Reader, k[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k[:]), nil
+}
+
+// Accept returns the Sec-WebSocket-Accept of the key
+func Accept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + keyGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Conn carries a byte stream over the binary messages of a WebSocket. Every
+// Write is sent as one message, and Read returns the payload of the messages
+// one after another regardless of where they are split. Pings are answered
+// by Read
+type Conn struct {
+	rwc       io.ReadWriteCloser
+	r         *bufio.Reader
+	client    bool
+	wlock     sync.Mutex
+	wclosed   bool
+	rclosed   bool
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+}
+
+// NewConn creates a Conn on rwc which the handshake has been done on.
+// Frames sent by the client side are masked, as RFC 6455 requires
+func NewConn(rwc io.ReadWriteCloser, client bool) *Conn {
+	return &Conn{
+		rwc:       rwc,
+		r:         bufio.NewReader(rwc),
+		client:    client,
+		wlock:     sync.Mutex{},
+		wclosed:   false,
+		rclosed:   false,
+		remaining: 0,
+		masked:    false,
+		mask:      [4]byte{},
+		maskPos:   0,
+	}
+}
+
+// Read returns io.EOF after the other side has started the closing handshake
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.rclosed {
+			return 0, io.EOF
+		}
+		err := c.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// next reads frame headers until the one of a data frame, the control
+// frames in between are taken care of
+func (c *Conn) next() error {
+	for {
+		h := [2]byte{}
+		_, err := io.ReadFull(c.r, h[:])
+		if err != nil {
+			return err
+		}
+		if h[0]&0x70 != 0 {
+			return ErrInvalidFrame
+		}
+		op := h[0] & 0x0f
+		masked := h[1]&0x80 != 0
+		if masked == c.client {
+			return ErrInvalidFrame
+		}
+		size := uint64(h[1] & 0x7f)
+		switch size {
+		case 126:
+			l := [2]byte{}
+			_, err = io.ReadFull(c.r, l[:])
+			size = uint64(binary.BigEndian.Uint16(l[:]))
+		case 127:
+			l := [8]byte{}
+			_, err = io.ReadFull(c.r, l[:])
+			size = binary.BigEndian.Uint64(l[:])
+			if size>>63 != 0 {
+				return ErrInvalidFrame
+			}
+		}
+		if err != nil {
+			return err
+		}
+		c.masked, c.maskPos = masked, 0
+		if masked {
+			_, err = io.ReadFull(c.r, c.mask[:])
+			if err != nil {
+				return err
+			}
+		}
+		switch op {
+		case opBinary, opContinuation:
+			c.remaining = size
+			return nil
+		case opText:
+			return ErrUnexpectedText
+		case opClose, opPing, opPong:
+		default:
+			return ErrInvalidFrame
+		}
+		if size > maxControlPayload || h[0]&0x80 == 0 {
+			return ErrInvalidFrame
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(c.r, payload)
+		if err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch op {
+		case opPing:
+			err = c.write(opPong, payload)
+			if err != nil && err != ErrClosed {
+				return err
+			}
+		case opClose:
+			c.rclosed = true
+			return nil
+		}
+	}
+}
+
+func (c *Conn) write(op byte, b []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.wclosed {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.wclosed = true
+	}
+	f := make([]byte, 2, 14+len(b))
+	f[0] = 0x80 | op
+	switch {
+	case len(b) < 126:
+		f[1] = byte(len(b))
+	case len(b) <= 0xffff:
+		f[1] = 126
+		f = append(f, 0, 0)
+		binary.BigEndian.PutUint16(f[2:], uint16(len(b)))
+	default:
+		f[1] = 127
+		f = append(f, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(f[2:], uint64(len(b)))
+	}
+	if !c.client {
+		f = append(f, b...)
+		_, err := c.rwc.Write(f)
+		return err
+	}
+	f[1] |= 0x80
+	mask := [4]byte{}
+	_, err := io.ReadFull(rand.Reader, mask[:])
+	if err != nil {
+		return err
+	}
+	f = append(f, mask[:]...)
+	start := len(f)
+	f = append(f, b...)
+	for i := range f[start:] {
+		f[start+i] ^= mask[i&3]
+	}
+	_, err = c.rwc.Write(f)
+	return err
+}
+
+// Write sends b as one binary message
+func (c *Conn) Write(b []byte) (int, error) {
+	err := c.write(opBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Shutdown starts or finishes the closing handshake, nothing can be written
+// after it. The other side is expected to respond with its own close once
+// it has sent what it has left
+func (c *Conn) Shutdown() error {
+	err := c.write(opClose, []byte{0x03, 0xe8})
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+func (c *Conn) Close() error {
+	return c.rwc.Close()
+}
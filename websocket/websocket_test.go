@@ -0,0 +1,97 @@
+// The Warwolf System
+// Copyright (C) 2020 The Warwolf Authors
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if Accept("dGhlIHNhbXBsZSBub25jZQ==") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("Invalid accept key")
+	}
+}
+
+func TestConn(t *testing.T) {
+	cc, sc := net.Pipe()
+	client, server := NewConn(cc, true), NewConn(sc, false)
+	small := []byte("ABC")
+	big := bytes.Repeat([]byte("0123456789"), 10000)
+	go func() {
+		client.Write(small)
+		client.write(opPing, []byte("P"))
+		client.Write(big)
+		client.Shutdown()
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		b := [16]byte{}
+		h := [2]byte{}
+		io.ReadFull(cc, h[:])
+		if h[0]&0x0f == opPong && int(h[1]) < len(b) {
+			io.ReadFull(cc, b[:h[1]])
+			pong <- b[:h[1]]
+		}
+		close(pong)
+	}()
+	r := [3]byte{}
+	_, err := io.ReadFull(server, r[:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(r[:], small) {
+		t.Error("Invalid small message")
+		return
+	}
+	rr, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(rr, big) {
+		t.Error("Invalid big message")
+		return
+	}
+	if !bytes.Equal(<-pong, []byte("P")) {
+		t.Error("Invalid pong")
+		return
+	}
+	_, err = client.Write(small)
+	if err != ErrClosed {
+		t.Error("Writing after Shutdown should fail")
+		return
+	}
+}
+
+func TestConnInvalid(t *testing.T) {
+	cc, sc := net.Pipe()
+	server := NewConn(sc, false)
+	go func() {
+		// Unmasked frame from the client side
+		cc.Write([]byte{0x82, 0x01, 'A'})
+	}()
+	_, err := server.Read(make([]byte, 1))
+	if err != ErrInvalidFrame {
+		t.Error("Unmasked client frame should be rejected")
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"warwolf/cipher"
 	"warwolf/client"
 	"warwolf/config"
 	"warwolf/server"
@@ -11,6 +14,19 @@ func main() {
 	case "Client":
 		client.New().Listen(client.Config{})
 
+	case "Keygen":
+		k, err := cipher.RandomKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to generate key: %s\n", err)
+			os.Exit(1)
+		}
+		salt, err := cipher.RandomSalt()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to generate salt: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("WWFKey=%s\nWWFKeySalt=%s\n", k, salt)
+
 	case "Server":
 		fallthrough
 	default: